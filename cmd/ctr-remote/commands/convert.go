@@ -20,15 +20,20 @@ import (
 	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/images/converter"
 	"github.com/containerd/containerd/images/converter/uncompress"
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
 	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
 	"github.com/containerd/stargz-snapshotter/recorder"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -42,6 +47,7 @@ var ConvertCommand = cli.Command{
 	Description: `Convert an image format.
 
 e.g., 'ctr-remote convert --estargz --oci example.com/foo:orig example.com/foo:esgz'
+e.g., 'ctr-remote convert --estargz-revert example.com/foo:esgz example.com/foo:plain'
 
 Use '--platform' to define the output platform.
 When '--all-platforms' is given all images in a manifest list must be available.
@@ -66,6 +72,78 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Usage: "eStargz chunk size",
 			Value: 0,
 		},
+		cli.IntFlag{
+			Name:  "estargz-min-chunk-size",
+			Usage: "Pack files smaller than this size into a compressed stream shared with preceding files. 0 disables packing",
+			Value: 0,
+		},
+		cli.BoolFlag{
+			Name:  "estargz-content-defined-chunking",
+			Usage: "Split files into chunks at content-defined boundaries. '--estargz-chunk-size' is used as the maximum chunk size",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-compact-toc",
+			Usage: "Use the compact binary encoding for TOC instead of JSON",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-tar-split",
+			Usage: "Embed tar-split metadata so that the original tar can be reconstructed from eStargz",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-store-incompressible",
+			Usage: "Store files that don't shrink by compression (detected by magic bytes or compression ratio) without compression",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-deduplicate",
+			Usage: "Store identical files only once by replacing duplicates with hardlinks to the first one",
+		},
+		cli.StringSliceFlag{
+			Name:  "estargz-exclude",
+			Usage: "Drop files matching the pattern (e.g. '*.pyc', 'usr/share/doc') from eStargz layers. Can't be used with '--estargz-tar-split'",
+		},
+		cli.StringFlag{
+			Name:  "estargz-sign-key",
+			Usage: "Path to a PEM-encoded PKCS #8 private key (ed25519 or ECDSA) for signing TOC of eStargz",
+		},
+		cli.StringFlag{
+			Name:  "estargz-temp-dir",
+			Usage: "Directory to store temporary files during conversion. Defaults to the system temp directory",
+		},
+		cli.IntFlag{
+			Name:  "estargz-max-parallelism",
+			Usage: "Maximum number of parts of a layer compressed in parallel. 0 means the number of CPUs",
+		},
+		cli.Int64Flag{
+			Name:  "estargz-disk-budget",
+			Usage: "Fail the conversion of a layer if its compressed temporary files exceed this number of bytes. Uncompressed copies of layers aren't counted. 0 means no limit",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-stream",
+			Usage: "Build eStargz directly from the compressed layers without storing uncompressed copies. Prioritized files keep the order in the layers",
+		},
+		cli.StringFlag{
+			Name:   "estargz-source-date-epoch",
+			Usage:  "Clamp modification time of files to the specified UNIX time for reproducible eStargz",
+			EnvVar: "SOURCE_DATE_EPOCH",
+		},
+		// zstd:chunked flags
+		cli.BoolFlag{
+			Name:  "zstdchunked",
+			Usage: "convert legacy tar(.gz) layers to zstd:chunked (eStargz compressed with zstd) for lazy pulling. '--estargz-*' flags except compression level are applied as well",
+		},
+		cli.IntFlag{
+			Name:  "zstdchunked-compression-level",
+			Usage: "zstd:chunked compression level",
+			Value: 3,
+		},
+		cli.BoolFlag{
+			Name:  "estargz-revert",
+			Usage: "convert eStargz and zstd:chunked layers back to legacy tar.gz layers. Layers built with '--estargz-tar-split' get their original DiffIDs back",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-upgrade",
+			Usage: "upgrade legacy stargz layers to eStargz so that they can be verified. Compressed contents are reused and only TOC is rewritten",
+		},
 		// generic flags
 		cli.BoolFlag{
 			Name:  "uncompress",
@@ -117,7 +195,12 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			if err != nil {
 				return err
 			}
-			convertOpts = append(convertOpts, converter.WithLayerConvertFunc(estargzconvert.LayerConvertFunc(esgzOpts...)))
+			convertFunc := estargzconvert.LayerConvertFunc
+			if context.Bool("estargz-stream") {
+				convertFunc = estargzconvert.LayerConvertStreamFunc
+			}
+			convertOpts = append(convertOpts, converter.WithLayerConvertFunc(
+				layerConvertFuncWithProgress(convertFunc, func(digest.Digest) []estargz.Option { return esgzOpts })))
 			if !context.Bool("oci") {
 				logrus.Warn("option --estargz should be used in conjunction with --oci")
 			}
@@ -126,6 +209,47 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			}
 		}
 
+		if context.Bool("zstdchunked") {
+			esgzOpts, err := getESGZConvertOpts(context)
+			if err != nil {
+				return err
+			}
+			esgzOpts = append(esgzOpts, estargz.WithCompression(zstdchunked.NewCompression(context.Int("zstdchunked-compression-level"))))
+			convertFunc := estargzconvert.LayerConvertZstdChunkedFunc
+			if context.Bool("estargz-stream") {
+				convertFunc = estargzconvert.LayerConvertZstdChunkedStreamFunc
+			}
+			convertOpts = append(convertOpts, converter.WithLayerConvertFunc(
+				layerConvertFuncWithProgress(convertFunc, func(digest.Digest) []estargz.Option { return esgzOpts })))
+			if context.Bool("estargz") {
+				return errors.New("option --zstdchunked conflicts with --estargz")
+			}
+			if context.Bool("uncompress") {
+				return errors.New("option --zstdchunked conflicts with --uncompress")
+			}
+		}
+
+		if context.Bool("estargz-revert") {
+			convertOpts = append(convertOpts, converter.WithLayerConvertFunc(estargzconvert.LayerRevertFunc()))
+			for _, f := range []string{"estargz", "zstdchunked", "uncompress"} {
+				if context.Bool(f) {
+					return errors.Errorf("option --estargz-revert conflicts with --%s", f)
+				}
+			}
+		}
+
+		if context.Bool("estargz-upgrade") {
+			convertOpts = append(convertOpts, converter.WithLayerConvertFunc(estargzconvert.LayerUpgradeFunc()))
+			if !context.Bool("oci") {
+				logrus.Warn("option --estargz-upgrade should be used in conjunction with --oci")
+			}
+			for _, f := range []string{"estargz", "zstdchunked", "estargz-revert", "uncompress"} {
+				if context.Bool(f) {
+					return errors.Errorf("option --estargz-upgrade conflicts with --%s", f)
+				}
+			}
+		}
+
 		if context.Bool("uncompress") {
 			convertOpts = append(convertOpts, converter.WithLayerConvertFunc(uncompress.LayerConvertFunc))
 		}
@@ -153,6 +277,10 @@ func getESGZConvertOpts(context *cli.Context) ([]estargz.Option, error) {
 	esgzOpts := []estargz.Option{
 		estargz.WithCompressionLevel(context.Int("estargz-compression-level")),
 		estargz.WithChunkSize(context.Int("estargz-chunk-size")),
+		estargz.WithMinChunkSize(context.Int("estargz-min-chunk-size")),
+		estargz.WithTempDir(context.String("estargz-temp-dir")),
+		estargz.WithMaxParallelism(context.Int("estargz-max-parallelism")),
+		estargz.WithDiskBudget(context.Int64("estargz-disk-budget")),
 	}
 	if estargzRecordIn := context.String("estargz-record-in"); estargzRecordIn != "" {
 		paths, err := readPathsFromRecordFile(estargzRecordIn)
@@ -163,6 +291,43 @@ func getESGZConvertOpts(context *cli.Context) ([]estargz.Option, error) {
 		var ignored []string
 		esgzOpts = append(esgzOpts, estargz.WithAllowPrioritizeNotFound(&ignored))
 	}
+	if context.Bool("estargz-content-defined-chunking") {
+		esgzOpts = append(esgzOpts, estargz.WithContentDefinedChunking())
+	}
+	if context.Bool("estargz-compact-toc") {
+		esgzOpts = append(esgzOpts, estargz.WithCompactTOC())
+	}
+	if context.Bool("estargz-tar-split") {
+		esgzOpts = append(esgzOpts, estargz.WithTarSplit())
+	}
+	if context.Bool("estargz-store-incompressible") {
+		esgzOpts = append(esgzOpts, estargz.WithStorePolicy(
+			estargz.StoreIfAny(estargz.StoreByMagic(), estargz.StoreByRatio(0.9))))
+	}
+	if context.Bool("estargz-deduplicate") {
+		esgzOpts = append(esgzOpts, estargz.WithDeduplication())
+	}
+	if patterns := context.StringSlice("estargz-exclude"); len(patterns) > 0 {
+		esgzOpts = append(esgzOpts, estargz.WithExcludePatterns(patterns...))
+	}
+	if keyFile := context.String("estargz-sign-key"); keyFile != "" {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read signing key %q", keyFile)
+		}
+		key, err := estargz.ParseTOCSigningKey(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid signing key %q", keyFile)
+		}
+		esgzOpts = append(esgzOpts, estargz.WithTOCSigningKey(key))
+	}
+	if epoch := context.String("estargz-source-date-epoch"); epoch != "" {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid source date epoch %q", epoch)
+		}
+		esgzOpts = append(esgzOpts, estargz.WithSourceDateEpoch(time.Unix(sec, 0)))
+	}
 	return esgzOpts, nil
 }
 
@@ -0,0 +1,242 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/remotes/docker/config"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	fsconfig "github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containerd/stargz-snapshotter/util/containerdutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// DiffCommand reports the differences between the file trees of two eStargz
+// images by fetching only the TOCs of their layers from the registry.
+var DiffCommand = cli.Command{
+	Name:      "diff",
+	Usage:     "compare eStargz images in registries by fetching only TOCs of their layers",
+	ArgsUsage: "[flags] <old ref> <new ref>",
+	Description: `Compare the file trees of two eStargz images without downloading layer data.
+
+Each line of the output is a changed file prefixed by "A" (added), "D" (removed)
+or "M" (modified) followed by the changed attributes of modified files.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "compare the images of the specified platform (default: the current platform)",
+		},
+		cli.StringFlag{
+			Name:  "user,u",
+			Usage: "user[:password] Registry user and password",
+		},
+		cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "allow connections using plain HTTP",
+		},
+		cli.BoolFlag{
+			Name:  "skip-verify,k",
+			Usage: "skip SSL certificate validation",
+		},
+		cli.StringFlag{
+			Name:  "hosts-dir",
+			Usage: "Custom hosts configuration directory",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		oldRef, newRef := clicontext.Args().Get(0), clicontext.Args().Get(1)
+		if oldRef == "" || newRef == "" {
+			return errors.New("two images need to be specified")
+		}
+		platform := platforms.DefaultStrict()
+		if ps := clicontext.String("platform"); ps != "" {
+			p, err := platforms.Parse(ps)
+			if err != nil {
+				return errors.Wrapf(err, "invalid platform %q", ps)
+			}
+			platform = platforms.OnlyStrict(p)
+		}
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+
+		hosts, err := registryHosts(ctx, clicontext)
+		if err != nil {
+			return err
+		}
+		var (
+			resolver = docker.NewResolver(docker.ResolverOptions{Hosts: hosts})
+			blobs    = remote.NewResolver(cache.NewMemoryCache(), fsconfig.BlobConfig{})
+			fetched  int64
+		)
+		var layers [2][]*estargz.Reader
+		for i, ref := range []string{oldRef, newRef} {
+			rs, n, err := openRemoteLayers(ctx, resolver, blobs, hosts, ref, platform)
+			if err != nil {
+				return errors.Wrapf(err, "failed to open layers of %q", ref)
+			}
+			layers[i] = rs
+			fetched += n
+		}
+
+		d := estargz.DiffTrees(layers[0], layers[1])
+		var added, removed, modified int
+		for _, c := range d.Changes {
+			switch c.Kind {
+			case estargz.FileAdded:
+				added++
+				fmt.Fprintf(clicontext.App.Writer, "A %s\n", c.Name)
+			case estargz.FileRemoved:
+				removed++
+				fmt.Fprintf(clicontext.App.Writer, "D %s\n", c.Name)
+			case estargz.FileModified:
+				modified++
+				fmt.Fprintf(clicontext.App.Writer, "M %s (%v)\n", c.Name, c.Fields)
+			}
+		}
+		fmt.Fprintf(clicontext.App.Writer, "%d added, %d removed, %d modified; %d bytes to fetch (fetched %d bytes of TOCs)\n",
+			added, removed, modified, d.FetchSize, fetched)
+		return nil
+	},
+}
+
+// openRemoteLayers opens the eStargz layers of the image in the registry. Only
+// the footers and TOCs are fetched using range requests. This also returns the
+// number of bytes fetched for the layers.
+func openRemoteLayers(ctx context.Context, resolver remotes.Resolver, blobs *remote.Resolver, hosts docker.RegistryHosts, ref string, platform platforms.MatchComparer) ([]*estargz.Reader, int64, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	provider := fetcherProvider{fetcher}
+	manifestDesc, err := containerdutil.ManifestDesc(ctx, provider, desc, platform)
+	if err != nil {
+		return nil, 0, err
+	}
+	p, err := content.ReadBlob(ctx, provider, manifestDesc)
+	if err != nil {
+		return nil, 0, err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(p, &manifest); err != nil {
+		return nil, 0, err
+	}
+	var (
+		layers  []*estargz.Reader
+		fetched int64
+	)
+	for _, l := range manifest.Layers {
+		blob, err := blobs.Resolve(ctx, hosts, refspec, l)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "failed to resolve layer %v", l.Digest)
+		}
+		sr := io.NewSectionReader(readerAtFunc(func(p []byte, off int64) (int, error) {
+			return blob.ReadAt(p, off)
+		}), 0, blob.Size())
+		r, err := estargz.Open(sr, estargz.WithDecompressors(new(zstdchunked.Decompressor)))
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "layer %v isn't eStargz", l.Digest)
+		}
+		layers = append(layers, r)
+		fetched += blob.FetchedSize()
+	}
+	return layers, fetched, nil
+}
+
+// registryHosts returns the registry hosts configured by the flags in the same
+// way as ctr does.
+func registryHosts(ctx context.Context, clicontext *cli.Context) (docker.RegistryHosts, error) {
+	username := clicontext.String("user")
+	var secret string
+	if i := strings.IndexByte(username, ':'); i > 0 {
+		secret = username[i+1:]
+		username = username[0:i]
+	}
+	if username != "" && secret == "" {
+		return nil, errors.New("password needs to be specified as --user=<user>:<password>")
+	}
+	hostOptions := config.HostOptions{
+		Credentials: func(host string) (string, string, error) {
+			return username, secret, nil
+		},
+		DefaultTLS: &tls.Config{InsecureSkipVerify: clicontext.Bool("skip-verify")},
+	}
+	if clicontext.Bool("plain-http") {
+		hostOptions.DefaultScheme = "http"
+	}
+	if hostDir := clicontext.String("hosts-dir"); hostDir != "" {
+		hostOptions.HostDir = config.HostDirFromRoot(hostDir)
+	}
+	return config.ConfigureHosts(ctx, hostOptions), nil
+}
+
+// fetcherProvider is content.Provider reading blobs from the registry. Blobs
+// are read into memory so this should be used only for small blobs (e.g.
+// manifests).
+type fetcherProvider struct {
+	fetcher remotes.Fetcher
+}
+
+func (p fetcherProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	rc, err := p.fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return bytesReaderAt{bytes.NewReader(b)}, nil
+}
+
+type bytesReaderAt struct {
+	*bytes.Reader
+}
+
+func (r bytesReaderAt) Close() error { return nil }
+
+type readerAtFunc func([]byte, int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, offset int64) (int, error) { return f(p, offset) }
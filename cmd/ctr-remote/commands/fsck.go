@@ -0,0 +1,127 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	"github.com/containerd/stargz-snapshotter/util/containerdutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// FsckCommand checks integrity of eStargz layers of an image.
+var FsckCommand = cli.Command{
+	Name:      "fsck",
+	Usage:     "check integrity of eStargz layers of an image",
+	ArgsUsage: "[flags] <ref>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "check the image of the specified platform (default: the current platform)",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		ref := clicontext.Args().First()
+		if ref == "" {
+			return errors.New("image need to be specified")
+		}
+		platform := platforms.DefaultStrict()
+		if ps := clicontext.String("platform"); ps != "" {
+			p, err := platforms.Parse(ps)
+			if err != nil {
+				return errors.Wrapf(err, "invalid platform %q", ps)
+			}
+			platform = platforms.OnlyStrict(p)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(clicontext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		cs := client.ContentStore()
+		manifestDesc, err := containerdutil.ManifestDesc(ctx, cs, img.Target, platform)
+		if err != nil {
+			return err
+		}
+		p, err := content.ReadBlob(ctx, cs, manifestDesc)
+		if err != nil {
+			return err
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(p, &manifest); err != nil {
+			return err
+		}
+		p, err = content.ReadBlob(ctx, cs, manifest.Config)
+		if err != nil {
+			return err
+		}
+		var config ocispec.Image
+		if err := json.Unmarshal(p, &config); err != nil {
+			return err
+		}
+		if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+			return fmt.Errorf("image has %d layers but %d DiffIDs", len(manifest.Layers), len(config.RootFS.DiffIDs))
+		}
+
+		var failed int
+		for i, desc := range manifest.Layers {
+			opts := []estargz.CheckOption{
+				estargz.WithCheckDecompressors(new(zstdchunked.Decompressor)),
+				estargz.WithCheckDiffID(config.RootFS.DiffIDs[i]),
+			}
+			if tocDgst, ok := desc.Annotations[estargz.TOCJSONDigestAnnotation]; ok {
+				dgst, err := digest.Parse(tocDgst)
+				if err != nil {
+					return errors.Wrapf(err, "invalid TOC digest annotation of layer %v", desc.Digest)
+				}
+				opts = append(opts, estargz.WithCheckTOCDigest(dgst))
+			}
+			ra, err := cs.ReaderAt(ctx, desc)
+			if err != nil {
+				return err
+			}
+			err = estargz.Check(io.NewSectionReader(ra, 0, desc.Size), opts...)
+			ra.Close()
+			if err != nil {
+				failed++
+				fmt.Fprintf(clicontext.App.Writer, "%s: FAILED\n%v\n", desc.Digest, err)
+				continue
+			}
+			fmt.Fprintf(clicontext.App.Writer, "%s: OK\n", desc.Digest)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d out of %d layers are broken", failed, len(manifest.Layers))
+		}
+		return nil
+	},
+}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/containerd/containerd"
@@ -77,6 +78,11 @@ var OptimizeCommand = cli.Command{
 			Name:  "oci",
 			Usage: "convert Docker media types to OCI media types",
 		},
+		cli.StringSliceFlag{
+			Name:  "prefetch-profile",
+			Usage: "record the files accessed in the record file (output of --record-out) as a named prefetch profile in the form of NAME=FILE. This can be specified multiple times",
+			Value: &cli.StringSlice{},
+		},
 	}, samplerFlags...),
 	Action: func(clicontext *cli.Context) error {
 		convertOpts := []converter.Opt{}
@@ -129,7 +135,17 @@ var OptimizeCommand = cli.Command{
 				return errors.Wrapf(err, "failed output record file")
 			}
 		}
-		f := estargzconvert.LayerConvertWithLayerOptsFunc(esgzOptsPerLayer)
+		if profiles := clicontext.StringSlice("prefetch-profile"); len(profiles) > 0 {
+			if esgzOptsPerLayer == nil {
+				esgzOptsPerLayer = make(map[digest.Digest][]estargz.Option)
+			}
+			if err := addPrefetchProfiles(ctx, client, srcRef, profiles, esgzOptsPerLayer); err != nil {
+				return err
+			}
+		}
+		f := layerConvertFuncWithProgress(estargzconvert.LayerConvertFunc, func(dgst digest.Digest) []estargz.Option {
+			return esgzOptsPerLayer[dgst]
+		})
 		if wrapper != nil {
 			f = wrapper(f)
 		}
@@ -184,7 +200,6 @@ func analyze(ctx context.Context, clicontext *cli.Context, client *containerd.Cl
 	}
 
 	cs := client.ContentStore()
-	is := client.ImageService()
 
 	// Analyze layers and get prioritized files
 	aOpts := []analyzer.Option{analyzer.WithSpecOpts(getSpecOpts(clicontext))}
@@ -212,35 +227,68 @@ func analyze(ctx context.Context, clicontext *cli.Context, client *containerd.Cl
 	}
 
 	// Parse record file
-	srcImg, err := is.Get(ctx, srcRef)
+	manifestDesc, manifest, err := defaultManifest(ctx, client, srcRef)
 	if err != nil {
 		return "", nil, nil, err
 	}
-	manifestDesc, err := containerdutil.ManifestDesc(ctx, cs, srcImg.Target, platforms.DefaultStrict())
+	ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: recordOut})
 	if err != nil {
 		return "", nil, nil, err
 	}
-	p, err := content.ReadBlob(ctx, cs, manifestDesc)
+	defer ra.Close()
+	layerLogs, err := readLayerLogs(io.NewSectionReader(ra, 0, ra.Size()), manifestDesc, manifest)
 	if err != nil {
 		return "", nil, nil, err
 	}
+
+	// Create a converter wrapper for skipping layer conversion. This skip occurs
+	// if "reuse" option is specified, the source layer is already valid estargz
+	// and no access occur to that layer.
+	var excludes []digest.Digest
+	layerOpts := make(map[digest.Digest][]estargz.Option, len(manifest.Layers))
+	for _, desc := range manifest.Layers {
+		if layerLog, ok := layerLogs[desc.Digest]; ok && len(layerLog) > 0 {
+			layerOpts[desc.Digest] = []estargz.Option{estargz.WithPrioritizedFiles(layerLog)}
+		} else if clicontext.Bool("reuse") && isReusableESGZLayer(ctx, desc, cs) {
+			excludes = append(excludes, desc.Digest) // reuse layer without conversion
+		}
+	}
+	return recordOut, layerOpts, excludeWrapper(excludes), nil
+}
+
+// defaultManifest returns the manifest of the image for the current platform.
+func defaultManifest(ctx context.Context, client *containerd.Client, ref string) (ocispec.Descriptor, ocispec.Manifest, error) {
+	cs := client.ContentStore()
+	img, err := client.ImageService().Get(ctx, ref)
+	if err != nil {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, err
+	}
+	manifestDesc, err := containerdutil.ManifestDesc(ctx, cs, img.Target, platforms.DefaultStrict())
+	if err != nil {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, err
+	}
+	p, err := content.ReadBlob(ctx, cs, manifestDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, err
+	}
 	var manifest ocispec.Manifest
 	if err := json.Unmarshal(p, &manifest); err != nil {
-		return "", nil, nil, err
+		return ocispec.Descriptor{}, ocispec.Manifest{}, err
 	}
+	return manifestDesc, manifest, nil
+}
+
+// readLayerLogs parses the record file and returns the paths accessed in each
+// layer of the manifest, in the accessed order.
+func readLayerLogs(r io.Reader, manifestDesc ocispec.Descriptor, manifest ocispec.Manifest) (map[digest.Digest][]string, error) {
 	// TODO: this should be indexed by layer "index" (not "digest")
 	layerLogs := make(map[digest.Digest][]string, len(manifest.Layers))
-	ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: recordOut})
-	if err != nil {
-		return "", nil, nil, err
-	}
-	defer ra.Close()
-	dec := json.NewDecoder(io.NewSectionReader(ra, 0, ra.Size()))
+	dec := json.NewDecoder(r)
 	added := make(map[digest.Digest]map[string]struct{}, len(manifest.Layers))
 	for dec.More() {
 		var e recorder.Entry
 		if err := dec.Decode(&e); err != nil {
-			return "", nil, nil, err
+			return nil, err
 		}
 		if *e.LayerIndex < len(manifest.Layers) &&
 			e.ManifestDigest == manifestDesc.Digest.String() {
@@ -254,20 +302,36 @@ func analyze(ctx context.Context, clicontext *cli.Context, client *containerd.Cl
 			}
 		}
 	}
+	return layerLogs, nil
+}
 
-	// Create a converter wrapper for skipping layer conversion. This skip occurs
-	// if "reuse" option is specified, the source layer is already valid estargz
-	// and no access occur to that layer.
-	var excludes []digest.Digest
-	layerOpts := make(map[digest.Digest][]estargz.Option, len(manifest.Layers))
-	for _, desc := range manifest.Layers {
-		if layerLog, ok := layerLogs[desc.Digest]; ok && len(layerLog) > 0 {
-			layerOpts[desc.Digest] = []estargz.Option{estargz.WithPrioritizedFiles(layerLog)}
-		} else if clicontext.Bool("reuse") && isReusableESGZLayer(ctx, desc, cs) {
-			excludes = append(excludes, desc.Digest) // reuse layer without conversion
+// addPrefetchProfiles adds options to record the prefetch profiles specified
+// in the form of NAME=FILE, where FILE is a record file, to layerOpts.
+func addPrefetchProfiles(ctx context.Context, client *containerd.Client, srcRef string, profiles []string, layerOpts map[digest.Digest][]estargz.Option) error {
+	manifestDesc, manifest, err := defaultManifest(ctx, client, srcRef)
+	if err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("invalid prefetch profile %q; must be NAME=FILE", p)
+		}
+		name, recordFile := kv[0], kv[1]
+		f, err := os.Open(recordFile)
+		if err != nil {
+			return err
+		}
+		layerLogs, err := readLayerLogs(f, manifestDesc, manifest)
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read record file of prefetch profile %q", name)
+		}
+		for dgst, layerLog := range layerLogs {
+			layerOpts[dgst] = append(layerOpts[dgst], estargz.WithPrefetchProfile(name, layerLog))
 		}
 	}
-	return recordOut, layerOpts, excludeWrapper(excludes), nil
+	return nil
 }
 
 func isReusableESGZLayer(ctx context.Context, desc ocispec.Descriptor, cs content.Store) bool {
@@ -308,6 +372,41 @@ func excludeWrapper(excludes []digest.Digest) func(converter.ConvertFunc) conver
 	}
 }
 
+// progressLogInterval is the minimum interval of logging the progress of the
+// conversion of each layer.
+const progressLogInterval = 5 * time.Second
+
+// layerConvertFuncWithProgress returns a ConvertFunc converting each layer by
+// the ConvertFunc made by newConvertFunc with the options returned by optsOf,
+// logging the progress of the conversion.
+func layerConvertFuncWithProgress(newConvertFunc func(...estargz.Option) converter.ConvertFunc, optsOf func(digest.Digest) []estargz.Option) converter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		opts := append([]estargz.Option{}, optsOf(desc.Digest)...)
+		opts = append(opts, estargz.WithProgress(progressLogger(desc.Digest)))
+		return newConvertFunc(opts...)(ctx, cs, desc)
+	}
+}
+
+// progressLogger returns a function logging the progress of the conversion of
+// the layer at most once per progressLogInterval, and on completion.
+func progressLogger(dgst digest.Digest) func(estargz.Progress) {
+	var last time.Time
+	return func(p estargz.Progress) {
+		done := p.TotalEntries > 0 && p.Entries == p.TotalEntries
+		if !done && time.Since(last) < progressLogInterval {
+			return
+		}
+		last = time.Now()
+		if p.TotalEntries == 0 {
+			// totals are unknown when the layer is streamed
+			logrus.WithField("digest", dgst).Infof("converted %d entries (%d bytes)", p.Entries, p.Bytes)
+			return
+		}
+		logrus.WithField("digest", dgst).Infof("converted %d/%d entries (%d/%d bytes)",
+			p.Entries, p.TotalEntries, p.Bytes, p.TotalBytes)
+	}
+}
+
 func logWrapper(convertFunc converter.ConvertFunc) converter.ConvertFunc {
 	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
 		logrus.WithField("digest", desc.Digest).Infof("converting...")
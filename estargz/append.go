@@ -0,0 +1,199 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Append appends the entries in the tar stream to the eStargz blob passed
+// through base and returns the resulting eStargz blob.
+//
+// The compressed payload of base is reused byte-for-byte and only the appended
+// entries are compressed, followed by the TOC which merges the entries of base
+// and the appended ones, and the footer. Entries in the tar stream override the
+// entries of base with the same name.
+//
+// The appended entries are compressed with the compression specified by
+// WithCompression option (gzip with WithCompressionLevel by default) which must
+// be the same compression as base. WithChunkSize, WithContentDefinedChunking
+// and WithTempDir options are also respected. The TOC is written in the same
+// encoding as base unless WithCompactTOC option is specified. Other options are
+// ignored.
+//
+// Tar-split metadata of base (see WithTarSplit) is dropped because it doesn't
+// describe the appended entries so the resulting blob doesn't provide
+// OriginalTar.
+func Append(base *io.SectionReader, tarStream io.Reader, opt ...Option) (_ *Blob, rErr error) {
+	var opts options
+	opts.compressionLevel = gzip.BestCompression // BestCompression by default
+	for _, o := range opt {
+		if err := o(&opts); err != nil {
+			return nil, err
+		}
+	}
+	decompressors := gzipDecompressors()
+	if opts.compression == nil {
+		opts.compression = NewGzipCompressionWithLevel(opts.compressionLevel)
+	} else {
+		decompressors = []Decompressor{opts.compression}
+	}
+	d, payloadSize, baseTOCOff, baseTOCSize, err := openFooter(base, decompressors)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse footer of the base blob")
+	}
+	baseTOC, _, err := d.ParseTOC(io.NewSectionReader(base, baseTOCOff, baseTOCSize))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse TOC of the base blob")
+	}
+
+	// Compress the appended entries.
+	layerFiles := newTempFiles()
+	defer func() {
+		if rErr != nil {
+			if err := layerFiles.CleanupAll(); err != nil {
+				rErr = errors.Wrapf(rErr, "failed to cleanup tmp files: %v", err)
+			}
+		}
+	}()
+	esgzFile, err := layerFiles.TempFile(opts.tempDir, "esgzdata")
+	if err != nil {
+		return nil, err
+	}
+	sw := NewWriterWithCompressor(esgzFile, opts.compression)
+	sw.ChunkSize = opts.chunkSize
+	sw.ContentDefinedChunking = opts.contentDefinedChunking
+	sw.TempDir = opts.tempDir
+	if err := sw.AppendTar(tarStream); err != nil {
+		return nil, err
+	}
+	if err := sw.closeGz(); err != nil {
+		return nil, err
+	}
+	if err := sw.bw.Flush(); err != nil {
+		return nil, err
+	}
+	sw.closed = true
+
+	// Write the merged TOC and footer.
+	tocAndFooter := new(bytes.Buffer)
+	mtoc := mergeTOC(baseTOC, sw.toc, payloadSize)
+	mtoc.Compact = mtoc.Compact || opts.compactTOC
+	tocDgst, err := opts.compression.WriteTOCAndFooter(tocAndFooter, payloadSize+sw.cw.n, mtoc, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tocSize := int64(tocAndFooter.Len())
+	appended, err := fileSectionReader(esgzFile)
+	if err != nil {
+		return nil, err
+	}
+	diffID := digest.Canonical.Digester()
+	pr, pw := io.Pipe()
+	go func() {
+		r, err := d.Reader(io.TeeReader(io.MultiReader(
+			io.NewSectionReader(base, 0, payloadSize), appended, tocAndFooter), pw))
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		defer r.Close()
+		if _, err := io.Copy(diffID.Hash(), r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Close()
+	}()
+	return &Blob{
+		ReadCloser: readCloser{
+			Reader:    pr,
+			closeFunc: layerFiles.CleanupAll,
+		},
+		tocDigest: tocDgst,
+		tocSize:   tocSize,
+		diffID:    diffID,
+	}, nil
+}
+
+// mergeTOC merges the TOC of the appended entries into the TOC of the base blob.
+// Offsets of the appended entries are shifted by payloadSize. Entries in base
+// overridden by the appended ones and tar-split metadata are removed.
+func mergeTOC(base, appended *JTOC, payloadSize int64) *JTOC {
+	overridden := map[string]struct{}{TarSplitName: {}}
+	for _, e := range appended.Entries {
+		if e.Type != "chunk" {
+			overridden[cleanEntryName(e.Name)] = struct{}{}
+		}
+	}
+	mtoc := &JTOC{Version: base.Version, Compact: base.Compact}
+	if appended.Version > mtoc.Version {
+		mtoc.Version = appended.Version
+	}
+	var (
+		skipping bool
+
+		// User and group names appear only in the first entry with the same
+		// ID so they need to be carried over from removed entries.
+		uname, gname         = map[int]string{}, map[int]string{}
+		keptUname, keptGname = map[int]string{}, map[int]string{}
+	)
+	for _, e := range base.Entries {
+		if e.Uname != "" {
+			uname[e.UID] = e.Uname
+		}
+		if e.Gname != "" {
+			gname[e.GID] = e.Gname
+		}
+		if e.Type != "chunk" {
+			// Chunks belong to the last non-chunk entry.
+			_, skipping = overridden[cleanEntryName(e.Name)]
+		}
+		if skipping {
+			continue
+		}
+		if e.Type != "chunk" {
+			if e.Uname == "" && keptUname[e.UID] != uname[e.UID] {
+				e.Uname = uname[e.UID]
+			}
+			if e.Gname == "" && keptGname[e.GID] != gname[e.GID] {
+				e.Gname = gname[e.GID]
+			}
+			keptUname[e.UID], keptGname[e.GID] = uname[e.UID], gname[e.GID]
+		}
+		mtoc.Entries = append(mtoc.Entries, e)
+	}
+	skipping = false
+	for _, e := range appended.Entries {
+		if e.Type != "chunk" {
+			skipping = cleanEntryName(e.Name) == TarSplitName
+		}
+		if skipping {
+			continue
+		}
+		if (e.Type == "reg" && e.Size > 0) || e.Type == "chunk" {
+			e.Offset += payloadSize
+		}
+		mtoc.Entries = append(mtoc.Entries, e)
+	}
+	return mtoc
+}
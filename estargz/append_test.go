@@ -0,0 +1,256 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunkSize int
+		base      []tarEntry
+		appended  []tarEntry
+		want      map[string]string // regular files and their contents
+	}{
+		{
+			name:      "add files",
+			chunkSize: 4,
+			base: tarOf(
+				dir("etc/"),
+				file("etc/hosts", "127.0.0.1 localhost"),
+				file("bin/sh", "shellshellshell"),
+			),
+			appended: tarOf(
+				dir("etc/ssl/"),
+				file("etc/ssl/cert.pem", "certcertcertcert"),
+				file("etc/app.conf", ""),
+			),
+			want: map[string]string{
+				"etc/hosts":        "127.0.0.1 localhost",
+				"bin/sh":           "shellshellshell",
+				"etc/ssl/cert.pem": "certcertcertcert",
+				"etc/app.conf":     "",
+			},
+		},
+		{
+			name:      "override files",
+			chunkSize: 4,
+			base: tarOf(
+				file("foo", "foofoofoofoofoo"),
+				file("bar", "barbarbar"),
+				file("baz", "baz"),
+			),
+			appended: tarOf(
+				file("foo", "new"),
+				file("bar", "newbarnewbarnewbar"),
+			),
+			want: map[string]string{
+				"foo": "new",
+				"bar": "newbarnewbarnewbar",
+				"baz": "baz",
+			},
+		},
+		{
+			name:      "empty append",
+			chunkSize: 4,
+			base: tarOf(
+				file("foo", "foofoofoofoofoo"),
+			),
+			appended: tarOf(),
+			want: map[string]string{
+				"foo": "foofoofoofoofoo",
+			},
+		},
+	}
+	for _, tt := range tests {
+		for _, cl := range testCompressions() {
+			cl := cl
+			t.Run(fmt.Sprintf("%s-compression=%v", tt.name, cl), func(t *testing.T) {
+				base, err := Build(buildTarStatic(t, tt.base, ""),
+					WithChunkSize(tt.chunkSize), WithCompression(cl))
+				if err != nil {
+					t.Fatalf("failed to build base: %v", err)
+				}
+				baseData, err := ioutil.ReadAll(base)
+				if err != nil {
+					t.Fatalf("failed to read base: %v", err)
+				}
+				base.Close()
+				baseSR := io.NewSectionReader(bytes.NewReader(baseData), 0, int64(len(baseData)))
+				_, payloadSize, _, _, err := openFooter(baseSR, []Decompressor{cl})
+				if err != nil {
+					t.Fatalf("failed to parse footer of base: %v", err)
+				}
+
+				blob, err := Append(baseSR, buildTarStatic(t, tt.appended, ""),
+					WithChunkSize(tt.chunkSize), WithCompression(cl))
+				if err != nil {
+					t.Fatalf("failed to append: %v", err)
+				}
+				gotData, err := ioutil.ReadAll(blob)
+				if err != nil {
+					t.Fatalf("failed to read appended blob: %v", err)
+				}
+				blob.Close()
+
+				// The payload of the base blob must be reused as is.
+				if !bytes.Equal(gotData[:payloadSize], baseData[:payloadSize]) {
+					t.Errorf("payload of base isn't reused")
+				}
+				if diffID, want := blob.DiffID().String(), cl.diffIDOf(t, gotData); diffID != want {
+					t.Errorf("DiffID = %q; want %q", diffID, want)
+				}
+
+				r, err := Open(io.NewSectionReader(bytes.NewReader(gotData), 0, int64(len(gotData))),
+					WithDecompressors(cl))
+				if err != nil {
+					t.Fatalf("failed to open appended blob: %v", err)
+				}
+				v, err := r.VerifyTOC(blob.TOCDigest())
+				if err != nil {
+					t.Fatalf("failed to verify TOC: %v", err)
+				}
+				for name, contents := range tt.want {
+					e, ok := r.Lookup(name)
+					if !ok {
+						t.Fatalf("%q not found", name)
+					}
+					if e.Size != int64(len(contents)) {
+						t.Errorf("size of %q = %d; want %d", name, e.Size, len(contents))
+					}
+					sr, err := r.OpenFile(name)
+					if err != nil {
+						t.Fatalf("failed to open %q: %v", name, err)
+					}
+					for off := int64(0); off < e.Size; off += int64(tt.chunkSize) {
+						ce, ok := r.ChunkEntryForOffset(name, off)
+						if !ok {
+							t.Fatalf("chunk of %q at %d not found", name, off)
+						}
+						cr := io.NewSectionReader(sr, ce.ChunkOffset, ce.ChunkSize)
+						cv, err := v.Verifier(ce)
+						if err != nil {
+							t.Fatalf("verifier of %q at %d not found: %v", name, off, err)
+						}
+						if _, err := io.Copy(cv, cr); err != nil {
+							t.Fatalf("failed to read chunk of %q at %d: %v", name, off, err)
+						}
+						if !cv.Verified() {
+							t.Errorf("chunk of %q at %d isn't verified", name, off)
+						}
+					}
+					got, err := ioutil.ReadAll(sr)
+					if err != nil {
+						t.Fatalf("failed to read %q: %v", name, err)
+					}
+					if string(got) != contents {
+						t.Errorf("contents of %q = %q; want %q", name, string(got), contents)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestAppendCompressionMismatch(t *testing.T) {
+	base, err := Build(buildTarStatic(t, tarOf(file("foo", "foo")), ""))
+	if err != nil {
+		t.Fatalf("failed to build base: %v", err)
+	}
+	baseData, err := ioutil.ReadAll(base)
+	if err != nil {
+		t.Fatalf("failed to read base: %v", err)
+	}
+	base.Close()
+	baseSR := io.NewSectionReader(bytes.NewReader(baseData), 0, int64(len(baseData)))
+	if _, err := Append(baseSR, buildTarStatic(t, tarOf(file("bar", "bar")), ""),
+		WithCompression(storeCompression{})); err == nil {
+		t.Errorf("appending to gzip blob with other compression must fail")
+	}
+}
+
+func TestMergeTOCNames(t *testing.T) {
+	base := &JTOC{
+		Version: 1,
+		Entries: []*TOCEntry{
+			{Name: "foo", Type: "reg", UID: 1, Uname: "user1", GID: 2, Gname: "group2"},
+			{Name: "bar", Type: "reg", UID: 1, GID: 2},
+		},
+	}
+	appended := &JTOC{
+		Version: 1,
+		Entries: []*TOCEntry{{Name: "foo", Type: "reg"}},
+	}
+	mtoc := mergeTOC(base, appended, 100)
+	if len(mtoc.Entries) != 2 {
+		t.Fatalf("unexpected number of entries %d; want 2", len(mtoc.Entries))
+	}
+	if e := mtoc.Entries[0]; e.Name != "bar" || e.Uname != "user1" || e.Gname != "group2" {
+		t.Errorf("names must be carried over from the overridden entry: %+v", e)
+	}
+}
+
+func TestAppendTarSplit(t *testing.T) {
+	base, err := Build(buildTarStatic(t, tarOf(file("foo", "foo")), ""), WithTarSplit())
+	if err != nil {
+		t.Fatalf("failed to build base: %v", err)
+	}
+	baseData, err := ioutil.ReadAll(base)
+	if err != nil {
+		t.Fatalf("failed to read base: %v", err)
+	}
+	base.Close()
+	blob, err := Append(io.NewSectionReader(bytes.NewReader(baseData), 0, int64(len(baseData))),
+		buildTarStatic(t, tarOf(file("bar", "bar")), ""))
+	if err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	defer blob.Close()
+	b, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read appended blob: %v", err)
+	}
+	sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+	if err := Check(sr); err != nil {
+		t.Fatalf("appended blob is invalid: %v", err)
+	}
+	r, err := Open(sr)
+	if err != nil {
+		t.Fatalf("failed to open appended blob: %v", err)
+	}
+	if _, ok := r.Lookup(TarSplitName); ok {
+		t.Errorf("tar-split metadata of base must be dropped")
+	}
+	pr, err := r.PlainTar()
+	if err != nil {
+		t.Fatalf("failed to get plain tar: %v", err)
+	}
+	defer pr.Close()
+	got, err := ioutil.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("failed to read plain tar: %v", err)
+	}
+	if ents := plainTarEntries(t, got); len(ents) != 2 || ents[0].name != "bar" || ents[1].name != "foo" {
+		t.Errorf("entries of plain tar = %+v; want bar and foo", ents)
+	}
+}
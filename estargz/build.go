@@ -26,15 +26,17 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
-	"encoding/json"
+	"crypto"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/containerd/stargz-snapshotter/estargz/errorutil"
 	digest "github.com/opencontainers/go-digest"
@@ -47,6 +49,21 @@ type options struct {
 	compressionLevel       int
 	prioritizedFiles       []string
 	missedPrioritizedFiles *[]string
+	compression            Compression
+	sourceDateEpoch        *time.Time
+	contentDefinedChunking bool
+	compactTOC             bool
+	tarSplit               bool
+	storePolicy            StorePolicy
+	minChunkSize           int
+	dedup                  bool
+	tocSigningKey          crypto.Signer
+	prefetchProfiles       []prefetchProfile
+	transformer            transformer
+	tempDir                string
+	maxParallelism         int
+	diskBudget             int64
+	progress               func(Progress)
 }
 
 type Option func(o *options) error
@@ -59,6 +76,126 @@ func WithChunkSize(chunkSize int) Option {
 	}
 }
 
+// WithMinChunkSize option makes regular files smaller than the specified size
+// packed into a compressed stream shared with the preceding entries instead
+// of each file starting a new stream. This improves the compression ratio of
+// layers containing many small files. See also Writer.MinChunkSize.
+func WithMinChunkSize(minChunkSize int) Option {
+	return func(o *options) error {
+		o.minChunkSize = minChunkSize
+		return nil
+	}
+}
+
+// WithDeduplication option makes Build store the contents of identical regular
+// files only once. Such files are replaced with hardlinks to the first one, both
+// in the uncompressed tar and in the TOC, so extracted and lazily mounted
+// layers see the same inode for them. As hardlinks share metadata, only files
+// whose metadata (mode, owner, modification time and xattrs) are identical as
+// well are deduplicated.
+func WithDeduplication() Option {
+	return func(o *options) error {
+		o.dedup = true
+		return nil
+	}
+}
+
+// WithTOCSigningKey option makes Build sign the digest of the TOC with the
+// specified key (ed25519.PrivateKey or *ecdsa.PrivateKey). The signature is
+// embedded to the blob next to the TOC so that the TOC can be verified even if
+// TOCJSONDigestAnnotation isn't available. See also Reader.VerifyTOCSignature.
+func WithTOCSigningKey(key crypto.Signer) Option {
+	return func(o *options) error {
+		o.tocSigningKey = key
+		return nil
+	}
+}
+
+// WithTempDir option specifies the directory where Build creates temporary
+// files. The compressed blob is kept in that directory until the returned Blob
+// is closed. The default is the default directory for temporary files (see
+// os.TempDir).
+func WithTempDir(dir string) Option {
+	return func(o *options) error {
+		o.tempDir = dir
+		return nil
+	}
+}
+
+// WithMaxParallelism option limits the number of sub-blobs Build compresses
+// concurrently. Zero or less means runtime.GOMAXPROCS(0). This doesn't change
+// the resulting blob.
+func WithMaxParallelism(n int) Option {
+	return func(o *options) error {
+		o.maxParallelism = n
+		return nil
+	}
+}
+
+// WithDiskBudget option makes Build fail if the temporary files holding the
+// compressed sub-blobs exceed the specified number of bytes, instead of filling
+// up the disk. Only the compressed output is counted; other temporary files
+// (e.g. the data of sparse files spooled by Writer) aren't limited. Zero or
+// less means no limit.
+func WithDiskBudget(bytes int64) Option {
+	return func(o *options) error {
+		o.diskBudget = bytes
+		return nil
+	}
+}
+
+// WithProgress option makes Build call f every time an entry of the input tar
+// is compressed. Calls of f are serialized. See also Progress.
+func WithProgress(f func(Progress)) Option {
+	return func(o *options) error {
+		o.progress = f
+		return nil
+	}
+}
+
+// WithContentDefinedChunking option makes the boundaries of chunks determined
+// by the contents of files instead of fixed offsets. The chunk size specified by
+// WithChunkSize option is used as the maximum size of chunks.
+// See also Writer.ContentDefinedChunking.
+func WithContentDefinedChunking() Option {
+	return func(o *options) error {
+		o.contentDefinedChunking = true
+		return nil
+	}
+}
+
+// WithCompactTOC option makes the TOC serialized in the compact binary encoding
+// instead of JSON. This reduces the time and memory to parse the TOC of layers
+// with very many files. The resulting blob can be read by Open as usual.
+func WithCompactTOC() Option {
+	return func(o *options) error {
+		o.compactTOC = true
+		return nil
+	}
+}
+
+// WithTarSplit option makes Build embed tar-split metadata to the blob as
+// TarSplitName file. The metadata records the parts of the original tar that
+// aren't stored in the blob (e.g. headers and paddings) so that the original
+// tar can be reconstructed byte-for-byte by Reader.OriginalTar.
+func WithTarSplit() Option {
+	return func(o *options) error {
+		o.tarSplit = true
+		return nil
+	}
+}
+
+// WithStorePolicy option makes Build store regular files chosen by the policy
+// without compression (e.g. as stored-only deflate blocks in gzip members).
+// This saves the time of building and lazily reading files which don't shrink
+// by compression. See also Writer.StorePolicy.
+func WithStorePolicy(policy StorePolicy) Option {
+	return func(o *options) error {
+		o.storePolicy = policy
+		return nil
+	}
+}
+
 // WithCompressionLevel option specifies the gzip compression level.
 // The default is gzip.BestCompression.
 // See also: https://godoc.org/compress/gzip#pkg-constants
@@ -69,6 +206,16 @@ func WithCompressionLevel(level int) Option {
 	}
 }
 
+// WithCompression option specifies compression algorithm of eStargz.
+// If this option isn't specified, gzip with the level specified by
+// WithCompressionLevel is used.
+func WithCompression(compression Compression) Option {
+	return func(o *options) error {
+		o.compression = compression
+		return nil
+	}
+}
+
 // WithPrioritizedFiles option specifies the list of prioritized files.
 // These files must be complete paths that are absolute or relative to "/"
 // For example, all of "foo/bar", "/foo/bar", "./foo/bar" and "../foo/bar"
@@ -80,6 +227,29 @@ func WithPrioritizedFiles(files []string) Option {
 	}
 }
 
+// WithPrefetchProfile option records the named list of files to prefetch for a
+// workload to the TOC (see JTOC.PrefetchProfiles) with the ranges of the blob
+// storing them. This can be specified several times with different names so
+// that a layer used by several workloads can be optimized for each of them.
+// Files of the profiles which aren't prioritized by WithPrioritizedFiles are
+// placed right after the prioritized files in the order of the profiles.
+// Files not found in the input tar (e.g. files in other layers of the image)
+// are skipped.
+func WithPrefetchProfile(name string, files []string) Option {
+	return func(o *options) error {
+		if name == "" {
+			return fmt.Errorf("WithPrefetchProfile: name must be specified")
+		}
+		for _, p := range o.prefetchProfiles {
+			if p.name == name {
+				return fmt.Errorf("WithPrefetchProfile: profile %q is specified twice", name)
+			}
+		}
+		o.prefetchProfiles = append(o.prefetchProfiles, prefetchProfile{name, files})
+		return nil
+	}
+}
+
 // WithAllowPrioritizeNotFound makes Build continue the execution even if some
 // of prioritized files specified by WithPrioritizedFiles option aren't found
 // in the input tar. Instead, this records all missed file names to the passed
@@ -94,11 +264,25 @@ func WithAllowPrioritizeNotFound(missedFiles *[]string) Option {
 	}
 }
 
+// WithSourceDateEpoch option clamps the modification time of the entries to the
+// specified time. Entries modified later than that time get that time instead
+// so that blobs built from the same contents at different times can be
+// identical. This follows the SOURCE_DATE_EPOCH convention used by
+// reproducible builds.
+// See also: https://reproducible-builds.org/specs/source-date-epoch/
+func WithSourceDateEpoch(t time.Time) Option {
+	return func(o *options) error {
+		o.sourceDateEpoch = &t
+		return nil
+	}
+}
+
 // Blob is an eStargz blob.
 type Blob struct {
 	io.ReadCloser
 	diffID    digest.Digester
 	tocDigest digest.Digest
+	tocSize   int64
 }
 
 // DiffID returns the digest of uncompressed blob.
@@ -112,11 +296,18 @@ func (b *Blob) TOCDigest() digest.Digest {
 	return b.tocDigest
 }
 
+// TOCSize returns the size of the TOC and the footer at the tail of the blob.
+// This can be passed to readers through TOCSizeAnnotation.
+func (b *Blob) TOCSize() int64 {
+	return b.tocSize
+}
+
 // Build builds an eStargz blob which is an extended version of stargz, from tar blob passed
 // through the argument. If there are some prioritized files are listed in the option, these
 // files are grouped as "prioritized" and can be used for runtime optimization (e.g. prefetch).
-// This function builds a blob in parallel, with dividing that blob into several (at least the
-// number of runtime.GOMAXPROCS(0)) sub-blobs.
+// This function builds a blob in parallel, with dividing that blob into several (at least
+// buildPartsNum unless WithMinChunkSize is large) sub-blobs. The number of sub-blobs doesn't
+// depend on the environment so the same input and options always result in the same blob.
 func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 	var opts options
 	opts.compressionLevel = gzip.BestCompression // BestCompression by default
@@ -125,6 +316,9 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 			return nil, err
 		}
 	}
+	if opts.compression == nil {
+		opts.compression = NewGzipCompressionWithLevel(opts.compressionLevel)
+	}
 	layerFiles := newTempFiles()
 	defer func() {
 		if rErr != nil {
@@ -133,25 +327,69 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 			}
 		}
 	}()
-	entries, err := sortEntries(tarBlob, opts.prioritizedFiles, opts.missedPrioritizedFiles)
+	var profiled []string
+	for _, p := range opts.prefetchProfiles {
+		profiled = append(profiled, p.files...)
+	}
+	if opts.tarSplit && opts.transformer.enabled() {
+		return nil, fmt.Errorf("WithTarSplit can't be used with options excluding or rewriting entries")
+	}
+	entries, err := sortEntries(tarBlob, &opts.transformer, opts.prioritizedFiles, profiled, opts.missedPrioritizedFiles)
 	if err != nil {
 		return nil, err
 	}
-	tarParts := divideEntries(entries, runtime.GOMAXPROCS(0))
+	if opts.sourceDateEpoch != nil {
+		for _, e := range entries {
+			clampTime(e.header, *opts.sourceDateEpoch)
+		}
+	}
+	var digests map[string]digest.Digest
+	if opts.dedup {
+		if digests, err = dedupEntries(entries); err != nil {
+			return nil, errors.Wrap(err, "failed to deduplicate files")
+		}
+	}
+	if opts.tarSplit {
+		split, err := tarSplitOf(tarBlob)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to make tar-split metadata")
+		}
+		entries = append(entries, &entry{
+			header: &tar.Header{
+				Name:     TarSplitName,
+				Typeflag: tar.TypeReg,
+				Size:     int64(len(split)),
+			},
+			payload: bytes.NewReader(split),
+		})
+	}
+	if opts.progress != nil {
+		reportProgress(entries, opts.progress)
+	}
+	// Small files are packed only within a sub-blob so sub-blobs shouldn't be
+	// smaller than the packing unit.
+	tarParts := divideEntries(entries, buildPartsNum, int64(opts.minChunkSize))
 	writers := make([]*Writer, len(tarParts))
 	payloads := make([]*os.File, len(tarParts))
 	var mu sync.Mutex
 	var eg errgroup.Group
+	parallelism := opts.maxParallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	sem := make(chan struct{}, parallelism)
+	var diskUsage int64
 	for i, parts := range tarParts {
 		i, parts := i, parts
 		// builds verifiable stargz sub-blobs
 		eg.Go(func() error {
-			esgzFile, err := layerFiles.TempFile("", "esgzdata")
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			sw, esgzFile, err := opts.newSubWriter(layerFiles, &diskUsage)
 			if err != nil {
 				return err
 			}
-			sw := NewWriterLevel(esgzFile, opts.compressionLevel)
-			sw.ChunkSize = opts.chunkSize
+			sw.digests = digests
 			if err := sw.AppendTar(readerFromEntries(parts...)); err != nil {
 				return err
 			}
@@ -166,11 +404,40 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 		rErr = err
 		return nil, err
 	}
-	tocAndFooter, tocDgst, err := closeWithCombine(opts.compressionLevel, writers...)
+	return combineBlob(opts.compression, layerFiles, writers, payloads, opts.prefetchProfiles)
+}
+
+// newSubWriter returns a Writer configured by the options which writes a
+// sub-blob to a new temporary file. diskUsage is shared among sub-writers to
+// enforce WithDiskBudget.
+func (opts *options) newSubWriter(layerFiles *tempFiles, diskUsage *int64) (*Writer, *os.File, error) {
+	esgzFile, err := layerFiles.TempFile(opts.tempDir, "esgzdata")
+	if err != nil {
+		return nil, nil, err
+	}
+	var w io.Writer = esgzFile
+	if opts.diskBudget > 0 {
+		w = &budgetWriter{w: esgzFile, used: diskUsage, budget: opts.diskBudget}
+	}
+	sw := NewWriterWithCompressor(w, opts.compression)
+	sw.ChunkSize = opts.chunkSize
+	sw.ContentDefinedChunking = opts.contentDefinedChunking
+	sw.CompactTOC = opts.compactTOC
+	sw.StorePolicy = opts.storePolicy
+	sw.MinChunkSize = opts.minChunkSize
+	sw.TOCSigningKey = opts.tocSigningKey
+	sw.TempDir = opts.tempDir
+	return sw, esgzFile, nil
+}
+
+// combineBlob combines the sub-blobs written by the unclosed writers to the
+// payloads into a single eStargz blob. See also closeWithCombine.
+func combineBlob(compression Compression, layerFiles *tempFiles, writers []*Writer, payloads []*os.File, profiles []prefetchProfile) (*Blob, error) {
+	tocAndFooter, tocDgst, err := closeWithCombine(profiles, writers...)
 	if err != nil {
-		rErr = err
 		return nil, err
 	}
+	tocSize := int64(tocAndFooter.Len())
 	var rs []io.Reader
 	for _, p := range payloads {
 		fs, err := fileSectionReader(p)
@@ -182,11 +449,12 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 	diffID := digest.Canonical.Digester()
 	pr, pw := io.Pipe()
 	go func() {
-		r, err := gzip.NewReader(io.TeeReader(io.MultiReader(append(rs, tocAndFooter)...), pw))
+		r, err := compression.Reader(io.TeeReader(io.MultiReader(append(rs, tocAndFooter)...), pw))
 		if err != nil {
 			pw.CloseWithError(err)
 			return
 		}
+		defer r.Close()
 		if _, err := io.Copy(diffID.Hash(), r); err != nil {
 			pw.CloseWithError(err)
 			return
@@ -199,6 +467,7 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 			closeFunc: layerFiles.CleanupAll,
 		},
 		tocDigest: tocDgst,
+		tocSize:   tocSize,
 		diffID:    diffID,
 	}, nil
 }
@@ -207,8 +476,9 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 // toc that combined all Writers into.
 // Writers doesn't write TOC and footer to the underlying writers so they can be
 // combined into a single eStargz and tocAndFooter returned by this function can
-// be appended at the tail of that combined blob.
-func closeWithCombine(compressionLevel int, ws ...*Writer) (tocAndFooter io.Reader, tocDgst digest.Digest, err error) {
+// be appended at the tail of that combined blob. profiles are recorded to the
+// TOC.
+func closeWithCombine(profiles []prefetchProfile, ws ...*Writer) (tocAndFooter *bytes.Buffer, tocDgst digest.Digest, err error) {
 	if len(ws) == 0 {
 		return nil, "", fmt.Errorf("at least one writer must be passed")
 	}
@@ -225,10 +495,11 @@ func closeWithCombine(compressionLevel int, ws ...*Writer) (tocAndFooter io.Read
 		}
 	}
 	var (
-		mtoc          = new(jtoc)
+		mtoc          = new(JTOC)
 		currentOffset int64
 	)
 	mtoc.Version = ws[0].toc.Version
+	mtoc.Compact = ws[0].CompactTOC
 	for _, w := range ws {
 		for _, e := range w.toc.Entries {
 			// Recalculate Offset of non-empty files/chunks
@@ -242,51 +513,38 @@ func closeWithCombine(compressionLevel int, ws ...*Writer) (tocAndFooter io.Read
 		}
 		currentOffset += w.cw.n
 	}
+	mtoc.PrefetchProfiles = prefetchProfilesOf(mtoc, currentOffset, profiles)
+	if key := ws[0].TOCSigningKey; key != nil {
+		if err := signTOC(mtoc, key); err != nil {
+			return nil, "", err
+		}
+	}
 
-	tocJSON, err := json.MarshalIndent(mtoc, "", "\t")
+	buf := new(bytes.Buffer)
+	tocDgst, err = ws[0].compressor.WriteTOCAndFooter(buf, currentOffset, mtoc, nil)
 	if err != nil {
 		return nil, "", err
 	}
-	pr, pw := io.Pipe()
-	go func() {
-		zw, _ := gzip.NewWriterLevel(pw, compressionLevel)
-		tw := tar.NewWriter(zw)
-		if err := tw.WriteHeader(&tar.Header{
-			Typeflag: tar.TypeReg,
-			Name:     TOCTarName,
-			Size:     int64(len(tocJSON)),
-		}); err != nil {
-			pw.CloseWithError(err)
-			return
-		}
-		if _, err := tw.Write(tocJSON); err != nil {
-			pw.CloseWithError(err)
-			return
-		}
-		if err := tw.Close(); err != nil {
-			pw.CloseWithError(err)
-			return
-		}
-		if err := zw.Close(); err != nil {
-			pw.CloseWithError(err)
-			return
-		}
-		pw.Close()
-	}()
-	return io.MultiReader(
-		pr,
-		bytes.NewReader(footerBytes(currentOffset)),
-	), digest.FromBytes(tocJSON), nil
+	return buf, tocDgst, nil
 }
 
+// buildPartsNum is the minimum number of sub-blobs Build divides a blob into.
+// This must be a constant because the boundaries of sub-blobs affect the
+// resulting blob.
+const buildPartsNum = 8
+
 // divideEntries divides passed entries to the parts at least the number specified by the
-// argument.
-func divideEntries(entries []*entry, minPartsNum int) (set [][]*entry) {
+// argument. If minPartSize is positive, each part is larger than it (except the last one)
+// so the number of parts can be less than minPartsNum.
+func divideEntries(entries []*entry, minPartsNum int, minPartSize int64) (set [][]*entry) {
 	var estimatedSize int64
 	for _, e := range entries {
 		estimatedSize += e.header.Size
 	}
 	unitSize := estimatedSize / int64(minPartsNum)
+	if unitSize < minPartSize {
+		unitSize = minPartSize
+	}
 	var (
 		nextEnd = unitSize
 		offset  int64
@@ -305,16 +563,22 @@ func divideEntries(entries []*entry, minPartsNum int) (set [][]*entry) {
 
 var errNotFound = errors.New("not found")
 
-// sortEntries reads the specified tar blob and returns a list of tar entries.
-// If some of prioritized files are specified, the list starts from these
-// files with keeping the order specified by the argument.
-func sortEntries(in io.ReaderAt, prioritized []string, missedPrioritized *[]string) ([]*entry, error) {
+// sortEntries reads the specified tar blob and returns a list of tar entries
+// transformed by t. If some of prioritized files are specified, the list starts
+// from these files with keeping the order specified by the argument. Names of
+// prioritized files are the transformed ones.
+func sortEntries(in io.ReaderAt, t *transformer, prioritized, profiled []string, missedPrioritized *[]string) ([]*entry, error) {
 
 	// Import tar file.
 	intar, err := importTar(in)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to sort")
 	}
+	if t != nil {
+		if intar, err = t.apply(intar); err != nil {
+			return nil, errors.Wrap(err, "failed to transform entries")
+		}
+	}
 
 	// Sort the tar file respecting to the prioritized files list.
 	sorted := &tarFile{}
@@ -347,10 +611,32 @@ func sortEntries(in io.ReaderAt, prioritized []string, missedPrioritized *[]stri
 		})
 	}
 
+	// Files of prefetch profiles follow the landmark so that they are close to
+	// each other but aren't prefetched by default. Profiles are recorded only
+	// for the files found in the layer so missing files are just skipped.
+	for _, l := range profiled {
+		if err := moveRec(l, intar, sorted); err != nil && !errors.Is(err, errNotFound) {
+			return nil, errors.Wrap(err, "failed to sort tar entries")
+		}
+	}
+
 	// Dump all entry and concatinate them.
 	return append(sorted.dump(), intar.dump()...), nil
 }
 
+// clampTime sets t to the timestamps of the header that are later than t.
+func clampTime(h *tar.Header, t time.Time) {
+	if h.ModTime.After(t) {
+		h.ModTime = t
+	}
+	if h.AccessTime.After(t) {
+		h.AccessTime = t
+	}
+	if h.ChangeTime.After(t) {
+		h.ChangeTime = t
+	}
+}
+
 // readerFromEntries returns a reader of tar archive that contains entries passed
 // through the arguments.
 func readerFromEntries(entries ...*entry) io.Reader {
@@ -359,6 +645,13 @@ func readerFromEntries(entries ...*entry) io.Reader {
 		tw := tar.NewWriter(pw)
 		defer tw.Close()
 		for _, entry := range entries {
+			if isSparseHeader(entry.header) {
+				if err := writeSparseEntry(tw, pw, entry); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				continue
+			}
 			if err := tw.WriteHeader(entry.header); err != nil {
 				pw.CloseWithError(fmt.Errorf("Failed to write tar header: %v", err))
 				return
@@ -373,6 +666,26 @@ func readerFromEntries(entries ...*entry) io.Reader {
 	return pr
 }
 
+// writeSparseEntry writes the sparse file entry to w which tw writes to. The
+// expanded payload is passed as the single region and Writer finds holes from it.
+func writeSparseEntry(tw *tar.Writer, w io.Writer, entry *entry) error {
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("Failed to flush tar: %v", err)
+	}
+	var regions []sparseRegion
+	if entry.header.Size > 0 {
+		regions = []sparseRegion{{0, entry.header.Size}}
+	}
+	sw, err := writeSparseHeader(w, entry.header, regions)
+	if err != nil {
+		return fmt.Errorf("Failed to write tar header: %v", err)
+	}
+	if _, err := io.Copy(sw, entry.payload); err != nil {
+		return fmt.Errorf("Failed to write tar payload: %v", err)
+	}
+	return sw.Close()
+}
+
 func importTar(in io.ReaderAt) (*tarFile, error) {
 	tf := &tarFile{}
 	pw, err := newCountReader(in)
@@ -382,6 +695,7 @@ func importTar(in io.ReaderAt) (*tarFile, error) {
 	tr := tar.NewReader(pw)
 
 	// Walk through all nodes.
+	var lastEnd int64 // the end of the payload of the last entry in the tar
 	for {
 		// Fetch and parse next header.
 		h, err := tr.Next()
@@ -392,9 +706,23 @@ func importTar(in io.ReaderAt) (*tarFile, error) {
 				return nil, errors.Wrap(err, "failed to parse tar file")
 			}
 		}
+		var payload io.Reader
+		if isSparseHeader(h) {
+			// tar.Reader expands the payload of sparse files so it can't be
+			// referred as a section of the tar. Instead, the payload is read
+			// by parsing the header again.
+			payload = &sparsePayload{in: in, off: (lastEnd + blockSize - 1) / blockSize * blockSize}
+			if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+				return nil, errors.Wrapf(err, "failed to read sparse file %q", h.Name)
+			}
+			lastEnd = pw.currentPos()
+		} else {
+			payload = io.NewSectionReader(in, pw.currentPos(), h.Size)
+			lastEnd = pw.currentPos() + tarPayloadSize(h)
+		}
 		switch cleanEntryName(h.Name) {
-		case PrefetchLandmark, NoPrefetchLandmark:
-			// Ignore existing landmark
+		case PrefetchLandmark, NoPrefetchLandmark, TarSplitName:
+			// Ignore existing landmark and tar-split metadata
 			continue
 		}
 
@@ -404,13 +732,43 @@ func importTar(in io.ReaderAt) (*tarFile, error) {
 		}
 		tf.add(&entry{
 			header:  h,
-			payload: io.NewSectionReader(in, pw.currentPos(), h.Size),
+			payload: payload,
 		})
 	}
 
 	return tf, nil
 }
 
+// tarPayloadSize returns the size of the payload of the entry stored in the tar.
+// The size of a sparse file in the tar isn't known from the header.
+func tarPayloadSize(h *tar.Header) int64 {
+	switch h.Typeflag {
+	case tar.TypeLink, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeDir, tar.TypeFifo:
+		// tar.Reader ignores the size of header-only entries
+		return 0
+	}
+	return h.Size
+}
+
+// sparsePayload reads the expanded payload of the sparse file whose header
+// starts at off in the tar.
+type sparsePayload struct {
+	in  io.ReaderAt
+	off int64
+	tr  *tar.Reader
+}
+
+func (sp *sparsePayload) Read(p []byte) (int, error) {
+	if sp.tr == nil {
+		tr := tar.NewReader(io.NewSectionReader(sp.in, sp.off, math.MaxInt64-sp.off))
+		if _, err := tr.Next(); err != nil {
+			return 0, err
+		}
+		sp.tr = tr
+	}
+	return sp.tr.Read(p)
+}
+
 func moveRec(name string, in *tarFile, out *tarFile) error {
 	name = cleanEntryName(name)
 	if name == "" { // root directory. stop recursion.
@@ -447,7 +805,7 @@ func moveRec(name string, in *tarFile, out *tarFile) error {
 
 type entry struct {
 	header  *tar.Header
-	payload io.ReadSeeker
+	payload io.Reader
 }
 
 type tarFile struct {
@@ -31,6 +31,7 @@ import (
 	"io"
 	"io/ioutil"
 	"reflect"
+	"runtime"
 	"testing"
 	"time"
 
@@ -109,7 +110,7 @@ func TestBuild(t *testing.T) {
 		},
 	}
 	for _, tt := range tests {
-		for _, cl := range compressionLevels {
+		for _, cl := range testCompressions() {
 			cl := cl
 			for _, prefix := range allowedPrefix {
 				prefix := prefix
@@ -117,12 +118,12 @@ func TestBuild(t *testing.T) {
 
 					tarBlob := buildTarStatic(t, tt.in, prefix)
 					// Test divideEntries()
-					entries, err := sortEntries(tarBlob, nil, nil) // identical order
+					entries, err := sortEntries(tarBlob, nil, nil, nil, nil) // identical order
 					if err != nil {
 						t.Fatalf("faield to parse tar: %v", err)
 					}
 					var merged []*entry
-					for _, part := range divideEntries(entries, 4) {
+					for _, part := range divideEntries(entries, 4, 0) {
 						merged = append(merged, part...)
 					}
 					if !reflect.DeepEqual(entries, merged) {
@@ -138,7 +139,7 @@ func TestBuild(t *testing.T) {
 
 					// Prepare sample data
 					wantBuf := new(bytes.Buffer)
-					sw := NewWriterLevel(wantBuf, cl)
+					sw := NewWriterWithCompressor(wantBuf, cl)
 					sw.ChunkSize = tt.chunkSize
 					if err := sw.AppendTar(tarBlob); err != nil {
 						t.Fatalf("faield to append tar to want stargz: %v", err)
@@ -148,13 +149,13 @@ func TestBuild(t *testing.T) {
 					}
 					wantData := wantBuf.Bytes()
 					want, err := Open(io.NewSectionReader(
-						bytes.NewReader(wantData), 0, int64(len(wantData))))
+						bytes.NewReader(wantData), 0, int64(len(wantData))), WithDecompressors(cl))
 					if err != nil {
 						t.Fatalf("failed to parse the want stargz: %v", err)
 					}
 
 					// Prepare testing data
-					rc, err := Build(tarBlob, WithChunkSize(tt.chunkSize), WithCompressionLevel(cl))
+					rc, err := Build(tarBlob, WithChunkSize(tt.chunkSize), WithCompression(cl))
 					if err != nil {
 						t.Fatalf("faield to build stargz: %v", err)
 					}
@@ -165,7 +166,7 @@ func TestBuild(t *testing.T) {
 					}
 					gotData := gotBuf.Bytes()
 					got, err := Open(io.NewSectionReader(
-						bytes.NewReader(gotBuf.Bytes()), 0, int64(len(gotData))))
+						bytes.NewReader(gotBuf.Bytes()), 0, int64(len(gotData))), WithDecompressors(cl))
 					if err != nil {
 						t.Fatalf("failed to parse the got stargz: %v", err)
 					}
@@ -173,13 +174,13 @@ func TestBuild(t *testing.T) {
 					// Check DiffID is properly calculated
 					rc.Close()
 					diffID := rc.DiffID()
-					wantDiffID := diffIDOfGz(t, gotData)
+					wantDiffID := cl.diffIDOf(t, gotData)
 					if diffID.String() != wantDiffID {
 						t.Errorf("DiffID = %q; want %q", diffID, wantDiffID)
 					}
 
 					// Compare as stargz
-					if !isSameVersion(t, wantData, gotData) {
+					if !isSameVersion(t, want, got) {
 						t.Errorf("built stargz hasn't same json")
 						return
 					}
@@ -189,7 +190,7 @@ func TestBuild(t *testing.T) {
 					}
 
 					// Compare as tar.gz
-					if !isSameTarGz(t, wantData, gotData) {
+					if !isSameTarGz(t, cl, wantData, gotData) {
 						t.Errorf("built stargz isn't same tar.gz")
 						return
 					}
@@ -199,15 +200,191 @@ func TestBuild(t *testing.T) {
 	}
 }
 
-func isSameTarGz(t *testing.T, a, b []byte) bool {
-	aGz, err := gzip.NewReader(bytes.NewReader(a))
+// TestBuildReproducible tests Build produces the same blob regardless of
+// GOMAXPROCS.
+func TestBuildReproducible(t *testing.T) {
+	ents := tarOf(
+		dir("foo/"),
+		file("foo/small", "small"),
+		file("foo/large", longstring(100000)),
+		file("bar", longstring(50000)),
+		file("baz", ""),
+		symlink("qux", "foo/small"),
+	)
+	build := func(procs int) []byte {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+		blob, err := Build(buildTarStatic(t, ents, ""), WithChunkSize(10000))
+		if err != nil {
+			t.Fatalf("failed to build with GOMAXPROCS=%d: %v", procs, err)
+		}
+		defer blob.Close()
+		data, err := ioutil.ReadAll(blob)
+		if err != nil {
+			t.Fatalf("failed to read blob with GOMAXPROCS=%d: %v", procs, err)
+		}
+		return data
+	}
+	want := build(1)
+	for _, procs := range []int{2, 3, 16} {
+		if got := build(procs); !bytes.Equal(got, want) {
+			t.Errorf("blob built with GOMAXPROCS=%d differs from GOMAXPROCS=1", procs)
+		}
+	}
+}
+
+func TestBuildSourceDateEpoch(t *testing.T) {
+	epoch := time.Unix(1600000000, 0)
+	old := time.Unix(1500000000, 0)
+	build := func(mtime time.Time) ([]byte, *Reader) {
+		blob, err := Build(buildTarStatic(t, tarOf(
+			file("old", "old", old),
+			file("new", "new", mtime),
+		), ""), WithSourceDateEpoch(epoch))
+		if err != nil {
+			t.Fatalf("failed to build: %v", err)
+		}
+		defer blob.Close()
+		data, err := ioutil.ReadAll(blob)
+		if err != nil {
+			t.Fatalf("failed to read blob: %v", err)
+		}
+		r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+		if err != nil {
+			t.Fatalf("failed to open blob: %v", err)
+		}
+		return data, r
+	}
+	a, r := build(time.Unix(1700000000, 0))
+	b, _ := build(time.Unix(1800000000, 0))
+	if !bytes.Equal(a, b) {
+		t.Errorf("blobs must be identical after clamping timestamps")
+	}
+	for name, want := range map[string]time.Time{"old": old, "new": epoch} {
+		e, ok := r.Lookup(name)
+		if !ok {
+			t.Fatalf("%q not found", name)
+		}
+		if !e.ModTime().Equal(want) {
+			t.Errorf("modtime of %q = %v; want %v", name, e.ModTime(), want)
+		}
+	}
+}
+
+func TestBuildMinChunkSize(t *testing.T) {
+	ents := []tarEntry{dir("foo/")}
+	files := map[string]string{"foo/large": longstring(10000)}
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("foo/small%d", i)
+		files[name] = longstring(50 + i*10)
+		ents = append(ents, file(name, files[name]))
+	}
+	ents = append(ents, file("foo/large", files["foo/large"]))
+	prioritized := []string{"foo/small3", "foo/small1", "foo/large", "foo/small2"}
+	for _, cl := range testCompressions() {
+		for _, compactTOC := range []bool{false, true} {
+			cl, compactTOC := cl, compactTOC
+			t.Run(fmt.Sprintf("compression=%v,compactTOC=%v", cl, compactTOC), func(t *testing.T) {
+				build := func(minChunkSize int) (*Blob, []byte) {
+					opts := []Option{WithCompression(cl), WithChunkSize(1000), WithMinChunkSize(minChunkSize),
+						WithPrioritizedFiles(prioritized)}
+					if compactTOC {
+						opts = append(opts, WithCompactTOC())
+					}
+					blob, err := Build(buildTarStatic(t, tarOf(ents...), ""), opts...)
+					if err != nil {
+						t.Fatalf("failed to build: %v", err)
+					}
+					defer blob.Close()
+					b, err := ioutil.ReadAll(blob)
+					if err != nil {
+						t.Fatalf("failed to read blob: %v", err)
+					}
+					return blob, b
+				}
+				_, unpacked := build(0)
+				blob, b := build(8192)
+				if got, max := cl.countStreams(t, b), cl.countStreams(t, unpacked)/2; got > max {
+					t.Errorf("small files must be packed; got %d streams, want at most %d", got, max)
+				}
+				sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+				if err := Check(sr, WithCheckDecompressors(cl), WithCheckTOCDigest(blob.TOCDigest()),
+					WithCheckDiffID(blob.DiffID())); err != nil {
+					t.Fatalf("failed to check blob: %v", err)
+				}
+				r, err := Open(sr, WithDecompressors(cl))
+				if err != nil {
+					t.Fatalf("failed to open blob: %v", err)
+				}
+				v, err := r.VerifyTOC(blob.TOCDigest())
+				if err != nil {
+					t.Fatalf("failed to verify TOC: %v", err)
+				}
+				var packed int
+				for name, want := range files {
+					e, ok := r.Lookup(name)
+					if !ok {
+						t.Fatalf("%q not found", name)
+					}
+					if e.InnerOffset > 0 {
+						packed++
+					}
+					fr, err := r.OpenFile(name)
+					if err != nil {
+						t.Fatalf("failed to open %q: %v", name, err)
+					}
+					got, err := ioutil.ReadAll(fr)
+					if err != nil {
+						t.Fatalf("failed to read %q: %v", name, err)
+					}
+					if string(got) != want {
+						t.Errorf("unexpected contents of %q", name)
+					}
+					for off := int64(0); off < e.Size; {
+						ce, ok := r.ChunkEntryForOffset(name, off)
+						if !ok {
+							t.Fatalf("chunk of %q at %d not found", name, off)
+						}
+						cv, err := v.Verifier(ce)
+						if err != nil {
+							t.Fatalf("verifier of %q at %d not found: %v", name, off, err)
+						}
+						cv.Write([]byte(want[ce.ChunkOffset : ce.ChunkOffset+ce.ChunkSize]))
+						if !cv.Verified() {
+							t.Errorf("chunk of %q at %d isn't verified", name, off)
+						}
+						off = ce.ChunkOffset + ce.ChunkSize
+					}
+				}
+				if packed == 0 {
+					t.Errorf("no file is packed")
+				}
+
+				// Prioritized files must be placed before the stream of the landmark.
+				landmark, ok := r.Lookup(PrefetchLandmark)
+				if !ok {
+					t.Fatalf("prefetch landmark not found")
+				}
+				for _, name := range prioritized {
+					e, _ := r.Lookup(name)
+					if e.Offset >= landmark.Offset {
+						t.Errorf("%q (offset %d) must be placed before the landmark (offset %d)",
+							name, e.Offset, landmark.Offset)
+					}
+				}
+			})
+		}
+	}
+}
+
+func isSameTarGz(t *testing.T, d Decompressor, a, b []byte) bool {
+	aGz, err := d.Reader(bytes.NewReader(a))
 	if err != nil {
-		t.Fatalf("failed to read A as gzip")
+		t.Fatalf("failed to decompress A")
 	}
 	defer aGz.Close()
-	bGz, err := gzip.NewReader(bytes.NewReader(b))
+	bGz, err := d.Reader(bytes.NewReader(b))
 	if err != nil {
-		t.Fatalf("failed to read B as gzip")
+		t.Fatalf("failed to decompress B")
 	}
 	defer bGz.Close()
 
@@ -259,15 +436,8 @@ func isSameTarGz(t *testing.T, a, b []byte) bool {
 	return true
 }
 
-func isSameVersion(t *testing.T, a, b []byte) bool {
-	ajtoc, _, err := parseStargz(io.NewSectionReader(bytes.NewReader(a), 0, int64(len(a))))
-	if err != nil {
-		t.Fatalf("failed to parse A: %v", err)
-	}
-	bjtoc, _, err := parseStargz(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))))
-	if err != nil {
-		t.Fatalf("failed to parse B: %v", err)
-	}
+func isSameVersion(t *testing.T, a, b *Reader) bool {
+	ajtoc, bjtoc := a.toc, b.toc
 	t.Logf("A: TOCJSON: %v", dumpTOCJSON(t, ajtoc))
 	t.Logf("B: TOCJSON: %v", dumpTOCJSON(t, bjtoc))
 	return ajtoc.Version == bjtoc.Version
@@ -424,7 +594,7 @@ func readOffset(t *testing.T, r *io.SectionReader, offset int64, e stargzEntry)
 	return data[:n], offset + ce.ChunkSize, true
 }
 
-func dumpTOCJSON(t *testing.T, tocJSON *jtoc) string {
+func dumpTOCJSON(t *testing.T, tocJSON *JTOC) string {
 	jtocData, err := json.Marshal(*tocJSON)
 	if err != nil {
 		t.Fatalf("failed to marshal TOC JSON: %v", err)
@@ -1216,7 +1386,7 @@ func checkVerifyTOC(t *testing.T, sgzData []byte, tocDigest digest.Digest, dgstM
 func checkVerifyInvalidTOCEntryFail(filename string) check {
 	return func(t *testing.T, sgzData []byte, tocDigest digest.Digest, dgstMap map[string]digest.Digest, compressionLevel int) {
 		funcs := map[string]rewriteFunc{
-			"lost digest in a entry": func(t *testing.T, toc *jtoc, sgz *io.SectionReader) {
+			"lost digest in a entry": func(t *testing.T, toc *JTOC, sgz *io.SectionReader) {
 				var found bool
 				for _, e := range toc.Entries {
 					if cleanEntryName(e.Name) == filename {
@@ -1234,7 +1404,7 @@ func checkVerifyInvalidTOCEntryFail(filename string) check {
 					t.Fatalf("rewrite target not found")
 				}
 			},
-			"duplicated entry offset": func(t *testing.T, toc *jtoc, sgz *io.SectionReader) {
+			"duplicated entry offset": func(t *testing.T, toc *JTOC, sgz *io.SectionReader) {
 				var (
 					sampleEntry *TOCEntry
 					targetEntry *TOCEntry
@@ -1367,7 +1537,7 @@ func chunkID(name string, offset, size int64) string {
 	return fmt.Sprintf("%s-%d-%d", cleanEntryName(name), offset, size)
 }
 
-type rewriteFunc func(t *testing.T, toc *jtoc, sgz *io.SectionReader)
+type rewriteFunc func(t *testing.T, toc *JTOC, sgz *io.SectionReader)
 
 func rewriteTOCJSON(t *testing.T, sgz *io.SectionReader, rewrite rewriteFunc, compressionLevel int) (newSgz io.Reader, tocDigest digest.Digest) {
 	decodedJTOC, jtocOffset, err := parseStargz(sgz)
@@ -1589,7 +1759,7 @@ func noPrefetchLandmark() tarEntry {
 	})
 }
 
-func parseStargz(sgz *io.SectionReader) (decodedJTOC *jtoc, jtocOffset int64, err error) {
+func parseStargz(sgz *io.SectionReader) (decodedJTOC *JTOC, jtocOffset int64, err error) {
 	// Parse stargz footer and get the offset of TOC JSON
 	tocOffset, footerSize, err := OpenFooter(sgz)
 	if err != nil {
@@ -1610,7 +1780,7 @@ func parseStargz(sgz *io.SectionReader) (decodedJTOC *jtoc, jtocOffset int64, er
 		return nil, 0, fmt.Errorf("invalid TOC JSON tar entry name %q; must be %q",
 			h.Name, TOCTarName)
 	}
-	decodedJTOC = new(jtoc)
+	decodedJTOC = new(JTOC)
 	if err := json.NewDecoder(tr).Decode(&decodedJTOC); err != nil {
 		return nil, 0, errors.Wrap(err, "failed to decode TOC JSON")
 	}
@@ -0,0 +1,344 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/containerd/stargz-snapshotter/estargz/errorutil"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+type checkOpts struct {
+	decompressors []Decompressor
+	tocDigest     digest.Digest
+	diffID        digest.Digest
+}
+
+// CheckOption is an option used by Check.
+type CheckOption func(o *checkOpts) error
+
+// WithCheckDecompressors option specifies decompressors to use in addition to
+// the gzip-based ones. See also WithDecompressors.
+func WithCheckDecompressors(decompressors ...Decompressor) CheckOption {
+	return func(o *checkOpts) error {
+		o.decompressors = append(o.decompressors, decompressors...)
+		return nil
+	}
+}
+
+// WithCheckTOCDigest option specifies the expected digest of the TOC (e.g. the
+// value of TOCJSONDigestAnnotation).
+func WithCheckTOCDigest(tocDigest digest.Digest) CheckOption {
+	return func(o *checkOpts) error {
+		o.tocDigest = tocDigest
+		return nil
+	}
+}
+
+// WithCheckDiffID option specifies the expected digest of the uncompressed blob.
+func WithCheckDiffID(diffID digest.Digest) CheckOption {
+	return func(o *checkOpts) error {
+		o.diffID = diffID
+		return nil
+	}
+}
+
+// Check walks the entire blob and checks its integrity. This checks the
+// following and returns all problems found.
+//
+//   - the footer can be parsed and points to a valid TOC
+//   - the TOC digest matches WithCheckTOCDigest option (if specified)
+//   - offsets of file payloads are monotonically increasing, don't overlap and
+//     are inside the blob payload
+//   - chunks of each file are contiguous and cover the whole file (or don't
+//     overlap if the file is sparse)
+//   - landmark files are valid and placed correctly
+//   - contents of all files and chunks match their Digest and ChunkDigest
+//   - tar-split metadata (if any) describes exactly the entries in the TOC
+//   - the decompressed blob is a valid tar where hardlinks follow their
+//     targets and its digest matches WithCheckDiffID option (if specified)
+func Check(sr *io.SectionReader, opt ...CheckOption) error {
+	var opts checkOpts
+	for _, o := range opt {
+		if err := o(&opts); err != nil {
+			return err
+		}
+	}
+	d, payloadSize, tocOff, tocSize, err := openFooter(sr, append(gzipDecompressors(), opts.decompressors...))
+	if err != nil {
+		return errors.Wrapf(err, "invalid footer")
+	}
+	toc, tocDgst, err := d.ParseTOC(io.NewSectionReader(sr, tocOff, tocSize))
+	if err != nil {
+		return errors.Wrapf(err, "invalid TOC")
+	}
+
+	var allErr []error
+	if opts.tocDigest != "" && tocDgst != opts.tocDigest {
+		allErr = append(allErr, fmt.Errorf("TOC digest %q doesn't match the expected %q", tocDgst, opts.tocDigest))
+	}
+	allErr = append(allErr, checkTOCEntries(toc, payloadSize)...)
+	allErr = append(allErr, checkPrefetchProfiles(toc, payloadSize)...)
+
+	r := &Reader{
+		sr:           sr,
+		toc:          toc,
+		tocDigest:    tocDgst,
+		decompressor: d,
+	}
+	if err := r.initFields(); err != nil {
+		return errorutil.Aggregate(append(allErr, errors.Wrapf(err, "invalid TOC entries")))
+	}
+	for _, e := range toc.Entries {
+		if e.isDataType() && e.Offset != 0 && e.NextOffset() <= e.Offset {
+			allErr = append(allErr, fmt.Errorf("%q (chunk offset %d): next offset %d isn't after the offset %d",
+				e.Name, e.ChunkOffset, e.NextOffset(), e.Offset))
+		}
+	}
+	allErr = append(allErr, checkContents(r)...)
+	if _, ok := r.Lookup(TarSplitName); ok {
+		if err := r.checkTarSplit(); err != nil {
+			allErr = append(allErr, errors.Wrapf(err, "invalid tar-split metadata"))
+		}
+	}
+
+	diffID, err := checkTarStream(sr, d)
+	if err != nil {
+		allErr = append(allErr, errors.Wrapf(err, "invalid uncompressed blob"))
+	} else if opts.diffID != "" && diffID != opts.diffID {
+		allErr = append(allErr, fmt.Errorf("DiffID %q doesn't match the expected %q", diffID, opts.diffID))
+	}
+	return errorutil.Aggregate(allErr)
+}
+
+// checkTOCEntries checks the structure of TOC entries. This must be called
+// before Reader.initFields because that fills missing fields of entries.
+func checkTOCEntries(toc *JTOC, payloadSize int64) (allErr []error) {
+	var (
+		lastOffset int64
+		// end of the previous chunk in the decompressed stream at lastOffset
+		lastInnerEnd int64
+		lastReg      *TOCEntry
+		lastChunk    *TOCEntry
+		landmarks    []string
+		seenData     bool
+	)
+	// checkChunksEnd checks the last chunk of the last regular file covers the
+	// end of that file.
+	checkChunksEnd := func() {
+		if lastReg == nil || lastReg.Size == 0 {
+			return
+		}
+		if lastReg.Sparse {
+			if end := lastChunk.ChunkOffset + lastChunk.ChunkSize; end > lastReg.Size {
+				allErr = append(allErr, fmt.Errorf("%q: chunks cover %d bytes but the file size is %d",
+					lastReg.Name, end, lastReg.Size))
+			}
+			return
+		}
+		if lastChunk.ChunkSize != 0 && lastChunk.ChunkOffset+lastChunk.ChunkSize != lastReg.Size {
+			allErr = append(allErr, fmt.Errorf("%q: chunks cover %d bytes but the file size is %d",
+				lastReg.Name, lastChunk.ChunkOffset+lastChunk.ChunkSize, lastReg.Size))
+		}
+		if lastChunk.ChunkOffset >= lastReg.Size {
+			allErr = append(allErr, fmt.Errorf("%q: chunk offset %d is out of the file size %d",
+				lastReg.Name, lastChunk.ChunkOffset, lastReg.Size))
+		}
+	}
+	for _, e := range toc.Entries {
+		switch e.Type {
+		case "dir", "symlink", "hardlink", "char", "block", "fifo":
+		case "reg":
+			checkChunksEnd()
+			lastReg, lastChunk = e, e
+			if e.ChunkOffset != 0 && !e.Sparse {
+				allErr = append(allErr, fmt.Errorf("%q: the first chunk starts at %d", e.Name, e.ChunkOffset))
+			}
+			if e.Size > 0 && e.Digest == "" {
+				allErr = append(allErr, fmt.Errorf("%q: digest isn't recorded", e.Name))
+			}
+			switch cleanEntryName(e.Name) {
+			case PrefetchLandmark, NoPrefetchLandmark:
+				landmarks = append(landmarks, e.Name)
+				if cleanEntryName(e.Name) == NoPrefetchLandmark && seenData {
+					allErr = append(allErr, fmt.Errorf("%q must be placed before all files", e.Name))
+				}
+				if e.Size != 1 {
+					allErr = append(allErr, fmt.Errorf("%q: invalid size %d of landmark", e.Name, e.Size))
+				}
+			}
+		case "chunk":
+			if lastReg == nil || cleanEntryName(e.Name) != cleanEntryName(lastReg.Name) {
+				allErr = append(allErr, fmt.Errorf("%q: chunk doesn't follow its regular file", e.Name))
+				continue
+			}
+			if lastChunk.ChunkSize == 0 {
+				allErr = append(allErr, fmt.Errorf("%q: chunk at %d follows the last chunk", e.Name, e.ChunkOffset))
+			} else if want := lastChunk.ChunkOffset + lastChunk.ChunkSize; lastReg.Sparse && e.ChunkOffset < want {
+				// chunks of sparse files can have holes between them
+				allErr = append(allErr, fmt.Errorf("%q: chunk offset %d overlaps the previous chunk", e.Name, e.ChunkOffset))
+			} else if !lastReg.Sparse && e.ChunkOffset != want {
+				allErr = append(allErr, fmt.Errorf("%q: chunk offset %d; want %d", e.Name, e.ChunkOffset, want))
+			}
+			lastChunk = e
+		default:
+			allErr = append(allErr, fmt.Errorf("%q: unknown type %q", e.Name, e.Type))
+			continue
+		}
+		if !(e.Type == "reg" && e.Size > 0 && !(e.Sparse && e.ChunkSize == 0)) && e.Type != "chunk" {
+			continue
+		}
+		seenData = true
+		if lastReg.Sparse && e.ChunkSize <= 0 {
+			allErr = append(allErr, fmt.Errorf("%q (chunk offset %d): chunk of sparse file must have size", e.Name, e.ChunkOffset))
+		}
+		if e.ChunkDigest == "" {
+			allErr = append(allErr, fmt.Errorf("%q (chunk offset %d): chunk digest isn't recorded", e.Name, e.ChunkOffset))
+		}
+		if e.InnerOffset < 0 {
+			allErr = append(allErr, fmt.Errorf("%q (chunk offset %d): negative inner offset %d",
+				e.Name, e.ChunkOffset, e.InnerOffset))
+		}
+		if e.InnerOffset > 0 && e.Offset == lastOffset {
+			// packed into the same stream as the previous chunk
+			if e.InnerOffset < lastInnerEnd {
+				allErr = append(allErr, fmt.Errorf("%q (chunk offset %d): inner offset %d overlaps the previous chunk ending at %d",
+					e.Name, e.ChunkOffset, e.InnerOffset, lastInnerEnd))
+			}
+		} else if e.Offset <= lastOffset || e.Offset >= payloadSize {
+			allErr = append(allErr, fmt.Errorf("%q (chunk offset %d): offset %d must be in (%d, %d)",
+				e.Name, e.ChunkOffset, e.Offset, lastOffset, payloadSize))
+		}
+		if e.Offset > lastOffset {
+			lastOffset = e.Offset
+		}
+		chunkSize := e.ChunkSize
+		if chunkSize == 0 {
+			chunkSize = lastReg.Size - e.ChunkOffset
+		}
+		lastInnerEnd = e.InnerOffset + chunkSize
+	}
+	checkChunksEnd()
+	if len(landmarks) > 1 {
+		allErr = append(allErr, fmt.Errorf("only one landmark is allowed but found %v", landmarks))
+	}
+	return
+}
+
+// checkContents checks contents of all regular files against their digests.
+func checkContents(r *Reader) (allErr []error) {
+	names := make([]string, 0, len(r.m))
+	for name, e := range r.m {
+		if e.Type == "reg" && e.Size > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := r.m[name]
+		if err := checkFile(r, e); err != nil {
+			allErr = append(allErr, errors.Wrapf(err, "%q", name))
+		}
+	}
+	return
+}
+
+func checkFile(r *Reader, e *TOCEntry) error {
+	sr, err := r.OpenFile(e.Name)
+	if err != nil {
+		return err
+	}
+	fileDgstr := digest.Canonical.Digester()
+	var allErr []error
+	for off := int64(0); off < e.Size; {
+		dataOff, ok := r.NextDataOffset(e.Name, off)
+		if !ok {
+			dataOff = e.Size
+		}
+		if dataOff > off {
+			// hole of the sparse file
+			if _, err := io.CopyN(fileDgstr.Hash(), zeroReader{}, dataOff-off); err != nil {
+				return err
+			}
+			off = dataOff
+			continue
+		}
+		ce, ok := r.ChunkEntryForOffset(e.Name, off)
+		if !ok || ce.ChunkOffset != off || ce.ChunkSize <= 0 {
+			return errorutil.Aggregate(append(allErr, fmt.Errorf("chunk at %d not found", off)))
+		}
+		chunkDgstr := digest.Canonical.Digester()
+		if _, err := io.Copy(io.MultiWriter(fileDgstr.Hash(), chunkDgstr.Hash()),
+			io.NewSectionReader(sr, ce.ChunkOffset, ce.ChunkSize)); err != nil {
+			return errorutil.Aggregate(append(allErr, errors.Wrapf(err, "failed to read chunk at %d", off)))
+		}
+		if ce.ChunkDigest != "" && chunkDgstr.Digest().String() != ce.ChunkDigest {
+			allErr = append(allErr, fmt.Errorf("chunk at %d doesn't match the chunk digest", off))
+		}
+		off += ce.ChunkSize
+	}
+	if e.Digest != "" && fileDgstr.Digest().String() != e.Digest {
+		allErr = append(allErr, fmt.Errorf("contents don't match the digest"))
+	}
+	switch cleanEntryName(e.Name) {
+	case PrefetchLandmark, NoPrefetchLandmark:
+		if p, err := ioutil.ReadAll(io.NewSectionReader(sr, 0, e.Size)); err != nil || len(p) != 1 || p[0] != landmarkContents {
+			allErr = append(allErr, fmt.Errorf("invalid contents of landmark"))
+		}
+	}
+	return errorutil.Aggregate(allErr)
+}
+
+// checkTarStream decompresses the whole blob and checks it's a valid tar where
+// each hardlink follows its target, which is required for extracting it. This
+// returns the digest of the uncompressed blob.
+func checkTarStream(sr *io.SectionReader, d Decompressor) (digest.Digest, error) {
+	zr, err := d.Reader(io.NewSectionReader(sr, 0, sr.Size()))
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	diffID := digest.Canonical.Digester()
+	tee := io.TeeReader(zr, diffID.Hash())
+	tr := tar.NewReader(tee)
+	seen := make(map[string]struct{})
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if h.Typeflag == tar.TypeLink {
+			if _, ok := seen[cleanEntryName(h.Linkname)]; !ok {
+				return "", fmt.Errorf("hardlink %q precedes its target %q", h.Name, h.Linkname)
+			}
+		}
+		seen[cleanEntryName(h.Name)] = struct{}{}
+	}
+	// Consume the remaining (e.g. padding) bytes.
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return "", err
+	}
+	return diffID.Digest(), nil
+}
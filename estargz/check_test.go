@@ -0,0 +1,198 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+var checkTestEntries = tarOf(
+	dir("foo/"),
+	file("foo/bar", "barbarbarbarbar"),
+	file("foo/empty", ""),
+	file("baz", "bazbazbazbazbazbaz"),
+	symlink("foo/link", "bar"),
+	link("foo/hardlink", "foo/bar"),
+)
+
+func buildCheckTestBlob(t *testing.T, cl Compression) ([]byte, digest.Digest) {
+	blob, err := Build(buildTarStatic(t, checkTestEntries, ""), WithChunkSize(4), WithCompression(cl))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	defer blob.Close()
+	b, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	return b, blob.TOCDigest()
+}
+
+func TestCheck(t *testing.T) {
+	for _, cl := range testCompressions() {
+		cl := cl
+		t.Run(fmt.Sprintf("compression=%v", cl), func(t *testing.T) {
+			b, tocDgst := buildCheckTestBlob(t, cl)
+			sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+			diffID := digest.Digest(cl.diffIDOf(t, b))
+			if err := Check(sr, WithCheckDecompressors(cl),
+				WithCheckTOCDigest(tocDgst), WithCheckDiffID(diffID)); err != nil {
+				t.Fatalf("valid blob must pass: %v", err)
+			}
+			if err := Check(sr, WithCheckDecompressors(cl),
+				WithCheckTOCDigest(digest.FromString("dummy"))); err == nil {
+				t.Errorf("invalid TOC digest must be detected")
+			}
+			if err := Check(sr, WithCheckDecompressors(cl),
+				WithCheckDiffID(digest.FromString("dummy"))); err == nil {
+				t.Errorf("invalid DiffID must be detected")
+			}
+			if err := Check(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))-1),
+				WithCheckDecompressors(cl)); err == nil {
+				t.Errorf("truncated blob must be detected")
+			}
+		})
+	}
+}
+
+func TestCheckHardlinkOrder(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.AppendTar(buildTarStatic(t, tarOf(
+		link("link", "target"),
+		file("target", "foo"),
+	), "")); err != nil {
+		t.Fatalf("failed to append tar: %v", err)
+	}
+	if _, err := w.Close(); err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+	if err := Check(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len()))); err == nil {
+		t.Errorf("hardlink preceding its target must be detected")
+	}
+}
+
+func TestCheckInvalidTOC(t *testing.T) {
+	findEntry := func(t *testing.T, toc *JTOC, name string, chunkOffset int64) *TOCEntry {
+		for _, e := range toc.Entries {
+			if e.Name == name && e.ChunkOffset == chunkOffset && (e.Type == "reg" || e.Type == "chunk") {
+				return e
+			}
+		}
+		t.Fatalf("entry %q (chunk offset %d) not found", name, chunkOffset)
+		return nil
+	}
+	tests := []struct {
+		name    string
+		rewrite rewriteFunc
+	}{
+		{
+			name: "chunk digest",
+			rewrite: func(t *testing.T, toc *JTOC, sgz *io.SectionReader) {
+				findEntry(t, toc, "foo/bar", 4).ChunkDigest = digest.FromString("dummy").String()
+			},
+		},
+		{
+			name: "file digest",
+			rewrite: func(t *testing.T, toc *JTOC, sgz *io.SectionReader) {
+				findEntry(t, toc, "baz", 0).Digest = digest.FromString("dummy").String()
+			},
+		},
+		{
+			name: "missing digest",
+			rewrite: func(t *testing.T, toc *JTOC, sgz *io.SectionReader) {
+				findEntry(t, toc, "baz", 8).ChunkDigest = ""
+			},
+		},
+		{
+			name: "overlapping offset",
+			rewrite: func(t *testing.T, toc *JTOC, sgz *io.SectionReader) {
+				findEntry(t, toc, "foo/bar", 8).Offset = findEntry(t, toc, "foo/bar", 4).Offset
+			},
+		},
+		{
+			name: "offset out of payload",
+			rewrite: func(t *testing.T, toc *JTOC, sgz *io.SectionReader) {
+				findEntry(t, toc, "foo/bar", 12).Offset = sgz.Size()
+			},
+		},
+		{
+			name: "chunk gap",
+			rewrite: func(t *testing.T, toc *JTOC, sgz *io.SectionReader) {
+				findEntry(t, toc, "baz", 8).ChunkOffset = 9
+			},
+		},
+		{
+			name: "chunk without file",
+			rewrite: func(t *testing.T, toc *JTOC, sgz *io.SectionReader) {
+				findEntry(t, toc, "baz", 4).Name = "qux"
+			},
+		},
+		{
+			name: "file size",
+			rewrite: func(t *testing.T, toc *JTOC, sgz *io.SectionReader) {
+				findEntry(t, toc, "baz", 0).Size = 100
+			},
+		},
+		{
+			name: "unknown type",
+			rewrite: func(t *testing.T, toc *JTOC, sgz *io.SectionReader) {
+				toc.Entries = append(toc.Entries, &TOCEntry{Name: "qux", Type: "unknown"})
+			},
+		},
+		{
+			name: "misplaced landmark",
+			rewrite: func(t *testing.T, toc *JTOC, sgz *io.SectionReader) {
+				if toc.Entries[0].Name != NoPrefetchLandmark {
+					t.Fatalf("the first entry must be the landmark but got %q", toc.Entries[0].Name)
+				}
+				toc.Entries = append(toc.Entries[1:], toc.Entries[0])
+			},
+		},
+		{
+			name: "multiple landmarks",
+			rewrite: func(t *testing.T, toc *JTOC, sgz *io.SectionReader) {
+				findEntry(t, toc, NoPrefetchLandmark, 0).Name = PrefetchLandmark
+				findEntry(t, toc, "foo/bar", 0).Name = NoPrefetchLandmark
+			},
+		},
+	}
+	b, _ := buildCheckTestBlob(t, NewGzipCompressionWithLevel(gzip.BestCompression))
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			sgz, tocDgst := rewriteTOCJSON(t, io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))),
+				tt.rewrite, gzip.BestCompression)
+			nb, err := ioutil.ReadAll(sgz)
+			if err != nil {
+				t.Fatalf("failed to read rewritten blob: %v", err)
+			}
+			err = Check(io.NewSectionReader(bytes.NewReader(nb), 0, int64(len(nb))), WithCheckTOCDigest(tocDgst))
+			if err == nil {
+				t.Fatalf("invalid TOC must be detected")
+			}
+			t.Logf("detected: %v", err)
+		})
+	}
+}
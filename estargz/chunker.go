@@ -0,0 +1,84 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import "math/bits"
+
+// gearTable is the table of random values used by the gear-based rolling hash.
+// This must never be changed because chunk boundaries (and therefore chunk
+// digests) of existing blobs depend on it.
+var gearTable = func() (t [256]uint64) {
+	// splitmix64 with a fixed seed
+	x := uint64(0x65737461726779) // "estargz"
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// contentDefinedChunker finds boundaries of chunks based on the contents using
+// a gear-based rolling hash so that the boundaries are preserved even if bytes
+// are inserted to or removed from the preceding contents.
+type contentDefinedChunker struct {
+	minSize int
+	maxSize int
+	mask    uint64
+}
+
+// newContentDefinedChunker returns a chunker that produces chunks at most
+// maxSize bytes. Chunks are maxSize/4 bytes on average and at least maxSize/16
+// bytes unless they are the last chunk of a file.
+func newContentDefinedChunker(maxSize int) *contentDefinedChunker {
+	minSize := maxSize / 16
+	if minSize < 1 {
+		minSize = 1
+	}
+	var mask uint64
+	if avg := maxSize / 4; avg > 1 {
+		// Use the upper bits which are affected by the last 64 bytes.
+		n := bits.Len(uint(avg)) - 1
+		mask = ^uint64(0) << (64 - n)
+	}
+	return &contentDefinedChunker{
+		minSize: minSize,
+		maxSize: maxSize,
+		mask:    mask,
+	}
+}
+
+// cut returns the size of the first chunk in p. p should contain maxSize bytes
+// unless it is the tail of a file. If no boundary is found, len(p) is returned.
+func (c *contentDefinedChunker) cut(p []byte) int {
+	if len(p) > c.maxSize {
+		p = p[:c.maxSize]
+	}
+	if len(p) <= c.minSize {
+		return len(p)
+	}
+	var h uint64
+	for i, b := range p {
+		h = (h << 1) + gearTable[b]
+		if i+1 >= c.minSize && h&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return len(p)
+}
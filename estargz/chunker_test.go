@@ -0,0 +1,97 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestContentDefinedChunking(t *testing.T) {
+	const maxChunkSize = 64 << 10
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(data)
+	inserted := append(append(append([]byte{}, data[:1000]...), []byte("inserted")...), data[1000:]...)
+
+	for _, cl := range testCompressions() {
+		cl := cl
+		t.Run(fmt.Sprintf("compression=%v", cl), func(t *testing.T) {
+			build := func(contents []byte) map[string]struct{} {
+				blob, err := Build(buildTarStatic(t, tarOf(file("foo", string(contents))), ""),
+					WithChunkSize(maxChunkSize), WithContentDefinedChunking(), WithCompression(cl))
+				if err != nil {
+					t.Fatalf("failed to build: %v", err)
+				}
+				defer blob.Close()
+				b, err := ioutil.ReadAll(blob)
+				if err != nil {
+					t.Fatalf("failed to read blob: %v", err)
+				}
+				r, err := Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))),
+					WithDecompressors(cl))
+				if err != nil {
+					t.Fatalf("failed to open blob: %v", err)
+				}
+				sr, err := r.OpenFile("foo")
+				if err != nil {
+					t.Fatalf("failed to open file: %v", err)
+				}
+				got, err := ioutil.ReadAll(io.NewSectionReader(sr, 0, int64(len(contents))))
+				if err != nil {
+					t.Fatalf("failed to read file: %v", err)
+				}
+				if !bytes.Equal(got, contents) {
+					t.Fatalf("unexpected contents")
+				}
+				digests := make(map[string]struct{})
+				for off := int64(0); off < int64(len(contents)); {
+					ce, ok := r.ChunkEntryForOffset("foo", off)
+					if !ok {
+						t.Fatalf("chunk at %d not found", off)
+					}
+					if ce.ChunkOffset != off {
+						t.Fatalf("chunk offset = %d; want %d", ce.ChunkOffset, off)
+					}
+					if ce.ChunkSize <= 0 || ce.ChunkSize > maxChunkSize {
+						t.Fatalf("invalid chunk size %d", ce.ChunkSize)
+					}
+					digests[ce.ChunkDigest] = struct{}{}
+					off += ce.ChunkSize
+				}
+				return digests
+			}
+			a, b := build(data), build(inserted)
+			if len(a) < 2*len(data)/maxChunkSize {
+				t.Errorf("too few chunks %d", len(a))
+			}
+			var shared int
+			for d := range b {
+				if _, ok := a[d]; ok {
+					shared++
+				}
+			}
+			// Only the chunk containing the inserted bytes should change.
+			if shared < len(b)-2 {
+				t.Errorf("only %d chunks out of %d are shared after insertion", shared, len(b))
+			}
+		})
+	}
+}
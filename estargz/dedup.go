@@ -0,0 +1,121 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// dedupEntries finds regular files whose contents are identical to a preceding
+// file and replaces them with hardlinks to that file, so that the data is
+// stored only once in the blob. The hardlinks are recorded in the TOC as well,
+// so that the extracted layer and the lazily mounted one agree that these
+// names share an inode. Hardlinks share the metadata so files are deduplicated
+// only if their metadata are identical as well.
+//
+// Only files having the same size as another file are read for comparing the
+// contents. This returns the digests of such files remaining as regular files,
+// keyed by the cleaned names, so that Writer doesn't compute them again.
+func dedupEntries(entries []*entry) (map[string]digest.Digest, error) {
+	candidate := func(e *entry) bool {
+		if _, ok := e.payload.(*io.SectionReader); !ok || e.header.Typeflag != tar.TypeReg || e.header.Size == 0 || isSparseHeader(e.header) {
+			return false
+		}
+		switch cleanEntryName(e.header.Name) {
+		case PrefetchLandmark, NoPrefetchLandmark, TarSplitName:
+			return false
+		}
+		return true
+	}
+	sizes := make(map[int64]int)
+	for _, e := range entries {
+		if candidate(e) {
+			sizes[e.header.Size]++
+		}
+	}
+	var (
+		digests  = make(map[string]digest.Digest)
+		seen     = make(map[digest.Digest][]*entry)
+		replaced = make(map[string]string) // deduplicated files to the originals
+	)
+	for i, e := range entries {
+		if e.header.Typeflag == tar.TypeLink {
+			// Hardlinks to deduplicated files must point to the original
+			// because TOC doesn't allow hardlinks to hardlinks.
+			if orig, ok := replaced[cleanEntryName(e.header.Linkname)]; ok {
+				h := *e.header
+				h.Linkname = orig
+				entries[i] = &entry{header: &h, payload: e.payload}
+			}
+			continue
+		}
+		if !candidate(e) || sizes[e.header.Size] < 2 {
+			continue
+		}
+		sr := e.payload.(*io.SectionReader)
+		dgstr := digest.Canonical.Digester()
+		if _, err := io.Copy(dgstr.Hash(), io.NewSectionReader(sr, 0, sr.Size())); err != nil {
+			return nil, fmt.Errorf("failed to read %q: %v", e.header.Name, err)
+		}
+		dgst := dgstr.Digest()
+		var orig *entry
+		for _, c := range seen[dgst] {
+			if c.header.Size == e.header.Size && sameInodeMetadata(c.header, e.header) {
+				orig = c
+				break
+			}
+		}
+		if orig == nil {
+			seen[dgst] = append(seen[dgst], e)
+			digests[cleanEntryName(e.header.Name)] = dgst
+			continue
+		}
+		h := *e.header
+		h.Typeflag = tar.TypeLink
+		h.Linkname = orig.header.Name
+		h.Size = 0
+		entries[i] = &entry{header: &h, payload: bytes.NewReader(nil)}
+		replaced[cleanEntryName(e.header.Name)] = orig.header.Name
+	}
+	return digests, nil
+}
+
+// sameInodeMetadata reports whether the files have the same metadata that
+// hardlinks share.
+func sameInodeMetadata(a, b *tar.Header) bool {
+	return a.Mode == b.Mode && a.Uid == b.Uid && a.Gid == b.Gid &&
+		a.Uname == b.Uname && a.Gname == b.Gname && a.ModTime.Equal(b.ModTime) &&
+		reflect.DeepEqual(xattrsOf(a), xattrsOf(b))
+}
+
+func xattrsOf(h *tar.Header) map[string]string {
+	const xattrPAXRecordsPrefix = "SCHILY.xattr."
+	xattrs := make(map[string]string)
+	for k, v := range h.PAXRecords {
+		if strings.HasPrefix(k, xattrPAXRecordsPrefix) {
+			xattrs[k] = v
+		}
+	}
+	return xattrs
+}
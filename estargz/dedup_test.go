@@ -0,0 +1,207 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestDeduplication(t *testing.T) {
+	large, small := string(randomBytes(5000)), "small contents"
+	files := map[string]string{
+		"foo/a":       large,
+		"foo/b":       large,
+		"foo/c":       large, // different owner
+		"foo/small1":  small,
+		"foo/small2":  small,
+		"foo/another": longstring(3000),
+	}
+	ents := tarOf(
+		dir("foo/"),
+		file("foo/a", large),
+		file("foo/small1", small),
+		file("foo/another", files["foo/another"]),
+		file("foo/b", large),
+		file("foo/c", large, owner{1000, 1000}),
+		file("foo/small2", small),
+		link("foo/link", "foo/a"),
+	)
+	// foo/b is placed first so foo/a is deduplicated.
+	prioritized := []string{"foo/b"}
+	wantDups := map[string]string{"foo/a": "foo/b", "foo/small2": "foo/small1"}
+	wantTarLinks := map[string]string{"foo/a": "foo/b", "foo/small2": "foo/small1", "foo/link": "foo/b"}
+	for _, cl := range testCompressions() {
+		for _, minChunkSize := range []int{0, 4096} {
+			cl, minChunkSize := cl, minChunkSize
+			t.Run(fmt.Sprintf("compression=%v,minChunkSize=%d", cl, minChunkSize), func(t *testing.T) {
+				tarBlob := buildTarStatic(t, ents, "")
+				build := func(opts ...Option) (*Blob, []byte) {
+					opts = append(opts, WithCompression(cl), WithChunkSize(1000), WithMinChunkSize(minChunkSize),
+						WithPrioritizedFiles(prioritized), WithTarSplit())
+					blob, err := Build(tarBlob, opts...)
+					if err != nil {
+						t.Fatalf("failed to build: %v", err)
+					}
+					defer blob.Close()
+					b, err := ioutil.ReadAll(blob)
+					if err != nil {
+						t.Fatalf("failed to read blob: %v", err)
+					}
+					return blob, b
+				}
+				_, orig := build()
+				blob, b := build(WithDeduplication())
+				if len(b) >= len(orig)-len(large)/2 {
+					t.Errorf("duplicated contents must be stored once; got %d bytes (%d without deduplication)", len(b), len(orig))
+				}
+				sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+				if err := Check(sr, WithCheckDecompressors(cl), WithCheckTOCDigest(blob.TOCDigest()),
+					WithCheckDiffID(blob.DiffID())); err != nil {
+					t.Fatalf("failed to check blob: %v", err)
+				}
+				r, err := Open(sr, WithDecompressors(cl))
+				if err != nil {
+					t.Fatalf("failed to open blob: %v", err)
+				}
+				v, err := r.VerifyTOC(blob.TOCDigest())
+				if err != nil {
+					t.Fatalf("failed to verify TOC: %v", err)
+				}
+				for name, want := range files {
+					e, ok := r.Lookup(name)
+					if !ok || e.Type != "reg" {
+						t.Fatalf("regular file %q not found", name)
+					}
+					fr, err := r.OpenFile(name)
+					if err != nil {
+						t.Fatalf("failed to open %q: %v", name, err)
+					}
+					got, err := ioutil.ReadAll(fr)
+					if err != nil {
+						t.Fatalf("failed to read %q: %v", name, err)
+					}
+					if string(got) != want {
+						t.Errorf("unexpected contents of %q", name)
+					}
+					for off := int64(0); off < e.Size; {
+						ce, ok := r.ChunkEntryForOffset(name, off)
+						if !ok {
+							t.Fatalf("chunk of %q at %d not found", name, off)
+						}
+						cv, err := v.Verifier(ce)
+						if err != nil {
+							t.Fatalf("verifier of %q at %d not found: %v", name, off, err)
+						}
+						cv.Write([]byte(want[ce.ChunkOffset : ce.ChunkOffset+ce.ChunkSize]))
+						if !cv.Verified() {
+							t.Errorf("chunk of %q at %d isn't verified", name, off)
+						}
+						off = ce.ChunkOffset + ce.ChunkSize
+					}
+				}
+
+				// Duplicates are hardlinks in the TOC as well so they share
+				// the inode with the original.
+				for name, origName := range wantDups {
+					if e := r.m[name]; e.Type != "hardlink" || e.LinkName != origName {
+						t.Errorf("%q must be a hardlink to %q in TOC; got %q (link %q)", name, origName, e.Type, e.LinkName)
+					}
+				}
+				if e := r.m["foo/link"]; e.LinkName != "foo/b" {
+					t.Errorf("hardlink to a deduplicated file must point to the original; got %q", e.LinkName)
+				}
+				if e, _ := r.Lookup("foo/b"); e.NumLink != 3 {
+					t.Errorf("number of links of foo/b = %d; want 3", e.NumLink)
+				}
+				if c := r.m["foo/c"]; c.Type != "reg" {
+					t.Errorf("file with different metadata must not be deduplicated")
+				}
+
+				// Duplicates are hardlinks in the uncompressed blob.
+				zr, err := cl.Reader(bytes.NewReader(b))
+				if err != nil {
+					t.Fatalf("failed to decompress blob: %v", err)
+				}
+				defer zr.Close()
+				tr := tar.NewReader(zr)
+				gotLinks := make(map[string]string)
+				for {
+					h, err := tr.Next()
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						t.Fatalf("failed to read tar: %v", err)
+					}
+					if h.Typeflag == tar.TypeLink {
+						gotLinks[h.Name] = h.Linkname
+					}
+				}
+				if fmt.Sprint(gotLinks) != fmt.Sprint(wantTarLinks) {
+					t.Errorf("hardlinks in the tar = %v; want %v", gotLinks, wantTarLinks)
+				}
+
+				// The original tar can be reconstructed from deduplicated files.
+				otr, err := r.OriginalTar()
+				if err != nil {
+					t.Fatalf("failed to get original tar: %v", err)
+				}
+				defer otr.Close()
+				got, err := ioutil.ReadAll(otr)
+				if err != nil {
+					t.Fatalf("failed to read original tar: %v", err)
+				}
+				want, err := ioutil.ReadAll(io.NewSectionReader(tarBlob, 0, tarBlob.Size()))
+				if err != nil {
+					t.Fatalf("failed to read tar: %v", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("reconstructed tar differs from the original")
+				}
+			})
+		}
+	}
+}
+
+func TestDedupEntriesDigests(t *testing.T) {
+	reg := func(name, contents string) *entry {
+		return &entry{
+			header:  &tar.Header{Name: name, Typeflag: tar.TypeReg, Size: int64(len(contents))},
+			payload: io.NewSectionReader(strings.NewReader(contents), 0, int64(len(contents))),
+		}
+	}
+	entries := []*entry{reg("a", "same"), reg("b", "same"), reg("c", "unique size")}
+	digests, err := dedupEntries(entries)
+	if err != nil {
+		t.Fatalf("failed to deduplicate: %v", err)
+	}
+	// Only files having the same size as another file are read.
+	if want := map[string]digest.Digest{"a": digest.FromString("same")}; !reflect.DeepEqual(digests, want) {
+		t.Errorf("digests = %v; want %v", digests, want)
+	}
+	if h := entries[1].header; h.Typeflag != tar.TypeLink || h.Linkname != "a" {
+		t.Errorf("b must be a hardlink to a; got %+v", h)
+	}
+}
@@ -0,0 +1,286 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ChangeKind is the kind of the change of a file between two images.
+type ChangeKind int
+
+const (
+	// FileAdded means that the file exists only in the new image.
+	FileAdded ChangeKind = iota
+
+	// FileRemoved means that the file exists only in the old image.
+	FileRemoved
+
+	// FileModified means that the file exists in both images but differs.
+	FileModified
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case FileAdded:
+		return "added"
+	case FileRemoved:
+		return "removed"
+	case FileModified:
+		return "modified"
+	}
+	return "unknown"
+}
+
+// ChangedFields is the set of the attributes changed in a modified file.
+type ChangedFields uint
+
+const (
+	// TypeChanged means that the type of the file (e.g. "reg" or "dir") changed.
+	TypeChanged ChangedFields = 1 << iota
+
+	// ContentChanged means that the contents of the regular file changed. The
+	// contents are compared by TOCEntry.Digest, or by the size if the digest
+	// isn't recorded (e.g. legacy stargz).
+	ContentChanged
+
+	// LinkChanged means that the target of the symlink changed.
+	LinkChanged
+
+	// DeviceChanged means that the device numbers changed.
+	DeviceChanged
+
+	// ModeChanged means that the permission and mode bits changed.
+	ModeChanged
+
+	// OwnerChanged means that the UID or GID changed.
+	OwnerChanged
+
+	// XattrsChanged means that the extended attributes changed.
+	XattrsChanged
+)
+
+var changedFieldNames = []string{"type", "content", "link", "device", "mode", "owner", "xattrs"}
+
+func (c ChangedFields) String() string {
+	var names []string
+	for i, name := range changedFieldNames {
+		if c&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// FileChange is a change of a file between two images.
+type FileChange struct {
+	// Name is the cleaned path of the file.
+	Name string
+
+	// Kind is the kind of the change.
+	Kind ChangeKind
+
+	// Fields is the set of changed attributes if the file is modified.
+	Fields ChangedFields
+
+	// Old and New are the entries of the file in the old and new image. Old
+	// is nil if the file is added and New is nil if the file is removed.
+	// Hardlinks are resolved to their targets.
+	Old, New *TOCEntry
+}
+
+// TreeDiff is the difference of the file trees of two images.
+type TreeDiff struct {
+	// Changes are the changed files sorted by name.
+	Changes []FileChange
+
+	// FetchSize is the number of bytes of the new image's layers which need
+	// to be fetched for reading the added or modified contents. This is an
+	// upper bound because ranges of files are rounded to compressed streams.
+	FetchSize int64
+}
+
+// DiffTrees compares the file trees of two images whose layers are given as
+// Readers, ordered from the lowest layer. Only the TOCs are read, so Readers
+// opened over range readers of remote blobs don't fetch any file contents.
+//
+// The file tree of each image is the merged view of the layers where files are
+// hidden by whiteouts and opaque whiteouts of upper layers as defined by the
+// OCI image spec. Directories created only implicitly (i.e. without entries)
+// aren't compared. Modification times aren't compared because they usually
+// differ between builds.
+func DiffTrees(oldLayers, newLayers []*Reader) *TreeDiff {
+	oldTree, newTree := mergeLayers(oldLayers), mergeLayers(newLayers)
+	var (
+		d      TreeDiff
+		ranges = make(map[*Reader][][2]int64)
+	)
+	fetch := func(e treeEntry) {
+		if off, size, ok := e.r.FileRange(e.e.Name); ok {
+			ranges[e.r] = append(ranges[e.r], [2]int64{off, off + size})
+		}
+	}
+	for name, ne := range newTree {
+		oe, ok := oldTree[name]
+		if !ok {
+			d.Changes = append(d.Changes, FileChange{Name: name, Kind: FileAdded, New: ne.e})
+			fetch(ne)
+			continue
+		}
+		if fields := compareEntries(oe.e, ne.e); fields != 0 {
+			d.Changes = append(d.Changes, FileChange{Name: name, Kind: FileModified, Fields: fields, Old: oe.e, New: ne.e})
+			if fields&(TypeChanged|ContentChanged) != 0 {
+				fetch(ne)
+			}
+		}
+	}
+	for name, oe := range oldTree {
+		if _, ok := newTree[name]; !ok {
+			d.Changes = append(d.Changes, FileChange{Name: name, Kind: FileRemoved, Old: oe.e})
+		}
+	}
+	sort.Slice(d.Changes, func(i, j int) bool { return d.Changes[i].Name < d.Changes[j].Name })
+	for _, rs := range ranges {
+		d.FetchSize += mergedRangesSize(rs)
+	}
+	return &d
+}
+
+// treeEntry is an entry of the merged file tree and the layer containing it.
+type treeEntry struct {
+	e *TOCEntry
+	r *Reader
+}
+
+// mergeLayers returns the merged file tree of the layers keyed by the cleaned
+// paths.
+func mergeLayers(layers []*Reader) map[string]treeEntry {
+	tree := make(map[string]treeEntry)
+	for _, r := range layers {
+		// Whiteouts hide files of the lower layers so they are applied
+		// before adding the files of this layer.
+		var added []string
+		for _, e := range r.toc.Entries {
+			if e.Type == "chunk" {
+				continue
+			}
+			name := cleanEntryName(e.Name)
+			switch name {
+			case "", PrefetchLandmark, NoPrefetchLandmark, TarSplitName:
+				continue
+			}
+			dir, base := path.Split(name)
+			dir = strings.TrimSuffix(dir, "/")
+			if base == whiteoutOpaque {
+				removeTree(tree, dir, false)
+			} else if strings.HasPrefix(base, whiteoutPrefix) {
+				removeTree(tree, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), true)
+			} else {
+				added = append(added, name)
+			}
+		}
+		for _, name := range added {
+			if e, ok := r.Lookup(name); ok {
+				tree[name] = treeEntry{e, r}
+			}
+		}
+	}
+	return tree
+}
+
+// removeTree removes the descendants of p from the tree. p is removed as well
+// if self is true.
+func removeTree(tree map[string]treeEntry, p string, self bool) {
+	if self {
+		delete(tree, p)
+	}
+	prefix := p + "/"
+	if p == "" {
+		prefix = ""
+	}
+	for name := range tree {
+		if strings.HasPrefix(name, prefix) {
+			delete(tree, name)
+		}
+	}
+}
+
+func compareEntries(a, b *TOCEntry) (c ChangedFields) {
+	if a.Type != b.Type {
+		c |= TypeChanged
+	} else {
+		switch a.Type {
+		case "reg":
+			if a.Digest != "" && b.Digest != "" {
+				if a.Digest != b.Digest {
+					c |= ContentChanged
+				}
+			} else if a.Size != b.Size {
+				c |= ContentChanged
+			}
+		case "symlink":
+			if a.LinkName != b.LinkName {
+				c |= LinkChanged
+			}
+		case "char", "block":
+			if a.DevMajor != b.DevMajor || a.DevMinor != b.DevMinor {
+				c |= DeviceChanged
+			}
+		}
+	}
+	if a.Mode != b.Mode {
+		c |= ModeChanged
+	}
+	if a.UID != b.UID || a.GID != b.GID {
+		c |= OwnerChanged
+	}
+	if !equalXattrs(a.Xattrs, b.Xattrs) {
+		c |= XattrsChanged
+	}
+	return c
+}
+
+func equalXattrs(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !bytes.Equal(v, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergedRangesSize returns the number of bytes covered by the ranges.
+func mergedRangesSize(ranges [][2]int64) (size int64) {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	var end int64
+	for _, r := range ranges {
+		if r[0] < end {
+			r[0] = end
+		}
+		if r[1] > r[0] {
+			size += r[1] - r[0]
+			end = r[1]
+		}
+	}
+	return size
+}
@@ -0,0 +1,137 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffTrees(t *testing.T) {
+	md := EntryMetadata{Mode: 0644}
+	large := longstring(5000)
+	base := diffLayer(t, func(w *Writer) error {
+		return firstErr(
+			w.AddDir("etc", md),
+			w.AddFile("etc/hosts", md, 9, strings.NewReader("localhost")),
+			w.AddFile("etc/passwd", md, 4, strings.NewReader("root")),
+			w.AddDir("var", md),
+			w.AddDir("var/cache", md),
+			w.AddFile("var/cache/a", md, 1, strings.NewReader("a")),
+			w.AddFile("var/cache/b", md, 1, strings.NewReader("b")),
+			w.AddSymlink("bin", "usr/bin", md),
+			w.AddFile("unchanged", md, int64(len(large)), strings.NewReader(large)),
+		)
+	})
+	oldTop := diffLayer(t, func(w *Writer) error {
+		return firstErr(
+			w.AddFile("etc/motd", md, 5, strings.NewReader("hello")),
+			w.AddFile("tmp", md, 0, nil),
+		)
+	})
+	owned := md
+	owned.UID, owned.GID = 1000, 1000
+	executable := md
+	executable.Mode = 0755
+	newTop := diffLayer(t, func(w *Writer) error {
+		return firstErr(
+			w.AddWhiteout("etc/passwd", md),                                   // removed
+			w.AddOpaqueWhiteout("var/cache", md),                              // removes var/cache/*
+			w.AddFile("var/cache/b", md, 1, strings.NewReader("b")),           // kept as is
+			w.AddFile("etc/hosts", md, 10, strings.NewReader("localhost2")),   // content
+			w.AddFile("etc/motd", owned, 5, strings.NewReader("hello")),       // owner
+			w.AddSymlink("bin", "usr/local/bin", md),                          // link
+			w.AddDir("tmp", executable),                                       // type and mode
+			w.AddFile("new", md, int64(len(large)), strings.NewReader(large)), // added
+			w.AddHardlink("newlink", "new", md),                               // added
+			w.AddFile("etc/.wh.notexist", md, 0, nil),                         // no effect
+		)
+	})
+
+	d := DiffTrees([]*Reader{base, oldTop}, []*Reader{base, newTop})
+	var got []string
+	for _, c := range d.Changes {
+		got = append(got, fmt.Sprintf("%s %s %v", c.Kind, c.Name, c.Fields))
+	}
+	want := []string{
+		"modified bin link",
+		"modified etc/hosts content",
+		"modified etc/motd owner",
+		"removed etc/passwd ",
+		"added new ",
+		"added newlink ",
+		"modified tmp type,mode",
+		"removed var/cache/a ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changes = %q; want %q", got, want)
+	}
+
+	// Contents of etc/hosts and new (shared with newlink) need to be fetched.
+	var wantFetch int64
+	for _, name := range []string{"etc/hosts", "new"} {
+		_, size, ok := newTop.FileRange(name)
+		if !ok {
+			t.Fatalf("range of %q not found", name)
+		}
+		wantFetch += size
+	}
+	if d.FetchSize != wantFetch {
+		t.Errorf("fetch size = %d; want %d", d.FetchSize, wantFetch)
+	}
+
+	if d := DiffTrees([]*Reader{base, oldTop}, []*Reader{base, oldTop}); len(d.Changes) != 0 || d.FetchSize != 0 {
+		t.Errorf("diff of the same image = %+v; want empty", d)
+	}
+}
+
+func TestMergedRangesSize(t *testing.T) {
+	if got := mergedRangesSize([][2]int64{{10, 20}, {0, 5}, {15, 30}, {20, 25}, {40, 40}}); got != 25 {
+		t.Errorf("merged size = %d; want 25", got)
+	}
+}
+
+// diffLayer returns the Reader of the blob written by f.
+func diffLayer(t *testing.T, f func(w *Writer) error) *Reader {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.ChunkSize = 1000
+	if err := f(w); err != nil {
+		t.Fatalf("failed to add entries: %v", err)
+	}
+	if _, err := w.Close(); err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+	r, err := Open(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())))
+	if err != nil {
+		t.Fatalf("failed to open blob: %v", err)
+	}
+	return r
+}
+
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
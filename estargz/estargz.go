@@ -27,9 +27,8 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"crypto"
 	"crypto/sha256"
-	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"hash"
 	"io"
@@ -37,7 +36,6 @@ import (
 	"os"
 	"path"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -50,7 +48,7 @@ import (
 // A Reader permits random access reads from a stargz file.
 type Reader struct {
 	sr        *io.SectionReader
-	toc       *jtoc
+	toc       *JTOC
 	tocDigest digest.Digest
 
 	// m stores all non-chunk entries, keyed by name.
@@ -60,57 +58,197 @@ type Reader struct {
 	// are split up. For a file with a single chunk, it's only
 	// stored in m.
 	chunks map[string][]*TOCEntry
+
+	// packed stores chunks packed into the same compressed stream, keyed by
+	// the Offset of the stream. Streams containing only one chunk aren't
+	// stored.
+	packed map[int64][]*TOCEntry
+
+	decompressor Decompressor
+}
+
+type openOpts struct {
+	decompressors []Decompressor
+	tailFetchSize int64
+}
+
+// OpenOption is an option used during opening the layer
+type OpenOption func(o *openOpts) error
+
+// WithDecompressors option specifies decompressors to use.
+// Gzip-based decompressors are always tried in addition to the specified ones.
+// This option can be specified multiple times and all decompressors are tried
+// in the order of the specification.
+func WithDecompressors(decompressors ...Decompressor) OpenOption {
+	return func(o *openOpts) error {
+		o.decompressors = append(o.decompressors, decompressors...)
+		return nil
+	}
+}
+
+// WithTailFetchSize option specifies the number of bytes read at once from the
+// tail of the blob for parsing the footer. If the TOC is contained in that range,
+// the TOC and the footer are got in a single read. The size of the TOC and the
+// footer can be known in advance through TOCSizeAnnotation, otherwise an
+// arbitrary (speculative) size can be used. The footer is always read even if
+// the specified size is smaller than the footer.
+func WithTailFetchSize(size int64) OpenOption {
+	return func(o *openOpts) error {
+		o.tailFetchSize = size
+		return nil
+	}
 }
 
 // Open opens a stargz file for reading.
+// The compression is detected by the footer. Gzip is always supported and other
+// algorithms can be enabled by WithDecompressors option.
 //
 // Note that each entry name is normalized as the path that is relative to root.
-func Open(sr *io.SectionReader) (*Reader, error) {
-	tocOff, footerSize, err := OpenFooter(sr)
+func Open(sr *io.SectionReader, opt ...OpenOption) (*Reader, error) {
+	var opts openOpts
+	for _, o := range opt {
+		if err := o(&opts); err != nil {
+			return nil, err
+		}
+	}
+	d, _, tocOff, tocSize, tail, err := openFooterWithTail(sr, append(gzipDecompressors(), opts.decompressors...), opts.tailFetchSize)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error parsing footer")
 	}
-	tocTargz := make([]byte, sr.Size()-tocOff-footerSize)
-	if _, err := sr.ReadAt(tocTargz, tocOff); err != nil {
-		return nil, fmt.Errorf("error reading %d byte TOC targz: %v", len(tocTargz), err)
+	var tocBytes []byte
+	if tailOff := sr.Size() - int64(len(tail)); tailOff <= tocOff {
+		// The TOC has already been read together with the footer.
+		tocBytes = tail[tocOff-tailOff : tocOff-tailOff+tocSize]
+	} else {
+		tocBytes = make([]byte, tocSize)
+		if _, err := sr.ReadAt(tocBytes, tocOff); err != nil {
+			return nil, fmt.Errorf("error reading %d byte TOC: %v", len(tocBytes), err)
+		}
 	}
-	zr, err := gzip.NewReader(bytes.NewReader(tocTargz))
+	toc, tocDgst, err := d.ParseTOC(bytes.NewReader(tocBytes))
 	if err != nil {
-		return nil, fmt.Errorf("malformed TOC gzip header: %v", err)
+		return nil, err
 	}
-	zr.Multistream(false)
-	tr := tar.NewReader(zr)
-	h, err := tr.Next()
-	if err != nil {
-		return nil, fmt.Errorf("failed to find tar header in TOC gzip stream: %v", err)
+	r := &Reader{
+		sr:           sr,
+		toc:          toc,
+		tocDigest:    tocDgst,
+		decompressor: d,
+	}
+	if err := r.initFields(); err != nil {
+		return nil, fmt.Errorf("failed to initialize fields of entries: %v", err)
 	}
-	if h.Name != TOCTarName {
-		return nil, fmt.Errorf("TOC tar entry had name %q; expected %q", h.Name, TOCTarName)
+	return r, nil
+}
+
+// OpenWithTOC opens a blob for reading using the passed TOC instead of the
+// one stored in the blob, so the blob doesn't need to contain the TOC and the
+// footer. This is useful for blobs indexed externally (e.g. an uncompressed tar
+// whose TOC entries point to the file payloads). Each chunk is read through the
+// passed Decompressor. The TOC must be serialized by MarshalTOC and the TOC
+// digest checked by VerifyTOC is the digest of tocBytes.
+func OpenWithTOC(sr *io.SectionReader, tocBytes []byte, d Decompressor) (*Reader, error) {
+	toc, err := UnmarshalTOC(tocBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding TOC: %v", err)
 	}
-	dgstr := digest.Canonical.Digester()
-	toc := new(jtoc)
-	if err := json.NewDecoder(io.TeeReader(tr, dgstr.Hash())).Decode(&toc); err != nil {
-		return nil, fmt.Errorf("error decoding TOC JSON: %v", err)
+	r := &Reader{
+		sr:           sr,
+		toc:          toc,
+		tocDigest:    digest.FromBytes(tocBytes),
+		decompressor: d,
 	}
-	r := &Reader{sr: sr, toc: toc, tocDigest: dgstr.Digest()}
 	if err := r.initFields(); err != nil {
 		return nil, fmt.Errorf("failed to initialize fields of entries: %v", err)
 	}
 	return r, nil
 }
 
-// OpenFooter extracts and parses footer from the given blob.
+// OpenFooter extracts and parses footer from the given gzip-based blob.
 func OpenFooter(sr *io.SectionReader) (tocOffset int64, footerSize int64, rErr error) {
-	if sr.Size() < FooterSize && sr.Size() < legacyFooterSize {
-		return 0, 0, fmt.Errorf("blob size %d is smaller than the footer size", sr.Size())
+	d, _, tocOffset, _, err := openFooter(sr, gzipDecompressors())
+	if err != nil {
+		return 0, 0, err
+	}
+	return tocOffset, d.FooterSize(), nil
+}
+
+// openFooter reads the footer of the blob and parses it with the passed
+// decompressors. This returns the first decompressor that succeeds to parse
+// the footer, the size of the blob payload and the range of the TOC.
+func openFooter(sr *io.SectionReader, decompressors []Decompressor) (d Decompressor, blobPayloadSize, tocOffset, tocSize int64, rErr error) {
+	d, blobPayloadSize, tocOffset, tocSize, _, err := openFooterWithTail(sr, decompressors, 0)
+	return d, blobPayloadSize, tocOffset, tocSize, err
+}
+
+// openFooterWithTail is the same as openFooter but reads at least tailFetchSize
+// bytes from the tail of the blob at once. The read bytes are returned as well.
+func openFooterWithTail(sr *io.SectionReader, decompressors []Decompressor, tailFetchSize int64) (d Decompressor, blobPayloadSize, tocOffset, tocSize int64, tail []byte, rErr error) {
+	fetchSize := tailFetchSize
+	for _, d := range decompressors {
+		if fs := d.FooterSize(); fs > fetchSize {
+			fetchSize = fs
+		}
+	}
+	if fetchSize > sr.Size() {
+		fetchSize = sr.Size()
 	}
-	// TODO: read a bigger chunk (1MB?) at once here to hopefully
-	// get the TOC + footer in one go.
-	var footer [FooterSize]byte
-	if _, err := sr.ReadAt(footer[:], sr.Size()-FooterSize); err != nil {
-		return 0, 0, fmt.Errorf("error reading footer: %v", err)
+	// Read the tail large enough for the largest footer among decompressors.
+	tail = make([]byte, fetchSize)
+	if _, err := sr.ReadAt(tail, sr.Size()-fetchSize); err != nil {
+		return nil, 0, 0, 0, nil, fmt.Errorf("error reading footer: %v", err)
+	}
+	d, blobPayloadSize, tocOffset, tocSize, err := parseBlobFooter(tail, sr.Size(), decompressors)
+	if err != nil {
+		return nil, 0, 0, 0, nil, err
 	}
-	return parseFooter(footer[:])
+	return d, blobPayloadSize, tocOffset, tocSize, tail, nil
+}
+
+// parseBlobFooter parses the tail of the blob of blobSize bytes in the same way
+// as parseFooter and validates the parsed ranges against the blob size.
+func parseBlobFooter(tail []byte, blobSize int64, decompressors []Decompressor) (d Decompressor, blobPayloadSize, tocOffset, tocSize int64, rErr error) {
+	d, blobPayloadSize, tocOffset, tocSize, err := parseFooter(tail, decompressors)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	if tocSize < 0 {
+		tocSize = blobSize - tocOffset - d.FooterSize()
+	}
+	if tocOffset < 0 || tocSize < 0 || tocOffset+tocSize > blobSize {
+		return nil, 0, 0, 0, fmt.Errorf("invalid TOC range (offset=%d,size=%d) in blob (size=%d)",
+			tocOffset, tocSize, blobSize)
+	}
+	if blobPayloadSize < 0 || blobPayloadSize > tocOffset {
+		return nil, 0, 0, 0, fmt.Errorf("invalid blob payload size %d (TOC offset=%d)",
+			blobPayloadSize, tocOffset)
+	}
+	return d, blobPayloadSize, tocOffset, tocSize, nil
+}
+
+// gzipDecompressors returns the decompressors that are always tried when
+// parsing a blob.
+func gzipDecompressors() []Decompressor {
+	return []Decompressor{new(GzipDecompressor), new(legacyGzipDecompressor)}
+}
+
+// parseFooter parses the tail of the blob, which must be at least as large as
+// the footer of each decompressor, with the passed decompressors in order.
+func parseFooter(p []byte, decompressors []Decompressor) (d Decompressor, blobPayloadSize, tocOffset, tocSize int64, rErr error) {
+	var allErr []error
+	for _, d := range decompressors {
+		fSize := d.FooterSize()
+		if fSize > int64(len(p)) {
+			allErr = append(allErr, fmt.Errorf("blob size %d is smaller than the footer size %d", len(p), fSize))
+			continue
+		}
+		blobPayloadSize, tocOffset, tocSize, err := d.ParseFooter(p[int64(len(p))-fSize:])
+		if err == nil {
+			return d, blobPayloadSize, tocOffset, tocSize, nil
+		}
+		allErr = append(allErr, err)
+	}
+	return nil, 0, 0, 0, errorutil.Aggregate(allErr)
 }
 
 // initFields populates the Reader from r.toc after decoding it from
@@ -157,11 +295,17 @@ func (r *Reader) initFields() error {
 			}
 			r.m[ent.Name] = ent
 		}
-		if ent.Type == "reg" && ent.ChunkSize > 0 && ent.ChunkSize < ent.Size {
+		if ent.Type == "reg" && ent.Sparse {
+			// Chunks of sparse files always have ChunkSize and may not exist.
+			r.chunks[ent.Name] = []*TOCEntry{}
+			if ent.ChunkSize > 0 {
+				r.chunks[ent.Name] = append(r.chunks[ent.Name], ent)
+			}
+		} else if ent.Type == "reg" && ent.ChunkSize > 0 && ent.ChunkSize < ent.Size {
 			r.chunks[ent.Name] = make([]*TOCEntry, 0, ent.Size/ent.ChunkSize+1)
 			r.chunks[ent.Name] = append(r.chunks[ent.Name], ent)
 		}
-		if ent.ChunkSize == 0 && ent.Size != 0 {
+		if ent.ChunkSize == 0 && ent.Size != 0 && !ent.Sparse {
 			ent.ChunkSize = ent.Size
 		}
 	}
@@ -206,14 +350,36 @@ func (r *Reader) initFields() error {
 		pdir.addChild(path.Base(name), ent)
 	}
 
-	lastOffset := r.sr.Size()
+	for _, ent := range r.toc.Entries {
+		if ent.InnerOffset > 0 {
+			if r.packed == nil {
+				r.packed = make(map[int64][]*TOCEntry)
+			}
+			r.packed[ent.Offset] = nil
+		}
+	}
+	if r.packed != nil {
+		for _, ent := range r.toc.Entries {
+			if _, ok := r.packed[ent.Offset]; ok && ent.isDataType() && ent.ChunkSize > 0 {
+				r.packed[ent.Offset] = append(r.packed[ent.Offset], ent)
+			}
+		}
+	}
+
+	// Entries packed into the same stream share the Offset so nextOffset is
+	// the next distinct Offset.
+	lastOffset, lastNextOffset := r.sr.Size(), r.sr.Size()
 	for i := len(r.toc.Entries) - 1; i >= 0; i-- {
 		e := r.toc.Entries[i]
 		if e.isDataType() {
-			e.nextOffset = lastOffset
+			if e.Offset == lastOffset {
+				e.nextOffset = lastNextOffset
+			} else {
+				e.nextOffset = lastOffset
+			}
 		}
-		if e.Offset != 0 {
-			lastOffset = e.Offset
+		if e.Offset != 0 && e.Offset != lastOffset {
+			lastOffset, lastNextOffset = e.Offset, lastOffset
 		}
 	}
 
@@ -252,16 +418,17 @@ func (r *Reader) VerifyTOC(tocDigest digest.Digest) (TOCEntryVerifier, error) {
 	if r.tocDigest != tocDigest {
 		return nil, fmt.Errorf("invalid TOC JSON %q; want %q", r.tocDigest, tocDigest)
 	}
-	digestMap := make(map[int64]digest.Digest) // map from chunk offset to the digest
+	digestMap := make(map[chunkPosition]digest.Digest) // map from chunk position to the digest
 	for _, e := range r.toc.Entries {
 		if e.Type == "reg" || e.Type == "chunk" {
-			if e.Type == "reg" && e.Size == 0 {
-				continue // ignores empty file
+			if e.Type == "reg" && (e.Size == 0 || (e.Sparse && e.ChunkSize == 0)) {
+				continue // ignores empty file and sparse file without data
 			}
 
-			// offset must be unique in stargz blob
-			if _, ok := digestMap[e.Offset]; ok {
-				return nil, fmt.Errorf("offset %d found twice", e.Offset)
+			// position must be unique in stargz blob
+			pos := chunkPosition{e.Offset, e.InnerOffset}
+			if _, ok := digestMap[pos]; ok {
+				return nil, fmt.Errorf("offset %d (inner offset %d) found twice", e.Offset, e.InnerOffset)
 			}
 
 			// all chunk entries must contain digest
@@ -274,17 +441,78 @@ func (r *Reader) VerifyTOC(tocDigest digest.Digest) (TOCEntryVerifier, error) {
 			if err != nil {
 				return nil, errors.Wrapf(err, "failed to parse digest %q", e.ChunkDigest)
 			}
-			digestMap[e.Offset] = d
+			digestMap[pos] = d
 		}
 	}
 
 	return &verifier{digestMap: digestMap}, nil
 }
 
+// VerifyTOCSignature checks that the TOC is signed by the private key of any
+// of the passed public keys, instead of checking the TOC digest against the
+// known one like VerifyTOC. If the verification succeeds, this function returns
+// TOCEntryVerifier which holds all chunk digests in the stargz blob.
+func (r *Reader) VerifyTOCSignature(keys ...crypto.PublicKey) (TOCEntryVerifier, error) {
+	if err := VerifyTOCSignature(r.tocDigest, r.toc.Signature, keys...); err != nil {
+		return nil, err
+	}
+	return r.VerifyTOC(r.tocDigest)
+}
+
+// TOCSignature returns the signature of the TOC digest embedded in the blob.
+// This returns nil if the TOC isn't signed.
+func (r *Reader) TOCSignature() []byte {
+	return r.toc.Signature
+}
+
+// PrefetchProfile returns the prefetch profile of the specified name recorded
+// in the TOC. See also WithPrefetchProfile.
+func (r *Reader) PrefetchProfile(name string) (*PrefetchProfile, bool) {
+	for _, p := range r.toc.PrefetchProfiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// FileRange returns the range of the blob storing all chunks of the regular
+// file. Files packed into the same compressed stream share the range of that
+// stream. The range of the last file extends to the end of the blob as the end
+// of the last stream isn't recorded in the TOC. ok is false if the file
+// doesn't have data in the blob.
+func (r *Reader) FileRange(name string) (offset, size int64, ok bool) {
+	e, ok := r.Lookup(name)
+	if !ok || e.Type != "reg" || e.Size == 0 || (e.Sparse && e.ChunkSize == 0) {
+		return 0, 0, false
+	}
+	ents := r.chunks[cleanEntryName(e.Name)]
+	if len(ents) == 0 {
+		ents = []*TOCEntry{e}
+	}
+	offset, end := ents[0].Offset, ents[0].NextOffset()
+	for _, c := range ents[1:] {
+		if c.Offset < offset {
+			offset = c.Offset
+		}
+		if n := c.NextOffset(); n > end {
+			end = n
+		}
+	}
+	return offset, end - offset, true
+}
+
+// chunkPosition is the position of the chunk in the blob. Chunks packed into
+// the same stream share the offset so the inner offset is needed as well.
+type chunkPosition struct {
+	offset      int64
+	innerOffset int64
+}
+
 // verifier is an implementation of TOCEntryVerifier which holds verifiers keyed by
-// offset of the chunk.
+// position of the chunk.
 type verifier struct {
-	digestMap   map[int64]digest.Digest
+	digestMap   map[chunkPosition]digest.Digest
 	digestMapMu sync.Mutex
 }
 
@@ -292,7 +520,7 @@ type verifier struct {
 func (v *verifier) Verifier(ce *TOCEntry) (digest.Verifier, error) {
 	v.digestMapMu.Lock()
 	defer v.digestMapMu.Unlock()
-	d, ok := v.digestMap[ce.Offset]
+	d, ok := v.digestMap[chunkPosition{ce.Offset, ce.InnerOffset}]
 	if !ok {
 		return nil, fmt.Errorf("verifier for offset=%d,size=%d hasn't been registered",
 			ce.Offset, ce.ChunkSize)
@@ -309,9 +537,9 @@ func (r *Reader) ChunkEntryForOffset(name string, offset int64) (e *TOCEntry, ok
 	if !ok || !e.isDataType() {
 		return nil, false
 	}
-	ents := r.chunks[name]
+	ents := r.chunks[e.Name] // e is the target if name is a hardlink
 	if len(ents) < 2 {
-		if offset >= e.ChunkSize {
+		if offset < e.ChunkOffset || offset >= e.ChunkOffset+e.ChunkSize {
 			return nil, false
 		}
 		return e, true
@@ -320,12 +548,82 @@ func (r *Reader) ChunkEntryForOffset(name string, offset int64) (e *TOCEntry, ok
 		e := ents[i]
 		return e.ChunkOffset >= offset || (offset > e.ChunkOffset && offset < e.ChunkOffset+e.ChunkSize)
 	})
-	if i == len(ents) {
+	if i == len(ents) || ents[i].ChunkOffset > offset {
+		// offset is out of the file or in a hole of a sparse file.
 		return nil, false
 	}
 	return ents[i], true
 }
 
+// NextDataOffset returns the offset of the first byte of data at or after
+// offset in the named file. ok is false if no data follows offset. All bytes
+// of regular files are data except holes of sparse files.
+// Name must be absolute path or one that is relative to root.
+func (r *Reader) NextDataOffset(name string, offset int64) (_ int64, ok bool) {
+	e, ok := r.Lookup(name)
+	if !ok || e.Type != "reg" || offset >= e.Size {
+		return 0, false
+	}
+	if !e.Sparse {
+		return offset, true
+	}
+	ents := r.getChunks(e)
+	i := sort.Search(len(ents), func(i int) bool {
+		return ents[i].ChunkOffset+ents[i].ChunkSize > offset
+	})
+	if i == len(ents) {
+		return 0, false
+	}
+	if ents[i].ChunkOffset > offset {
+		return ents[i].ChunkOffset, true
+	}
+	return offset, true
+}
+
+// NextHoleOffset returns the offset of the first hole at or after offset in
+// the named file. The end of the file is regarded as a hole so the file size
+// is returned if no hole follows offset.
+// Name must be absolute path or one that is relative to root.
+func (r *Reader) NextHoleOffset(name string, offset int64) int64 {
+	e, ok := r.Lookup(name)
+	if !ok || e.Type != "reg" || offset >= e.Size {
+		return offset
+	}
+	if !e.Sparse {
+		return e.Size
+	}
+	ents := r.getChunks(e)
+	i := sort.Search(len(ents), func(i int) bool {
+		return ents[i].ChunkOffset+ents[i].ChunkSize > offset
+	})
+	if i == len(ents) || ents[i].ChunkOffset > offset {
+		return offset
+	}
+	end := ents[i].ChunkOffset + ents[i].ChunkSize
+	for i++; i < len(ents) && ents[i].ChunkOffset == end; i++ {
+		end += ents[i].ChunkSize
+	}
+	return end
+}
+
+// PackedEntries returns chunks (i.e. "reg" or "chunk" entries) packed into the
+// compressed stream at the offset in the order of InnerOffset. ok is false if
+// the stream doesn't contain more than one chunk. OpenStream can be used for
+// reading all of them by decompressing the stream once.
+func (r *Reader) PackedEntries(offset int64) (ents []*TOCEntry, ok bool) {
+	ents = r.packed[offset]
+	return ents, len(ents) > 1
+}
+
+// OpenStream returns the decompressed stream at the Offset of the chunk e.
+// The stream starts InnerOffset bytes before the data of e.
+func (r *Reader) OpenStream(e *TOCEntry) (io.ReadCloser, error) {
+	if !e.isDataType() || e.nextOffset <= e.Offset {
+		return nil, fmt.Errorf("%q (chunk offset %d) doesn't have data", e.Name, e.ChunkOffset)
+	}
+	return r.decompressor.Reader(io.NewSectionReader(r.sr, e.Offset, e.nextOffset-e.Offset))
+}
+
 // Lookup returns the Table of Contents entry for the given path.
 //
 // To get the root directory, use the empty string.
@@ -364,9 +662,10 @@ func (r *Reader) OpenFile(name string) (*io.SectionReader, error) {
 		}
 	}
 	fr := &fileReader{
-		r:    r,
-		size: ent.Size,
-		ents: r.getChunks(ent),
+		r:      r,
+		size:   ent.Size,
+		ents:   r.getChunks(ent),
+		sparse: ent.Sparse,
 	}
 	return io.NewSectionReader(fr, 0, fr.size), nil
 }
@@ -379,9 +678,10 @@ func (r *Reader) getChunks(ent *TOCEntry) []*TOCEntry {
 }
 
 type fileReader struct {
-	r    *Reader
-	size int64
-	ents []*TOCEntry // 1 or more reg/chunk entries
+	r      *Reader
+	size   int64
+	ents   []*TOCEntry // 1 or more reg/chunk entries (may be 0 if sparse)
+	sparse bool
 }
 
 func (fr *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
@@ -391,6 +691,9 @@ func (fr *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
 	if off < 0 {
 		return 0, errors.New("invalid offset")
 	}
+	if fr.sparse {
+		return fr.readSparseAt(p, off)
+	}
 	var i int
 	if len(fr.ents) > 1 {
 		i = sort.Search(len(fr.ents), func(i int) bool {
@@ -410,8 +713,57 @@ func (fr *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
 
 	//  If ent is a chunk of a large file, adjust the ReadAt
 	//  offset by the chunk's offset.
-	off -= ent.ChunkOffset
+	return fr.readChunkAt(ent, p, off-ent.ChunkOffset)
+}
+
+// readSparseAt reads the sparse file. Holes are filled with zeros without
+// reading the blob.
+func (fr *fileReader) readSparseAt(p []byte, off int64) (n int, err error) {
+	var eof bool
+	if remain := fr.size - off; int64(len(p)) > remain {
+		p, eof = p[:remain], true
+	}
+	for n < len(p) {
+		cur := off + int64(n)
+		i := sort.Search(len(fr.ents), func(i int) bool {
+			return fr.ents[i].ChunkOffset+fr.ents[i].ChunkSize > cur
+		})
+		if i == len(fr.ents) || fr.ents[i].ChunkOffset > cur {
+			end := fr.size
+			if i < len(fr.ents) {
+				end = fr.ents[i].ChunkOffset
+			}
+			m := len(p) - n
+			if end-cur < int64(m) {
+				m = int(end - cur)
+			}
+			zeroReader{}.Read(p[n : n+m])
+			n += m
+			continue
+		}
+		// Contiguous chunks can be read at once.
+		end := fr.ents[i].ChunkOffset + fr.ents[i].ChunkSize
+		for j := i + 1; j < len(fr.ents) && fr.ents[j].ChunkOffset == end; j++ {
+			end += fr.ents[j].ChunkSize
+		}
+		m := len(p) - n
+		if end-cur < int64(m) {
+			m = int(end - cur)
+		}
+		if _, err := fr.readChunkAt(fr.ents[i], p[n:n+m], cur-fr.ents[i].ChunkOffset); err != nil {
+			return n, err
+		}
+		n += m
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
 
+// readChunkAt reads p from off bytes after the beginning of the chunk ent.
+// The read can continue to the following chunks.
+func (fr *fileReader) readChunkAt(ent *TOCEntry, p []byte, off int64) (n int, err error) {
 	finalEnt := fr.ents[len(fr.ents)-1]
 	gzOff := ent.Offset
 	// gzBytesRemain is the number of compressed gzip bytes in this
@@ -431,48 +783,105 @@ func (fr *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
 		return 0, fmt.Errorf("fileReader.ReadAt.peek: %v", err)
 	}
 
-	gz, err := gzip.NewReader(br)
+	dr, err := fr.r.decompressor.Reader(br)
 	if err != nil {
-		return 0, fmt.Errorf("fileReader.ReadAt.gzipNewReader: %v", err)
+		return 0, fmt.Errorf("fileReader.ReadAt.decompressor.Reader: %v", err)
 	}
-	if n, err := io.CopyN(ioutil.Discard, gz, off); n != off || err != nil {
+	defer dr.Close()
+	off += ent.InnerOffset
+	if n, err := io.CopyN(ioutil.Discard, dr, off); n != off || err != nil {
 		return 0, fmt.Errorf("discard of %d bytes = %v, %v", off, n, err)
 	}
-	return io.ReadFull(gz, p)
+	return io.ReadFull(dr, p)
 }
 
 // A Writer writes stargz files.
 //
-// Use NewWriter to create a new Writer.
+// Use NewWriter to create a new Writer. Entries are appended from tar streams
+// with AppendTar or one by one with AppendEntry and the Add methods (e.g.
+// AddFile).
 type Writer struct {
 	bw       *bufio.Writer
 	cw       *countWriter
-	toc      *jtoc
+	toc      *JTOC
 	diffHash hash.Hash // SHA-256 of uncompressed tar
 
-	closed           bool
-	gz               *gzip.Writer
-	lastUsername     map[int]string
-	lastGroupname    map[int]string
-	compressionLevel int
+	closed        bool
+	gz            io.WriteCloser
+	lastUsername  map[int]string
+	lastGroupname map[int]string
+	compressor    Compressor
 
 	// ChunkSize optionally controls the maximum number of bytes
 	// of data of a regular file that can be written in one gzip
 	// stream before a new gzip stream is started.
 	// Zero means to use a default, currently 4 MiB.
 	ChunkSize int
+
+	// ContentDefinedChunking optionally makes the boundaries of chunks
+	// of regular files determined by their contents using a rolling hash,
+	// instead of fixed ChunkSize offsets. This keeps chunks (and their
+	// ChunkDigest) unchanged even if bytes are inserted to or removed from
+	// preceding contents of the file. ChunkSize is still the maximum size
+	// of a chunk and chunks are a quarter of it on average.
+	ContentDefinedChunking bool
+
+	// CompactTOC optionally makes the TOC serialized in the compact binary
+	// encoding instead of JSON. See also JTOC.Compact.
+	CompactTOC bool
+
+	// StorePolicy optionally chooses regular files to be stored without
+	// compression. Chunks of such files are written by StoreWriter of the
+	// compressor so this has no effect unless the compressor implements
+	// StoreCompressor. The TOC and verification are the same as compressed
+	// files.
+	StorePolicy StorePolicy
+
+	// MinChunkSize optionally makes regular files smaller than this packed
+	// into the compressed stream shared with the preceding entries, instead
+	// of starting a new stream per file. A stream containing packed files is
+	// closed once it exceeds MinChunkSize bytes. TOCEntry.InnerOffset of a
+	// packed file records where its data starts in the decompressed stream.
+	// Zero means no packing.
+	MinChunkSize int
+
+	// TOCSigningKey optionally signs the digest of the TOC with this key
+	// (ed25519.PrivateKey or *ecdsa.PrivateKey). The signature is written
+	// next to the TOC so that readers can verify the TOC without knowing its
+	// digest in advance. See also SignTOC.
+	TOCSigningKey crypto.Signer
+
+	// TempDir optionally specifies the directory where temporary files
+	// (e.g. spooled contents of sparse files) are created. Empty means the
+	// default directory for temporary files (see os.TempDir).
+	TempDir string
+
+	store bool // the current chunk is written without compression
+
+	gzOffset int64 // offset of the current compressed stream in the blob
+	gzN      int64 // number of bytes written to the current compressed stream
+
+	chunker   *contentDefinedChunker
+	chunkerBr *bufio.Reader
+
+	// digests are the digests of regular files already computed by the caller
+	// (e.g. for deduplication in Build) keyed by the cleaned names. They are
+	// used instead of computing the digests again.
+	digests map[string]digest.Digest
 }
 
-// currentGzipWriter writes to the current w.gz field, which can
+// currentCompressionWriter writes to the current w.gz field, which can
 // change throughout writing a tar entry.
 //
 // Additionally, it updates w's SHA-256 of the uncompressed bytes
 // of the tar file.
-type currentGzipWriter struct{ w *Writer }
+type currentCompressionWriter struct{ w *Writer }
 
-func (cgw currentGzipWriter) Write(p []byte) (int, error) {
-	cgw.w.diffHash.Write(p)
-	return cgw.w.gz.Write(p)
+func (ccw currentCompressionWriter) Write(p []byte) (int, error) {
+	ccw.w.diffHash.Write(p)
+	n, err := ccw.w.gz.Write(p)
+	ccw.w.gzN += int64(n)
+	return n, err
 }
 
 func (w *Writer) chunkSize() int {
@@ -482,26 +891,34 @@ func (w *Writer) chunkSize() int {
 	return w.ChunkSize
 }
 
-// NewWriter returns a new stargz writer writing to w.
+// NewWriter returns a new stargz writer (gzip-based) writing to w.
 //
 // The writer must be closed to write its trailing table of contents.
 func NewWriter(w io.Writer) *Writer {
 	return NewWriterLevel(w, gzip.BestCompression)
 }
 
-// NewWriterLevel returns a new stargz writer writing to w.
+// NewWriterLevel returns a new stargz writer (gzip-based) writing to w.
 // The compression level is configurable.
 //
 // The writer must be closed to write its trailing table of contents.
 func NewWriterLevel(w io.Writer, compressionLevel int) *Writer {
+	return NewWriterWithCompressor(w, NewGzipCompressorWithLevel(compressionLevel))
+}
+
+// NewWriterWithCompressor returns a new stargz writer writing to w.
+// The compression method is configurable.
+//
+// The writer must be closed to write its trailing table of contents.
+func NewWriterWithCompressor(w io.Writer, c Compressor) *Writer {
 	bw := bufio.NewWriter(w)
 	cw := &countWriter{w: bw}
 	return &Writer{
-		bw:               bw,
-		cw:               cw,
-		toc:              &jtoc{Version: 1},
-		diffHash:         sha256.New(),
-		compressionLevel: compressionLevel,
+		bw:         bw,
+		cw:         cw,
+		toc:        &JTOC{Version: 1},
+		diffHash:   sha256.New(),
+		compressor: c,
 	}
 }
 
@@ -517,42 +934,22 @@ func (w *Writer) Close() (digest.Digest, error) {
 		return "", err
 	}
 
-	// Write the TOC index.
-	tocOff := w.cw.n
-	w.gz, _ = gzip.NewWriterLevel(w.cw, w.compressionLevel)
-	tw := tar.NewWriter(currentGzipWriter{w})
-	tocJSON, err := json.MarshalIndent(w.toc, "", "\t")
-	if err != nil {
-		return "", err
-	}
-	if err := tw.WriteHeader(&tar.Header{
-		Typeflag: tar.TypeReg,
-		Name:     TOCTarName,
-		Size:     int64(len(tocJSON)),
-	}); err != nil {
-		return "", err
-	}
-	if _, err := tw.Write(tocJSON); err != nil {
-		return "", err
-	}
-
-	if err := tw.Close(); err != nil {
-		return "", err
-	}
-	if err := w.closeGz(); err != nil {
-		return "", err
+	// Write the TOC index and footer.
+	w.toc.Compact = w.CompactTOC
+	if w.TOCSigningKey != nil {
+		if err := signTOC(w.toc, w.TOCSigningKey); err != nil {
+			return "", err
+		}
 	}
-
-	// And a little footer with pointer to the TOC gzip stream.
-	if _, err := w.bw.Write(footerBytes(tocOff)); err != nil {
+	tocDigest, err := w.compressor.WriteTOCAndFooter(w.cw, w.cw.n, w.toc, w.diffHash)
+	if err != nil {
 		return "", err
 	}
-
 	if err := w.bw.Flush(); err != nil {
 		return "", err
 	}
 
-	return digest.FromBytes(tocJSON), nil
+	return tocDigest, nil
 }
 
 func (w *Writer) closeGz() error {
@@ -584,17 +981,63 @@ func (w *Writer) nameIfChanged(mp *map[int]string, id int, name string) string {
 	return name
 }
 
-func (w *Writer) condOpenGz() {
+func (w *Writer) condOpenGz() (err error) {
 	if w.gz == nil {
-		w.gz, _ = gzip.NewWriterLevel(w.cw, w.compressionLevel)
+		w.gzOffset, w.gzN = w.cw.n, 0
+		if sc, ok := w.compressor.(StoreCompressor); ok && w.store {
+			w.gz, err = sc.StoreWriter(w.cw)
+		} else {
+			w.gz, err = w.compressor.Writer(w.cw)
+		}
+	}
+	return
+}
+
+// packFile returns true if the data of the regular file should be written to
+// the current compressed stream which contains the header of the file.
+func (w *Writer) packFile(h *tar.Header, store bool) bool {
+	if w.MinChunkSize <= 0 || h.Size >= int64(w.MinChunkSize) || h.Size > int64(w.chunkSize()) {
+		return false
+	}
+	if w.store != store {
+		return false // the current stream is compressed differently
+	}
+	switch cleanEntryName(h.Name) {
+	case PrefetchLandmark, NoPrefetchLandmark:
+		// Landmarks must start streams because their offsets are used as
+		// the boundary of prefetch.
+		return false
 	}
+	return true
+}
+
+// storeFile returns true if the regular file should be stored without
+// compression. The returned reader must be used for reading the payload.
+func (w *Writer) storeFile(h *tar.Header, r io.Reader) (bool, io.Reader) {
+	if w.StorePolicy == nil {
+		return false, r
+	}
+	if _, ok := w.compressor.(StoreCompressor); !ok {
+		return false, r
+	}
+	br := bufio.NewReaderSize(r, storePolicySampleSize)
+	n := storePolicySampleSize
+	if h.Size < int64(n) {
+		n = int(h.Size)
+	}
+	head, err := br.Peek(n)
+	if err != nil {
+		// the error will be returned when copying the payload
+		return false, br
+	}
+	return w.StorePolicy(h.Name, head), br
 }
 
 // AppendTar reads the tar or tar.gz file from r and appends
 // each of its contents to w.
 //
 // The input r can optionally be gzip compressed but the output will
-// always be gzip compressed.
+// always be compressed by the specified compressor.
 func (w *Writer) AppendTar(r io.Reader) error {
 	br := bufio.NewReader(r)
 	var tr *tar.Reader
@@ -613,202 +1056,282 @@ func (w *Writer) AppendTar(r io.Reader) error {
 		if err != nil {
 			return fmt.Errorf("error reading from source tar: tar.Reader.Next: %v", err)
 		}
-		if h.Name == TOCTarName {
+		if h.Name == TOCTarName || h.Name == TOCSignatureTarName {
 			// It is possible for a layer to be "stargzified" twice during the
 			// distribution lifecycle. So we reserve "TOCTarName" here to avoid
 			// duplicated entries in the resulting layer.
 			continue
 		}
-
-		xattrs := make(map[string][]byte)
-		const xattrPAXRecordsPrefix = "SCHILY.xattr."
-		if h.PAXRecords != nil {
-			for k, v := range h.PAXRecords {
-				if strings.HasPrefix(k, xattrPAXRecordsPrefix) {
-					xattrs[k[len(xattrPAXRecordsPrefix):]] = []byte(v)
-				}
-			}
-		}
-		ent := &TOCEntry{
-			Name:        h.Name,
-			Mode:        h.Mode,
-			UID:         h.Uid,
-			GID:         h.Gid,
-			Uname:       w.nameIfChanged(&w.lastUsername, h.Uid, h.Uname),
-			Gname:       w.nameIfChanged(&w.lastGroupname, h.Gid, h.Gname),
-			ModTime3339: formatModtime(h.ModTime),
-			Xattrs:      xattrs,
-		}
-		w.condOpenGz()
-		tw := tar.NewWriter(currentGzipWriter{w})
-		if err := tw.WriteHeader(h); err != nil {
+		if err := w.appendEntry(h, tr); err != nil {
 			return err
 		}
-		switch h.Typeflag {
-		case tar.TypeLink:
-			ent.Type = "hardlink"
-			ent.LinkName = h.Linkname
-		case tar.TypeSymlink:
-			ent.Type = "symlink"
-			ent.LinkName = h.Linkname
-		case tar.TypeDir:
-			ent.Type = "dir"
-		case tar.TypeReg:
-			ent.Type = "reg"
-			ent.Size = h.Size
-		case tar.TypeChar:
-			ent.Type = "char"
-			ent.DevMajor = int(h.Devmajor)
-			ent.DevMinor = int(h.Devminor)
-		case tar.TypeBlock:
-			ent.Type = "block"
-			ent.DevMajor = int(h.Devmajor)
-			ent.DevMinor = int(h.Devminor)
-		case tar.TypeFifo:
-			ent.Type = "fifo"
-		default:
-			return fmt.Errorf("unsupported input tar entry %q", h.Typeflag)
-		}
-
-		// We need to keep a reference to the TOC entry for regular files, so that we
-		// can fill the digest later.
-		var regFileEntry *TOCEntry
-		var payloadDigest digest.Digester
-		if h.Typeflag == tar.TypeReg {
-			regFileEntry = ent
+	}
+	return nil
+}
+
+// appendEntry appends the entry whose header is h. r provides the payload of
+// regular files.
+func (w *Writer) appendEntry(h *tar.Header, r io.Reader) (err error) {
+	if w.closed {
+		return errors.New("write on closed Writer")
+	}
+	if isSparseHeader(h) {
+		return w.appendSparseFile(h, r)
+	}
+
+	ent := w.tocEntryOf(h)
+	if err := w.condOpenGz(); err != nil {
+		return err
+	}
+	tw := tar.NewWriter(currentCompressionWriter{w})
+	if err := tw.WriteHeader(h); err != nil {
+		return err
+	}
+	switch h.Typeflag {
+	case tar.TypeLink:
+		ent.Type = "hardlink"
+		ent.LinkName = h.Linkname
+	case tar.TypeSymlink:
+		ent.Type = "symlink"
+		ent.LinkName = h.Linkname
+	case tar.TypeDir:
+		ent.Type = "dir"
+	case tar.TypeReg:
+		ent.Type = "reg"
+		ent.Size = h.Size
+	case tar.TypeChar:
+		ent.Type = "char"
+		ent.DevMajor = int(h.Devmajor)
+		ent.DevMinor = int(h.Devminor)
+	case tar.TypeBlock:
+		ent.Type = "block"
+		ent.DevMajor = int(h.Devmajor)
+		ent.DevMinor = int(h.Devminor)
+	case tar.TypeFifo:
+		ent.Type = "fifo"
+	default:
+		return fmt.Errorf("unsupported input tar entry %q", h.Typeflag)
+	}
+
+	// We need to keep a reference to the TOC entry for regular files, so that we
+	// can fill the digest later.
+	var regFileEntry *TOCEntry
+	var payloadDigest digest.Digester
+	if h.Typeflag == tar.TypeReg {
+		regFileEntry = ent
+		if dgst, ok := w.digests[cleanEntryName(h.Name)]; ok {
+			ent.Digest = dgst.String()
+		} else {
 			payloadDigest = digest.Canonical.Digester()
 		}
+	}
 
-		if h.Typeflag == tar.TypeReg && ent.Size > 0 {
-			var written int64
-			totalSize := ent.Size // save it before we destroy ent
-			tee := io.TeeReader(tr, payloadDigest.Hash())
-			for written < totalSize {
+	if h.Typeflag == tar.TypeReg && ent.Size > 0 {
+		var written int64
+		totalSize := ent.Size // save it before we destroy ent
+		store, payload := w.storeFile(h, r)
+		pack := w.packFile(h, store)
+		if w.ContentDefinedChunking {
+			payload = w.resetChunker(payload)
+		}
+		tee := payload
+		if payloadDigest != nil {
+			tee = io.TeeReader(payload, payloadDigest.Hash())
+		}
+		for written < totalSize {
+			if !pack {
 				if err := w.closeGz(); err != nil {
 					return err
 				}
+			}
 
-				chunkSize := int64(w.chunkSize())
-				remain := totalSize - written
-				if remain < chunkSize {
-					chunkSize = remain
-				} else {
-					ent.ChunkSize = chunkSize
+			chunkSize := int64(w.chunkSize())
+			remain := totalSize - written
+			if w.ContentDefinedChunking {
+				if chunkSize, err = w.nextChunkSize(remain); err != nil {
+					return fmt.Errorf("error reading %q: %v", h.Name, err)
 				}
-				ent.Offset = w.cw.n
-				ent.ChunkOffset = written
-				chunkDigest := digest.Canonical.Digester()
+			}
+			if remain < chunkSize {
+				chunkSize = remain
+			} else {
+				ent.ChunkSize = chunkSize
+			}
+			ent.Offset = w.cw.n
+			ent.ChunkOffset = written
+			chunkDigest := digest.Canonical.Digester()
 
-				w.condOpenGz()
+			w.store = store
+			if err := w.condOpenGz(); err != nil {
+				return err
+			}
+			if pack {
+				// The header of this file is already in the current stream.
+				ent.Offset, ent.InnerOffset = w.gzOffset, w.gzN
+			}
 
-				teeChunk := io.TeeReader(tee, chunkDigest.Hash())
-				if _, err := io.CopyN(tw, teeChunk, chunkSize); err != nil {
-					return fmt.Errorf("error copying %q: %v", h.Name, err)
-				}
-				ent.ChunkDigest = chunkDigest.Digest().String()
-				w.toc.Entries = append(w.toc.Entries, ent)
-				written += chunkSize
-				ent = &TOCEntry{
-					Name: h.Name,
-					Type: "chunk",
-				}
+			teeChunk := io.TeeReader(tee, chunkDigest.Hash())
+			if _, err := io.CopyN(tw, teeChunk, chunkSize); err != nil {
+				return fmt.Errorf("error copying %q: %v", h.Name, err)
 			}
-		} else {
+			ent.ChunkDigest = chunkDigest.Digest().String()
 			w.toc.Entries = append(w.toc.Entries, ent)
+			written += chunkSize
+			ent = &TOCEntry{
+				Name: h.Name,
+				Type: "chunk",
+			}
 		}
-		if payloadDigest != nil {
-			regFileEntry.Digest = payloadDigest.Digest().String()
-		}
-		if err := tw.Flush(); err != nil {
+	} else {
+		w.toc.Entries = append(w.toc.Entries, ent)
+	}
+	if payloadDigest != nil {
+		regFileEntry.Digest = payloadDigest.Digest().String()
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if w.store || (w.MinChunkSize > 0 && w.gzN > int64(w.MinChunkSize)) {
+		// Following headers are compressed as usual in a new stream.
+		if err := w.closeGz(); err != nil {
 			return err
 		}
+		w.store = false
 	}
 	return nil
 }
 
-// DiffID returns the SHA-256 of the uncompressed tar bytes.
-// It is only valid to call DiffID after Close.
-func (w *Writer) DiffID() string {
-	return fmt.Sprintf("sha256:%x", w.diffHash.Sum(nil))
-}
-
-// footerBytes returns the 51 bytes footer.
-func footerBytes(tocOff int64) []byte {
-	buf := bytes.NewBuffer(make([]byte, 0, FooterSize))
-	gz, _ := gzip.NewWriterLevel(buf, gzip.NoCompression) // MUST be NoCompression to keep 51 bytes
-
-	// Extra header indicating the offset of TOCJSON
-	// https://tools.ietf.org/html/rfc1952#section-2.3.1.1
-	header := make([]byte, 4)
-	header[0], header[1] = 'S', 'G'
-	subfield := fmt.Sprintf("%016xSTARGZ", tocOff)
-	binary.LittleEndian.PutUint16(header[2:4], uint16(len(subfield))) // little-endian per RFC1952
-	gz.Header.Extra = append(header, []byte(subfield)...)
-	gz.Close()
-	if buf.Len() != FooterSize {
-		panic(fmt.Sprintf("footer buffer = %d, not %d", buf.Len(), FooterSize))
+// tocEntryOf returns the TOCEntry of the header. Type and fields depending on
+// it aren't filled.
+func (w *Writer) tocEntryOf(h *tar.Header) *TOCEntry {
+	xattrs := make(map[string][]byte)
+	const xattrPAXRecordsPrefix = "SCHILY.xattr."
+	if h.PAXRecords != nil {
+		for k, v := range h.PAXRecords {
+			if strings.HasPrefix(k, xattrPAXRecordsPrefix) {
+				xattrs[k[len(xattrPAXRecordsPrefix):]] = []byte(v)
+			}
+		}
 	}
-	return buf.Bytes()
-}
-
-func parseFooter(p []byte) (tocOffset int64, footerSize int64, rErr error) {
-	var allErr []error
-
-	tocOffset, err := parseEStargzFooter(p)
-	if err == nil {
-		return tocOffset, FooterSize, nil
+	return &TOCEntry{
+		Name:        h.Name,
+		Mode:        h.Mode,
+		UID:         h.Uid,
+		GID:         h.Gid,
+		Uname:       w.nameIfChanged(&w.lastUsername, h.Uid, h.Uname),
+		Gname:       w.nameIfChanged(&w.lastGroupname, h.Gid, h.Gname),
+		ModTime3339: formatModtime(h.ModTime),
+		Xattrs:      xattrs,
 	}
-	allErr = append(allErr, err)
+}
 
-	pad := len(p) - legacyFooterSize
-	if pad < 0 {
-		pad = 0
+// appendSparseFile appends the sparse file read from r whose header is h.
+// Holes of the file aren't stored in the blob. The file is written in GNU
+// sparse format 1.0 and only the regions containing data are chunked.
+func (w *Writer) appendSparseFile(h *tar.Header, r io.Reader) error {
+	// The sparse map precedes the data in the tar so the data is spooled to
+	// a temporary file until all regions are found.
+	data, err := ioutil.TempFile(w.TempDir, "esgzsparse")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		data.Close()
+		os.Remove(data.Name())
+	}()
+	payloadDigest := digest.Canonical.Digester()
+	regions, err := scanSparse(io.TeeReader(r, payloadDigest.Hash()), h.Size, func(_ int64, p []byte) error {
+		_, err := data.Write(p)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error reading %q: %v", h.Name, err)
 	}
-	tocOffset, err = parseLegacyFooter(p[pad:])
-	if err == nil {
-		return tocOffset, legacyFooterSize, nil
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		return err
 	}
-	return 0, 0, errorutil.Aggregate(append(allErr, err))
-}
 
-func parseEStargzFooter(p []byte) (tocOffset int64, err error) {
-	if len(p) != FooterSize {
-		return 0, fmt.Errorf("invalid length %d cannot be parsed", len(p))
+	ent := w.tocEntryOf(h)
+	ent.Type = "reg"
+	ent.Size = h.Size
+	ent.Sparse = true
+	ent.Digest = payloadDigest.Digest().String()
+	if err := w.condOpenGz(); err != nil {
+		return err
 	}
-	zr, err := gzip.NewReader(bytes.NewReader(p))
+	sw, err := writeSparseHeader(currentCompressionWriter{w}, h, regions)
 	if err != nil {
-		return 0, err
-	}
-	extra := zr.Header.Extra
-	si1, si2, subfieldlen, subfield := extra[0], extra[1], extra[2:4], extra[4:]
-	if si1 != 'S' || si2 != 'G' {
-		return 0, fmt.Errorf("invalid subfield IDs: %q, %q; want E, S", si1, si2)
+		return err
+	}
+	br := bufio.NewReader(data)
+	var chunks int
+	for _, rg := range regions {
+		for written := int64(0); written < rg.length; {
+			if err := w.closeGz(); err != nil {
+				return err
+			}
+			chunkSize := int64(w.chunkSize())
+			if remain := rg.length - written; remain < chunkSize {
+				chunkSize = remain
+			}
+			if chunks > 0 {
+				ent = &TOCEntry{
+					Name: h.Name,
+					Type: "chunk",
+				}
+			}
+			ent.Offset = w.cw.n
+			ent.ChunkOffset = rg.offset + written
+			ent.ChunkSize = chunkSize
+			chunkDigest := digest.Canonical.Digester()
+			if err := w.condOpenGz(); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(sw, io.TeeReader(br, chunkDigest.Hash()), chunkSize); err != nil {
+				return fmt.Errorf("error copying %q: %v", h.Name, err)
+			}
+			ent.ChunkDigest = chunkDigest.Digest().String()
+			w.toc.Entries = append(w.toc.Entries, ent)
+			written += chunkSize
+			chunks++
+		}
 	}
-	if slen := binary.LittleEndian.Uint16(subfieldlen); slen != uint16(16+len("STARGZ")) {
-		return 0, fmt.Errorf("invalid length of subfield %d; want %d", slen, 16+len("STARGZ"))
+	if chunks == 0 {
+		w.toc.Entries = append(w.toc.Entries, ent)
 	}
-	if string(subfield[16:]) != "STARGZ" {
-		return 0, fmt.Errorf("STARGZ magic string must be included in the footer subfield")
+	return sw.Close()
+}
+
+// resetChunker prepares content-defined chunking of the payload read from r.
+// The returned reader must be used for reading the payload.
+func (w *Writer) resetChunker(r io.Reader) io.Reader {
+	if w.chunker == nil || w.chunker.maxSize != w.chunkSize() {
+		w.chunker = newContentDefinedChunker(w.chunkSize())
+		w.chunkerBr = bufio.NewReaderSize(r, w.chunkSize())
+	} else {
+		w.chunkerBr.Reset(r)
 	}
-	return strconv.ParseInt(string(subfield[:16]), 16, 64)
+	return w.chunkerBr
 }
 
-func parseLegacyFooter(p []byte) (tocOffset int64, err error) {
-	if len(p) != legacyFooterSize {
-		return 0, fmt.Errorf("legacy: invalid length %d cannot be parsed", len(p))
+// nextChunkSize returns the size of the next content-defined chunk of the
+// payload of which remain bytes are left unread.
+func (w *Writer) nextChunkSize(remain int64) (int64, error) {
+	n := w.chunkSize()
+	if remain < int64(n) {
+		n = int(remain)
 	}
-	zr, err := gzip.NewReader(bytes.NewReader(p))
+	p, err := w.chunkerBr.Peek(n)
 	if err != nil {
-		return 0, errors.Wrapf(err, "legacy: failed to get footer gzip reader")
-	}
-	extra := zr.Header.Extra
-	if len(extra) != 16+len("STARGZ") {
-		return 0, fmt.Errorf("legacy: invalid stargz's extra field size")
-	}
-	if string(extra[16:]) != "STARGZ" {
-		return 0, fmt.Errorf("legacy: magic string STARGZ not found")
+		return 0, err
 	}
-	return strconv.ParseInt(string(extra[:16]), 16, 64)
+	return int64(w.chunker.cut(p)), nil
+}
+
+// DiffID returns the SHA-256 of the uncompressed tar bytes.
+// It is only valid to call DiffID after Close.
+func (w *Writer) DiffID() string {
+	return fmt.Sprintf("sha256:%x", w.diffHash.Sum(nil))
 }
 
 func formatModtime(t time.Time) string {
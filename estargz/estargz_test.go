@@ -27,15 +27,21 @@ import (
 	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"reflect"
 	"sort"
 	"strings"
 	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
 )
 
 var allowedPrefix = [4]string{"", "./", "/", "../"}
@@ -56,17 +62,50 @@ func TestFooter(t *testing.T) {
 	}
 }
 
+// Tests that the footer is byte-identical to the one emitted by compress/gzip
+// with gzip.NoCompression in the past, so that existing blobs keep the same digests.
+func TestFooterBytes(t *testing.T) {
+	tests := []struct {
+		off  int64
+		want string
+	}{
+		{
+			off: 0,
+			want: "1f8b08040000000000ff1a00" + "5347" + "1600" +
+				hex.EncodeToString([]byte("0000000000000000STARGZ")) +
+				"010000ffff" + "00000000" + "00000000",
+		},
+		{
+			off: 0x123456789abcdef,
+			want: "1f8b08040000000000ff1a00" + "5347" + "1600" +
+				hex.EncodeToString([]byte("0123456789abcdefSTARGZ")) +
+				"010000ffff" + "00000000" + "00000000",
+		},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(footerBytes(tt.off)); got != tt.want {
+			t.Errorf("footer of offset %d = %s; want %s", tt.off, got, tt.want)
+		}
+	}
+	wantLegacy := "1f8b08040000000000ff1600" +
+		hex.EncodeToString([]byte("0000000000001234STARGZ")) +
+		"010000ffff" + "00000000" + "00000000"
+	if got := hex.EncodeToString(legacyFooterBytes(0x1234)); got != wantLegacy {
+		t.Errorf("legacy footer = %s; want %s", got, wantLegacy)
+	}
+}
+
 func checkFooter(t *testing.T, off int64) {
 	footer := footerBytes(off)
 	if len(footer) != FooterSize {
 		t.Fatalf("for offset %v, footer length was %d, not expected %d. got bytes: %q", off, len(footer), FooterSize, footer)
 	}
-	got, size, err := parseFooter(footer)
+	d, _, got, _, err := parseFooter(footer, gzipDecompressors())
 	if err != nil {
 		t.Fatalf("failed to parse footer for offset %d, footer: %x: err: %v",
 			off, footer, err)
 	}
-	if size != FooterSize {
+	if size := d.FooterSize(); size != FooterSize {
 		t.Fatalf("invalid footer size %d; want %d", size, FooterSize)
 	}
 	if got != off {
@@ -80,12 +119,12 @@ func checkLegacyFooter(t *testing.T, off int64) {
 	if len(footer) != legacyFooterSize {
 		t.Fatalf("for offset %v, footer length was %d, not expected %d. got bytes: %q", off, len(footer), legacyFooterSize, footer)
 	}
-	got, size, err := parseFooter(footer)
+	d, _, got, _, err := parseFooter(footer, gzipDecompressors())
 	if err != nil {
 		t.Fatalf("failed to parse legacy footer for offset %d, footer: %x: err: %v",
 			off, footer, err)
 	}
-	if size != legacyFooterSize {
+	if size := d.FooterSize(); size != legacyFooterSize {
 		t.Fatalf("invalid legacy footer size %d; want %d", size, legacyFooterSize)
 	}
 	if got != off {
@@ -95,14 +134,11 @@ func checkLegacyFooter(t *testing.T, off int64) {
 }
 
 func legacyFooterBytes(tocOff int64) []byte {
-	buf := bytes.NewBuffer(make([]byte, 0, legacyFooterSize))
-	gz, _ := gzip.NewWriterLevel(buf, gzip.NoCompression)
-	gz.Header.Extra = []byte(fmt.Sprintf("%016xSTARGZ", tocOff))
-	gz.Close()
-	if buf.Len() != legacyFooterSize {
-		panic(fmt.Sprintf("footer buffer = %d, not %d", buf.Len(), legacyFooterSize))
+	footer := emptyGzipWithExtra([]byte(fmt.Sprintf("%016xSTARGZ", tocOff)))
+	if len(footer) != legacyFooterSize {
+		panic(fmt.Sprintf("footer buffer = %d, not %d", len(footer), legacyFooterSize))
 	}
-	return buf.Bytes()
+	return footer
 }
 
 func TestWriteAndOpen(t *testing.T) {
@@ -290,7 +326,7 @@ func TestWriteAndOpen(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		for _, cl := range compressionLevels {
+		for _, cl := range testCompressions() {
 			cl := cl
 			for _, prefix := range allowedPrefix {
 				prefix := prefix
@@ -298,31 +334,42 @@ func TestWriteAndOpen(t *testing.T) {
 					tr, cancel := buildTar(t, tt.in, prefix)
 					defer cancel()
 					var stargzBuf bytes.Buffer
-					w := NewWriterLevel(&stargzBuf, cl)
+					w := NewWriterWithCompressor(&stargzBuf, cl)
 					w.ChunkSize = tt.chunkSize
 					if err := w.AppendTar(tr); err != nil {
 						t.Fatalf("Append: %v", err)
 					}
-					if _, err := w.Close(); err != nil {
+					tocDigest, err := w.Close()
+					if err != nil {
 						t.Fatalf("Writer.Close: %v", err)
 					}
 					b := stargzBuf.Bytes()
 
 					diffID := w.DiffID()
-					wantDiffID := diffIDOfGz(t, b)
+					wantDiffID := cl.diffIDOf(t, b)
 					if diffID != wantDiffID {
 						t.Errorf("DiffID = %q; want %q", diffID, wantDiffID)
 					}
 
-					got := countGzStreams(t, b)
+					got := cl.countStreams(t, b)
 					if got != tt.wantNumGz {
-						t.Errorf("number of gzip streams = %d; want %d", got, tt.wantNumGz)
+						t.Errorf("number of streams = %d; want %d", got, tt.wantNumGz)
 					}
 
-					r, err := Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))))
+					sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+					if _, ok := cl.(storeCompression); ok {
+						// The footer of non-gzip blob must not be recognized by default.
+						if _, err := Open(sr); err == nil {
+							t.Fatalf("stargz.Open succeeded without the decompressor")
+						}
+					}
+					r, err := Open(sr, WithDecompressors(cl))
 					if err != nil {
 						t.Fatalf("stargz.Open: %v", err)
 					}
+					if r.tocDigest != tocDigest {
+						t.Errorf("TOC digest = %q; want %q", r.tocDigest, tocDigest)
+					}
 					for _, want := range tt.want {
 						want.check(t, r)
 					}
@@ -372,6 +419,245 @@ func countGzStreams(t *testing.T, b []byte) (numStreams int) {
 	}
 }
 
+// testCompression is a Compression with helpers to inspect the blob created by it.
+type testCompression interface {
+	Compression
+	fmt.Stringer
+
+	// countStreams returns the number of compressed streams in the blob.
+	countStreams(t *testing.T, b []byte) int
+
+	// diffIDOf returns the digest of the uncompressed tar stream of the blob.
+	diffIDOf(t *testing.T, b []byte) string
+}
+
+// testCompressions returns gzip-based compressions with all compression levels
+// as well as storeCompression which has the different footer and TOC layout.
+func testCompressions() (c []testCompression) {
+	for _, cl := range compressionLevels {
+		c = append(c, gzipTestCompression{NewGzipCompressionWithLevel(cl), cl})
+	}
+	return append(c, storeCompression{})
+}
+
+type gzipTestCompression struct {
+	Compression
+	level int
+}
+
+func (tc gzipTestCompression) String() string {
+	return fmt.Sprintf("gzip-level=%d", tc.level)
+}
+
+// StoreWriter exposes StoreCompressor of the underlying compression.
+func (tc gzipTestCompression) StoreWriter(w io.Writer) (io.WriteCloser, error) {
+	return tc.Compression.(StoreCompressor).StoreWriter(w)
+}
+
+func (tc gzipTestCompression) countStreams(t *testing.T, b []byte) int {
+	return countGzStreams(t, b)
+}
+
+func (tc gzipTestCompression) diffIDOf(t *testing.T, b []byte) string {
+	return diffIDOfGz(t, b)
+}
+
+const (
+	storeDataFrame      = 'D'
+	storeSkippableFrame = 'S'
+	storeFrameHeader    = 1 + 4 // frame type + big-endian uint32 payload size
+	storeFooterMagic    = "ESGZSTOR"
+	storeFooterSize     = storeFrameHeader + 8 + 8 + len(storeFooterMagic)
+)
+
+// storeCompression is a Compression which stores each chunk in an uncompressed
+// length-prefixed frame. Skippable frames aren't part of the uncompressed stream.
+// The TOC is stored in a data frame and the footer is a skippable frame which
+// contains the offset and the size of the TOC followed by the magic string.
+type storeCompression struct{}
+
+func (sc storeCompression) String() string { return "store" }
+
+func (sc storeCompression) Writer(w io.Writer) (io.WriteCloser, error) {
+	return &storeFrameWriter{w: w}, nil
+}
+
+func (sc storeCompression) WriteTOCAndFooter(w io.Writer, off int64, toc *JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := MarshalTOC(toc)
+	if err != nil {
+		return "", err
+	}
+	tocTar := new(bytes.Buffer)
+	tw := tar.NewWriter(tocTar)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     TOCTarName,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if len(toc.Signature) > 0 {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     TOCSignatureTarName,
+			Size:     int64(len(toc.Signature)),
+		}); err != nil {
+			return "", err
+		}
+		if _, err := tw.Write(toc.Signature); err != nil {
+			return "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if diffHash != nil {
+		diffHash.Write(tocTar.Bytes())
+	}
+	if err := writeStoreFrame(w, storeDataFrame, tocTar.Bytes()); err != nil {
+		return "", err
+	}
+	footer := make([]byte, storeFooterSize-storeFrameHeader)
+	binary.BigEndian.PutUint64(footer[0:8], uint64(off))
+	binary.BigEndian.PutUint64(footer[8:16], uint64(storeFrameHeader+tocTar.Len()))
+	copy(footer[16:], storeFooterMagic)
+	if err := writeStoreFrame(w, storeSkippableFrame, footer); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(tocJSON), nil
+}
+
+func (sc storeCompression) Reader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(&storeFrameReader{r: r}), nil
+}
+
+func (sc storeCompression) FooterSize() int64 {
+	return int64(storeFooterSize)
+}
+
+func (sc storeCompression) ParseFooter(p []byte) (blobPayloadSize, tocOffset, tocSize int64, err error) {
+	if len(p) != storeFooterSize {
+		return 0, 0, 0, fmt.Errorf("store: invalid footer size %d", len(p))
+	}
+	if p[0] != storeSkippableFrame ||
+		binary.BigEndian.Uint32(p[1:storeFrameHeader]) != uint32(storeFooterSize-storeFrameHeader) {
+		return 0, 0, 0, fmt.Errorf("store: footer isn't a skippable frame")
+	}
+	p = p[storeFrameHeader:]
+	if string(p[16:]) != storeFooterMagic {
+		return 0, 0, 0, fmt.Errorf("store: magic string not found")
+	}
+	tocOffset = int64(binary.BigEndian.Uint64(p[0:8]))
+	return tocOffset, tocOffset, int64(binary.BigEndian.Uint64(p[8:16])), nil
+}
+
+func (sc storeCompression) ParseTOC(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error) {
+	tr := tar.NewReader(&storeFrameReader{r: r})
+	h, err := tr.Next()
+	if err != nil {
+		return nil, "", err
+	}
+	if h.Name != TOCTarName {
+		return nil, "", fmt.Errorf("store: unexpected TOC name %q", h.Name)
+	}
+	tocBytes, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, "", err
+	}
+	if toc, err = UnmarshalTOC(tocBytes); err != nil {
+		return nil, "", err
+	}
+	if h, err := tr.Next(); err == nil && h.Name == TOCSignatureTarName {
+		if toc.Signature, err = ioutil.ReadAll(tr); err != nil {
+			return nil, "", err
+		}
+	}
+	return toc, digest.FromBytes(tocBytes), nil
+}
+
+func (sc storeCompression) countStreams(t *testing.T, b []byte) (numStreams int) {
+	for len(b) > 0 {
+		if len(b) < storeFrameHeader {
+			t.Fatalf("countStreams: truncated frame header")
+		}
+		size := int(binary.BigEndian.Uint32(b[1:storeFrameHeader]))
+		t.Logf("  [%d] frame type %q, size %d", numStreams, b[0], size)
+		b = b[storeFrameHeader+size:]
+		numStreams++
+	}
+	return
+}
+
+func (sc storeCompression) diffIDOf(t *testing.T, b []byte) string {
+	h := sha256.New()
+	if _, err := io.Copy(h, &storeFrameReader{r: bytes.NewReader(b)}); err != nil {
+		t.Fatalf("diffIDOf(store).Copy: %v", err)
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
+
+func writeStoreFrame(w io.Writer, typ byte, p []byte) error {
+	var h [storeFrameHeader]byte
+	h[0] = typ
+	binary.BigEndian.PutUint32(h[1:], uint32(len(p)))
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+type storeFrameWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (fw *storeFrameWriter) Write(p []byte) (int, error) { return fw.buf.Write(p) }
+
+func (fw *storeFrameWriter) Close() error {
+	return writeStoreFrame(fw.w, storeDataFrame, fw.buf.Bytes())
+}
+
+type storeFrameReader struct {
+	r      io.Reader
+	remain int64
+}
+
+func (fr *storeFrameReader) Read(p []byte) (int, error) {
+	for fr.remain == 0 {
+		var h [storeFrameHeader]byte
+		if _, err := io.ReadFull(fr.r, h[:]); err != nil {
+			return 0, err
+		}
+		size := int64(binary.BigEndian.Uint32(h[1:]))
+		switch h[0] {
+		case storeDataFrame:
+			fr.remain = size
+		case storeSkippableFrame:
+			if _, err := io.CopyN(ioutil.Discard, fr.r, size); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("store: unknown frame type %q", h[0])
+		}
+	}
+	if int64(len(p)) > fr.remain {
+		p = p[:fr.remain]
+	}
+	n, err := fr.r.Read(p)
+	fr.remain -= int64(n)
+	if err == io.EOF {
+		if fr.remain > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
 func digestFor(content string) string {
 	sum := sha256.Sum256([]byte(content))
 	return fmt.Sprintf("sha256:%x", sum)
@@ -735,12 +1021,15 @@ func file(name, contents string, opts ...interface{}) tarEntry {
 	return tarEntryFunc(func(tw *tar.Writer, prefix string) error {
 		var xattrs xAttr
 		var o owner
+		var mtime time.Time
 		for _, opt := range opts {
 			switch v := opt.(type) {
 			case xAttr:
 				xattrs = v
 			case owner:
 				o = v
+			case time.Time:
+				mtime = v
 			default:
 				return errors.New("unsupported opt")
 			}
@@ -753,6 +1042,7 @@ func file(name, contents string, opts ...interface{}) tarEntry {
 			Name:     prefix + name,
 			Mode:     0644,
 			Xattrs:   xattrs,
+			ModTime:  mtime,
 			Size:     int64(len(contents)),
 			Uid:      o.uid,
 			Gid:      o.gid,
@@ -874,3 +1164,63 @@ func regularFileReader(name string, size int64, chunkSize int64) (*TOCEntry, *Re
 		chunks: map[string][]*TOCEntry{name: chunks},
 	}
 }
+
+type readCountReaderAt struct {
+	ra    io.ReaderAt
+	reads int
+}
+
+func (r *readCountReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.reads++
+	return r.ra.ReadAt(p, off)
+}
+
+func TestOpenWithTailFetchSize(t *testing.T) {
+	for _, cl := range testCompressions() {
+		cl := cl
+		t.Run(fmt.Sprintf("compression=%v", cl), func(t *testing.T) {
+			blob, err := Build(buildTarStatic(t, tarOf(
+				dir("foo/"),
+				file("foo/bar", "barbarbar"),
+			), ""), WithCompression(cl))
+			if err != nil {
+				t.Fatalf("failed to build: %v", err)
+			}
+			defer blob.Close()
+			b, err := ioutil.ReadAll(blob)
+			if err != nil {
+				t.Fatalf("failed to read blob: %v", err)
+			}
+			_, _, tocOff, _, err := openFooter(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), []Decompressor{cl})
+			if err != nil {
+				t.Fatalf("failed to parse footer: %v", err)
+			}
+			if want := int64(len(b)) - tocOff; blob.TOCSize() != want {
+				t.Errorf("TOCSize() = %d; want %d", blob.TOCSize(), want)
+			}
+			for _, tt := range []struct {
+				tailFetchSize int64
+				wantReads     int
+			}{
+				{0, 2},
+				{10, 2},
+				{blob.TOCSize() - 1, 2},
+				{blob.TOCSize(), 1},
+				{1 << 20, 1},
+			} {
+				ra := &readCountReaderAt{ra: bytes.NewReader(b)}
+				r, err := Open(io.NewSectionReader(ra, 0, int64(len(b))),
+					WithDecompressors(cl), WithTailFetchSize(tt.tailFetchSize))
+				if err != nil {
+					t.Fatalf("failed to open with tail fetch size %d: %v", tt.tailFetchSize, err)
+				}
+				if _, err := r.VerifyTOC(blob.TOCDigest()); err != nil {
+					t.Errorf("failed to verify TOC with tail fetch size %d: %v", tt.tailFetchSize, err)
+				}
+				if ra.reads != tt.wantReads {
+					t.Errorf("tail fetch size %d: %d reads; want %d", tt.tailFetchSize, ra.reads, tt.wantReads)
+				}
+			}
+		})
+	}
+}
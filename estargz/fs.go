@@ -0,0 +1,301 @@
+//go:build go1.16
+// +build go1.16
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxSymlinks is the maximum number of symlinks followed while resolving a
+// path in FS.
+const maxSymlinks = 255
+
+// FS returns the file system in the blob as fs.FS. The returned value also
+// implements fs.ReadDirFS, fs.StatFS and fs.ReadFileFS.
+//
+// Open, Stat and ReadFile follow symlinks in the same way as os.DirFS except
+// that absolute symlinks and ".." are resolved inside the blob (i.e. the root
+// of the blob is treated as "/"). Entries returned by ReadDir describe
+// symlinks themselves and Lstat and ReadLink methods are provided for
+// inspecting them. Hardlinks are seen as their targets. Files other than
+// directories and regular files (e.g. devices) read as empty.
+//
+// The blob is a single layer so whiteouts (".wh." prefixed files) are
+// exposed as is, without hiding any files. Entries specific to eStargz (i.e.
+// landmarks and tar-split metadata) are hidden. See PlainTar for the tar view
+// of the same contents.
+func (r *Reader) FS() fs.FS {
+	return &readerFS{r}
+}
+
+type readerFS struct {
+	r *Reader
+}
+
+var (
+	_ fs.ReadDirFS  = &readerFS{}
+	_ fs.StatFS     = &readerFS{}
+	_ fs.ReadFileFS = &readerFS{}
+)
+
+func (fsys *readerFS) Open(name string) (fs.File, error) {
+	e, p, err := fsys.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	fi := namedFileInfo{fileInfo{e}, fsBase(name)}
+	if e.Type == "dir" {
+		return &fsDir{fsys: fsys, fi: fi, path: name, dir: p}, nil
+	}
+	f := &fsFile{fi: fi, SectionReader: io.NewSectionReader(strings.NewReader(""), 0, 0)}
+	if e.Type == "reg" {
+		sr, err := fsys.r.OpenFile(p)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		f.SectionReader = sr
+	}
+	return f, nil
+}
+
+func (fsys *readerFS) Stat(name string) (fs.FileInfo, error) {
+	e, _, err := fsys.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return namedFileInfo{fileInfo{e}, fsBase(name)}, nil
+}
+
+func (fsys *readerFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, p, err := fsys.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if e.Type != "dir" {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return fsys.readDir(p), nil
+}
+
+func (fsys *readerFS) ReadFile(name string) ([]byte, error) {
+	e, p, err := fsys.resolve("read", name, true)
+	if err != nil {
+		return nil, err
+	}
+	switch e.Type {
+	case "dir":
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	case "reg":
+		sr, err := fsys.r.OpenFile(p)
+		if err != nil {
+			return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+		}
+		b := make([]byte, e.Size)
+		if _, err := io.ReadFull(sr, b); err != nil {
+			return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+		}
+		return b, nil
+	}
+	return []byte{}, nil
+}
+
+// Lstat returns the FileInfo of the file at name without following the
+// symlink at name.
+func (fsys *readerFS) Lstat(name string) (fs.FileInfo, error) {
+	e, _, err := fsys.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return namedFileInfo{fileInfo{e}, fsBase(name)}, nil
+}
+
+// ReadLink returns the target of the symlink at name.
+func (fsys *readerFS) ReadLink(name string) (string, error) {
+	e, _, err := fsys.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if e.Type != "symlink" {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return e.LinkName, nil
+}
+
+// resolve returns the entry at name and the path of the entry in the blob.
+// Symlinks in the parent directories of name are followed. The symlink at name
+// is followed only if follow is true.
+func (fsys *readerFS) resolve(op, name string, follow bool) (*TOCEntry, string, error) {
+	if !fs.ValidPath(name) {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	var (
+		resolved []string
+		rest     = strings.Split(name, "/")
+		links    int
+	)
+	for len(rest) > 0 {
+		elem := rest[0]
+		rest = rest[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		p := path.Join(append(resolved, elem)...)
+		e, ok := fsys.r.m[p]
+		if !ok || fsys.hidden(p) {
+			return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if e.Type == "symlink" && (follow || len(rest) > 0) {
+			if links++; links > maxSymlinks {
+				return nil, "", &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+			}
+			if strings.HasPrefix(e.LinkName, "/") {
+				resolved = nil
+			}
+			rest = append(strings.Split(e.LinkName, "/"), rest...)
+			continue
+		}
+		if e, ok := fsys.r.Lookup(p); !ok || (len(rest) > 0 && e.Type != "dir") {
+			return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		resolved = append(resolved, elem)
+	}
+	p := path.Join(resolved...)
+	e, ok := fsys.r.Lookup(p)
+	if !ok {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, p, nil
+}
+
+// readDir returns the entries of the directory at p sorted by name.
+func (fsys *readerFS) readDir(p string) []fs.DirEntry {
+	dir, _ := fsys.r.Lookup(p)
+	var ents []fs.DirEntry
+	dir.ForeachChild(func(baseName string, ent *TOCEntry) bool {
+		if fsys.hidden(path.Join(p, baseName)) {
+			return true
+		}
+		if ent.Type == "hardlink" {
+			if target, ok := fsys.r.Lookup(ent.Name); ok {
+				ent = target
+			}
+		}
+		ents = append(ents, fsDirEntry{namedFileInfo{fileInfo{ent}, baseName}})
+		return true
+	})
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name() < ents[j].Name() })
+	return ents
+}
+
+func (fsys *readerFS) hidden(p string) bool {
+	switch p {
+	case PrefetchLandmark, NoPrefetchLandmark, TarSplitName:
+		return true
+	}
+	return false
+}
+
+// namedFileInfo is fileInfo named by the path it is opened with, which can
+// differ from the entry (e.g. hardlinks and symlinks).
+type namedFileInfo struct {
+	fileInfo
+	name string
+}
+
+func (fi namedFileInfo) Name() string { return fi.name }
+
+// fsDirEntry is an entry of a directory in FS. The entry describes the
+// symlink itself if the entry is a symlink.
+type fsDirEntry struct {
+	fi namedFileInfo
+}
+
+func (d fsDirEntry) Name() string               { return d.fi.Name() }
+func (d fsDirEntry) IsDir() bool                { return d.fi.IsDir() }
+func (d fsDirEntry) Type() fs.FileMode          { return d.fi.Mode().Type() }
+func (d fsDirEntry) Info() (fs.FileInfo, error) { return d.fi, nil }
+
+func fsBase(name string) string {
+	if name == "." {
+		return name
+	}
+	return path.Base(name)
+}
+
+// fsFile is a non-directory file opened in FS. Files other than regular files
+// are empty.
+type fsFile struct {
+	*io.SectionReader
+	fi namedFileInfo
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.fi, nil }
+
+func (f *fsFile) Close() error { return nil }
+
+// fsDir is a directory opened in FS.
+type fsDir struct {
+	fsys *readerFS
+	fi   namedFileInfo
+	path string
+	dir  string // path of the directory in the blob
+
+	ents []fs.DirEntry // nil until ReadDir is called
+	off  int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.fi, nil }
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: errors.New("is a directory")}
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.ents == nil {
+		d.ents = append([]fs.DirEntry{}, d.fsys.readDir(d.dir)...)
+	}
+	rest := d.ents[d.off:]
+	if n <= 0 {
+		d.off = len(d.ents)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
+
+func (d *fsDir) Close() error { return nil }
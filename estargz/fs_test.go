@@ -0,0 +1,139 @@
+//go:build go1.16
+// +build go1.16
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	large := longstring(3000)
+	ents := tarOf(
+		dir("etc/"),
+		file("etc/hosts", "127.0.0.1 localhost"),
+		symlink("etc/localhosts", "/etc/hosts"),
+		dir("usr/"),
+		dir("usr/lib/"),
+		file("usr/lib/large", large),
+		link("usr/lib/hardlink", "usr/lib/large"),
+		symlink("lib", "usr/lib"),
+		symlink("usr/up", "../etc/hosts"),
+		fifo("usr/fifo"),
+		file("usr/.wh.deleted", ""),
+	)
+	fsys := fsOf(t, ents, WithChunkSize(1000), WithPrioritizedFiles([]string{"etc/hosts"}), WithTarSplit())
+
+	if err := fstest.TestFS(fsys,
+		"etc/hosts", "etc/localhosts", "lib", "usr/lib/large", "usr/lib/hardlink", "usr/up", "usr/fifo", "usr/.wh.deleted"); err != nil {
+		t.Fatalf("TestFS: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"etc/hosts":        "127.0.0.1 localhost",
+		"etc/localhosts":   "127.0.0.1 localhost",
+		"usr/up":           "127.0.0.1 localhost",
+		"lib/large":        large,
+		"lib/hardlink":     large,
+		"usr/lib/hardlink": large,
+		"usr/fifo":         "",
+	} {
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("unexpected contents of %q", name)
+		}
+	}
+
+	root, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatalf("failed to read root directory: %v", err)
+	}
+	var names []string
+	for _, d := range root {
+		names = append(names, d.Name())
+		if d.Name() == "lib" && d.Type() != fs.ModeSymlink {
+			t.Errorf("type of symlink %q = %v; want symlink", d.Name(), d.Type())
+		}
+	}
+	if want := []string{"etc", "lib", "usr"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("root directory = %v; want %v (eStargz entries must be hidden)", names, want)
+	}
+	if fi, err := fs.Stat(fsys, "lib"); err != nil || !fi.IsDir() || fi.Name() != "lib" {
+		t.Errorf("Stat of symlink to directory = (%v, %v); want directory named lib", fi, err)
+	}
+	lfs := fsys.(interface {
+		Lstat(name string) (fs.FileInfo, error)
+		ReadLink(name string) (string, error)
+	})
+	if fi, err := lfs.Lstat("lib"); err != nil || fi.Mode().Type() != fs.ModeSymlink {
+		t.Errorf("Lstat of symlink = (%v, %v); want symlink", fi, err)
+	}
+	if target, err := lfs.ReadLink("etc/localhosts"); err != nil || target != "/etc/hosts" {
+		t.Errorf("ReadLink = (%q, %v); want /etc/hosts", target, err)
+	}
+	for _, name := range []string{PrefetchLandmark, TarSplitName, "etc/hosts/x", "../etc", "/etc"} {
+		if _, err := fsys.Open(name); err == nil {
+			t.Errorf("opening %q must fail", name)
+		}
+	}
+	if _, err := fsys.Open("notexist"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("opening non-existent file = %v; want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestFSSymlinkLoop(t *testing.T) {
+	fsys := fsOf(t, tarOf(
+		symlink("loop1", "loop2"),
+		symlink("loop2", "/loop1"),
+	))
+	if _, err := fs.Stat(fsys, "loop1"); err == nil {
+		t.Errorf("stat of symlink loop must fail")
+	}
+	ents, err := fs.ReadDir(fsys, ".")
+	if err != nil || len(ents) != 2 {
+		t.Errorf("ReadDir of symlink loops = (%v, %v); want 2 entries", ents, err)
+	}
+}
+
+func fsOf(t *testing.T, ents []tarEntry, opts ...Option) fs.FS {
+	blob, err := Build(buildTarStatic(t, ents, ""), opts...)
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	defer blob.Close()
+	b, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	r, err := Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))))
+	if err != nil {
+		t.Fatalf("failed to open blob: %v", err)
+	}
+	return r.FS()
+}
@@ -3,6 +3,7 @@ module github.com/containerd/stargz-snapshotter/estargz
 go 1.15
 
 require (
+	github.com/klauspost/compress v1.11.3
 	github.com/opencontainers/go-digest v1.0.0
 	github.com/pkg/errors v0.9.1
 	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
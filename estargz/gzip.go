@@ -0,0 +1,298 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+   Copyright 2019 The Go Authors. All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// GzipCompression is the gzip-based Compression used by eStargz by default.
+type GzipCompression struct {
+	*GzipCompressor
+	*GzipDecompressor
+}
+
+// NewGzipCompressionWithLevel returns a gzip-based Compression with the
+// specified compression level.
+func NewGzipCompressionWithLevel(level int) Compression {
+	return &GzipCompression{
+		&GzipCompressor{level},
+		&GzipDecompressor{},
+	}
+}
+
+// NewGzipCompressor returns a gzip-based Compressor with gzip.BestCompression.
+func NewGzipCompressor() *GzipCompressor {
+	return &GzipCompressor{gzip.BestCompression}
+}
+
+// NewGzipCompressorWithLevel returns a gzip-based Compressor with the
+// specified compression level.
+func NewGzipCompressorWithLevel(level int) *GzipCompressor {
+	return &GzipCompressor{level}
+}
+
+// GzipCompressor is a Compressor which writes each chunk as a gzip member.
+type GzipCompressor struct {
+	compressionLevel int
+}
+
+// Writer implements Compressor.Writer. Each chunk is written as a gzip member.
+func (gc *GzipCompressor) Writer(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, gc.compressionLevel)
+}
+
+// StoreWriter implements StoreCompressor.StoreWriter. Each chunk is written
+// as a gzip member containing stored-only deflate blocks.
+func (gc *GzipCompressor) StoreWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, gzip.NoCompression)
+}
+
+// WriteTOCAndFooter implements Compressor.WriteTOCAndFooter. The TOC
+// serialized by MarshalTOC is written as a tar entry named TOCTarName in a
+// gzip member, followed by the 51 bytes footer. If the TOC is signed, the
+// signature is written as a tar entry named TOCSignatureTarName following the
+// TOC in the same gzip member.
+func (gc *GzipCompressor) WriteTOCAndFooter(w io.Writer, off int64, toc *JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := MarshalTOC(toc)
+	if err != nil {
+		return "", err
+	}
+	gz, err := gzip.NewWriterLevel(w, gc.compressionLevel)
+	if err != nil {
+		return "", err
+	}
+	gw := io.Writer(gz)
+	if diffHash != nil {
+		gw = io.MultiWriter(gz, diffHash)
+	}
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     TOCTarName,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if len(toc.Signature) > 0 {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     TOCSignatureTarName,
+			Size:     int64(len(toc.Signature)),
+		}); err != nil {
+			return "", err
+		}
+		if _, err := tw.Write(toc.Signature); err != nil {
+			return "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	if _, err := w.Write(footerBytes(off)); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(tocJSON), nil
+}
+
+// GzipDecompressor is a Decompressor for gzip-based eStargz.
+type GzipDecompressor struct{}
+
+// Reader implements Decompressor.Reader.
+func (gz *GzipDecompressor) Reader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// ParseTOC implements Decompressor.ParseTOC.
+func (gz *GzipDecompressor) ParseTOC(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error) {
+	return parseTOCEStargz(r)
+}
+
+// ParseFooter implements Decompressor.ParseFooter. The TOC lasts until the
+// footer so the returned tocSize is always negative.
+func (gz *GzipDecompressor) ParseFooter(p []byte) (blobPayloadSize, tocOffset, tocSize int64, err error) {
+	if len(p) != FooterSize {
+		return 0, 0, 0, fmt.Errorf("invalid length %d cannot be parsed", len(p))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer zr.Close()
+	extra := zr.Header.Extra
+	if len(extra) != 4+16+len("STARGZ") {
+		return 0, 0, 0, fmt.Errorf("invalid extra field size %d", len(extra))
+	}
+	si1, si2, subfieldlen, subfield := extra[0], extra[1], extra[2:4], extra[4:]
+	if si1 != 'S' || si2 != 'G' {
+		return 0, 0, 0, fmt.Errorf("invalid subfield IDs: %q, %q; want E, S", si1, si2)
+	}
+	if slen := binary.LittleEndian.Uint16(subfieldlen); slen != uint16(16+len("STARGZ")) {
+		return 0, 0, 0, fmt.Errorf("invalid length of subfield %d; want %d", slen, 16+len("STARGZ"))
+	}
+	if string(subfield[16:]) != "STARGZ" {
+		return 0, 0, 0, fmt.Errorf("STARGZ magic string must be included in the footer subfield")
+	}
+	tocOffset, err = strconv.ParseInt(string(subfield[:16]), 16, 64)
+	if err != nil {
+		return 0, 0, 0, errors.Wrapf(err, "failed to parse toc offset")
+	}
+	return tocOffset, tocOffset, -1, nil // TOC lasts until the footer
+}
+
+// FooterSize implements Decompressor.FooterSize.
+func (gz *GzipDecompressor) FooterSize() int64 {
+	return FooterSize
+}
+
+// legacyGzipDecompressor is a Decompressor for CRFS-era stargz blobs.
+type legacyGzipDecompressor struct{}
+
+func (gz *legacyGzipDecompressor) Reader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gz *legacyGzipDecompressor) ParseTOC(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error) {
+	return parseTOCEStargz(r)
+}
+
+func (gz *legacyGzipDecompressor) ParseFooter(p []byte) (blobPayloadSize, tocOffset, tocSize int64, err error) {
+	if len(p) != legacyFooterSize {
+		return 0, 0, 0, fmt.Errorf("legacy: invalid length %d cannot be parsed", len(p))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return 0, 0, 0, errors.Wrapf(err, "legacy: failed to get footer gzip reader")
+	}
+	defer zr.Close()
+	extra := zr.Header.Extra
+	if len(extra) != 16+len("STARGZ") {
+		return 0, 0, 0, fmt.Errorf("legacy: invalid stargz's extra field size")
+	}
+	if string(extra[16:]) != "STARGZ" {
+		return 0, 0, 0, fmt.Errorf("legacy: magic string STARGZ not found")
+	}
+	tocOffset, err = strconv.ParseInt(string(extra[:16]), 16, 64)
+	if err != nil {
+		return 0, 0, 0, errors.Wrapf(err, "legacy: failed to parse toc offset")
+	}
+	return tocOffset, tocOffset, -1, nil // TOC lasts until the footer
+}
+
+func (gz *legacyGzipDecompressor) FooterSize() int64 {
+	return legacyFooterSize
+}
+
+func parseTOCEStargz(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("malformed TOC gzip header: %v", err)
+	}
+	defer zr.Close()
+	zr.Multistream(false)
+	tr := tar.NewReader(zr)
+	h, err := tr.Next()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to find tar header in TOC gzip stream: %v", err)
+	}
+	if h.Name != TOCTarName {
+		return nil, "", fmt.Errorf("TOC tar entry had name %q; expected %q", h.Name, TOCTarName)
+	}
+	tocBytes, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read TOC: %v", err)
+	}
+	if toc, err = UnmarshalTOC(tocBytes); err != nil {
+		return nil, "", fmt.Errorf("error decoding TOC: %v", err)
+	}
+	if h, err := tr.Next(); err == nil && h.Name == TOCSignatureTarName {
+		if toc.Signature, err = ioutil.ReadAll(tr); err != nil {
+			return nil, "", fmt.Errorf("failed to read TOC signature: %v", err)
+		}
+	}
+	return toc, digest.FromBytes(tocBytes), nil
+}
+
+// footerBytes returns the 51 bytes footer.
+func footerBytes(tocOff int64) []byte {
+	// Extra header indicating the offset of TOCJSON
+	// https://tools.ietf.org/html/rfc1952#section-2.3.1.1
+	header := make([]byte, 4)
+	header[0], header[1] = 'S', 'G'
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOff)
+	binary.LittleEndian.PutUint16(header[2:4], uint16(len(subfield))) // little-endian per RFC1952
+	footer := emptyGzipWithExtra(append(header, []byte(subfield)...))
+	if len(footer) != FooterSize {
+		panic(fmt.Sprintf("footer buffer = %d, not %d", len(footer), FooterSize))
+	}
+	return footer
+}
+
+// emptyGzipWithExtra returns an empty gzip member which contains the specified
+// Extra field. The member is constructed by hand because the size of the empty
+// stored deflate block emitted by compress/flate for gzip.NoCompression isn't
+// guaranteed across Go versions but the footer MUST have a fixed size.
+//
+// The result is byte-identical to what compress/gzip used to emit with
+// gzip.NoCompression (zero MTIME, zero XFL and OS=unknown), so existing blobs
+// keep the same digests.
+func emptyGzipWithExtra(extra []byte) []byte {
+	const (
+		gzipID1     = 0x1f
+		gzipID2     = 0x8b
+		gzipDeflate = 8
+		flagExtra   = 1 << 2
+		osUnknown   = 0xff
+	)
+	buf := bytes.NewBuffer(make([]byte, 0, 10+2+len(extra)+5+8))
+	buf.Write([]byte{gzipID1, gzipID2, gzipDeflate, flagExtra, 0, 0, 0, 0, 0, osUnknown})
+	var le [4]byte
+	binary.LittleEndian.PutUint16(le[:2], uint16(len(extra)))
+	buf.Write(le[:2])
+	buf.Write(extra)
+	// A final stored deflate block with no data (BFINAL=1, BTYPE=00, LEN=0, NLEN=^0)
+	buf.Write([]byte{0x01, 0x00, 0x00, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(le[:], crc32.ChecksumIEEE(nil))
+	buf.Write(le[:]) // CRC32 of the empty payload
+	binary.LittleEndian.PutUint32(le[:], 0)
+	buf.Write(le[:]) // ISIZE
+	return buf.Bytes()
+}
@@ -0,0 +1,145 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"fmt"
+	"sort"
+)
+
+// prefetchProfile is a profile specified by WithPrefetchProfile.
+type prefetchProfile struct {
+	name  string
+	files []string
+}
+
+// fileRange is the range of the blob storing the chunks of a regular file.
+type fileRange struct {
+	name   string // name of the TOCEntry
+	offset int64
+	size   int64
+}
+
+// fileRangesOf returns the ranges of all regular files with data in the blob,
+// keyed by the cleaned name. tocOffset is the offset of the TOC which is the
+// end of the last compressed stream.
+func fileRangesOf(toc *JTOC, tocOffset int64) map[string]fileRange {
+	var (
+		offsets  []int64
+		starts   = make(map[string]fileRange)
+		lasts    = make(map[string]int64) // offset of the last stream of each file
+		lastName string
+		lastReg  string
+	)
+	for _, e := range toc.Entries {
+		name := cleanEntryName(e.Name)
+		if e.Type == "chunk" {
+			name = lastName
+		} else {
+			lastName, lastReg = name, e.Name
+		}
+		if !(e.Type == "reg" && e.Size > 0 && !(e.Sparse && e.ChunkSize == 0)) && e.Type != "chunk" {
+			continue
+		}
+		offsets = append(offsets, e.Offset)
+		if r, ok := starts[name]; !ok || e.Offset < r.offset {
+			starts[name] = fileRange{name: lastReg, offset: e.Offset}
+		}
+		if l, ok := lasts[name]; !ok || e.Offset > l {
+			lasts[name] = e.Offset
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	ranges := make(map[string]fileRange, len(starts))
+	for name, r := range starts {
+		end := tocOffset
+		if i := sort.Search(len(offsets), func(i int) bool { return offsets[i] > lasts[name] }); i < len(offsets) {
+			end = offsets[i]
+		}
+		r.size = end - r.offset
+		ranges[name] = r
+	}
+	return ranges
+}
+
+// prefetchProfilesOf resolves the files of the profiles to their ranges in the
+// blob. Hardlinks (e.g. deduplicated files) are resolved to their targets.
+// Files that aren't regular files with data in the TOC are skipped as they
+// don't need to be fetched.
+func prefetchProfilesOf(toc *JTOC, tocOffset int64, profiles []prefetchProfile) []*PrefetchProfile {
+	if len(profiles) == 0 {
+		return nil
+	}
+	ranges := fileRangesOf(toc, tocOffset)
+	links := make(map[string]string)
+	for _, e := range toc.Entries {
+		if e.Type == "hardlink" {
+			links[cleanEntryName(e.Name)] = cleanEntryName(e.LinkName)
+		}
+	}
+	var res []*PrefetchProfile
+	for _, p := range profiles {
+		var (
+			rp    = &PrefetchProfile{Name: p.name, Files: []PrefetchFile{}}
+			added = make(map[string]struct{})
+		)
+		for _, f := range p.files {
+			name := cleanEntryName(f)
+			if target, ok := links[name]; ok {
+				name = target
+			}
+			r, ok := ranges[name]
+			if _, dup := added[name]; !ok || dup {
+				continue
+			}
+			added[name] = struct{}{}
+			rp.Files = append(rp.Files, PrefetchFile{Name: r.name, Offset: r.offset, Size: r.size})
+		}
+		res = append(res, rp)
+	}
+	return res
+}
+
+// checkPrefetchProfiles checks the profiles in the TOC refer to existing files
+// with their correct ranges.
+func checkPrefetchProfiles(toc *JTOC, tocOffset int64) (allErr []error) {
+	if len(toc.PrefetchProfiles) == 0 {
+		return nil
+	}
+	var (
+		ranges = fileRangesOf(toc, tocOffset)
+		names  = make(map[string]struct{})
+	)
+	for _, p := range toc.PrefetchProfiles {
+		if p.Name == "" {
+			allErr = append(allErr, fmt.Errorf("prefetch profile must have a name"))
+		} else if _, ok := names[p.Name]; ok {
+			allErr = append(allErr, fmt.Errorf("prefetch profile %q is duplicated", p.Name))
+		}
+		names[p.Name] = struct{}{}
+		for _, f := range p.Files {
+			r, ok := ranges[cleanEntryName(f.Name)]
+			if !ok {
+				allErr = append(allErr, fmt.Errorf("prefetch profile %q: regular file %q with data not found", p.Name, f.Name))
+			} else if f.Offset != r.offset || f.Size != r.size {
+				allErr = append(allErr, fmt.Errorf("prefetch profile %q: range of %q is (%d, %d); want (%d, %d)",
+					p.Name, f.Name, f.Offset, f.Size, r.offset, r.size))
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,217 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestPrefetchProfiles(t *testing.T) {
+	files := map[string]string{
+		"foo/a":     longstring(3000),
+		"foo/b":     longstring(5000),
+		"foo/c":     "small",
+		"foo/d/e":   "small2",
+		"foo/z":     longstring(4000),
+		"foo/empty": "",
+	}
+	ents := tarOf(
+		dir("foo/"),
+		file("foo/a", files["foo/a"]),
+		file("foo/b", files["foo/b"]),
+		file("foo/c", files["foo/c"]),
+		dir("foo/d/"),
+		file("foo/d/e", files["foo/d/e"]),
+		file("foo/empty", files["foo/empty"]),
+		file("foo/z", files["foo/z"]),
+	)
+	wantProfiles := map[string][]string{
+		"web":    {"foo/b", "foo/a"},
+		"worker": {"foo/d/e", "foo/c"},
+	}
+	for _, cl := range testCompressions() {
+		for _, compact := range []bool{false, true} {
+			for _, minChunkSize := range []int{0, 4096} {
+				cl, compact, minChunkSize := cl, compact, minChunkSize
+				t.Run(fmt.Sprintf("compression=%v,compact=%v,minChunkSize=%d", cl, compact, minChunkSize), func(t *testing.T) {
+					opts := []Option{
+						WithCompression(cl), WithChunkSize(1000), WithMinChunkSize(minChunkSize),
+						WithPrioritizedFiles([]string{"foo/a"}),
+						WithPrefetchProfile("web", []string{"foo/b", "/foo/a", "foo/empty", "foo/b"}),
+						WithPrefetchProfile("worker", []string{"foo/d/e", "foo/notexist", "./foo/c"}),
+					}
+					if compact {
+						opts = append(opts, WithCompactTOC())
+					}
+					blob, err := Build(buildTarStatic(t, ents, ""), opts...)
+					if err != nil {
+						t.Fatalf("failed to build: %v", err)
+					}
+					defer blob.Close()
+					b, err := ioutil.ReadAll(blob)
+					if err != nil {
+						t.Fatalf("failed to read blob: %v", err)
+					}
+					sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+					if err := Check(sr, WithCheckDecompressors(cl), WithCheckTOCDigest(blob.TOCDigest())); err != nil {
+						t.Fatalf("failed to check blob: %v", err)
+					}
+					r, err := Open(sr, WithDecompressors(cl))
+					if err != nil {
+						t.Fatalf("failed to open blob: %v", err)
+					}
+					if _, ok := r.PrefetchProfile("notexist"); ok {
+						t.Errorf("unknown profile must not be found")
+					}
+
+					// Files of profiles follow the landmark and precede other files.
+					landmark, ok := r.Lookup(PrefetchLandmark)
+					if !ok {
+						t.Fatalf("landmark not found")
+					}
+					if a := r.m["foo/a"]; a.Offset >= landmark.Offset {
+						t.Errorf("prioritized file must precede the landmark")
+					}
+					for _, name := range []string{"foo/b", "foo/c", "foo/d/e"} {
+						if e := r.m[name]; e.Offset < landmark.Offset || e.Offset >= r.m["foo/z"].Offset {
+							t.Errorf("%q must be placed between the landmark and other files", name)
+						}
+					}
+
+					// Ranges of profiles are enough to read their files.
+					_, _, tocOffset, _, err := openFooter(sr, append(gzipDecompressors(), cl))
+					if err != nil {
+						t.Fatalf("failed to parse footer: %v", err)
+					}
+					for name, want := range wantProfiles {
+						p, ok := r.PrefetchProfile(name)
+						if !ok {
+							t.Fatalf("profile %q not found", name)
+						}
+						var got []string
+						ranges := [][2]int64{{tocOffset, sr.Size()}}
+						for _, f := range p.Files {
+							if off, size, ok := r.FileRange(f.Name); !ok || off != f.Offset || size != f.Size {
+								t.Errorf("range of %q in profile %q is (%d, %d); FileRange returned (%d, %d, %v)",
+									f.Name, name, f.Offset, f.Size, off, size, ok)
+							}
+							got = append(got, cleanEntryName(f.Name))
+							ranges = append(ranges, [2]int64{f.Offset, f.Offset + f.Size})
+						}
+						if !reflect.DeepEqual(got, want) {
+							t.Fatalf("files of profile %q = %v; want %v", name, got, want)
+						}
+						pr, err := Open(io.NewSectionReader(rangeReaderAt{bytes.NewReader(b), ranges}, 0, sr.Size()), WithDecompressors(cl))
+						if err != nil {
+							t.Fatalf("failed to open blob with profile %q: %v", name, err)
+						}
+						for _, f := range want {
+							fr, err := pr.OpenFile(f)
+							if err != nil {
+								t.Fatalf("failed to open %q: %v", f, err)
+							}
+							data, err := ioutil.ReadAll(io.NewSectionReader(fr, 0, r.m[f].Size))
+							if err != nil {
+								t.Fatalf("failed to read %q in profile %q: %v", f, name, err)
+							}
+							if string(data) != files[f] {
+								t.Errorf("unexpected contents of %q", f)
+							}
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// Files missing in the layer are skipped in profiles but missing prioritized
+// files are still errors unless WithAllowPrioritizeNotFound is specified.
+func TestPrefetchProfilesNotFound(t *testing.T) {
+	ents := tarOf(file("foo", "foo"))
+	if _, err := Build(buildTarStatic(t, ents, ""),
+		WithPrioritizedFiles([]string{"notexist"}),
+		WithPrefetchProfile("web", []string{"foo", "notexist"})); err == nil {
+		t.Errorf("missing prioritized file must be an error")
+	}
+	var missed []string
+	blob, err := Build(buildTarStatic(t, ents, ""),
+		WithPrioritizedFiles([]string{"notexist"}),
+		WithPrefetchProfile("web", []string{"foo", "notexist2"}),
+		WithAllowPrioritizeNotFound(&missed))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	blob.Close()
+	if !reflect.DeepEqual(missed, []string{"notexist"}) {
+		t.Errorf("missed files = %v; want [notexist]", missed)
+	}
+}
+
+func TestCheckPrefetchProfiles(t *testing.T) {
+	toc := &JTOC{
+		Entries: []*TOCEntry{
+			{Name: "foo", Type: "dir"},
+			{Name: "foo/a", Type: "reg", Size: 10, Offset: 100, ChunkSize: 5},
+			{Name: "foo/a", Type: "chunk", Offset: 150, ChunkOffset: 5, ChunkSize: 5},
+			{Name: "foo/b", Type: "reg", Size: 10, Offset: 200},
+		},
+	}
+	tests := []struct {
+		name     string
+		profiles []*PrefetchProfile
+		wantErr  bool
+	}{
+		{"valid", []*PrefetchProfile{
+			{Name: "p1", Files: []PrefetchFile{{"foo/b", 200, 100}, {"foo/a", 100, 100}}},
+			{Name: "p2", Files: []PrefetchFile{}},
+		}, false},
+		{"wrong_range", []*PrefetchProfile{{Name: "p1", Files: []PrefetchFile{{"foo/a", 100, 50}}}}, true},
+		{"not_regular", []*PrefetchProfile{{Name: "p1", Files: []PrefetchFile{{"foo", 0, 0}}}}, true},
+		{"not_found", []*PrefetchProfile{{Name: "p1", Files: []PrefetchFile{{"foo/c", 200, 100}}}}, true},
+		{"duplicated_name", []*PrefetchProfile{{Name: "p1"}, {Name: "p1"}}, true},
+		{"no_name", []*PrefetchProfile{{}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			toc.PrefetchProfiles = tt.profiles
+			if errs := checkPrefetchProfiles(toc, 300); (len(errs) > 0) != tt.wantErr {
+				t.Errorf("checkPrefetchProfiles() = %v; want error = %v", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+// rangeReaderAt fails reads outside of the ranges.
+type rangeReaderAt struct {
+	r      io.ReaderAt
+	ranges [][2]int64
+}
+
+func (ra rangeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	for _, r := range ra.ranges {
+		if r[0] <= off && off+int64(len(p)) <= r[1] {
+			return ra.r.ReadAt(p, off)
+		}
+	}
+	return 0, fmt.Errorf("read (%d, %d) is out of ranges %v", off, len(p), ra.ranges)
+}
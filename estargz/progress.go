@@ -0,0 +1,101 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Progress is the progress of Build reported through WithProgress option.
+// TotalEntries and TotalBytes are zero if they are unknown (e.g. BuildFromStream).
+type Progress struct {
+	// Entries is the number of entries compressed so far.
+	Entries int
+
+	// TotalEntries is the number of entries to compress including the ones
+	// added by Build (e.g. landmark files).
+	TotalEntries int
+
+	// Bytes is the number of bytes of the contents compressed so far.
+	Bytes int64
+
+	// TotalBytes is the number of bytes of the contents to compress.
+	TotalBytes int64
+}
+
+// reportProgress makes f called every time the payload of each entry is read
+// until the end.
+func reportProgress(entries []*entry, f func(Progress)) {
+	pr := &progressReporter{f: f}
+	pr.p.TotalEntries = len(entries)
+	for _, e := range entries {
+		pr.p.TotalBytes += e.header.Size
+		e.payload = &progressReader{r: e.payload, pr: pr}
+	}
+}
+
+type progressReporter struct {
+	f  func(Progress)
+	p  Progress
+	mu sync.Mutex
+}
+
+func (pr *progressReporter) add(entries int, n int64) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.p.Entries += entries
+	pr.p.Bytes += n
+	if entries > 0 {
+		pr.f(pr.p)
+	}
+}
+
+// progressReader reports the bytes read from r and the end of r.
+type progressReader struct {
+	r    io.Reader
+	pr   *progressReporter
+	done bool
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF && !r.done {
+		r.done = true
+		r.pr.add(1, int64(n))
+	} else {
+		r.pr.add(0, int64(n))
+	}
+	return n, err
+}
+
+// budgetWriter fails writes once the bytes written by all writers sharing used
+// exceed the budget.
+type budgetWriter struct {
+	w      io.Writer
+	used   *int64
+	budget int64
+}
+
+func (bw *budgetWriter) Write(p []byte) (int, error) {
+	if atomic.AddInt64(bw.used, int64(len(p))) > bw.budget {
+		return 0, fmt.Errorf("disk budget of %d bytes exceeded", bw.budget)
+	}
+	return bw.w.Write(p)
+}
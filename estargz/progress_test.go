@@ -0,0 +1,129 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBuildResourceOptions(t *testing.T) {
+	ents := tarOf(
+		dir("foo/"),
+		file("foo/a", longstring(3000)),
+		file("foo/b", longstring(5000)),
+		file("foo/c", "small"),
+		symlink("foo/d", "c"),
+	)
+	const wantBytes = 3000 + 5000 + len("small") + 1 // with the landmark file
+	build := func(opts ...Option) ([]byte, error) {
+		blob, err := Build(buildTarStatic(t, ents, ""), append([]Option{WithChunkSize(1000)}, opts...)...)
+		if err != nil {
+			return nil, err
+		}
+		defer blob.Close()
+		return ioutil.ReadAll(blob)
+	}
+	want, err := build()
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+
+	t.Run("progress", func(t *testing.T) {
+		var ps []Progress
+		got, err := build(WithProgress(func(p Progress) { ps = append(ps, p) }))
+		if err != nil {
+			t.Fatalf("failed to build: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("progress must not change the blob")
+		}
+		if len(ps) != 6 {
+			t.Fatalf("progress is reported %d times; want 6", len(ps))
+		}
+		var last Progress
+		for _, p := range ps {
+			if p.Entries <= last.Entries || p.Bytes < last.Bytes {
+				t.Errorf("progress %+v must increase from %+v", p, last)
+			}
+			if p.TotalEntries != 6 || p.TotalBytes != int64(wantBytes) {
+				t.Errorf("total of progress %+v; want (6, %d)", p, wantBytes)
+			}
+			last = p
+		}
+		if last.Entries != last.TotalEntries || last.Bytes != last.TotalBytes {
+			t.Errorf("last progress %+v must be complete", last)
+		}
+	})
+
+	t.Run("temp_dir", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir("", "esgztest")
+		if err != nil {
+			t.Fatalf("failed to make temp dir: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+		blob, err := Build(buildTarStatic(t, ents, ""), WithChunkSize(1000), WithTempDir(tempDir))
+		if err != nil {
+			t.Fatalf("failed to build: %v", err)
+		}
+		if files, err := ioutil.ReadDir(tempDir); err != nil || len(files) == 0 {
+			t.Errorf("temporary files must be created in the temp dir (files: %d, err: %v)", len(files), err)
+		}
+		got, err := ioutil.ReadAll(blob)
+		if err != nil {
+			t.Fatalf("failed to read blob: %v", err)
+		}
+		if err := blob.Close(); err != nil {
+			t.Fatalf("failed to close blob: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("temp dir must not change the blob")
+		}
+		if files, err := ioutil.ReadDir(tempDir); err != nil || len(files) != 0 {
+			t.Errorf("temporary files must be removed on close (files: %d, err: %v)", len(files), err)
+		}
+	})
+
+	for _, n := range []int{1, 2} {
+		n := n
+		t.Run(fmt.Sprintf("max_parallelism=%d", n), func(t *testing.T) {
+			got, err := build(WithMaxParallelism(n))
+			if err != nil {
+				t.Fatalf("failed to build: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("parallelism must not change the blob")
+			}
+		})
+	}
+
+	t.Run("disk_budget", func(t *testing.T) {
+		if _, err := build(WithDiskBudget(100)); err == nil {
+			t.Errorf("exceeding the disk budget must fail")
+		}
+		got, err := build(WithDiskBudget(int64(len(want))))
+		if err != nil {
+			t.Fatalf("failed to build within the disk budget: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("disk budget must not change the blob")
+		}
+	})
+}
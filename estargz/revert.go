@@ -0,0 +1,120 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// PlainTar returns the uncompressed tar of the blob without the entries
+// specific to eStargz (i.e. TOC, its signature, landmarks and tar-split
+// metadata) so that it can be compressed into an ordinary tar.gz layer. If the
+// blob contains tar-split metadata describing all entries in the TOC, this
+// returns the original tar the blob was built from (see OriginalTar).
+// Otherwise, headers of the remaining entries are re-encoded so the result can
+// differ from the original tar. See also FS for the file system view of the
+// same contents.
+func (r *Reader) PlainTar() (io.ReadCloser, error) {
+	if _, ok := r.Lookup(TarSplitName); ok && r.checkTarSplit() == nil {
+		return r.tarSplitStream(r.copyFilePayload)
+	}
+	zr, err := r.decompressor.Reader(io.NewSectionReader(r.sr, 0, r.sr.Size()))
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer zr.Close()
+		tr := tar.NewReader(zr)
+		tw := tar.NewWriter(pw)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				pw.CloseWithError(errors.Wrap(err, "failed to read tar"))
+				return
+			}
+			switch cleanEntryName(h.Name) {
+			case TOCTarName, TOCSignatureTarName, PrefetchLandmark, NoPrefetchLandmark, TarSplitName:
+				continue
+			}
+			if isSparseHeader(h) {
+				if err := r.writeSparseFile(tw, pw, h, tr); err != nil {
+					pw.CloseWithError(errors.Wrapf(err, "failed to write sparse file %q", h.Name))
+					return
+				}
+				continue
+			}
+			if err := tw.WriteHeader(h); err != nil {
+				pw.CloseWithError(errors.Wrapf(err, "failed to write header of %q", h.Name))
+				return
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				pw.CloseWithError(errors.Wrapf(err, "failed to write payload of %q", h.Name))
+				return
+			}
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+	return pr, nil
+}
+
+// writeSparseFile writes the sparse file keeping the holes recorded in the TOC.
+// data is the expanded contents of the file.
+func (r *Reader) writeSparseFile(tw *tar.Writer, w io.Writer, h *tar.Header, data io.Reader) error {
+	var regions []sparseRegion
+	for off := int64(0); off < h.Size; {
+		ce, ok := r.ChunkEntryForOffset(h.Name, off)
+		if !ok {
+			next, ok := r.NextDataOffset(h.Name, off)
+			if !ok || next <= off {
+				break
+			}
+			off = next
+			continue
+		}
+		if n := len(regions); n > 0 && regions[n-1].offset+regions[n-1].length == ce.ChunkOffset {
+			regions[n-1].length += ce.ChunkSize
+		} else {
+			regions = append(regions, sparseRegion{ce.ChunkOffset, ce.ChunkSize})
+		}
+		off = ce.ChunkOffset + ce.ChunkSize
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	sw, err := writeSparseHeader(w, h, regions)
+	if err != nil {
+		return err
+	}
+	var pos int64
+	for _, rg := range regions {
+		if _, err := io.CopyN(ioutil.Discard, data, rg.offset-pos); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(sw, data, rg.length); err != nil {
+			return err
+		}
+		pos = rg.offset + rg.length
+	}
+	return sw.Close()
+}
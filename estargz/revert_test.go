@@ -0,0 +1,141 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"testing"
+)
+
+func TestPlainTar(t *testing.T) {
+	for _, cl := range testCompressions() {
+		for _, tarSplit := range []bool{false, true} {
+			for _, sparse := range []bool{false, true} {
+				if tarSplit && sparse {
+					continue // tar-split doesn't support sparse files
+				}
+				cl, tarSplit, sparse := cl, tarSplit, sparse
+				t.Run(fmt.Sprintf("compression=%v,tarSplit=%v,sparse=%v", cl, tarSplit, sparse), func(t *testing.T) {
+					var src []byte
+					if sparse {
+						src = sparseTar(t, false)
+					} else {
+						tr := buildTarStatic(t, tarOf(
+							dir("foo/"),
+							file("foo/a", longstring(3000)),
+							file("foo/bar", "bar"),
+							symlink("foo/c", "bar"),
+							link("foo/d", "foo/bar"),
+						), "")
+						var err error
+						if src, err = ioutil.ReadAll(tr); err != nil {
+							t.Fatalf("failed to read tar: %v", err)
+						}
+					}
+					opts := []Option{WithCompression(cl), WithChunkSize(1000), WithPrioritizedFiles([]string{"foo/bar"})}
+					if tarSplit {
+						opts = append(opts, WithTarSplit())
+					}
+					rc, err := Build(io.NewSectionReader(bytes.NewReader(src), 0, int64(len(src))), opts...)
+					if err != nil {
+						t.Fatalf("failed to build: %v", err)
+					}
+					defer rc.Close()
+					b, err := ioutil.ReadAll(rc)
+					if err != nil {
+						t.Fatalf("failed to read blob: %v", err)
+					}
+					r, err := Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), WithDecompressors(cl))
+					if err != nil {
+						t.Fatalf("failed to open blob: %v", err)
+					}
+					pr, err := r.PlainTar()
+					if err != nil {
+						t.Fatalf("failed to get plain tar: %v", err)
+					}
+					defer pr.Close()
+					got, err := ioutil.ReadAll(pr)
+					if err != nil {
+						t.Fatalf("failed to read plain tar: %v", err)
+					}
+					if tarSplit {
+						if !bytes.Equal(got, src) {
+							t.Errorf("plain tar must be identical to the original tar")
+						}
+						return
+					}
+					want := plainTarEntries(t, src)
+					gotEnts := plainTarEntries(t, got)
+					if len(gotEnts) != len(want) {
+						t.Fatalf("number of entries = %d; want %d", len(gotEnts), len(want))
+					}
+					for i, e := range gotEnts {
+						if e.name != want[i].name || e.linkname != want[i].linkname || !bytes.Equal(e.contents, want[i].contents) {
+							t.Errorf("entry %d = %q (link %q); want %q (link %q)", i, e.name, e.linkname, want[i].name, want[i].linkname)
+						}
+						if e.sparse != want[i].sparse {
+							t.Errorf("%q: sparse = %v; want %v", e.name, e.sparse, want[i].sparse)
+						}
+					}
+					if sparse && len(got) > sparseFileSize/4 {
+						t.Errorf("holes must not be stored; tar size = %d", len(got))
+					}
+				})
+			}
+		}
+	}
+}
+
+type plainTarEntry struct {
+	name     string
+	linkname string
+	contents []byte
+	sparse   bool
+}
+
+// plainTarEntries returns entries of the tar sorted by name. The order of
+// entries can differ from the original as eStargz reorders prioritized files.
+func plainTarEntries(t *testing.T, b []byte) (ents []plainTarEntry) {
+	tr := tar.NewReader(bytes.NewReader(b))
+	m := make(map[string]plainTarEntry)
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("failed to read %q: %v", h.Name, err)
+		}
+		name := cleanEntryName(h.Name)
+		names = append(names, name)
+		m[name] = plainTarEntry{name, h.Linkname, data, isSparseHeader(h)}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		ents = append(ents, m[n])
+	}
+	return
+}
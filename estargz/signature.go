@@ -0,0 +1,121 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// SignTOC returns the signature of the TOC digest. The signed message is the
+// string form of the digest (e.g. "sha256:0123abcd..."). key must be either
+// ed25519.PrivateKey or *ecdsa.PrivateKey. ECDSA signatures are ASN.1-encoded
+// and sign the SHA-256 of the message.
+func SignTOC(tocDigest digest.Digest, key crypto.Signer) ([]byte, error) {
+	msg := []byte(tocDigest.String())
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, msg), nil
+	case *ecdsa.PrivateKey:
+		h := sha256.Sum256(msg)
+		return ecdsa.SignASN1(rand.Reader, k, h[:])
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+}
+
+// VerifyTOCSignature checks that sig is a signature of the TOC digest made by
+// the private key of any of the public keys. See also SignTOC.
+func VerifyTOCSignature(tocDigest digest.Digest, sig []byte, keys ...crypto.PublicKey) error {
+	if len(sig) == 0 {
+		return fmt.Errorf("TOC isn't signed")
+	}
+	msg := []byte(tocDigest.String())
+	h := sha256.Sum256(msg)
+	for _, key := range keys {
+		switch k := key.(type) {
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, msg, sig) {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(k, h[:], sig) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("signature of TOC %q isn't made by any of %d trusted keys", tocDigest, len(keys))
+}
+
+// signTOC sets the signature of the TOC signed by key.
+func signTOC(toc *JTOC, key crypto.Signer) error {
+	tocJSON, err := MarshalTOC(toc)
+	if err != nil {
+		return err
+	}
+	toc.Signature, err = SignTOC(digest.FromBytes(tocJSON), key)
+	return errors.Wrap(err, "failed to sign TOC")
+}
+
+// ParseTOCSigningKey parses the PEM-encoded PKCS #8 private key (ed25519 or
+// ECDSA) used for signing TOCs.
+func ParseTOCSigningKey(pemBytes []byte) (crypto.Signer, error) {
+	b, _ := pem.Decode(pemBytes)
+	if b == nil {
+		return nil, fmt.Errorf("PEM block not found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse private key")
+	}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// ParseTOCVerificationKey parses the PEM-encoded PKIX public key (ed25519 or
+// ECDSA) used for verifying TOC signatures.
+func ParseTOCVerificationKey(pemBytes []byte) (crypto.PublicKey, error) {
+	b, _ := pem.Decode(pemBytes)
+	if b == nil {
+		return nil, fmt.Errorf("PEM block not found")
+	}
+	key, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse public key")
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
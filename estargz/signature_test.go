@@ -0,0 +1,187 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestTOCSignature(t *testing.T) {
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ECDSA key: %v", err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key: %v", err)
+	}
+	tests := []struct {
+		name    string
+		key     crypto.Signer
+		trusted []crypto.PublicKey
+		wantOK  bool
+	}{
+		{"ed25519", edKey, []crypto.PublicKey{otherPub, edPub}, true},
+		{"ecdsa", ecKey, []crypto.PublicKey{&ecKey.PublicKey}, true},
+		{"untrusted", edKey, []crypto.PublicKey{otherPub, &ecKey.PublicKey}, false},
+		{"unsigned", nil, []crypto.PublicKey{edPub}, false},
+	}
+	for _, cl := range testCompressions() {
+		for _, tt := range tests {
+			for _, writer := range []bool{false, true} {
+				cl, tt, writer := cl, tt, writer
+				t.Run(fmt.Sprintf("compression=%v,%s,writer=%v", cl, tt.name, writer), func(t *testing.T) {
+					tr := buildTarStatic(t, tarOf(
+						dir("foo/"),
+						file("foo/bar", "bar"),
+					), "")
+					var (
+						b         []byte
+						tocDigest string
+					)
+					if writer {
+						var buf bytes.Buffer
+						w := NewWriterWithCompressor(&buf, cl)
+						w.TOCSigningKey = tt.key
+						if err := w.AppendTar(io.NewSectionReader(tr, 0, tr.Size())); err != nil {
+							t.Fatalf("failed to append tar: %v", err)
+						}
+						dgst, err := w.Close()
+						if err != nil {
+							t.Fatalf("failed to close writer: %v", err)
+						}
+						b, tocDigest = buf.Bytes(), dgst.String()
+					} else {
+						opts := []Option{WithCompression(cl)}
+						if tt.key != nil {
+							opts = append(opts, WithTOCSigningKey(tt.key))
+						}
+						rc, err := Build(tr, opts...)
+						if err != nil {
+							t.Fatalf("failed to build: %v", err)
+						}
+						defer rc.Close()
+						if b, err = ioutil.ReadAll(rc); err != nil {
+							t.Fatalf("failed to read blob: %v", err)
+						}
+						tocDigest = rc.TOCDigest().String()
+					}
+					sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+					if err := Check(sr, WithCheckDecompressors(cl)); err != nil {
+						t.Fatalf("failed to check blob: %v", err)
+					}
+					r, err := Open(sr, WithDecompressors(cl))
+					if err != nil {
+						t.Fatalf("failed to open blob: %v", err)
+					}
+					if got := r.tocDigest.String(); got != tocDigest {
+						t.Fatalf("TOC digest = %q; want %q", got, tocDigest)
+					}
+					if signed := len(r.TOCSignature()) > 0; signed != (tt.key != nil) {
+						t.Errorf("signed = %v; want %v", signed, tt.key != nil)
+					}
+					v, err := r.VerifyTOCSignature(tt.trusted...)
+					if (err == nil) != tt.wantOK {
+						t.Fatalf("VerifyTOCSignature = %v; want ok = %v", err, tt.wantOK)
+					}
+					if err != nil {
+						return
+					}
+					e, ok := r.Lookup("foo/bar")
+					if !ok {
+						t.Fatalf("foo/bar not found")
+					}
+					cv, err := v.Verifier(e)
+					if err != nil {
+						t.Fatalf("verifier of foo/bar not found: %v", err)
+					}
+					cv.Write([]byte("bar"))
+					if !cv.Verified() {
+						t.Errorf("foo/bar isn't verified")
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestParseTOCKeys(t *testing.T) {
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ECDSA key: %v", err)
+	}
+	for _, k := range []struct {
+		name string
+		key  crypto.Signer
+		pub  crypto.PublicKey
+	}{
+		{"ed25519", edKey, edPub},
+		{"ecdsa", ecKey, &ecKey.PublicKey},
+	} {
+		keyDER, err := x509.MarshalPKCS8PrivateKey(k.key)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal private key: %v", k.name, err)
+		}
+		pubDER, err := x509.MarshalPKIXPublicKey(k.pub)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal public key: %v", k.name, err)
+		}
+		key, err := ParseTOCSigningKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+		if err != nil {
+			t.Fatalf("%s: failed to parse private key: %v", k.name, err)
+		}
+		pub, err := ParseTOCVerificationKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+		if err != nil {
+			t.Fatalf("%s: failed to parse public key: %v", k.name, err)
+		}
+		const dgst digest.Digest = "sha256:a4c0e1c5d8b2b0e1bc2c3a0b0c7b6f9e6a1b3f0d5f1c3e2b9d7c8a6e4f2d1c0b"
+		sig, err := SignTOC(dgst, key)
+		if err != nil {
+			t.Fatalf("%s: failed to sign: %v", k.name, err)
+		}
+		if err := VerifyTOCSignature(dgst, sig, pub); err != nil {
+			t.Errorf("%s: failed to verify: %v", k.name, err)
+		}
+		if err := VerifyTOCSignature(dgst[:len(dgst)-1]+"d", sig, pub); err == nil {
+			t.Errorf("%s: signature of another digest must not be verified", k.name)
+		}
+	}
+	if _, err := ParseTOCVerificationKey([]byte("not a PEM")); err == nil {
+		t.Errorf("invalid PEM must not be parsed")
+	}
+}
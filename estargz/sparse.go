@@ -0,0 +1,224 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sparseBlockSize is the granularity of holes of sparse files. Blocks of this
+// size filled with zeros are treated as holes.
+const sparseBlockSize = 4096
+
+// GNU sparse format 1.0 PAX records. See also:
+// https://www.gnu.org/software/tar/manual/html_node/Sparse-Formats.html
+const (
+	paxGNUSparsePrefix   = "GNU.sparse."
+	paxGNUSparseMajor    = "GNU.sparse.major"
+	paxGNUSparseMinor    = "GNU.sparse.minor"
+	paxGNUSparseName     = "GNU.sparse.name"
+	paxGNUSparseRealSize = "GNU.sparse.realsize"
+)
+
+// sparseRegion is a region of a sparse file that contains data.
+type sparseRegion struct {
+	offset int64
+	length int64
+}
+
+// isSparseHeader returns true if the header is of a sparse file. tar.Reader
+// expands sparse files so their payloads differ from the raw bytes in the tar.
+func isSparseHeader(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range h.PAXRecords {
+		if strings.HasPrefix(k, paxGNUSparsePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanSparse reads size bytes of the expanded contents of a sparse file from r
+// and calls fn for each block containing data. This returns the regions
+// containing data.
+func scanSparse(r io.Reader, size int64, fn func(off int64, p []byte) error) (regions []sparseRegion, _ error) {
+	buf := make([]byte, sparseBlockSize)
+	for off := int64(0); off < size; {
+		p := buf
+		if remain := size - off; remain < int64(len(p)) {
+			p = p[:remain]
+		}
+		if _, err := io.ReadFull(r, p); err != nil {
+			return nil, err
+		}
+		if !isZero(p) {
+			if err := fn(off, p); err != nil {
+				return nil, err
+			}
+			if n := len(regions); n > 0 && regions[n-1].offset+regions[n-1].length == off {
+				regions[n-1].length += int64(len(p))
+			} else {
+				regions = append(regions, sparseRegion{off, int64(len(p))})
+			}
+		}
+		off += int64(len(p))
+	}
+	return regions, nil
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeSparseHeader writes the header of the sparse file in GNU sparse format
+// 1.0 followed by the sparse map to w. archive/tar doesn't allow writing
+// GNU.sparse.* PAX records so this writes the raw header blocks by itself. The
+// data of the regions must be written to the returned writer which pads the
+// entry on Close. The tar.Writer writing to w (if any) must be flushed before
+// calling this.
+func writeSparseHeader(w io.Writer, h *tar.Header, regions []sparseRegion) (io.WriteCloser, error) {
+	var spmap bytes.Buffer
+	fmt.Fprintf(&spmap, "%d\n", len(regions))
+	var dataSize int64
+	for _, r := range regions {
+		fmt.Fprintf(&spmap, "%d\n%d\n", r.offset, r.length)
+		dataSize += r.length
+	}
+	if rem := spmap.Len() % blockSize; rem != 0 {
+		spmap.Write(make([]byte, blockSize-rem))
+	}
+
+	sh := *h
+	sh.Typeflag = tar.TypeReg
+	sh.Format = tar.FormatPAX
+	sh.PAXRecords = make(map[string]string)
+	for k, v := range h.PAXRecords {
+		if !strings.HasPrefix(k, paxGNUSparsePrefix) {
+			sh.PAXRecords[k] = v
+		}
+	}
+	dir, file := path.Split(h.Name)
+	sh.Name = path.Join(dir, "GNUSparseFile.0", file)
+	sh.Size = int64(spmap.Len()) + dataSize
+
+	// Let archive/tar encode the header then add GNU.sparse.* records to its
+	// PAX extended header.
+	var hdr bytes.Buffer
+	if err := tar.NewWriter(&hdr).WriteHeader(&sh); err != nil {
+		return nil, err
+	}
+	blocks := hdr.Bytes()
+	ustarBlock := blocks[len(blocks)-blockSize:]
+	xBlock := append([]byte{}, ustarBlock...)
+	var records []byte
+	if len(blocks) > blockSize {
+		xBlock = blocks[:blockSize]
+		size, err := strconv.ParseInt(strings.Trim(string(xBlock[124:136]), " \x00"), 8, 64)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, blocks[blockSize:blockSize+size]...)
+	}
+	for _, kv := range [][2]string{
+		{paxGNUSparseMajor, "1"},
+		{paxGNUSparseMinor, "0"},
+		{paxGNUSparseName, h.Name},
+		{paxGNUSparseRealSize, strconv.FormatInt(h.Size, 10)},
+	} {
+		records = append(records, paxRecord(kv[0], kv[1])...)
+	}
+	copy(xBlock[124:136], fmt.Sprintf("%011o\x00", len(records)))
+	setTypeflag(xBlock, tar.TypeXHeader)
+
+	for _, b := range [][]byte{xBlock, records, make([]byte, padding(int64(len(records)))), ustarBlock, spmap.Bytes()} {
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+	}
+	return &sparseDataWriter{w: w}, nil
+}
+
+// paxRecord formats a PAX record. The length prefix counts itself.
+func paxRecord(k, v string) string {
+	size := len(k) + len(v) + len(" =\n")
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	if len(record) != size {
+		// the length prefix gained a digit
+		record = strconv.Itoa(len(record)) + " " + k + "=" + v + "\n"
+	}
+	return record
+}
+
+// setTypeflag sets the typeflag of the raw header block and updates its checksum.
+func setTypeflag(blk []byte, flag byte) {
+	blk[156] = flag
+	copy(blk[148:156], "        ")
+	var sum int64
+	for _, c := range blk {
+		sum += int64(c)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+}
+
+func padding(n int64) int64 {
+	return (blockSize - n%blockSize) % blockSize
+}
+
+// sparseDataWriter writes the data of a sparse file and pads it to the block
+// boundary on Close.
+type sparseDataWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (sw *sparseDataWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	sw.n += int64(n)
+	return n, err
+}
+
+func (sw *sparseDataWriter) Close() error {
+	_, err := sw.w.Write(make([]byte, padding(sw.n)))
+	return err
+}
+
+// blockSize is the size of a block of tar.
+const blockSize = 512
+
+// zeroReader reads zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
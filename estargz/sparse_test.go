@@ -0,0 +1,253 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+const (
+	sparseFileSize = 256*sparseBlockSize + 100
+	sparseFileName = "foo/sparse"
+	holeFileName   = "foo/hole"
+)
+
+// sparseRegions are the regions containing data of sparseFileName.
+var sparseRegions = []sparseRegion{
+	{sparseBlockSize, sparseBlockSize},
+	{256 * sparseBlockSize, 100},
+}
+
+// sparseContents returns the expanded contents of sparseFileName.
+func sparseContents() []byte {
+	b := make([]byte, sparseFileSize)
+	for _, r := range sparseRegions {
+		for i := r.offset; i < r.offset+r.length; i++ {
+			b[i] = byte('a' + i%26)
+		}
+	}
+	return b
+}
+
+// sparseTar returns a tar containing sparse files. If gnu is true, sparse
+// files are stored in the old GNU format. Otherwise, GNU sparse format 1.0
+// (PAX) is used.
+func sparseTar(t *testing.T, gnu bool) []byte {
+	contents := sparseContents()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range []struct {
+		h       *tar.Header
+		sparse  bool
+		regions []sparseRegion
+	}{
+		{&tar.Header{Name: "foo/", Typeflag: tar.TypeDir, Mode: 0755}, false, nil},
+		{&tar.Header{Name: sparseFileName, Typeflag: tar.TypeReg, Mode: 0644, Size: sparseFileSize}, true, sparseRegions},
+		{&tar.Header{Name: holeFileName, Typeflag: tar.TypeReg, Mode: 0644, Size: 3 * sparseBlockSize}, true, nil},
+		{&tar.Header{Name: "foo/bar", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, false, nil},
+	} {
+		if !e.sparse {
+			if err := tw.WriteHeader(e.h); err != nil {
+				t.Fatalf("failed to write header of %q: %v", e.h.Name, err)
+			}
+			if _, err := tw.Write([]byte("bar")[:e.h.Size]); err != nil {
+				t.Fatalf("failed to write payload of %q: %v", e.h.Name, err)
+			}
+			continue
+		}
+		if err := tw.Flush(); err != nil {
+			t.Fatalf("failed to flush tar: %v", err)
+		}
+		var (
+			sw  io.WriteCloser
+			err error
+		)
+		if gnu {
+			sw, err = writeOldGNUSparseHeader(&buf, e.h, e.regions)
+		} else {
+			sw, err = writeSparseHeader(&buf, e.h, e.regions)
+		}
+		if err != nil {
+			t.Fatalf("failed to write sparse header of %q: %v", e.h.Name, err)
+		}
+		for _, r := range e.regions {
+			if _, err := sw.Write(contents[r.offset : r.offset+r.length]); err != nil {
+				t.Fatalf("failed to write data of %q: %v", e.h.Name, err)
+			}
+		}
+		if err := sw.Close(); err != nil {
+			t.Fatalf("failed to close data of %q: %v", e.h.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// writeOldGNUSparseHeader writes the header of the sparse file in the old GNU
+// format. Up to 4 regions can be written.
+func writeOldGNUSparseHeader(w io.Writer, h *tar.Header, regions []sparseRegion) (io.WriteCloser, error) {
+	if len(regions) > 4 {
+		return nil, fmt.Errorf("too many regions")
+	}
+	var dataSize int64
+	for _, r := range regions {
+		dataSize += r.length
+	}
+	sh := *h
+	sh.Format = tar.FormatGNU
+	sh.Size = dataSize
+	var hdr bytes.Buffer
+	if err := tar.NewWriter(&hdr).WriteHeader(&sh); err != nil {
+		return nil, err
+	}
+	blk := hdr.Bytes()
+	for i, r := range regions {
+		copy(blk[386+i*24:], fmt.Sprintf("%011o\x00%011o\x00", r.offset, r.length))
+	}
+	copy(blk[483:495], fmt.Sprintf("%011o\x00", h.Size))
+	setTypeflag(blk, tar.TypeGNUSparse)
+	if _, err := w.Write(blk); err != nil {
+		return nil, err
+	}
+	return &sparseDataWriter{w: w}, nil
+}
+
+func TestSparse(t *testing.T) {
+	for _, gnu := range []bool{false, true} {
+		src := sparseTar(t, gnu)
+		for _, cl := range testCompressions() {
+			gnu, cl := gnu, cl
+			t.Run(fmt.Sprintf("gnu=%v,compression=%v,build", gnu, cl), func(t *testing.T) {
+				rc, err := Build(io.NewSectionReader(bytes.NewReader(src), 0, int64(len(src))),
+					WithCompression(cl), WithChunkSize(1000))
+				if err != nil {
+					t.Fatalf("failed to build: %v", err)
+				}
+				defer rc.Close()
+				b, err := ioutil.ReadAll(rc)
+				if err != nil {
+					t.Fatalf("failed to read blob: %v", err)
+				}
+				checkSparseBlob(t, b, cl)
+			})
+			t.Run(fmt.Sprintf("gnu=%v,compression=%v,writer", gnu, cl), func(t *testing.T) {
+				var buf bytes.Buffer
+				w := NewWriterWithCompressor(&buf, cl)
+				w.ChunkSize = 1000
+				if err := w.AppendTar(bytes.NewReader(src)); err != nil {
+					t.Fatalf("failed to append tar: %v", err)
+				}
+				if _, err := w.Close(); err != nil {
+					t.Fatalf("failed to close writer: %v", err)
+				}
+				checkSparseBlob(t, buf.Bytes(), cl)
+			})
+		}
+	}
+}
+
+func checkSparseBlob(t *testing.T, b []byte, cl testCompression) {
+	if len(b) > sparseFileSize/4 {
+		t.Errorf("holes must not be stored; blob size = %d", len(b))
+	}
+	sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+	if err := Check(sr, WithCheckDecompressors(cl)); err != nil {
+		t.Fatalf("failed to check blob: %v", err)
+	}
+	r, err := Open(sr, WithDecompressors(cl))
+	if err != nil {
+		t.Fatalf("failed to open blob: %v", err)
+	}
+	if _, err := r.VerifyTOC(r.tocDigest); err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+
+	for _, f := range []struct {
+		name     string
+		contents []byte
+	}{
+		{sparseFileName, sparseContents()},
+		{holeFileName, make([]byte, 3*sparseBlockSize)},
+		{"foo/bar", []byte("bar")},
+	} {
+		e, ok := r.Lookup(f.name)
+		if !ok {
+			t.Fatalf("%q not found", f.name)
+		}
+		if e.Size != int64(len(f.contents)) {
+			t.Errorf("%q: size = %d; want %d", f.name, e.Size, len(f.contents))
+		}
+		if wantSparse := f.name != "foo/bar"; e.Sparse != wantSparse {
+			t.Errorf("%q: sparse = %v; want %v", f.name, e.Sparse, wantSparse)
+		}
+		fr, err := r.OpenFile(f.name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", f.name, err)
+		}
+		got, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatalf("failed to read %q: %v", f.name, err)
+		}
+		if !bytes.Equal(got, f.contents) {
+			t.Errorf("%q: unexpected contents", f.name)
+		}
+		// read across a hole boundary
+		p := make([]byte, 200)
+		if _, err := fr.ReadAt(p, 2*sparseBlockSize-100); err != nil && (err != io.EOF || int64(len(f.contents)) > 2*sparseBlockSize+100) {
+			t.Fatalf("%q: failed to read at the hole boundary: %v", f.name, err)
+		}
+		if len(f.contents) > 2*sparseBlockSize+100 && !bytes.Equal(p, f.contents[2*sparseBlockSize-100:2*sparseBlockSize+100]) {
+			t.Errorf("%q: unexpected contents at the hole boundary", f.name)
+		}
+	}
+
+	for _, tt := range []struct {
+		off      int64
+		wantData int64
+		wantOK   bool
+		wantHole int64
+	}{
+		{0, sparseBlockSize, true, 0},
+		{sparseBlockSize, sparseBlockSize, true, 2 * sparseBlockSize},
+		{sparseBlockSize + 10, sparseBlockSize + 10, true, 2 * sparseBlockSize},
+		{2 * sparseBlockSize, 256 * sparseBlockSize, true, 2 * sparseBlockSize},
+		{256*sparseBlockSize + 50, 256*sparseBlockSize + 50, true, sparseFileSize},
+	} {
+		if got, ok := r.NextDataOffset(sparseFileName, tt.off); got != tt.wantData || ok != tt.wantOK {
+			t.Errorf("NextDataOffset(%d) = (%d, %v); want (%d, %v)", tt.off, got, ok, tt.wantData, tt.wantOK)
+		}
+		if got := r.NextHoleOffset(sparseFileName, tt.off); got != tt.wantHole {
+			t.Errorf("NextHoleOffset(%d) = %d; want %d", tt.off, got, tt.wantHole)
+		}
+	}
+	if _, ok := r.NextDataOffset(holeFileName, 0); ok {
+		t.Errorf("file without data must not have data offset")
+	}
+	if got, ok := r.NextDataOffset("foo/bar", 1); got != 1 || !ok {
+		t.Errorf("NextDataOffset of non-sparse file = (%d, %v); want (1, true)", got, ok)
+	}
+	if got := r.NextHoleOffset("foo/bar", 1); got != 3 {
+		t.Errorf("NextHoleOffset of non-sparse file = %d; want 3", got)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// storePolicySampleSize is the maximum size of the head of the file passed
+// to StorePolicy.
+const storePolicySampleSize = 64 << 10
+
+// StorePolicy decides whether the regular file is stored without compression.
+// name is the name of the file in the tar and head is the first bytes of its
+// contents (up to 64 KiB). Files that don't shrink by compression (e.g. JPEG
+// images and gzip archives) should be stored to save the time of building
+// and decompressing them.
+type StorePolicy func(name string, head []byte) bool
+
+// StoreByExtension returns a StorePolicy which stores files whose names end
+// with one of the extensions (e.g. ".jpg"). Extensions are case-insensitive.
+func StoreByExtension(exts ...string) StorePolicy {
+	m := make(map[string]struct{}, len(exts))
+	for _, e := range exts {
+		m[strings.ToLower(e)] = struct{}{}
+	}
+	return func(name string, _ []byte) bool {
+		_, ok := m[strings.ToLower(path.Ext(name))]
+		return ok
+	}
+}
+
+// compressedMagics are the magic bytes of well-known compressed formats.
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'B', 'Z', 'h'},                    // bzip2
+	{0x04, 0x22, 0x4d, 0x18},           // lz4
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{'P', 'K', 0x03, 0x04},             // zip (including jar, whl, etc.)
+	{0xff, 0xd8, 0xff},                 // jpeg
+	{0x89, 'P', 'N', 'G', '\r', '\n'},  // png
+	{'G', 'I', 'F', '8'},               // gif
+	{0x1a, 0x45, 0xdf, 0xa3},           // matroska and webm
+	{'O', 'g', 'g', 'S'},               // ogg
+	{'f', 'L', 'a', 'C'},               // flac
+	{'I', 'D', '3'},                    // mp3
+	{'w', 'O', 'F', 'F'},               // woff
+	{'w', 'O', 'F', '2'},               // woff2
+}
+
+// StoreByMagic returns a StorePolicy which stores files whose contents start
+// with the magic bytes of well-known compressed formats (e.g. gzip, zstd, zip,
+// jpeg and png).
+func StoreByMagic() StorePolicy {
+	return func(_ string, head []byte) bool {
+		for _, m := range compressedMagics {
+			if bytes.HasPrefix(head, m) {
+				return true
+			}
+		}
+		// formats identified by the type following the size field
+		if len(head) >= 12 {
+			if string(head[4:8]) == "ftyp" { // mp4, mov, heic, etc.
+				return true
+			}
+			if string(head[:4]) == "RIFF" && (string(head[8:12]) == "WEBP" || string(head[8:12]) == "AVI ") {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// StoreByRatio returns a StorePolicy which stores files whose head can't be
+// compressed to less than the specified ratio (e.g. 0.9 stores files which
+// shrink by less than 10%). The ratio is measured by compressing the head of
+// the file with the fastest deflate level.
+func StoreByRatio(ratio float64) StorePolicy {
+	return func(_ string, head []byte) bool {
+		if len(head) == 0 {
+			return false
+		}
+		cw := &countWriter{w: ioutil.Discard}
+		fw, err := flate.NewWriter(cw, flate.BestSpeed)
+		if err != nil {
+			return false
+		}
+		if _, err := fw.Write(head); err != nil {
+			return false
+		}
+		if err := fw.Close(); err != nil {
+			return false
+		}
+		return float64(cw.n) >= float64(len(head))*ratio
+	}
+}
+
+// StoreIfAny returns a StorePolicy which stores files which any of the
+// policies stores.
+func StoreIfAny(policies ...StorePolicy) StorePolicy {
+	return func(name string, head []byte) bool {
+		for _, p := range policies {
+			if p(name, head) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,139 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+func TestStorePolicies(t *testing.T) {
+	text := []byte(strings.Repeat("hello world ", 1000))
+	tests := []struct {
+		name   string
+		policy StorePolicy
+		file   string
+		head   []byte
+		want   bool
+	}{
+		{"ext", StoreByExtension(".jpg", ".GZ"), "a/b.JPG", text, true},
+		{"ext-gz", StoreByExtension(".jpg", ".GZ"), "a/b.tar.gz", text, true},
+		{"ext-miss", StoreByExtension(".jpg"), "a/jpg", text, false},
+		{"magic-gzip", StoreByMagic(), "a", []byte{0x1f, 0x8b, 0x08, 0x00}, true},
+		{"magic-png", StoreByMagic(), "a", []byte("\x89PNG\r\n\x1a\n"), true},
+		{"magic-mp4", StoreByMagic(), "a", []byte("\x00\x00\x00\x20ftypisom"), true},
+		{"magic-webp", StoreByMagic(), "a", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), true},
+		{"magic-wav", StoreByMagic(), "a", []byte("RIFF\x00\x00\x00\x00WAVEfmt "), false},
+		{"magic-text", StoreByMagic(), "a", text, false},
+		{"magic-empty", StoreByMagic(), "a", nil, false},
+		{"ratio-random", StoreByRatio(0.9), "a", randomBytes(10000), true},
+		{"ratio-text", StoreByRatio(0.9), "a", text, false},
+		{"ratio-empty", StoreByRatio(0.9), "a", nil, false},
+		{"any", StoreIfAny(StoreByExtension(".jpg"), StoreByMagic()), "a", []byte{0x1f, 0x8b}, true},
+		{"any-miss", StoreIfAny(StoreByExtension(".jpg"), StoreByMagic()), "a", text, false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy(tt.file, tt.head); got != tt.want {
+			t.Errorf("%s: got %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	stored := strings.Repeat("stored ", 1000)
+	compressed := strings.Repeat("compressed ", 1000)
+	random := string(randomBytes(5000))
+	files := map[string]string{
+		"foo/a.txt":    stored,
+		"foo/b.dat":    compressed,
+		"foo/rand.bin": random,
+	}
+	policy := StoreIfAny(StoreByExtension(".txt"), StoreByRatio(0.9))
+	for _, cl := range testCompressions() {
+		for _, chunkSize := range []int{0, 1000} {
+			cl, chunkSize := cl, chunkSize
+			t.Run(fmt.Sprintf("compression=%v,chunkSize=%d", cl, chunkSize), func(t *testing.T) {
+				tr := buildTarStatic(t, tarOf(
+					dir("foo/"),
+					file("foo/a.txt", stored),
+					file("foo/b.dat", compressed),
+					file("foo/rand.bin", random),
+				), "")
+				rc, err := Build(tr, WithCompression(cl), WithChunkSize(chunkSize), WithStorePolicy(policy))
+				if err != nil {
+					t.Fatalf("failed to build: %v", err)
+				}
+				defer rc.Close()
+				b, err := ioutil.ReadAll(rc)
+				if err != nil {
+					t.Fatalf("failed to read blob: %v", err)
+				}
+				if got, want := rc.DiffID().String(), cl.diffIDOf(t, b); got != want {
+					t.Errorf("DiffID = %q; want %q", got, want)
+				}
+				sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+				if err := Check(sr, WithCheckDecompressors(cl), WithCheckTOCDigest(rc.TOCDigest())); err != nil {
+					t.Fatalf("failed to check blob: %v", err)
+				}
+				r, err := Open(sr, WithDecompressors(cl))
+				if err != nil {
+					t.Fatalf("failed to open blob: %v", err)
+				}
+				for name, want := range files {
+					fr, err := r.OpenFile(name)
+					if err != nil {
+						t.Fatalf("failed to open %q: %v", name, err)
+					}
+					got, err := ioutil.ReadAll(fr)
+					if err != nil {
+						t.Fatalf("failed to read %q: %v", name, err)
+					}
+					if string(got) != want {
+						t.Errorf("unexpected contents of %q", name)
+					}
+				}
+
+				tc, ok := cl.(gzipTestCompression)
+				if !ok || tc.level == gzip.NoCompression {
+					return // everything is stored as is
+				}
+				head := 500
+				if !bytes.Contains(b, []byte(stored[:head])) {
+					t.Errorf("file chosen by the policy must be stored")
+				}
+				if !bytes.Contains(b, []byte(random[:head])) {
+					t.Errorf("incompressible file must be stored")
+				}
+				if bytes.Contains(b, []byte(compressed[:head])) {
+					t.Errorf("file not chosen by the policy must be compressed")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,261 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrStreamUnsupported is returned by BuildFromStream if some of the options
+// need to read the input tar more than once or the entries can't be reordered
+// in a single pass.
+var ErrStreamUnsupported = errors.New("option unsupported by BuildFromStream")
+
+// BuildFromStream builds an eStargz blob from the tar stream in the same way
+// as Build, but reads the stream only once so that a layer can be converted
+// without storing its uncompressed copy. The stream can be compressed with gzip.
+// Temporary storage is used only for the compressed blob.
+//
+// Prioritized files specified by WithPrioritizedFiles are placed before the
+// landmark in the order of the input tar, not in the order of the list.
+// WithTarSplit, WithDeduplication, WithPrefetchProfile and options excluding or
+// rewriting entries aren't supported and ErrStreamUnsupported is returned if
+// they are specified. ErrStreamUnsupported is also returned if a prioritized
+// file is a hardlink to a file that isn't prioritized because the target has
+// already been written after the landmark when the hardlink is read.
+// WithMaxParallelism is ignored and the totals of the progress reported through
+// WithProgress are unknown (zero).
+func BuildFromStream(tarStream io.Reader, opt ...Option) (_ *Blob, rErr error) {
+	var opts options
+	opts.compressionLevel = gzip.BestCompression // BestCompression by default
+	for _, o := range opt {
+		if err := o(&opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.tarSplit || opts.dedup || len(opts.prefetchProfiles) > 0 || opts.transformer.enabled() {
+		return nil, ErrStreamUnsupported
+	}
+	if opts.compression == nil {
+		opts.compression = NewGzipCompressionWithLevel(opts.compressionLevel)
+	}
+	br := bufio.NewReader(tarStream)
+	var in io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decompress the input")
+		}
+		defer zr.Close()
+		in = zr
+	}
+	layerFiles := newTempFiles()
+	defer func() {
+		if rErr != nil {
+			if err := layerFiles.CleanupAll(); err != nil {
+				rErr = errors.Wrapf(rErr, "failed to cleanup tmp files: %v", err)
+			}
+		}
+	}()
+
+	// Prioritized files and their parent directories are written to the
+	// first sub-blob followed by the landmark and others to the second one.
+	var (
+		writers   = make([]*Writer, 2)
+		payloads  = make([]*os.File, 2)
+		sinks     = make([]*streamSink, 2)
+		diskUsage int64
+	)
+	for i := range writers {
+		sw, f, err := opts.newSubWriter(layerFiles, &diskUsage)
+		if err != nil {
+			return nil, err
+		}
+		writers[i], payloads[i], sinks[i] = sw, f, newStreamSink(sw)
+	}
+	prioritized, missed, err := routeStream(in, &opts, sinks[0], sinks[1])
+	for _, s := range sinks {
+		if cErr := s.close(); err == nil {
+			err = cErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range missed {
+		if opts.missedPrioritizedFiles == nil {
+			return nil, errors.Wrapf(errNotFound, "prioritized file %q", name)
+		}
+		*opts.missedPrioritizedFiles = append(*opts.missedPrioritizedFiles, name)
+	}
+	if !prioritized {
+		// No prioritized file so the landmark is the first entry.
+		writers = writers[1:]
+		payloads = payloads[1:]
+	}
+	return combineBlob(opts.compression, layerFiles, writers, payloads, nil)
+}
+
+// routeStream writes the entries of the tar stream to the sinks. Prioritized
+// files and their parent directories are written to prioritized followed by the
+// landmark, and other entries are written to others. NoPrefetchLandmark is
+// written to others if no file is prioritized. This returns whether any file is
+// prioritized and the prioritized files not found in the stream.
+func routeStream(in io.Reader, opts *options, prioritized, others *streamSink) (bool, []string, error) {
+	var (
+		order   []string
+		targets = make(map[string]bool) // whether each prioritized file is found
+		parents = make(map[string]struct{})
+		written = make(map[string]struct{}) // entries written to prioritized
+		p       = &progressReporter{f: opts.progress}
+	)
+	for _, name := range opts.prioritizedFiles {
+		name = cleanEntryName(name)
+		if _, ok := targets[name]; ok {
+			continue
+		}
+		order = append(order, name)
+		targets[name] = false
+		for dir := name; strings.Contains(dir, "/"); {
+			dir = dir[:strings.LastIndex(dir, "/")]
+			parents[dir] = struct{}{}
+		}
+		parents[""] = struct{}{}
+	}
+	landmark := &entry{
+		header: &tar.Header{
+			Name:     NoPrefetchLandmark,
+			Typeflag: tar.TypeReg,
+			Size:     int64(len([]byte{landmarkContents})),
+		},
+		payload: bytes.NewReader([]byte{landmarkContents}),
+	}
+	if len(order) > 0 {
+		landmark.header.Name = PrefetchLandmark
+	} else if err := others.write(landmark); err != nil {
+		return false, nil, err
+	}
+
+	tr := tar.NewReader(in)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return false, nil, errors.Wrap(err, "failed to parse tar file")
+		}
+		name := cleanEntryName(h.Name)
+		switch name {
+		case PrefetchLandmark, NoPrefetchLandmark, TarSplitName:
+			// Ignore existing landmark and tar-split metadata
+			continue
+		}
+		if opts.sourceDateEpoch != nil {
+			clampTime(h, *opts.sourceDateEpoch)
+		}
+		s := others
+		if _, ok := targets[name]; ok {
+			targets[name] = true
+			s = prioritized
+		} else if _, ok := parents[name]; ok && h.Typeflag == tar.TypeDir {
+			s = prioritized
+		}
+		if s == prioritized {
+			if h.Typeflag == tar.TypeLink {
+				// The target must precede the hardlink in the blob.
+				if _, ok := written[cleanEntryName(h.Linkname)]; !ok {
+					return false, nil, errors.Wrapf(ErrStreamUnsupported,
+						"prioritized hardlink %q to non-prioritized file %q", h.Name, h.Linkname)
+				}
+			}
+			written[name] = struct{}{}
+		}
+		var payload io.Reader = tr
+		if opts.progress != nil {
+			payload = &progressReader{r: tr, pr: p}
+		}
+		if err := s.write(&entry{header: h, payload: payload}); err != nil {
+			return false, nil, err
+		}
+	}
+	if len(order) > 0 {
+		if err := prioritized.write(landmark); err != nil {
+			return false, nil, err
+		}
+	}
+	var missed []string
+	for _, name := range order {
+		if !targets[name] {
+			missed = append(missed, name)
+		}
+	}
+	return len(order) > 0, missed, nil
+}
+
+// streamSink writes tar entries to the Writer.
+type streamSink struct {
+	pw   *io.PipeWriter
+	tw   *tar.Writer
+	done chan error
+}
+
+func newStreamSink(sw *Writer) *streamSink {
+	pr, pw := io.Pipe()
+	s := &streamSink{pw: pw, tw: tar.NewWriter(pw), done: make(chan error, 1)}
+	go func() {
+		err := sw.AppendTar(pr)
+		if err == nil {
+			// consume the remaining of the tar (e.g. paddings)
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		s.done <- err
+	}()
+	return s
+}
+
+func (s *streamSink) write(e *entry) error {
+	if isSparseHeader(e.header) {
+		return writeSparseEntry(s.tw, s.pw, e)
+	}
+	if err := s.tw.WriteHeader(e.header); err != nil {
+		return errors.Wrapf(err, "failed to write tar header of %q", e.header.Name)
+	}
+	if _, err := io.Copy(s.tw, e.payload); err != nil {
+		return errors.Wrapf(err, "failed to write tar payload of %q", e.header.Name)
+	}
+	return nil
+}
+
+// close finishes the tar stream and waits for the Writer.
+func (s *streamSink) close() error {
+	err := s.tw.Close()
+	s.pw.CloseWithError(err)
+	if wErr := <-s.done; wErr != nil {
+		return wErr
+	}
+	return err
+}
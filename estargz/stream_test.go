@@ -0,0 +1,224 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestBuildFromStream(t *testing.T) {
+	want := map[string]string{
+		"foo/a":   longstring(3000),
+		"foo/b":   "bar",
+		"baz/c":   "",
+		"baz/d/e": "prioritized",
+	}
+	ents := tarOf(
+		dir("foo/"),
+		file("foo/a", want["foo/a"]),
+		file("foo/b", want["foo/b"]),
+		dir("baz/"),
+		file("baz/c", want["baz/c"]),
+		dir("baz/d/"),
+		file("baz/d/e", want["baz/d/e"]),
+		file(NoPrefetchLandmark, string([]byte{landmarkContents})),
+	)
+	tests := []struct {
+		name        string
+		prioritized []string
+		wantMissed  []string
+	}{
+		{name: "no_prioritized"},
+		{name: "prioritized", prioritized: []string{"baz/d/e", "/foo/a"}},
+		{name: "missed", prioritized: []string{"foo/b", "notexist"}, wantMissed: []string{"notexist"}},
+	}
+	for _, tt := range tests {
+		for _, cl := range testCompressions() {
+			for _, compressed := range []bool{false, true} {
+				tt, cl, compressed := tt, cl, compressed
+				t.Run(fmt.Sprintf("%s,compression=%v,gzip=%v", tt.name, cl, compressed), func(t *testing.T) {
+					sr := buildTarStatic(t, ents, "")
+					var in io.Reader = sr
+					if compressed {
+						in = gzipOf(t, sr)
+					}
+					var missed []string
+					var entries int
+					blob, err := BuildFromStream(in, WithCompression(cl), WithChunkSize(1000),
+						WithPrioritizedFiles(tt.prioritized), WithAllowPrioritizeNotFound(&missed),
+						WithProgress(func(p Progress) { entries = p.Entries }))
+					if err != nil {
+						t.Fatalf("failed to build: %v", err)
+					}
+					defer blob.Close()
+					b, err := ioutil.ReadAll(blob)
+					if err != nil {
+						t.Fatalf("failed to read blob: %v", err)
+					}
+					if !reflect.DeepEqual(missed, tt.wantMissed) {
+						t.Errorf("missed files = %v; want %v", missed, tt.wantMissed)
+					}
+					if entries != len(ents)-1 { // the landmark in the input is skipped
+						t.Errorf("progress reported %d entries; want %d", entries, len(ents)-1)
+					}
+					bsr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+					if err := Check(bsr, WithCheckDecompressors(cl),
+						WithCheckTOCDigest(blob.TOCDigest()), WithCheckDiffID(blob.DiffID())); err != nil {
+						t.Fatalf("failed to check blob: %v", err)
+					}
+					r, err := Open(bsr, WithDecompressors(cl))
+					if err != nil {
+						t.Fatalf("failed to open blob: %v", err)
+					}
+					for name, contents := range want {
+						e, ok := r.Lookup(name)
+						if !ok {
+							t.Fatalf("%q not found", name)
+						}
+						if e.Size == 0 {
+							continue
+						}
+						fr, err := r.OpenFile(name)
+						if err != nil {
+							t.Fatalf("failed to open %q: %v", name, err)
+						}
+						got, err := ioutil.ReadAll(io.NewSectionReader(fr, 0, e.Size))
+						if err != nil {
+							t.Fatalf("failed to read %q: %v", name, err)
+						}
+						if string(got) != contents {
+							t.Errorf("unexpected contents of %q", name)
+						}
+					}
+
+					if len(tt.prioritized) == 0 {
+						if _, ok := r.Lookup(NoPrefetchLandmark); !ok {
+							t.Fatalf("no-prefetch landmark not found")
+						}
+						return
+					}
+					landmark, ok := r.Lookup(PrefetchLandmark)
+					if !ok {
+						t.Fatalf("landmark not found")
+					}
+					if _, ok := r.Lookup(NoPrefetchLandmark); ok {
+						t.Errorf("no-prefetch landmark must not be contained")
+					}
+					prioritized := make(map[string]bool)
+					for _, name := range tt.prioritized {
+						prioritized[cleanEntryName(name)] = true
+					}
+					for name := range want {
+						if e := r.m[name]; (e.Offset < landmark.Offset) != prioritized[name] && e.Size > 0 {
+							t.Errorf("%q placed at %d; landmark at %d; prioritized=%v",
+								name, e.Offset, landmark.Offset, prioritized[name])
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestBuildFromStreamSparse(t *testing.T) {
+	for _, gnu := range []bool{false, true} {
+		src := sparseTar(t, gnu)
+		for _, cl := range testCompressions() {
+			gnu, cl := gnu, cl
+			t.Run(fmt.Sprintf("gnu=%v,compression=%v", gnu, cl), func(t *testing.T) {
+				rc, err := BuildFromStream(bytes.NewReader(src), WithCompression(cl), WithChunkSize(1000))
+				if err != nil {
+					t.Fatalf("failed to build: %v", err)
+				}
+				defer rc.Close()
+				b, err := ioutil.ReadAll(rc)
+				if err != nil {
+					t.Fatalf("failed to read blob: %v", err)
+				}
+				checkSparseBlob(t, b, cl)
+			})
+		}
+	}
+}
+
+func TestBuildFromStreamUnsupported(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"tar-split":        WithTarSplit(),
+		"dedup":            WithDeduplication(),
+		"prefetch-profile": WithPrefetchProfile("web", []string{"foo"}),
+		"exclude":          WithExcludePatterns("*.pyc"),
+		"rewrite":          WithPathRewrite("usr/local", "opt"),
+	} {
+		opt := opt
+		t.Run(name, func(t *testing.T) {
+			// The input must not be read.
+			if _, err := BuildFromStream(failReader{}, opt); errors.Cause(err) != ErrStreamUnsupported {
+				t.Errorf("BuildFromStream() = %v; want %v", err, ErrStreamUnsupported)
+			}
+		})
+	}
+}
+
+func TestBuildFromStreamHardlink(t *testing.T) {
+	src := tarOf(
+		file("target", "foo"),
+		link("link", "target"),
+	)
+
+	// The target is already written after the landmark when the hardlink is
+	// read so the hardlink can't be prioritized.
+	if _, err := BuildFromStream(buildTarStatic(t, src, ""), WithPrioritizedFiles([]string{"link"})); errors.Cause(err) != ErrStreamUnsupported {
+		t.Errorf("prioritizing hardlink = %v; want %v", err, ErrStreamUnsupported)
+	}
+
+	blob, err := BuildFromStream(buildTarStatic(t, src, ""), WithPrioritizedFiles([]string{"target", "link"}))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	defer blob.Close()
+	b, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	if err := Check(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))); err != nil {
+		t.Errorf("blob with prioritized hardlink and target is invalid: %v", err)
+	}
+}
+
+func gzipOf(t *testing.T, r io.Reader) io.Reader {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, r); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close gzip writer: %v", err)
+	}
+	return &buf
+}
+
+type failReader struct{}
+
+func (failReader) Read([]byte) (int, error) { return 0, fmt.Errorf("unexpected read") }
@@ -0,0 +1,249 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// tarSplitEntry is an element of the tar-split metadata stored in TarSplitName
+// file. The metadata is a sequence of JSON-encoded tarSplitEntry. The original
+// tar is the concatenation of Segment and the payload of the file Name of each
+// element.
+type tarSplitEntry struct {
+	// Segment is raw bytes of the original tar that aren't stored in the blob
+	// as file payloads (e.g. headers, paddings and payloads of overwritten
+	// entries).
+	Segment []byte `json:"segment,omitempty"`
+
+	// Name is the name of the file in the blob whose payload follows Segment.
+	Name string `json:"name,omitempty"`
+
+	// Size is the size of the payload of Name.
+	Size int64 `json:"size,omitempty"`
+}
+
+// tarSplitPoint is the position of the payload of a tar entry in the original tar.
+type tarSplitPoint struct {
+	name       string
+	stored     bool // the payload is stored in the blob as the file name
+	payloadOff int64
+	size       int64
+}
+
+// tarSplitOf returns the tar-split metadata of the tar. The metadata refers to
+// file payloads stored by Build so this must be consistent with importTar and
+// Writer.AppendTar.
+func tarSplitOf(in *io.SectionReader) ([]byte, error) {
+	cr, err := newCountReader(in)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(cr)
+	var points []tarSplitPoint
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to parse tar file")
+		}
+		if isSparseHeader(h) {
+			return nil, fmt.Errorf("tar-split of sparse file %q isn't supported", h.Name)
+		}
+		p := tarSplitPoint{
+			name:       cleanEntryName(h.Name),
+			payloadOff: cr.currentPos(),
+			size:       tarPayloadSize(h),
+		}
+		switch p.name {
+		case PrefetchLandmark, NoPrefetchLandmark, TarSplitName:
+			// importTar ignores these entries
+		default:
+			p.stored = h.Typeflag == tar.TypeReg && h.Name != TOCTarName && h.Name != TOCSignatureTarName
+		}
+		points = append(points, p)
+	}
+
+	// Only the last entry of the same name is stored by importTar.
+	last := make(map[string]int)
+	for i, p := range points {
+		last[p.name] = i
+	}
+	var (
+		buf     bytes.Buffer
+		enc     = json.NewEncoder(&buf)
+		prevEnd int64
+	)
+	segment := func(off int64) ([]byte, error) {
+		p := make([]byte, off-prevEnd)
+		if _, err := in.ReadAt(p, prevEnd); err != nil {
+			return nil, err
+		}
+		prevEnd = off
+		return p, nil
+	}
+	for i, p := range points {
+		var te tarSplitEntry
+		if p.stored && p.size > 0 && last[p.name] == i {
+			if te.Segment, err = segment(p.payloadOff); err != nil {
+				return nil, err
+			}
+			te.Name, te.Size = p.name, p.size
+			prevEnd += p.size
+		} else if te.Segment, err = segment(p.payloadOff + p.size); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(te); err != nil {
+			return nil, err
+		}
+	}
+	trailer, err := segment(in.Size())
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(tarSplitEntry{Segment: trailer}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// OriginalTar returns the original uncompressed tar that the blob was built
+// from. The result is identical to the original tar byte-for-byte including
+// the header format, PAX records and paddings so it has the same DiffID as
+// the original. This is available only when the blob was built with
+// WithTarSplit option and the tar-split metadata describes all entries in the
+// TOC.
+func (r *Reader) OriginalTar() (io.ReadCloser, error) {
+	if err := r.checkTarSplit(); err != nil {
+		return nil, err
+	}
+	return r.tarSplitStream(r.copyFilePayload)
+}
+
+// checkTarSplit checks that the tar-split metadata describes exactly the
+// entries in the TOC. The metadata can be stale if entries were added to the
+// blob without updating it.
+func (r *Reader) checkTarSplit() error {
+	// Only headers are needed so payloads aren't read from the blob.
+	rc, err := r.tarSplitStream(func(w io.Writer, name string, size int64) error {
+		_, err := io.CopyN(w, zeroReader{}, size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	recorded := make(map[string]*tar.Header)
+	tr := tar.NewReader(rc)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "failed to parse tar in tar-split metadata")
+		}
+		recorded[cleanEntryName(h.Name)] = h
+	}
+	for _, e := range r.toc.Entries {
+		if e.Type == "chunk" {
+			continue
+		}
+		name := cleanEntryName(e.Name)
+		switch name {
+		case "", PrefetchLandmark, NoPrefetchLandmark, TarSplitName:
+			continue
+		}
+		h, ok := recorded[name]
+		if !ok {
+			return fmt.Errorf("%q isn't recorded in tar-split metadata", name)
+		}
+		if e.Type == "reg" && h.Size != e.Size {
+			return fmt.Errorf("size of %q is %d but %d in tar-split metadata", name, e.Size, h.Size)
+		}
+		delete(recorded, name)
+	}
+	for name := range recorded {
+		switch name {
+		case "", PrefetchLandmark, NoPrefetchLandmark, TarSplitName, TOCTarName, TOCSignatureTarName:
+			continue
+		}
+		return fmt.Errorf("%q in tar-split metadata isn't in the TOC", name)
+	}
+	return nil
+}
+
+// tarSplitStream returns the tar described by the tar-split metadata. payload
+// writes the payload of the file in the blob.
+func (r *Reader) tarSplitStream(payload func(w io.Writer, name string, size int64) error) (io.ReadCloser, error) {
+	e, ok := r.Lookup(TarSplitName)
+	if !ok {
+		return nil, fmt.Errorf("tar-split metadata %q not found", TarSplitName)
+	}
+	sr, err := r.OpenFile(TarSplitName)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		dec := json.NewDecoder(io.NewSectionReader(sr, 0, e.Size))
+		for {
+			var te tarSplitEntry
+			if err := dec.Decode(&te); err == io.EOF {
+				break
+			} else if err != nil {
+				pw.CloseWithError(errors.Wrap(err, "failed to decode tar-split metadata"))
+				return
+			}
+			if _, err := pw.Write(te.Segment); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if te.Name == "" {
+				continue
+			}
+			if err := payload(pw, te.Name, te.Size); err != nil {
+				pw.CloseWithError(errors.Wrapf(err, "failed to copy payload of %q", te.Name))
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr, nil
+}
+
+func (r *Reader) copyFilePayload(w io.Writer, name string, size int64) error {
+	e, ok := r.Lookup(name)
+	if !ok || e.Type != "reg" {
+		return fmt.Errorf("regular file not found")
+	}
+	if e.Size != size {
+		return fmt.Errorf("size %d doesn't match the recorded size %d", e.Size, size)
+	}
+	sr, err := r.OpenFile(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, io.NewSectionReader(sr, 0, size))
+	return err
+}
@@ -0,0 +1,173 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// originalTar returns a tar containing details that aren't recorded in TOC.
+func originalTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	mtime := time.Unix(1600000000, 123456789)
+	for _, e := range []struct {
+		h       *tar.Header
+		payload string
+	}{
+		{&tar.Header{Name: "foo/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime, Format: tar.FormatUSTAR}, ""},
+		{&tar.Header{Name: "foo/bar", Typeflag: tar.TypeReg, Mode: 0644, Size: 11, ModTime: mtime,
+			AccessTime: mtime.Add(time.Hour), ChangeTime: mtime.Add(2 * time.Hour), Format: tar.FormatPAX,
+			PAXRecords: map[string]string{"SCHILY.xattr.user.foo": "bar", "custom.record": "value"}}, "hello world"},
+		{&tar.Header{Name: "./baz", Typeflag: tar.TypeReg, Mode: 0600, Size: 5, ModTime: mtime, Uname: "user",
+			Format: tar.FormatGNU, AccessTime: mtime}, "first"},
+		{&tar.Header{Name: NoPrefetchLandmark, Typeflag: tar.TypeReg, Size: 1}, string([]byte{landmarkContents})},
+		{&tar.Header{Name: "foo/link", Typeflag: tar.TypeSymlink, Linkname: "bar", ModTime: mtime}, ""},
+		{&tar.Header{Name: "baz", Typeflag: tar.TypeReg, Mode: 0644, Size: 6, ModTime: mtime}, "second"},
+		{&tar.Header{Name: "foo/hardlink", Typeflag: tar.TypeLink, Linkname: "foo/bar", ModTime: mtime}, ""},
+		{&tar.Header{Name: "empty", Typeflag: tar.TypeReg, ModTime: mtime}, ""},
+		{&tar.Header{Name: "long/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime}, ""},
+		{&tar.Header{Name: "long/" + longstring(200), Typeflag: tar.TypeReg, Size: 3000, ModTime: mtime}, longstring(3000)},
+	} {
+		if err := tw.WriteHeader(e.h); err != nil {
+			t.Fatalf("failed to write header of %q: %v", e.h.Name, err)
+		}
+		if _, err := tw.Write([]byte(e.payload)); err != nil {
+			t.Fatalf("failed to write payload of %q: %v", e.h.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	// Pad to the record size as some tar implementations do.
+	return append(buf.Bytes(), make([]byte, 10240-buf.Len()%10240)...)
+}
+
+func TestTarSplit(t *testing.T) {
+	orig := originalTar(t)
+	for _, cl := range testCompressions() {
+		for _, prioritized := range [][]string{nil, {"long/" + longstring(200), "baz"}} {
+			cl, prioritized := cl, prioritized
+			t.Run(fmt.Sprintf("compression=%v,prioritized=%d", cl, len(prioritized)), func(t *testing.T) {
+				blob, err := Build(io.NewSectionReader(bytes.NewReader(orig), 0, int64(len(orig))),
+					WithTarSplit(), WithChunkSize(1000), WithCompression(cl),
+					WithPrioritizedFiles(prioritized), WithSourceDateEpoch(time.Unix(0, 0)))
+				if err != nil {
+					t.Fatalf("failed to build: %v", err)
+				}
+				defer blob.Close()
+				b, err := ioutil.ReadAll(blob)
+				if err != nil {
+					t.Fatalf("failed to read blob: %v", err)
+				}
+				r, err := Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), WithDecompressors(cl))
+				if err != nil {
+					t.Fatalf("failed to open blob: %v", err)
+				}
+				if e, ok := r.Lookup("baz"); !ok || e.Size != 6 {
+					t.Fatalf("the last entry of baz must be stored")
+				}
+				tr, err := r.OriginalTar()
+				if err != nil {
+					t.Fatalf("failed to get original tar: %v", err)
+				}
+				defer tr.Close()
+				got, err := ioutil.ReadAll(tr)
+				if err != nil {
+					t.Fatalf("failed to read original tar: %v", err)
+				}
+				if !bytes.Equal(got, orig) {
+					t.Fatalf("reconstructed tar (%d bytes) differs from the original (%d bytes)", len(got), len(orig))
+				}
+			})
+		}
+	}
+}
+
+func TestTarSplitNotFound(t *testing.T) {
+	blob, err := Build(buildTarStatic(t, tarOf(file("foo", "bar")), ""))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	defer blob.Close()
+	b, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	r, err := Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))))
+	if err != nil {
+		t.Fatalf("failed to open blob: %v", err)
+	}
+	if _, err := r.OriginalTar(); err == nil {
+		t.Errorf("blob without tar-split metadata must fail")
+	}
+}
+
+func TestTarSplitStale(t *testing.T) {
+	split, err := tarSplitOf(buildTarStatic(t, tarOf(dir("foo/"), file("foo/a", "a")), ""))
+	if err != nil {
+		t.Fatalf("failed to make tar-split metadata: %v", err)
+	}
+	// The metadata doesn't describe foo/new.
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.AppendTar(buildTarStatic(t, tarOf(
+		dir("foo/"),
+		file("foo/a", "a"),
+		file("foo/new", "new"),
+		file(TarSplitName, string(split)),
+	), "")); err != nil {
+		t.Fatalf("failed to append tar: %v", err)
+	}
+	if _, err := w.Close(); err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+	sr := io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len()))
+	r, err := Open(sr)
+	if err != nil {
+		t.Fatalf("failed to open blob: %v", err)
+	}
+	if _, err := r.OriginalTar(); err == nil {
+		t.Errorf("stale tar-split metadata must not be used")
+	}
+	pr, err := r.PlainTar()
+	if err != nil {
+		t.Fatalf("failed to get plain tar: %v", err)
+	}
+	defer pr.Close()
+	got, err := ioutil.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("failed to read plain tar: %v", err)
+	}
+	var names []string
+	for _, e := range plainTarEntries(t, got) {
+		names = append(names, e.name)
+	}
+	if want := []string{"foo", "foo/a", "foo/new"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("entries of plain tar = %v; want %v", names, want)
+	}
+	if err := Check(sr); err == nil {
+		t.Errorf("stale tar-split metadata must be detected")
+	}
+}
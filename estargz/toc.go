@@ -0,0 +1,397 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// compactTOCMagic is the prefix of the TOC in the compact binary encoding.
+// JSON TOCs always start with '{' so the encoding can be detected by this.
+const compactTOCMagic = "ESGZTOC\x01"
+
+// Fields of TOCEntry present in the compact encoding. Each entry starts with
+// a bitmap of these flags and only fields with non-zero values follow.
+const (
+	compactSize = 1 << iota
+	compactModTime
+	compactLinkName
+	compactMode
+	compactUID
+	compactGID
+	compactUname
+	compactGname
+	compactOffset
+	compactDevMajor
+	compactDevMinor
+	compactNumLink
+	compactXattrs
+	compactDigest
+	compactChunkOffset
+	compactChunkSize
+	compactChunkDigest
+	compactSparse
+	compactInnerOffset
+)
+
+// MarshalTOC serializes the TOC. The TOC is encoded as JSON unless
+// toc.Compact is true, in which case the compact binary encoding is used.
+// The digest of the returned bytes is the TOC digest of the blob.
+func MarshalTOC(toc *JTOC) ([]byte, error) {
+	if !toc.Compact {
+		return json.MarshalIndent(toc, "", "\t")
+	}
+	return marshalCompactTOC(toc), nil
+}
+
+// UnmarshalTOC parses the TOC serialized by MarshalTOC. The encoding is
+// detected from the contents and recorded to Compact field of the result.
+func UnmarshalTOC(p []byte) (*JTOC, error) {
+	if !bytes.HasPrefix(p, []byte(compactTOCMagic)) {
+		toc := new(JTOC)
+		if err := json.Unmarshal(p, toc); err != nil {
+			return nil, err
+		}
+		return toc, nil
+	}
+	toc, err := unmarshalCompactTOC(p[len(compactTOCMagic):])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode compact TOC")
+	}
+	return toc, nil
+}
+
+// marshalCompactTOC encodes the TOC as the following.
+//
+//	magic | version | number of strings | strings... | number of entries | entries... [| number of profiles | profiles...]
+//
+// Prefetch profiles follow the entries only if the TOC has any. All integers are varints and all strings in entries are indexes of the
+// string table so that repeated names (e.g. of chunks, users or xattrs)
+// are stored only once.
+func marshalCompactTOC(toc *JTOC) []byte {
+	var (
+		strs    = []string{""}
+		strIdx  = map[string]uint64{"": 0}
+		entries bytes.Buffer
+		tmp     [binary.MaxVarintLen64]byte
+	)
+	putUvarint := func(b *bytes.Buffer, v uint64) {
+		b.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+	}
+	putVarint := func(b *bytes.Buffer, v int64) {
+		b.Write(tmp[:binary.PutVarint(tmp[:], v)])
+	}
+	putString := func(b *bytes.Buffer, s string) {
+		i, ok := strIdx[s]
+		if !ok {
+			i = uint64(len(strs))
+			strIdx[s] = i
+			strs = append(strs, s)
+		}
+		putUvarint(b, i)
+	}
+	putUvarint(&entries, uint64(len(toc.Entries)))
+	for _, e := range toc.Entries {
+		var flags uint64
+		for _, f := range []struct {
+			flag    uint64
+			present bool
+		}{
+			{compactSize, e.Size != 0},
+			{compactModTime, e.ModTime3339 != ""},
+			{compactLinkName, e.LinkName != ""},
+			{compactMode, e.Mode != 0},
+			{compactUID, e.UID != 0},
+			{compactGID, e.GID != 0},
+			{compactUname, e.Uname != ""},
+			{compactGname, e.Gname != ""},
+			{compactOffset, e.Offset != 0},
+			{compactDevMajor, e.DevMajor != 0},
+			{compactDevMinor, e.DevMinor != 0},
+			{compactNumLink, e.NumLink != 0},
+			{compactXattrs, len(e.Xattrs) != 0},
+			{compactDigest, e.Digest != ""},
+			{compactChunkOffset, e.ChunkOffset != 0},
+			{compactChunkSize, e.ChunkSize != 0},
+			{compactChunkDigest, e.ChunkDigest != ""},
+			{compactSparse, e.Sparse},
+			{compactInnerOffset, e.InnerOffset != 0},
+		} {
+			if f.present {
+				flags |= f.flag
+			}
+		}
+		putString(&entries, e.Name)
+		putString(&entries, e.Type)
+		putUvarint(&entries, flags)
+		if flags&compactSize != 0 {
+			putVarint(&entries, e.Size)
+		}
+		if flags&compactModTime != 0 {
+			putString(&entries, e.ModTime3339)
+		}
+		if flags&compactLinkName != 0 {
+			putString(&entries, e.LinkName)
+		}
+		if flags&compactMode != 0 {
+			putVarint(&entries, e.Mode)
+		}
+		if flags&compactUID != 0 {
+			putVarint(&entries, int64(e.UID))
+		}
+		if flags&compactGID != 0 {
+			putVarint(&entries, int64(e.GID))
+		}
+		if flags&compactUname != 0 {
+			putString(&entries, e.Uname)
+		}
+		if flags&compactGname != 0 {
+			putString(&entries, e.Gname)
+		}
+		if flags&compactOffset != 0 {
+			putVarint(&entries, e.Offset)
+		}
+		if flags&compactDevMajor != 0 {
+			putVarint(&entries, int64(e.DevMajor))
+		}
+		if flags&compactDevMinor != 0 {
+			putVarint(&entries, int64(e.DevMinor))
+		}
+		if flags&compactNumLink != 0 {
+			putVarint(&entries, int64(e.NumLink))
+		}
+		if flags&compactXattrs != 0 {
+			// Sort keys so that the result is deterministic.
+			keys := make([]string, 0, len(e.Xattrs))
+			for k := range e.Xattrs {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			putUvarint(&entries, uint64(len(keys)))
+			for _, k := range keys {
+				putString(&entries, k)
+				putString(&entries, string(e.Xattrs[k]))
+			}
+		}
+		if flags&compactDigest != 0 {
+			putString(&entries, e.Digest)
+		}
+		if flags&compactChunkOffset != 0 {
+			putVarint(&entries, e.ChunkOffset)
+		}
+		if flags&compactChunkSize != 0 {
+			putVarint(&entries, e.ChunkSize)
+		}
+		if flags&compactChunkDigest != 0 {
+			putString(&entries, e.ChunkDigest)
+		}
+		if flags&compactInnerOffset != 0 {
+			putVarint(&entries, e.InnerOffset)
+		}
+	}
+	if len(toc.PrefetchProfiles) > 0 {
+		putUvarint(&entries, uint64(len(toc.PrefetchProfiles)))
+		for _, p := range toc.PrefetchProfiles {
+			putString(&entries, p.Name)
+			putUvarint(&entries, uint64(len(p.Files)))
+			for _, f := range p.Files {
+				putString(&entries, f.Name)
+				putVarint(&entries, f.Offset)
+				putVarint(&entries, f.Size)
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString(compactTOCMagic)
+	putVarint(&b, int64(toc.Version))
+	putUvarint(&b, uint64(len(strs)-1)) // the empty string is implicit
+	for _, s := range strs[1:] {
+		putUvarint(&b, uint64(len(s)))
+		b.WriteString(s)
+	}
+	b.Write(entries.Bytes())
+	return b.Bytes()
+}
+
+// compactDecoder decodes the compact TOC. Once an error occurs, all following
+// reads return zero values and the error is kept in err.
+type compactDecoder struct {
+	p    []byte
+	strs []string
+	err  error
+}
+
+func (d *compactDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.p)
+	if n <= 0 {
+		d.err = fmt.Errorf("malformed varint")
+		return 0
+	}
+	d.p = d.p[n:]
+	return v
+}
+
+func (d *compactDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.p)
+	if n <= 0 {
+		d.err = fmt.Errorf("malformed varint")
+		return 0
+	}
+	d.p = d.p[n:]
+	return v
+}
+
+// length reads a length of following elements which must be at least
+// elemSize bytes each.
+func (d *compactDecoder) length(elemSize int) int {
+	l := d.uvarint()
+	if d.err == nil && l > uint64(len(d.p)/elemSize) {
+		d.err = fmt.Errorf("invalid length %d", l)
+		return 0
+	}
+	return int(l)
+}
+
+func (d *compactDecoder) string() string {
+	i := d.uvarint()
+	if d.err == nil && i >= uint64(len(d.strs)) {
+		d.err = fmt.Errorf("invalid string index %d", i)
+		return ""
+	}
+	return d.strs[i]
+}
+
+func unmarshalCompactTOC(p []byte) (*JTOC, error) {
+	d := &compactDecoder{p: p}
+	toc := &JTOC{Compact: true}
+	toc.Version = int(d.varint())
+	nstrs := d.length(1)
+	d.strs = make([]string, 1, nstrs+1)
+	for i := 0; i < nstrs && d.err == nil; i++ {
+		l := d.length(1)
+		if d.err == nil {
+			d.strs = append(d.strs, string(d.p[:l]))
+			d.p = d.p[l:]
+		}
+	}
+	nents := d.length(3) // name, type and flags
+	entries := make([]TOCEntry, nents)
+	toc.Entries = make([]*TOCEntry, nents)
+	for i := 0; i < nents && d.err == nil; i++ {
+		e := &entries[i]
+		e.Name = d.string()
+		e.Type = d.string()
+		flags := d.uvarint()
+		if flags&compactSize != 0 {
+			e.Size = d.varint()
+		}
+		if flags&compactModTime != 0 {
+			e.ModTime3339 = d.string()
+		}
+		if flags&compactLinkName != 0 {
+			e.LinkName = d.string()
+		}
+		if flags&compactMode != 0 {
+			e.Mode = d.varint()
+		}
+		if flags&compactUID != 0 {
+			e.UID = int(d.varint())
+		}
+		if flags&compactGID != 0 {
+			e.GID = int(d.varint())
+		}
+		if flags&compactUname != 0 {
+			e.Uname = d.string()
+		}
+		if flags&compactGname != 0 {
+			e.Gname = d.string()
+		}
+		if flags&compactOffset != 0 {
+			e.Offset = d.varint()
+		}
+		if flags&compactDevMajor != 0 {
+			e.DevMajor = int(d.varint())
+		}
+		if flags&compactDevMinor != 0 {
+			e.DevMinor = int(d.varint())
+		}
+		if flags&compactNumLink != 0 {
+			e.NumLink = int(d.varint())
+		}
+		if flags&compactXattrs != 0 {
+			n := d.length(2)
+			e.Xattrs = make(map[string][]byte, n)
+			for j := 0; j < n && d.err == nil; j++ {
+				k := d.string()
+				e.Xattrs[k] = []byte(d.string())
+			}
+		}
+		if flags&compactDigest != 0 {
+			e.Digest = d.string()
+		}
+		if flags&compactChunkOffset != 0 {
+			e.ChunkOffset = d.varint()
+		}
+		if flags&compactChunkSize != 0 {
+			e.ChunkSize = d.varint()
+		}
+		if flags&compactChunkDigest != 0 {
+			e.ChunkDigest = d.string()
+		}
+		e.Sparse = flags&compactSparse != 0
+		if flags&compactInnerOffset != 0 {
+			e.InnerOffset = d.varint()
+		}
+		toc.Entries[i] = e
+	}
+	if d.err == nil && len(d.p) > 0 {
+		nprofiles := d.length(2) // name and number of files
+		if d.err == nil && nprofiles == 0 {
+			// the profiles are written only if any
+			d.err = fmt.Errorf("empty prefetch profiles")
+		}
+		toc.PrefetchProfiles = make([]*PrefetchProfile, nprofiles)
+		for i := 0; i < nprofiles && d.err == nil; i++ {
+			p := &PrefetchProfile{Name: d.string()}
+			p.Files = make([]PrefetchFile, d.length(3)) // name, offset and size
+			for j := range p.Files {
+				p.Files[j] = PrefetchFile{Name: d.string(), Offset: d.varint(), Size: d.varint()}
+			}
+			toc.PrefetchProfiles[i] = p
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.p) != 0 {
+		return nil, fmt.Errorf("%d bytes of trailing garbage", len(d.p))
+	}
+	return toc, nil
+}
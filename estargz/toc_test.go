@@ -0,0 +1,144 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompactTOC(t *testing.T) {
+	ents := tarOf(
+		dir("foo/", owner{uid: 1000, gid: 1000}),
+		file("foo/bar", "barbarbarbarbar", xAttr{"user.a": "1", "user.b": ""}, owner{uid: 1000, gid: 1000}),
+		file("foo/empty", ""),
+		symlink("foo/link", "bar"),
+		link("foo/hardlink", "foo/bar"),
+		chardev("dev/null", 1, 3),
+		fifo("fifo"),
+	)
+	for _, cl := range testCompressions() {
+		cl := cl
+		t.Run(fmt.Sprintf("compression=%v", cl), func(t *testing.T) {
+			build := func(opts ...Option) (*Reader, []byte, *JTOC) {
+				blob, err := Build(buildTarStatic(t, ents, ""),
+					append(opts, WithChunkSize(4), WithCompression(cl), WithPrefetchProfile("p", []string{"foo/bar"}))...)
+				if err != nil {
+					t.Fatalf("failed to build: %v", err)
+				}
+				defer blob.Close()
+				b, err := ioutil.ReadAll(blob)
+				if err != nil {
+					t.Fatalf("failed to read blob: %v", err)
+				}
+				sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+				r, err := Open(sr, WithDecompressors(cl))
+				if err != nil {
+					t.Fatalf("failed to open blob: %v", err)
+				}
+				if _, err := r.VerifyTOC(blob.TOCDigest()); err != nil {
+					t.Fatalf("failed to verify TOC: %v", err)
+				}
+				d, _, tocOff, tocSize, err := openFooter(sr, []Decompressor{cl})
+				if err != nil {
+					t.Fatalf("failed to parse footer: %v", err)
+				}
+				if tocSize < 0 {
+					tocSize = sr.Size() - tocOff - d.FooterSize()
+				}
+				tocBytes, err := ioutil.ReadAll(io.NewSectionReader(sr, tocOff, tocSize))
+				if err != nil {
+					t.Fatalf("failed to read TOC: %v", err)
+				}
+				toc, _, err := d.ParseTOC(bytes.NewReader(tocBytes))
+				if err != nil {
+					t.Fatalf("failed to parse TOC: %v", err)
+				}
+				return r, tocBytes, toc
+			}
+			_, jsonTOC, jtoc := build()
+			r, compactTOC, ctoc := build(WithCompactTOC())
+			if jtoc.Compact || !ctoc.Compact {
+				t.Fatalf("encoding isn't detected: JSON=%v, compact=%v", jtoc.Compact, ctoc.Compact)
+			}
+			if len(compactTOC) >= len(jsonTOC) {
+				t.Errorf("compact TOC (%d bytes) isn't smaller than JSON (%d bytes)", len(compactTOC), len(jsonTOC))
+			}
+
+			// Both encodings must hold the same entries and profiles.
+			ctoc.Compact = false
+			a, err := MarshalTOC(jtoc)
+			if err != nil {
+				t.Fatalf("failed to marshal JSON TOC: %v", err)
+			}
+			b, err := MarshalTOC(ctoc)
+			if err != nil {
+				t.Fatalf("failed to marshal decoded compact TOC: %v", err)
+			}
+			if !bytes.Equal(a, b) {
+				t.Errorf("entries mismatch:\n%s\n%s", string(a), string(b))
+			}
+
+			e, ok := r.Lookup("foo/bar")
+			if !ok {
+				t.Fatalf("foo/bar not found")
+			}
+			if v := string(e.Xattrs["user.a"]); v != "1" {
+				t.Errorf("xattr user.a = %q; want %q", v, "1")
+			}
+			sr, err := r.OpenFile("foo/bar")
+			if err != nil {
+				t.Fatalf("failed to open foo/bar: %v", err)
+			}
+			got, err := ioutil.ReadAll(io.NewSectionReader(sr, 0, e.Size))
+			if err != nil {
+				t.Fatalf("failed to read foo/bar: %v", err)
+			}
+			if string(got) != "barbarbarbarbar" {
+				t.Errorf("contents of foo/bar = %q", string(got))
+			}
+		})
+	}
+}
+
+func TestCompactTOCMalformed(t *testing.T) {
+	p, err := MarshalTOC(&JTOC{
+		Version: 1,
+		Compact: true,
+		Entries: []*TOCEntry{
+			{Name: "foo", Type: "reg", Size: 10, Digest: "sha256:abc", Xattrs: map[string][]byte{"a": []byte("b")}},
+			{Name: "foo", Type: "chunk", ChunkOffset: 5, ChunkSize: 5},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	if _, err := UnmarshalTOC(p); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	for i := len(compactTOCMagic); i < len(p); i++ {
+		if _, err := UnmarshalTOC(p[:i]); err == nil {
+			t.Errorf("truncated TOC (%d/%d bytes) must not be parsed", i, len(p))
+		}
+	}
+	if _, err := UnmarshalTOC(append(p, 0)); err == nil {
+		t.Errorf("TOC with trailing garbage must not be parsed")
+	}
+}
@@ -0,0 +1,255 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// WithExcludeFunc option makes Build drop the entries of the input tar for
+// which f returns true. f receives the headers of the input tar before they are
+// rewritten by WithRewriteFunc. Excluding a directory with this option doesn't
+// exclude its children. This option can be specified multiple times and an
+// entry is dropped if any of the functions returns true.
+func WithExcludeFunc(f func(h *tar.Header) bool) Option {
+	return func(o *options) error {
+		o.transformer.excludes = append(o.transformer.excludes, f)
+		return nil
+	}
+}
+
+// WithExcludePatterns option makes Build drop the entries of the input tar
+// whose paths match any of the patterns (see path.Match for the syntax). A
+// pattern containing "/" is matched against the path from the root (e.g.
+// "usr/share/doc") and other patterns are matched against each element of the
+// path (e.g. "*.pyc" or "__pycache__"). If a directory matches, all entries
+// under it are dropped as well. Whiteouts are matched by the path they hide so
+// that a layer slimmed with the same patterns as its lower layers keeps the same
+// merged view.
+func WithExcludePatterns(patterns ...string) Option {
+	return func(o *options) error {
+		var cleaned []string
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return errors.Wrapf(err, "WithExcludePatterns: invalid pattern %q", p)
+			}
+			if strings.Contains(p, "/") {
+				p = cleanEntryName(p)
+			}
+			cleaned = append(cleaned, p)
+		}
+		o.transformer.excludes = append(o.transformer.excludes, func(h *tar.Header) bool {
+			return matchExcludePatterns(cleaned, whiteoutTarget(h.Name))
+		})
+		return nil
+	}
+}
+
+// WithRewriteFunc option makes Build rewrite the headers of the entries (e.g.
+// names or ownership) with f. Targets of hardlinks are updated to follow the
+// rewritten names unless f changes Linkname by itself. If several entries are
+// rewritten to the same name, the last one is kept in the same way as in the
+// input tar. This option can be specified multiple times and the functions are
+// applied in the order of the specification.
+func WithRewriteFunc(f func(h *tar.Header) error) Option {
+	return func(o *options) error {
+		o.transformer.rewrites = append(o.transformer.rewrites, f)
+		return nil
+	}
+}
+
+// WithPathRewrite option makes Build move the entries under the directory from
+// to the directory to (e.g. "usr/local" to "opt"). An empty from moves all
+// entries under to. Whiteouts are moved with the paths they hide.
+func WithPathRewrite(from, to string) Option {
+	from, to = cleanEntryName(from), cleanEntryName(to)
+	return WithRewriteFunc(func(h *tar.Header) error {
+		target := whiteoutTarget(h.Name)
+		var rest string
+		if from == "" {
+			rest = target
+		} else if target == from {
+			rest = ""
+		} else if strings.HasPrefix(target, from+"/") {
+			rest = strings.TrimPrefix(target, from+"/")
+		} else {
+			return nil
+		}
+		name := path.Join(to, rest)
+		if target != cleanEntryName(h.Name) {
+			// whiteout of the path
+			name = path.Join(path.Dir(name), whiteoutPrefix+path.Base(name))
+		}
+		if name == "." || name == "" {
+			return fmt.Errorf("%q is rewritten to the root directory", h.Name)
+		}
+		if strings.HasSuffix(h.Name, "/") {
+			name += "/"
+		}
+		h.Name = name
+		return nil
+	})
+}
+
+// WithIDMapping option makes Build remap the owners of the entries. uids and
+// gids map the IDs in the input tar to the IDs in the blob. IDs not contained
+// in the maps are kept as is. User and group names of remapped entries are
+// cleared because they don't correspond to the new IDs.
+func WithIDMapping(uids, gids map[int]int) Option {
+	return WithRewriteFunc(func(h *tar.Header) error {
+		if id, ok := uids[h.Uid]; ok {
+			h.Uid, h.Uname = id, ""
+		}
+		if id, ok := gids[h.Gid]; ok {
+			h.Gid, h.Gname = id, ""
+		}
+		return nil
+	})
+}
+
+// transformer drops and rewrites the entries of the input tar.
+type transformer struct {
+	excludes []func(h *tar.Header) bool
+	rewrites []func(h *tar.Header) error
+}
+
+func (t *transformer) enabled() bool {
+	return len(t.excludes) > 0 || len(t.rewrites) > 0
+}
+
+func (t *transformer) excluded(h *tar.Header) bool {
+	for _, f := range t.excludes {
+		if f(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns the entries of in transformed by t. Hardlinks are kept
+// consistent with their targets. They follow the rewritten names of the
+// targets and, if the target is dropped, the first hardlink to it takes over
+// the contents.
+func (t *transformer) apply(in *tarFile) (*tarFile, error) {
+	if !t.enabled() {
+		return in, nil
+	}
+	var (
+		out     = &tarFile{}
+		kept    = make(map[string]*entry) // keyed by the name in the input tar
+		dropped = make(map[string]*entry) // keyed by the name in the input tar
+	)
+	for _, e := range in.dump() {
+		orig := e.header
+		h := copyHeader(orig)
+		for _, f := range t.rewrites {
+			if err := f(h); err != nil {
+				return nil, errors.Wrapf(err, "failed to rewrite %q", orig.Name)
+			}
+		}
+		if h.Name == "" {
+			return nil, fmt.Errorf("name of %q is rewritten to empty", orig.Name)
+		}
+		name := cleanEntryName(orig.Name)
+		ne := &entry{header: h, payload: e.payload}
+		if t.excluded(orig) {
+			dropped[name] = ne
+			continue
+		}
+		if h.Typeflag == tar.TypeLink && h.Linkname == orig.Linkname {
+			target := cleanEntryName(orig.Linkname)
+			if te, ok := kept[target]; ok {
+				h.Linkname = te.header.Name
+			} else if te, ok := dropped[target]; ok {
+				// The target is dropped so this link takes over the contents.
+				// Hardlinks share the metadata with the target.
+				ph := copyHeader(te.header)
+				ph.Name = h.Name
+				ne = &entry{header: ph, payload: te.payload}
+				delete(dropped, target)
+				kept[target] = ne
+			}
+		}
+		kept[name] = ne
+		if _, ok := out.get(ne.header.Name); ok {
+			out.remove(ne.header.Name)
+		}
+		out.add(ne)
+	}
+	return out, nil
+}
+
+// copyHeader returns a copy of h which doesn't share the maps with h.
+func copyHeader(h *tar.Header) *tar.Header {
+	c := *h
+	if h.PAXRecords != nil {
+		c.PAXRecords = make(map[string]string, len(h.PAXRecords))
+		for k, v := range h.PAXRecords {
+			c.PAXRecords[k] = v
+		}
+	}
+	if h.Xattrs != nil {
+		c.Xattrs = make(map[string]string, len(h.Xattrs))
+		for k, v := range h.Xattrs {
+			c.Xattrs[k] = v
+		}
+	}
+	return &c
+}
+
+// whiteoutTarget returns the cleaned path hidden by the whiteout name. Other
+// names (including opaque whiteouts) are returned as is after cleaned.
+func whiteoutTarget(name string) string {
+	name = cleanEntryName(name)
+	dir, base := path.Split(name)
+	if base == whiteoutOpaque || !strings.HasPrefix(base, whiteoutPrefix) {
+		return name
+	}
+	return path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+}
+
+// matchExcludePatterns reports whether name or any of its parent directories
+// matches the patterns.
+func matchExcludePatterns(patterns []string, name string) bool {
+	if name == "" {
+		return false // never excludes the root directory
+	}
+	elems := strings.Split(name, "/")
+	for i := range elems {
+		prefix := strings.Join(elems[:i+1], "/")
+		for _, p := range patterns {
+			target := elems[i]
+			if strings.Contains(p, "/") {
+				target = prefix
+			}
+			if ok, _ := path.Match(p, target); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	ents := tarOf(
+		dir("app/", owner{1000, 1000}),
+		file("app/main.py", "main", owner{1000, 1000}),
+		file("app/main.pyc", "compiled", owner{1000, 1000}),
+		dir("app/__pycache__/"),
+		file("app/__pycache__/x.pyc", "cache"),
+		link("app/main2.pyc", "app/main.pyc"),
+		link("app/main3.pyc", "app/main.pyc"),
+		file("app/.wh.old.pyc", ""),
+		file("app/.wh.gone", ""),
+		dir("usr/"),
+		dir("usr/share/"),
+		dir("usr/share/doc/"),
+		file("usr/share/doc/README", "doc"),
+		file("usr/bin", "bin", owner{0, 5}),
+		link("usr/bin2", "usr/bin"),
+		dir("opt/"),
+	)
+	type want struct {
+		typ      string
+		contents string
+		linkName string
+		uid, gid int
+	}
+	tests := []struct {
+		name       string
+		opts       []Option
+		prioritize []string
+		want       map[string]want
+	}{
+		{
+			name: "exclude_patterns",
+			opts: []Option{WithExcludePatterns("*.pyc", "__pycache__", "usr/share/doc")},
+			want: map[string]want{
+				"app":          {typ: "dir", uid: 1000, gid: 1000},
+				"app/main.py":  {typ: "reg", contents: "main", uid: 1000, gid: 1000},
+				"app/.wh.gone": {typ: "reg"},
+				"usr":          {typ: "dir"},
+				"usr/share":    {typ: "dir"},
+				"usr/bin":      {typ: "reg", contents: "bin", gid: 5},
+				"usr/bin2":     {typ: "hardlink", linkName: "usr/bin"},
+				"opt":          {typ: "dir"},
+			},
+		},
+		{
+			name: "exclude_func_link_takes_over",
+			opts: []Option{WithExcludeFunc(func(h *tar.Header) bool {
+				return (strings.HasPrefix(h.Name, "app/") && h.Name != "app/") || h.Name == "usr/bin"
+			})},
+			want: map[string]want{
+				"app":                  {typ: "dir", uid: 1000, gid: 1000},
+				"usr":                  {typ: "dir"},
+				"usr/share":            {typ: "dir"},
+				"usr/share/doc":        {typ: "dir"},
+				"usr/share/doc/README": {typ: "reg", contents: "doc"},
+				"usr/bin2":             {typ: "reg", contents: "bin", gid: 5},
+				"opt":                  {typ: "dir"},
+			},
+		},
+		{
+			name: "path_rewrite_and_id_mapping",
+			opts: []Option{
+				WithExcludePatterns("usr/share"),
+				WithPathRewrite("app", "opt/app"),
+				WithIDMapping(map[int]int{1000: 2000}, map[int]int{5: 6}),
+			},
+			prioritize: []string{"opt/app/main.py"},
+			want: map[string]want{
+				"opt/app":                   {typ: "dir", uid: 2000, gid: 1000},
+				"opt/app/main.py":           {typ: "reg", contents: "main", uid: 2000, gid: 1000},
+				"opt/app/main.pyc":          {typ: "reg", contents: "compiled", uid: 2000, gid: 1000},
+				"opt/app/__pycache__":       {typ: "dir"},
+				"opt/app/__pycache__/x.pyc": {typ: "reg", contents: "cache"},
+				"opt/app/main2.pyc":         {typ: "hardlink", linkName: "opt/app/main.pyc"},
+				"opt/app/main3.pyc":         {typ: "hardlink", linkName: "opt/app/main.pyc"},
+				"opt/app/.wh.old.pyc":       {typ: "reg"},
+				"opt/app/.wh.gone":          {typ: "reg"},
+				"usr":                       {typ: "dir"},
+				"usr/bin":                   {typ: "reg", contents: "bin", gid: 6},
+				"usr/bin2":                  {typ: "hardlink", linkName: "usr/bin"},
+				"opt":                       {typ: "dir"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		for _, cl := range testCompressions() {
+			tt, cl := tt, cl
+			t.Run(fmt.Sprintf("%s,compression=%v", tt.name, cl), func(t *testing.T) {
+				opts := append([]Option{WithCompression(cl), WithPrioritizedFiles(tt.prioritize)}, tt.opts...)
+				blob, err := Build(buildTarStatic(t, ents, ""), opts...)
+				if err != nil {
+					t.Fatalf("failed to build: %v", err)
+				}
+				defer blob.Close()
+				b, err := ioutil.ReadAll(blob)
+				if err != nil {
+					t.Fatalf("failed to read blob: %v", err)
+				}
+				if err := blob.Close(); err != nil {
+					t.Fatalf("failed to close blob: %v", err)
+				}
+				sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+				if err := Check(sr, WithCheckDecompressors(cl), WithCheckDiffID(blob.DiffID())); err != nil {
+					t.Fatalf("failed to check blob: %v", err)
+				}
+				r, err := Open(sr, WithDecompressors(cl))
+				if err != nil {
+					t.Fatalf("failed to open blob: %v", err)
+				}
+				var got []string
+				tocEnts := make(map[string]*TOCEntry)
+				for _, e := range r.toc.Entries {
+					switch name := cleanEntryName(e.Name); {
+					case e.Type == "chunk", name == PrefetchLandmark, name == NoPrefetchLandmark:
+					default:
+						got = append(got, name)
+						tocEnts[name] = e
+					}
+				}
+				var wantNames []string
+				for name := range tt.want {
+					wantNames = append(wantNames, name)
+				}
+				sort.Strings(got)
+				sort.Strings(wantNames)
+				if !reflect.DeepEqual(got, wantNames) {
+					t.Fatalf("entries = %v; want %v", got, wantNames)
+				}
+				for name, w := range tt.want {
+					// Lookup resolves hardlinks so the TOC entry is checked.
+					e := tocEnts[name]
+					if e.Type != w.typ || e.LinkName != w.linkName || e.UID != w.uid || e.GID != w.gid {
+						t.Errorf("%q = (%q, %q, %d, %d); want (%q, %q, %d, %d)", name,
+							e.Type, e.LinkName, e.UID, e.GID, w.typ, w.linkName, w.uid, w.gid)
+					}
+					if w.typ != "reg" || e.Size == 0 {
+						continue
+					}
+					fr, err := r.OpenFile(name)
+					if err != nil {
+						t.Fatalf("failed to open %q: %v", name, err)
+					}
+					data, err := ioutil.ReadAll(io.NewSectionReader(fr, 0, e.Size))
+					if err != nil {
+						t.Fatalf("failed to read %q: %v", name, err)
+					}
+					if string(data) != w.contents {
+						t.Errorf("contents of %q = %q; want %q", name, data, w.contents)
+					}
+				}
+				if len(tt.prioritize) > 0 {
+					landmark, ok := r.Lookup(PrefetchLandmark)
+					if !ok {
+						t.Fatalf("landmark not found")
+					}
+					for _, name := range tt.prioritize {
+						if e, _ := r.Lookup(name); e.Offset >= landmark.Offset {
+							t.Errorf("%q must precede the landmark", name)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestTransformTarSplit(t *testing.T) {
+	_, err := Build(buildTarStatic(t, tarOf(file("foo", "foo")), ""),
+		WithTarSplit(), WithExcludePatterns("foo"))
+	if err == nil {
+		t.Errorf("WithTarSplit must not be used with WithExcludePatterns")
+	}
+	if _, err := Build(buildTarStatic(t, tarOf(file("foo", "foo")), ""),
+		WithExcludePatterns("[")); err == nil {
+		t.Errorf("invalid pattern must be rejected")
+	}
+}
+
+func TestMatchExcludePatterns(t *testing.T) {
+	patterns := []string{"*.pyc", "__pycache__", "usr/share/doc", "var/cache/*"}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"a.pyc", true},
+		{"app/lib/a.pyc", true},
+		{"app/a.py", false},
+		{"app/__pycache__", true},
+		{"app/__pycache__/a", true},
+		{"usr/share/doc", true},
+		{"usr/share/doc/README", true},
+		{"usr/share/docs", false},
+		{"share/doc", false},
+		{"var/cache", false},
+		{"var/cache/apt/a", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := matchExcludePatterns(patterns, tt.name); got != tt.want {
+			t.Errorf("matchExcludePatterns(%q) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+	for name, want := range map[string]string{
+		"app/.wh.a.pyc":      "app/a.pyc",
+		"./app/.wh..wh..opq": "app/.wh..wh..opq",
+		"app/a":              "app/a",
+	} {
+		if got := whiteoutTarget(name); got != want {
+			t.Errorf("whiteoutTarget(%q) = %q; want %q", name, got, want)
+		}
+	}
+}
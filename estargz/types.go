@@ -23,6 +23,8 @@
 package estargz
 
 import (
+	"hash"
+	"io"
 	"os"
 	"path"
 	"time"
@@ -35,6 +37,11 @@ const (
 	// table of contents gzip stream.
 	TOCTarName = "stargz.index.json"
 
+	// TOCSignatureTarName is the name of the file containing the signature of
+	// the TOC digest (see SignTOC). This follows the TOC JSON file in the
+	// table of contents gzip stream if the TOC is signed.
+	TOCSignatureTarName = "stargz.index.json.sig"
+
 	// FooterSize is the number of bytes in the footer
 	//
 	// The footer is an empty gzip stream with no compression and an Extra
@@ -72,6 +79,13 @@ const (
 	// of an image manifest.
 	TOCJSONDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
 
+	// TOCSizeAnnotation is an annotation for an image layer. This stores the
+	// size of the TOC and the footer at the tail of the blob, in decimal, so
+	// that they can be read in a single request (see WithTailFetchSize).
+	// This annotation is valid only when it is specified in `.[]layers.annotations`
+	// of an image manifest.
+	TOCSizeAnnotation = "containerd.io/snapshot/stargz/toc.size"
+
 	// PrefetchLandmark is a file entry which indicates the end position of
 	// prefetch in the stargz file.
 	PrefetchLandmark = ".prefetch.landmark"
@@ -80,13 +94,56 @@ const (
 	// occur in the stargz file.
 	NoPrefetchLandmark = ".no.prefetch.landmark"
 
+	// TarSplitName is a file entry which contains the metadata to reconstruct
+	// the original tar of the blob. See WithTarSplit.
+	TarSplitName = ".tar-split.json"
+
 	landmarkContents = 0xf
 )
 
-// jtoc is the JSON-serialized table of contents index of the files in the stargz file.
-type jtoc struct {
+// JTOC is the JSON-serialized table of contents index of the files in the stargz file.
+// This is exported so that Compressor and Decompressor implementations outside of
+// this package can serialize and parse it.
+type JTOC struct {
 	Version int         `json:"version"`
 	Entries []*TOCEntry `json:"entries"`
+
+	// PrefetchProfiles are the named lists of files to prefetch for each
+	// workload of the layer. Runtimes choose one of them instead of
+	// PrefetchLandmark (e.g. by a snapshot label). See WithPrefetchProfile.
+	PrefetchProfiles []*PrefetchProfile `json:"prefetchProfiles,omitempty"`
+
+	// Compact makes MarshalTOC serialize this TOC in the compact binary
+	// encoding instead of JSON. This is useful for layers with very many
+	// files. UnmarshalTOC sets this when it decodes the compact encoding.
+	Compact bool `json:"-"`
+
+	// Signature is the signature of the digest of the serialized TOC (see
+	// SignTOC). This isn't a part of the serialized TOC. Compressors write it
+	// next to the TOC if non-empty and decompressors set it if found.
+	Signature []byte `json:"-"`
+}
+
+// PrefetchProfile is a named list of files to prefetch, in the order they are
+// needed by the workload.
+type PrefetchProfile struct {
+	// Name is the name of the profile which is unique in the TOC.
+	Name string `json:"name"`
+
+	// Files are the regular files to prefetch.
+	Files []PrefetchFile `json:"files"`
+}
+
+// PrefetchFile is a file in a PrefetchProfile.
+type PrefetchFile struct {
+	// Name is the name of the TOCEntry of the file.
+	Name string `json:"name"`
+
+	// Offset and Size are the range of the blob storing the chunks of the file.
+	// Ranges of files sharing a compressed stream (e.g. packed small files)
+	// overlap.
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
 }
 
 // TOCEntry is an entry in the stargz file's TOC (Table of Contents).
@@ -140,7 +197,13 @@ type TOCEntry struct {
 	// ChunkSize.
 	Offset int64 `json:"offset,omitempty"`
 
-	nextOffset int64 // the Offset of the next entry with a non-zero Offset
+	// InnerOffset is non-zero if the data of this entry doesn't start at the
+	// beginning of the compressed stream at Offset (e.g. small files packed
+	// into a stream shared with preceding entries). If so, the data starts
+	// InnerOffset bytes after the beginning of the decompressed stream.
+	InnerOffset int64 `json:"innerOffset,omitempty"`
+
+	nextOffset int64 // the next Offset after the stream at Offset
 
 	// DevMajor is the major device number for "char" and "block" types.
 	DevMajor int `json:"devMajor,omitempty"`
@@ -175,6 +238,13 @@ type TOCEntry struct {
 	// as "sha256:0123abcd...".
 	ChunkDigest string `json:"chunkDigest,omitempty"`
 
+	// Sparse is true if the regular file is sparse. Chunks of a sparse file
+	// only cover the regions containing data and always have ChunkSize.
+	// Ranges not covered by any chunk are holes which read as zeros. If a
+	// sparse file has no data, its "reg" entry has neither Offset nor
+	// ChunkSize.
+	Sparse bool `json:"sparse,omitempty"`
+
 	children map[string]*TOCEntry
 }
 
@@ -254,3 +324,64 @@ type TOCEntryVerifier interface {
 	// contents of the specified TOCEntry.
 	Verifier(ce *TOCEntry) (digest.Verifier, error)
 }
+
+// Compression provides the compression helper to be used creating and parsing eStargz.
+// This package provides gzip-based Compression by default, but any compression
+// algorithm (e.g. zstd) can be supported by implementing this interface.
+type Compression interface {
+	Compressor
+	Decompressor
+}
+
+// Compressor represents the helper methods to be used for creating eStargz.
+type Compressor interface {
+	// Writer returns WriteCloser to be used for writing a chunk to eStargz.
+	// Everytime a chunk is written, the WriteCloser is closed and Writer is
+	// called again for writing the next chunk.
+	Writer(w io.Writer) (io.WriteCloser, error)
+
+	// WriteTOCAndFooter is called to write JTOC and the footer to the passed
+	// Writer. off is the offset where the TOC starts in the blob.
+	// WriteTOCAndFooter must write anything that is a part of the uncompressed
+	// tar stream (e.g. tar header of TOC JSON, tar EOF) to diffHash as well,
+	// if diffHash is non-nil.
+	//
+	// This function returns tocDgst that represents the digest of TOC that will
+	// be used to verify this blob when it's parsed.
+	WriteTOCAndFooter(w io.Writer, off int64, toc *JTOC, diffHash hash.Hash) (tocDgst digest.Digest, err error)
+}
+
+// StoreCompressor is an optional interface of Compressor which can write a
+// chunk without compressing it (e.g. as stored-only deflate blocks). The output
+// must be decompressed by the Decompressor of the Compressor as usual. Writer
+// uses this for files chosen by its StorePolicy.
+type StoreCompressor interface {
+	// StoreWriter is the same as Compressor.Writer but the returned
+	// WriteCloser doesn't compress the chunk.
+	StoreWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// Decompressor represents the helper methods to be used for parsing eStargz.
+type Decompressor interface {
+	// Reader returns ReadCloser to be used for decompressing file payload.
+	// The returned reader must be able to read through the subsequent chunks.
+	Reader(r io.Reader) (io.ReadCloser, error)
+
+	// FooterSize returns the size of the footer of this blob.
+	FooterSize() int64
+
+	// ParseFooter parses the footer and returns the offset and the (compressed)
+	// size of TOC. Negative tocSize means the TOC lasts until the footer.
+	// blobPayloadSize is the size of the blob excluding the TOC and the footer
+	// (i.e. the offset where the TOC section written by WriteTOCAndFooter starts).
+	ParseFooter(p []byte) (blobPayloadSize, tocOffset, tocSize int64, err error)
+
+	// ParseTOC parses TOC from the passed reader. The reader provides the partial
+	// contents of the underlying blob that has the range specified by ParseFooter
+	// method.
+	//
+	// This function returns tocDgst that represents the digest of TOC that will
+	// be used to verify this blob. This must match to the value returned from
+	// Compressor.WriteTOCAndFooter that is used when creating this blob.
+	ParseTOC(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error)
+}
@@ -0,0 +1,180 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// ErrNotLegacyStargz is returned by Upgrade if the blob isn't a legacy stargz
+// blob.
+var ErrNotLegacyStargz = errors.New("not a legacy stargz blob")
+
+// ErrUpgradeUnsupported is returned by Upgrade if some of the options need to
+// rewrite the payload of the legacy blob.
+var ErrUpgradeUnsupported = errors.New("option unsupported by Upgrade")
+
+// Upgrade upgrades the legacy (CRFS-era) stargz blob into eStargz. Legacy
+// stargz doesn't record digests of chunks in the TOC so its contents can't be
+// verified. Upgrade reads the blob once to compute the digests of all files and
+// chunks and writes the new TOC and the eStargz footer. The compressed payload
+// of the legacy blob is reused byte-for-byte so offsets recorded in the TOC
+// don't change.
+//
+// If the footer of the blob isn't a legacy stargz footer, this returns
+// ErrNotLegacyStargz. Errors of reading the blob are returned as is.
+// WithCompressionLevel and WithCompactTOC options are respected for writing the
+// TOC. Options changing the payload or the entries (e.g. WithChunkSize,
+// WithPrioritizedFiles and WithPrefetchProfile) and WithTOCSigningKey aren't
+// supported and ErrUpgradeUnsupported is returned if they are specified. Other
+// options (e.g. WithTempDir) are ignored.
+func Upgrade(legacy *io.SectionReader, opt ...Option) (*Blob, error) {
+	var opts options
+	opts.compressionLevel = gzip.BestCompression // BestCompression by default
+	for _, o := range opt {
+		if err := o(&opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.chunkSize != 0 || opts.minChunkSize != 0 || len(opts.prioritizedFiles) > 0 ||
+		opts.compression != nil || opts.sourceDateEpoch != nil || opts.contentDefinedChunking ||
+		opts.tarSplit || opts.storePolicy != nil || opts.dedup || opts.tocSigningKey != nil ||
+		len(opts.prefetchProfiles) > 0 || opts.transformer.enabled() {
+		return nil, ErrUpgradeUnsupported
+	}
+	ld := new(legacyGzipDecompressor)
+	if legacy.Size() < ld.FooterSize() {
+		return nil, ErrNotLegacyStargz
+	}
+	footer := make([]byte, ld.FooterSize())
+	if _, err := legacy.ReadAt(footer, legacy.Size()-ld.FooterSize()); err != nil {
+		return nil, errors.Wrap(err, "failed to read footer")
+	}
+	d, payloadSize, tocOff, tocSize, err := parseBlobFooter(footer, legacy.Size(), []Decompressor{ld})
+	if err != nil {
+		return nil, ErrNotLegacyStargz
+	}
+	toc, _, err := d.ParseTOC(io.NewSectionReader(legacy, tocOff, tocSize))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse TOC of the legacy blob")
+	}
+	if err := fillDigests(toc, legacy, payloadSize); err != nil {
+		return nil, err
+	}
+	toc.Compact = toc.Compact || opts.compactTOC
+
+	tocAndFooter := new(bytes.Buffer)
+	tocDgst, err := NewGzipCompressorWithLevel(opts.compressionLevel).WriteTOCAndFooter(tocAndFooter, payloadSize, toc, nil)
+	if err != nil {
+		return nil, err
+	}
+	tocSize = int64(tocAndFooter.Len())
+	diffID := digest.Canonical.Digester()
+	pr, pw := io.Pipe()
+	go func() {
+		r, err := d.Reader(io.TeeReader(io.MultiReader(
+			io.NewSectionReader(legacy, 0, payloadSize), tocAndFooter), pw))
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		defer r.Close()
+		if _, err := io.Copy(diffID.Hash(), r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Close()
+	}()
+	return &Blob{
+		ReadCloser: readCloser{
+			Reader:    pr,
+			closeFunc: func() error { return nil },
+		},
+		tocDigest: tocDgst,
+		tocSize:   tocSize,
+		diffID:    diffID,
+	}, nil
+}
+
+// fillDigests reads the payload of the blob and records the digests of files
+// and chunks to the TOC.
+func fillDigests(toc *JTOC, sr *io.SectionReader, payloadSize int64) error {
+	// Chunks of each file in the TOC keyed by the cleaned name. Entries of
+	// the same file appear in the order of the tar stream.
+	chunks := make(map[string][][]*TOCEntry)
+	var last string
+	for _, e := range toc.Entries {
+		if e.Type == "chunk" {
+			if g := chunks[last]; len(g) > 0 {
+				g[len(g)-1] = append(g[len(g)-1], e)
+			}
+			continue
+		}
+		last = cleanEntryName(e.Name)
+		if e.Type == "reg" && e.Size > 0 {
+			chunks[last] = append(chunks[last], []*TOCEntry{e})
+		}
+	}
+
+	zr, err := gzip.NewReader(io.NewSectionReader(sr, 0, payloadSize))
+	if err != nil {
+		return errors.Wrapf(err, "failed to decompress the payload")
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to read the payload")
+		}
+		name := cleanEntryName(h.Name)
+		g := chunks[name]
+		if h.Typeflag != tar.TypeReg || h.Size == 0 || len(g) == 0 {
+			continue
+		}
+		ents := g[0]
+		chunks[name] = g[1:]
+		fileDigester := digest.Canonical.Digester()
+		for i, e := range ents {
+			size := e.ChunkSize
+			if size == 0 || i == len(ents)-1 {
+				size = h.Size - e.ChunkOffset
+			}
+			chunkDigester := digest.Canonical.Digester()
+			if _, err := io.CopyN(io.MultiWriter(fileDigester.Hash(), chunkDigester.Hash()), tr, size); err != nil {
+				return errors.Wrapf(err, "failed to read chunk of %q at %d", h.Name, e.ChunkOffset)
+			}
+			e.ChunkDigest = chunkDigester.Digest().String()
+		}
+		ents[0].Digest = fileDigester.Digest().String()
+	}
+	for name, g := range chunks {
+		if len(g) > 0 {
+			return fmt.Errorf("file %q in the TOC not found in the payload", name)
+		}
+	}
+	return nil
+}
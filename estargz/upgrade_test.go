@@ -0,0 +1,222 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestUpgrade(t *testing.T) {
+	want := map[string]string{
+		"foo/a": longstring(3000),
+		"foo/b": "bar",
+		"foo/c": "",
+	}
+	for _, compact := range []bool{false, true} {
+		compact := compact
+		t.Run(fmt.Sprintf("compact=%v", compact), func(t *testing.T) {
+			legacy := legacyStargz(t, tarOf(
+				dir("foo/"),
+				file("foo/a", want["foo/a"]),
+				file("foo/b", want["foo/b"]),
+				file("foo/c", want["foo/c"]),
+				symlink("foo/d", "b"),
+			))
+			legacySR := io.NewSectionReader(bytes.NewReader(legacy), 0, int64(len(legacy)))
+			lr, err := Open(legacySR)
+			if err != nil {
+				t.Fatalf("failed to open legacy blob: %v", err)
+			}
+			if _, err := lr.VerifyTOC(lr.tocDigest); err == nil {
+				t.Fatalf("legacy blob must not be verifiable")
+			}
+			_, payloadSize, _, _, err := openFooter(legacySR, gzipDecompressors())
+			if err != nil {
+				t.Fatalf("failed to parse footer of legacy blob: %v", err)
+			}
+
+			var opts []Option
+			if compact {
+				opts = append(opts, WithCompactTOC())
+			}
+			blob, err := Upgrade(legacySR, opts...)
+			if err != nil {
+				t.Fatalf("failed to upgrade: %v", err)
+			}
+			b, err := ioutil.ReadAll(blob)
+			if err != nil {
+				t.Fatalf("failed to read upgraded blob: %v", err)
+			}
+			blob.Close()
+
+			// The payload of the legacy blob must be reused as is.
+			if !bytes.Equal(b[:payloadSize], legacy[:payloadSize]) {
+				t.Errorf("payload of the legacy blob isn't reused")
+			}
+			sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+			if err := Check(sr, WithCheckTOCDigest(blob.TOCDigest()), WithCheckDiffID(blob.DiffID())); err != nil {
+				t.Fatalf("failed to check upgraded blob: %v", err)
+			}
+			r, err := Open(sr)
+			if err != nil {
+				t.Fatalf("failed to open upgraded blob: %v", err)
+			}
+			if r.toc.Compact != compact {
+				t.Errorf("compact = %v; want %v", r.toc.Compact, compact)
+			}
+			v, err := r.VerifyTOC(blob.TOCDigest())
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			for name, contents := range want {
+				e, ok := r.Lookup(name)
+				if !ok {
+					t.Fatalf("%q not found", name)
+				}
+				if e.Size == 0 {
+					continue
+				}
+				fr, err := r.OpenFile(name)
+				if err != nil {
+					t.Fatalf("failed to open %q: %v", name, err)
+				}
+				got, err := ioutil.ReadAll(io.NewSectionReader(fr, 0, e.Size))
+				if err != nil {
+					t.Fatalf("failed to read %q: %v", name, err)
+				}
+				if string(got) != contents {
+					t.Errorf("unexpected contents of %q", name)
+				}
+				for off := int64(0); off < e.Size; {
+					ce, ok := r.ChunkEntryForOffset(name, off)
+					if !ok {
+						t.Fatalf("chunk of %q at %d not found", name, off)
+					}
+					cv, err := v.Verifier(ce)
+					if err != nil {
+						t.Fatalf("verifier of %q at %d not found: %v", name, off, err)
+					}
+					cv.Write([]byte(contents[ce.ChunkOffset : ce.ChunkOffset+ce.ChunkSize]))
+					if !cv.Verified() {
+						t.Errorf("chunk of %q at %d isn't verified", name, off)
+					}
+					off = ce.ChunkOffset + ce.ChunkSize
+				}
+			}
+
+			// eStargz can't be upgraded.
+			if _, err := Upgrade(sr); errors.Cause(err) != ErrNotLegacyStargz {
+				t.Errorf("upgrading eStargz = %v; want %v", err, ErrNotLegacyStargz)
+			}
+		})
+	}
+}
+
+func TestUpgradeErrors(t *testing.T) {
+	legacy := legacyStargz(t, tarOf(file("foo", "bar")))
+	legacySR := io.NewSectionReader(bytes.NewReader(legacy), 0, int64(len(legacy)))
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	for _, opt := range []Option{
+		WithChunkSize(100),
+		WithPrioritizedFiles([]string{"foo"}),
+		WithTOCSigningKey(key),
+		WithPrefetchProfile("boot", []string{"foo"}),
+		WithTarSplit(),
+	} {
+		if _, err := Upgrade(legacySR, opt); errors.Cause(err) != ErrUpgradeUnsupported {
+			t.Errorf("Upgrade() = %v; want %v", err, ErrUpgradeUnsupported)
+		}
+	}
+
+	// Errors of reading the blob must not be reported as ErrNotLegacyStargz.
+	readErr := errors.New("read failure")
+	sr := io.NewSectionReader(failReaderAt{readErr}, 0, int64(len(legacy)))
+	if _, err := Upgrade(sr); errors.Cause(err) != readErr {
+		t.Errorf("Upgrade() = %v; want %v", err, readErr)
+	}
+	short := io.NewSectionReader(bytes.NewReader(legacy[:10]), 0, 10)
+	if _, err := Upgrade(short); errors.Cause(err) != ErrNotLegacyStargz {
+		t.Errorf("upgrading short blob = %v; want %v", err, ErrNotLegacyStargz)
+	}
+}
+
+type failReaderAt struct{ err error }
+
+func (r failReaderAt) ReadAt([]byte, int64) (int, error) { return 0, r.err }
+
+// legacyStargz returns a legacy stargz blob of the entries. This builds
+// eStargz then removes digests from the TOC and replaces the footer with the
+// legacy one.
+func legacyStargz(t *testing.T, ents []tarEntry) []byte {
+	blob, err := Build(buildTarStatic(t, ents, ""), WithChunkSize(1000))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	defer blob.Close()
+	b, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+	d, _, tocOff, tocSize, err := openFooter(sr, gzipDecompressors())
+	if err != nil {
+		t.Fatalf("failed to parse footer: %v", err)
+	}
+	toc, _, err := d.ParseTOC(io.NewSectionReader(sr, tocOff, tocSize))
+	if err != nil {
+		t.Fatalf("failed to parse TOC: %v", err)
+	}
+	for _, e := range toc.Entries {
+		e.Digest, e.ChunkDigest = "", ""
+	}
+	tocJSON, err := json.Marshal(toc)
+	if err != nil {
+		t.Fatalf("failed to marshal TOC: %v", err)
+	}
+	buf := bytes.NewBuffer(append([]byte{}, b[:tocOff]...))
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: TOCTarName, Size: int64(len(tocJSON))}); err != nil {
+		t.Fatalf("failed to write TOC header: %v", err)
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		t.Fatalf("failed to write TOC: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close gzip: %v", err)
+	}
+	buf.Write(legacyFooterBytes(tocOff))
+	return buf.Bytes()
+}
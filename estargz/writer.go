@@ -0,0 +1,149 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// EntryMetadata is the metadata of an entry added to Writer without tar input.
+type EntryMetadata struct {
+	// Mode is the permission and mode bits (e.g. 0755 or 04755) in the same
+	// way as tar.Header.Mode. The file type is specified by the method adding
+	// the entry.
+	Mode int64
+
+	// UID and GID are the owner of the entry.
+	UID, GID int
+
+	// Uname and Gname are optional names of the owner.
+	Uname, Gname string
+
+	// ModTime is the modification time of the entry.
+	ModTime time.Time
+
+	// Xattrs are the extended attributes of the entry.
+	Xattrs map[string][]byte
+}
+
+// AppendEntry appends a single tar entry whose header is h. r must provide
+// h.Size bytes of the contents if h is a regular file and is ignored
+// otherwise. The entry is written in the same way as AppendTar writes the
+// entry read from a tar, so chunks, digests and TOC entries are the same as
+// the ones AppendTar produces for a tar containing h.
+func (w *Writer) AppendEntry(h *tar.Header, r io.Reader) error {
+	switch h.Name {
+	case TOCTarName, TOCSignatureTarName:
+		return fmt.Errorf("entry name %q is reserved", h.Name)
+	}
+	if r == nil {
+		r = bytes.NewReader(nil)
+	}
+	return w.appendEntry(h, r)
+}
+
+// AddDir appends a directory. "/" is appended to name if it doesn't end with
+// it as tar archivers do.
+func (w *Writer) AddDir(name string, md EntryMetadata) error {
+	if !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	return w.AppendEntry(md.header(tar.TypeDir, name), nil)
+}
+
+// AddFile appends a regular file whose contents are size bytes read from r.
+func (w *Writer) AddFile(name string, md EntryMetadata, size int64, r io.Reader) error {
+	h := md.header(tar.TypeReg, name)
+	h.Size = size
+	return w.AppendEntry(h, r)
+}
+
+// AddSymlink appends a symbolic link to target.
+func (w *Writer) AddSymlink(name, target string, md EntryMetadata) error {
+	h := md.header(tar.TypeSymlink, name)
+	h.Linkname = target
+	return w.AppendEntry(h, nil)
+}
+
+// AddHardlink appends a hard link to target which must be added before.
+func (w *Writer) AddHardlink(name, target string, md EntryMetadata) error {
+	h := md.header(tar.TypeLink, name)
+	h.Linkname = target
+	return w.AppendEntry(h, nil)
+}
+
+// AddCharDevice appends a character device.
+func (w *Writer) AddCharDevice(name string, major, minor int64, md EntryMetadata) error {
+	h := md.header(tar.TypeChar, name)
+	h.Devmajor, h.Devminor = major, minor
+	return w.AppendEntry(h, nil)
+}
+
+// AddBlockDevice appends a block device.
+func (w *Writer) AddBlockDevice(name string, major, minor int64, md EntryMetadata) error {
+	h := md.header(tar.TypeBlock, name)
+	h.Devmajor, h.Devminor = major, minor
+	return w.AppendEntry(h, nil)
+}
+
+// AddFifo appends a named pipe.
+func (w *Writer) AddFifo(name string, md EntryMetadata) error {
+	return w.AppendEntry(md.header(tar.TypeFifo, name), nil)
+}
+
+// AddWhiteout appends a whiteout hiding name in the lower layers. The whiteout
+// is an empty regular file named ".wh.<base name>" in the same directory as
+// the OCI image spec defines.
+func (w *Writer) AddWhiteout(name string, md EntryMetadata) error {
+	name = cleanEntryName(name)
+	if name == "" {
+		return fmt.Errorf("root directory can't be whited out")
+	}
+	return w.AddFile(path.Join(path.Dir(name), whiteoutPrefix+path.Base(name)), md, 0, nil)
+}
+
+// AddOpaqueWhiteout appends an opaque whiteout hiding all children of the
+// directory dir in the lower layers.
+func (w *Writer) AddOpaqueWhiteout(dir string, md EntryMetadata) error {
+	return w.AddFile(path.Join(cleanEntryName(dir), whiteoutOpaque), md, 0, nil)
+}
+
+func (md EntryMetadata) header(typ byte, name string) *tar.Header {
+	h := &tar.Header{
+		Typeflag: typ,
+		Name:     name,
+		Mode:     md.Mode,
+		Uid:      md.UID,
+		Gid:      md.GID,
+		Uname:    md.Uname,
+		Gname:    md.Gname,
+		ModTime:  md.ModTime,
+	}
+	if len(md.Xattrs) > 0 {
+		h.PAXRecords = make(map[string]string, len(md.Xattrs))
+		for k, v := range md.Xattrs {
+			h.PAXRecords["SCHILY.xattr."+k] = string(v)
+		}
+	}
+	return h
+}
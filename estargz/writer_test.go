@@ -0,0 +1,169 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriterAddEntries(t *testing.T) {
+	modTime := time.Unix(1600000000, 0)
+	md := EntryMetadata{Mode: 0644, UID: 1000, GID: 1000, Uname: "user", Gname: "group", ModTime: modTime}
+	xmd := md
+	xmd.Xattrs = map[string][]byte{"user.foo": []byte("bar")}
+	dmd := md
+	dmd.Mode = 0755
+	large := longstring(5000)
+	hdr := func(typ byte, name string, mode int64, fill ...func(h *tar.Header)) *tar.Header {
+		h := &tar.Header{Typeflag: typ, Name: name, Mode: mode, Uid: 1000, Gid: 1000,
+			Uname: "user", Gname: "group", ModTime: modTime}
+		for _, f := range fill {
+			f(h)
+		}
+		return h
+	}
+	ops := []struct {
+		add  func(w *Writer) error
+		h    *tar.Header
+		data string
+	}{
+		{
+			add: func(w *Writer) error { return w.AddDir("foo", dmd) },
+			h:   hdr(tar.TypeDir, "foo/", 0755),
+		},
+		{
+			add:  func(w *Writer) error { return w.AddFile("foo/large", md, int64(len(large)), strings.NewReader(large)) },
+			h:    hdr(tar.TypeReg, "foo/large", 0644, func(h *tar.Header) { h.Size = int64(len(large)) }),
+			data: large,
+		},
+		{
+			add:  func(w *Writer) error { return w.AddFile("foo/xattr", xmd, 3, strings.NewReader("baz")) },
+			h:    hdr(tar.TypeReg, "foo/xattr", 0644, func(h *tar.Header) { h.Size = 3; h.PAXRecords = map[string]string{"SCHILY.xattr.user.foo": "bar"} }),
+			data: "baz",
+		},
+		{
+			add: func(w *Writer) error { return w.AddFile("foo/empty", md, 0, nil) },
+			h:   hdr(tar.TypeReg, "foo/empty", 0644),
+		},
+		{
+			add: func(w *Writer) error { return w.AddSymlink("foo/symlink", "large", md) },
+			h:   hdr(tar.TypeSymlink, "foo/symlink", 0644, func(h *tar.Header) { h.Linkname = "large" }),
+		},
+		{
+			add: func(w *Writer) error { return w.AddHardlink("foo/hardlink", "foo/large", md) },
+			h:   hdr(tar.TypeLink, "foo/hardlink", 0644, func(h *tar.Header) { h.Linkname = "foo/large" }),
+		},
+		{
+			add: func(w *Writer) error { return w.AddCharDevice("foo/char", 1, 3, md) },
+			h:   hdr(tar.TypeChar, "foo/char", 0644, func(h *tar.Header) { h.Devmajor, h.Devminor = 1, 3 }),
+		},
+		{
+			add: func(w *Writer) error { return w.AddBlockDevice("foo/block", 8, 1, md) },
+			h:   hdr(tar.TypeBlock, "foo/block", 0644, func(h *tar.Header) { h.Devmajor, h.Devminor = 8, 1 }),
+		},
+		{
+			add: func(w *Writer) error { return w.AddFifo("foo/fifo", md) },
+			h:   hdr(tar.TypeFifo, "foo/fifo", 0644),
+		},
+		{
+			add: func(w *Writer) error { return w.AddWhiteout("/foo/deleted", md) },
+			h:   hdr(tar.TypeReg, "foo/.wh.deleted", 0644),
+		},
+		{
+			add: func(w *Writer) error { return w.AddOpaqueWhiteout("bar/", md) },
+			h:   hdr(tar.TypeReg, "bar/.wh..wh..opq", 0644),
+		},
+	}
+	for _, cl := range testCompressions() {
+		for _, minChunkSize := range []int{0, 4096} {
+			cl, minChunkSize := cl, minChunkSize
+			t.Run(fmt.Sprintf("compression=%v,minChunkSize=%d", cl, minChunkSize), func(t *testing.T) {
+				newWriter := func(buf *bytes.Buffer) *Writer {
+					w := NewWriterWithCompressor(buf, cl)
+					w.ChunkSize = 1000
+					w.MinChunkSize = minChunkSize
+					return w
+				}
+
+				var tarBuf bytes.Buffer
+				tw := tar.NewWriter(&tarBuf)
+				for _, op := range ops {
+					if err := tw.WriteHeader(op.h); err != nil {
+						t.Fatalf("failed to write header of %q: %v", op.h.Name, err)
+					}
+					if _, err := tw.Write([]byte(op.data)); err != nil {
+						t.Fatalf("failed to write %q: %v", op.h.Name, err)
+					}
+				}
+				if err := tw.Close(); err != nil {
+					t.Fatalf("failed to close tar: %v", err)
+				}
+				var wantBuf bytes.Buffer
+				ww := newWriter(&wantBuf)
+				if err := ww.AppendTar(&tarBuf); err != nil {
+					t.Fatalf("failed to append tar: %v", err)
+				}
+				wantTOCDigest, err := ww.Close()
+				if err != nil {
+					t.Fatalf("failed to close writer: %v", err)
+				}
+
+				var gotBuf bytes.Buffer
+				gw := newWriter(&gotBuf)
+				for _, op := range ops {
+					if err := op.add(gw); err != nil {
+						t.Fatalf("failed to add %q: %v", op.h.Name, err)
+					}
+				}
+				gotTOCDigest, err := gw.Close()
+				if err != nil {
+					t.Fatalf("failed to close writer: %v", err)
+				}
+
+				if gotTOCDigest != wantTOCDigest {
+					t.Errorf("TOC digest = %v; want %v", gotTOCDigest, wantTOCDigest)
+				}
+				if gw.DiffID() != ww.DiffID() {
+					t.Errorf("DiffID = %v; want %v", gw.DiffID(), ww.DiffID())
+				}
+				if !bytes.Equal(gotBuf.Bytes(), wantBuf.Bytes()) {
+					t.Errorf("blob differs from the one built with AppendTar")
+				}
+				if err := gw.AddFile("foo/closed", md, 0, nil); err == nil {
+					t.Errorf("adding to closed writer must fail")
+				}
+			})
+		}
+	}
+}
+
+func TestWriterReservedNames(t *testing.T) {
+	w := NewWriter(new(bytes.Buffer))
+	for _, name := range []string{TOCTarName, TOCSignatureTarName} {
+		if err := w.AddFile(name, EntryMetadata{}, 0, nil); err == nil {
+			t.Errorf("adding %q must fail", name)
+		}
+	}
+	if err := w.AddWhiteout("/", EntryMetadata{}); err == nil {
+		t.Errorf("whiting out the root directory must fail")
+	}
+}
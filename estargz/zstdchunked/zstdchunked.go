@@ -0,0 +1,344 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package zstdchunked provides a zstd-based estargz.Compression.
+//
+// Each chunk is compressed as a zstd frame so the blob is still a valid zstd
+// stream. The TOC JSON is compressed with zstd and stored in a skippable frame
+// followed by the zstd frame terminating the tar stream and the footer which is
+// also a skippable frame. So decompressors unaware of this format can extract
+// the blob as a normal tar.zst. If the TOC is signed, the signature is stored in
+// a skippable frame preceding the compressed TOC in the TOC payload.
+package zstdchunked
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// FooterSize is the number of bytes in the zstd:chunked footer.
+	//
+	// The footer is a zstd skippable frame which contains the following
+	// 32 bytes payload in little-endian.
+	//
+	//   - 8 bytes: offset of the compressed TOC payload
+	//   - 8 bytes: size of the compressed TOC payload
+	//   - 8 bytes: size of the uncompressed TOC JSON
+	//   - 8 bytes: magic string FooterMagic
+	FooterSize = skippableFrameHeaderSize + footerPayloadSize
+
+	// FooterMagic is the magic string placed at the end of the footer.
+	FooterMagic = "ZSTDCHNK"
+
+	skippableFrameMagic      = 0x184D2A50
+	signatureFrameMagic      = 0x184D2A51
+	skippableFrameHeaderSize = 4 + 4 // magic + frame size
+	footerPayloadSize        = 8 + 8 + 8 + len(FooterMagic)
+
+	frameMagic = 0xFD2FB528
+
+	// Raw frames have no content size and a 128 KiB window, which is the
+	// maximum block size.
+	rawFrameHeaderDescriptor = 0x00
+	rawFrameWindowDescriptor = 7 << 3 // 1 << (10 + 7)
+	rawBlockMaxSize          = 128 << 10
+)
+
+// Compression is the zstd-based estargz.Compression.
+type Compression struct {
+	*Compressor
+	*Decompressor
+}
+
+// NewCompression returns a zstd-based estargz.Compression with the
+// specified zstd compression level.
+func NewCompression(level int) estargz.Compression {
+	return &Compression{
+		&Compressor{CompressionLevel: level},
+		&Decompressor{},
+	}
+}
+
+// Compressor is an estargz.Compressor which writes each chunk as a zstd frame.
+type Compressor struct {
+	// CompressionLevel is the zstd compression level (e.g. 3 for the
+	// default level of zstd).
+	CompressionLevel int
+
+	// encoders pools zstd encoders. Creating an encoder is expensive
+	// compared to compressing a chunk so they are reused among chunks.
+	encoders sync.Pool
+}
+
+// Writer implements estargz.Compressor.Writer. Each chunk is written as a
+// zstd frame.
+func (zc *Compressor) Writer(w io.Writer) (io.WriteCloser, error) {
+	if enc, ok := zc.encoders.Get().(*zstd.Encoder); ok {
+		enc.Reset(w)
+		return &pooledEncoder{enc, zc}, nil
+	}
+	enc, err := zstd.NewWriter(w,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(zc.CompressionLevel)),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithZeroFrames(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledEncoder{enc, zc}, nil
+}
+
+// pooledEncoder returns the encoder to the pool of the Compressor on Close.
+type pooledEncoder struct {
+	*zstd.Encoder
+	zc *Compressor
+}
+
+func (pe *pooledEncoder) Close() error {
+	if pe.Encoder == nil {
+		return nil
+	}
+	err := pe.Encoder.Close()
+	if err == nil {
+		pe.zc.encoders.Put(pe.Encoder)
+	}
+	pe.Encoder = nil
+	return err
+}
+
+// StoreWriter implements estargz.StoreCompressor.StoreWriter. Each chunk is
+// written as a zstd frame consisting of raw (uncompressed) blocks.
+func (zc *Compressor) StoreWriter(w io.Writer) (io.WriteCloser, error) {
+	return &rawFrameWriter{w: w}, nil
+}
+
+// rawFrameWriter writes a zstd frame of raw blocks. The frame header is
+// written on the first write and the last block is written on Close.
+type rawFrameWriter struct {
+	w             io.Writer
+	buf           []byte
+	headerWritten bool
+}
+
+func (rw *rawFrameWriter) Write(p []byte) (int, error) {
+	if err := rw.writeHeader(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if len(rw.buf) == rawBlockMaxSize {
+			if err := rw.writeBlock(false); err != nil {
+				return 0, err
+			}
+		}
+		l := rawBlockMaxSize - len(rw.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		rw.buf = append(rw.buf, p[:l]...)
+		p = p[l:]
+	}
+	return n, nil
+}
+
+func (rw *rawFrameWriter) Close() error {
+	if err := rw.writeHeader(); err != nil {
+		return err
+	}
+	return rw.writeBlock(true)
+}
+
+func (rw *rawFrameWriter) writeHeader() error {
+	if rw.headerWritten {
+		return nil
+	}
+	rw.headerWritten = true
+	h := make([]byte, 6)
+	binary.LittleEndian.PutUint32(h, frameMagic)
+	h[4] = rawFrameHeaderDescriptor
+	h[5] = rawFrameWindowDescriptor
+	_, err := rw.w.Write(h)
+	return err
+}
+
+func (rw *rawFrameWriter) writeBlock(last bool) error {
+	// 3 bytes little-endian block header: Last_Block (1 bit), Block_Type
+	// (2 bits; 0 is raw) and Block_Size (21 bits)
+	bh := uint32(len(rw.buf)) << 3
+	if last {
+		bh |= 1
+	}
+	if _, err := rw.w.Write([]byte{byte(bh), byte(bh >> 8), byte(bh >> 16)}); err != nil {
+		return err
+	}
+	_, err := rw.w.Write(rw.buf)
+	rw.buf = rw.buf[:0]
+	return err
+}
+
+// WriteTOCAndFooter implements estargz.Compressor.WriteTOCAndFooter. The
+// end-of-archive marker of tar is written as a zstd frame. Then the
+// compressed TOC and the footer are written as skippable frames so
+// they aren't included in the uncompressed tar stream.
+func (zc *Compressor) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := estargz.MarshalTOC(toc)
+	if err != nil {
+		return "", err
+	}
+
+	compressedTOC := new(bytes.Buffer)
+	if len(toc.Signature) > 0 {
+		// Decompressors skip this frame so the TOC JSON is still read as is.
+		compressedTOC.Write(skippableFrame(signatureFrameMagic, toc.Signature))
+	}
+	tocW, err := zc.Writer(compressedTOC)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tocW.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if err := tocW.Close(); err != nil {
+		return "", err
+	}
+
+	tocOff := off + skippableFrameHeaderSize
+	if _, err := w.Write(skippableFrame(skippableFrameMagic, compressedTOC.Bytes())); err != nil {
+		return "", err
+	}
+
+	// Terminate the tar stream.
+	eofW, err := zc.Writer(w)
+	if err != nil {
+		return "", err
+	}
+	tw := io.Writer(eofW)
+	if diffHash != nil {
+		tw = io.MultiWriter(eofW, diffHash)
+	}
+	if err := tar.NewWriter(tw).Close(); err != nil {
+		return "", err
+	}
+	if err := eofW.Close(); err != nil {
+		return "", err
+	}
+
+	if _, err := w.Write(footerBytes(tocOff, int64(compressedTOC.Len()), int64(len(tocJSON)))); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(tocJSON), nil
+}
+
+// Decompressor is an estargz.Decompressor for zstd:chunked blobs.
+type Decompressor struct{}
+
+// Reader implements estargz.Decompressor.Reader. Skippable frames are ignored.
+func (zd *Decompressor) Reader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// FooterSize implements estargz.Decompressor.FooterSize.
+func (zd *Decompressor) FooterSize() int64 {
+	return int64(FooterSize)
+}
+
+// ParseFooter implements estargz.Decompressor.ParseFooter. The returned
+// tocOffset and tocSize point to the compressed TOC payload. The skippable
+// frame of the TOC directly follows the blob payload.
+func (zd *Decompressor) ParseFooter(p []byte) (blobPayloadSize, tocOffset, tocSize int64, err error) {
+	if len(p) != FooterSize {
+		return 0, 0, 0, fmt.Errorf("zstdchunked: invalid length %d cannot be parsed", len(p))
+	}
+	if magic := binary.LittleEndian.Uint32(p[0:4]); magic != skippableFrameMagic {
+		return 0, 0, 0, fmt.Errorf("zstdchunked: footer isn't a skippable frame (magic %#x)", magic)
+	}
+	if size := binary.LittleEndian.Uint32(p[4:8]); size != uint32(footerPayloadSize) {
+		return 0, 0, 0, fmt.Errorf("zstdchunked: invalid footer frame size %d; want %d", size, footerPayloadSize)
+	}
+	payload := p[skippableFrameHeaderSize:]
+	if string(payload[24:]) != FooterMagic {
+		return 0, 0, 0, fmt.Errorf("zstdchunked: magic string %s not found", FooterMagic)
+	}
+	tocOffset = int64(binary.LittleEndian.Uint64(payload[0:8]))
+	tocSize = int64(binary.LittleEndian.Uint64(payload[8:16]))
+	if tocOffset < skippableFrameHeaderSize {
+		return 0, 0, 0, fmt.Errorf("zstdchunked: invalid TOC offset %d", tocOffset)
+	}
+	return tocOffset - skippableFrameHeaderSize, tocOffset, tocSize, nil
+}
+
+// ParseTOC implements estargz.Decompressor.ParseTOC. r must provide the
+// compressed TOC payload pointed by the footer.
+func (zd *Decompressor) ParseTOC(r io.Reader) (toc *estargz.JTOC, tocDgst digest.Digest, err error) {
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "zstdchunked: failed to read TOC payload")
+	}
+	var sig []byte
+	if len(payload) >= skippableFrameHeaderSize && binary.LittleEndian.Uint32(payload[0:4]) == signatureFrameMagic {
+		size := int64(binary.LittleEndian.Uint32(payload[4:8]))
+		if int64(len(payload)) < skippableFrameHeaderSize+size {
+			return nil, "", fmt.Errorf("zstdchunked: TOC signature frame is truncated")
+		}
+		sig = payload[skippableFrameHeaderSize : skippableFrameHeaderSize+size]
+	}
+	zr, err := zd.Reader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "zstdchunked: malformed TOC")
+	}
+	defer zr.Close()
+	tocBytes, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "zstdchunked: failed to read TOC")
+	}
+	if toc, err = estargz.UnmarshalTOC(tocBytes); err != nil {
+		return nil, "", errors.Wrapf(err, "zstdchunked: error decoding TOC")
+	}
+	toc.Signature = sig
+	return toc, digest.FromBytes(tocBytes), nil
+}
+
+func skippableFrame(magic uint32, payload []byte) []byte {
+	b := make([]byte, skippableFrameHeaderSize, skippableFrameHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(b[0:4], magic)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func footerBytes(tocOff, tocCompressedSize, tocUncompressedSize int64) []byte {
+	payload := make([]byte, footerPayloadSize)
+	binary.LittleEndian.PutUint64(payload[0:8], uint64(tocOff))
+	binary.LittleEndian.PutUint64(payload[8:16], uint64(tocCompressedSize))
+	binary.LittleEndian.PutUint64(payload[16:24], uint64(tocUncompressedSize))
+	copy(payload[24:], FooterMagic)
+	return skippableFrame(skippableFrameMagic, payload)
+}
@@ -0,0 +1,241 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zstdchunked
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type testFile struct {
+	name     string
+	contents string
+}
+
+var testFiles = []testFile{
+	{"foo.txt", "foo"},
+	{"bar/", ""},
+	{"bar/baz.txt", "baz baz baz baz baz baz"},
+	{"empty.txt", ""},
+	{"big.txt", string(bytes.Repeat([]byte("0123456789abcdef"), 20))},
+}
+
+func buildTar(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, f := range testFiles {
+		h := &tar.Header{Name: f.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(f.contents))}
+		if f.name[len(f.name)-1] == '/' {
+			h.Mode, h.Typeflag = 0755, tar.TypeDir
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(f.contents)); err != nil {
+			t.Fatalf("failed to write tar payload: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestWriteAndOpen(t *testing.T) {
+	tarBlob := buildTar(t)
+	for _, chunkSize := range []int{0, 3, 64} {
+		for _, level := range []int{1, 3, 9} {
+			for _, store := range []bool{false, true} {
+				chunkSize, level, store := chunkSize, level, store
+				t.Run(fmt.Sprintf("chunksize=%d-level=%d-store=%v", chunkSize, level, store), func(t *testing.T) {
+					var blobBuf bytes.Buffer
+					w := estargz.NewWriterWithCompressor(&blobBuf, &Compressor{CompressionLevel: level})
+					w.ChunkSize = chunkSize
+					if store {
+						w.StorePolicy = estargz.StoreByExtension(".txt")
+					}
+					if err := w.AppendTar(bytes.NewReader(tarBlob)); err != nil {
+						t.Fatalf("AppendTar: %v", err)
+					}
+					tocDigest, err := w.Close()
+					if err != nil {
+						t.Fatalf("Writer.Close: %v", err)
+					}
+					blob := blobBuf.Bytes()
+					checkBlob(t, blob, tocDigest.String(), w.DiffID())
+					// the first chunk of the repetitive file appears as is only if stored
+					big := testFiles[len(testFiles)-1].contents
+					if n := chunkSize; n == 0 || n >= 64 {
+						if n == 0 {
+							n = len(big)
+						}
+						if stored := bytes.Contains(blob, []byte(big[:n])); stored != store {
+							t.Errorf("big.txt: stored = %v; want %v", stored, store)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	for _, compactTOC := range []bool{false, true} {
+		for _, signed := range []bool{false, true} {
+			compactTOC, signed := compactTOC, signed
+			t.Run(fmt.Sprintf("compactTOC=%v,signed=%v", compactTOC, signed), func(t *testing.T) {
+				tarBlob := buildTar(t)
+				opts := []estargz.Option{estargz.WithChunkSize(5), estargz.WithCompression(NewCompression(3))}
+				if compactTOC {
+					opts = append(opts, estargz.WithCompactTOC())
+				}
+				if signed {
+					opts = append(opts, estargz.WithTOCSigningKey(key))
+				}
+				rc, err := estargz.Build(io.NewSectionReader(bytes.NewReader(tarBlob), 0, int64(len(tarBlob))), opts...)
+				if err != nil {
+					t.Fatalf("Build: %v", err)
+				}
+				defer rc.Close()
+				blob, err := ioutil.ReadAll(rc)
+				if err != nil {
+					t.Fatalf("failed to read the built blob: %v", err)
+				}
+				if err := rc.Close(); err != nil {
+					t.Fatalf("failed to close the built blob: %v", err)
+				}
+				checkBlob(t, blob, rc.TOCDigest().String(), rc.DiffID().String())
+
+				r, err := estargz.Open(io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob))),
+					estargz.WithDecompressors(new(Decompressor)))
+				if err != nil {
+					t.Fatalf("failed to open zstd:chunked blob: %v", err)
+				}
+				if _, err := r.VerifyTOCSignature(pub); (err == nil) != signed {
+					t.Errorf("VerifyTOCSignature = %v; want signed = %v", err, signed)
+				}
+			})
+		}
+	}
+}
+
+func checkBlob(t *testing.T, blob []byte, wantTOCDigest, wantDiffID string) {
+	// The blob must be a valid tar.zst for decompressors unaware of zstd:chunked.
+	dec, err := zstd.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("failed to create zstd reader: %v", err)
+	}
+	defer dec.Close()
+	h := sha256.New()
+	tr := tar.NewReader(io.TeeReader(dec, h))
+	var names []string
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+		names = append(names, th.Name)
+	}
+	if _, err := io.Copy(h, dec); err != nil {
+		t.Fatalf("failed to read remaining stream: %v", err)
+	}
+	if diffID := fmt.Sprintf("sha256:%x", h.Sum(nil)); diffID != wantDiffID {
+		t.Errorf("DiffID = %q; want %q", wantDiffID, diffID)
+	}
+	for _, f := range testFiles {
+		if !contains(names, f.name) {
+			t.Errorf("%q not found in the decompressed tar (got %v)", f.name, names)
+		}
+	}
+
+	sr := io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob)))
+	if _, err := estargz.Open(sr); err == nil {
+		t.Fatalf("zstd:chunked blob must not be opened without the decompressor")
+	}
+	r, err := estargz.Open(sr, estargz.WithDecompressors(new(Decompressor)))
+	if err != nil {
+		t.Fatalf("failed to open zstd:chunked blob: %v", err)
+	}
+	if _, err := r.VerifyTOC(digest.Digest(wantTOCDigest)); err != nil {
+		t.Errorf("failed to verify TOC: %v", err)
+	}
+	for _, f := range testFiles {
+		if f.name[len(f.name)-1] == '/' {
+			continue
+		}
+		fr, err := r.OpenFile(f.name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", f.name, err)
+		}
+		// Read from every offset so that reads start in the middle of chunks.
+		for off := 0; off < len(f.contents); off++ {
+			got := make([]byte, len(f.contents)-off)
+			if _, err := fr.ReadAt(got, int64(off)); err != nil && err != io.EOF {
+				t.Fatalf("failed to read %q at %d: %v", f.name, off, err)
+			}
+			if string(got) != f.contents[off:] {
+				t.Fatalf("unexpected contents of %q at %d: %q; want %q", f.name, off, got, f.contents[off:])
+			}
+		}
+	}
+}
+
+func TestFooter(t *testing.T) {
+	for _, off := range []int64{8, 9, 0x123456789abcdef} {
+		footer := footerBytes(off, 100, 200)
+		if len(footer) != FooterSize {
+			t.Fatalf("footer size = %d; want %d", len(footer), FooterSize)
+		}
+		gotPayloadSize, gotOff, gotSize, err := new(Decompressor).ParseFooter(footer)
+		if err != nil {
+			t.Fatalf("failed to parse footer: %v", err)
+		}
+		if gotPayloadSize != off-8 || gotOff != off || gotSize != 100 {
+			t.Errorf("ParseFooter = (%d, %d, %d); want (%d, %d, %d)",
+				gotPayloadSize, gotOff, gotSize, off-8, off, 100)
+		}
+		footer[len(footer)-1] ^= 0xff
+		if _, _, _, err := new(Decompressor).ParseFooter(footer); err == nil {
+			t.Errorf("footer with broken magic must not be parsed")
+		}
+	}
+}
+
+func contains(a []string, s string) bool {
+	for _, e := range a {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
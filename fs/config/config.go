@@ -31,6 +31,30 @@ const (
 	// the layer. If the layer is eStargz and contains prefetch landmarks, these config
 	// will be respeced.
 	TargetPrefetchSizeLabel = "containerd.io/snapshot/remote/stargz.prefetch"
+
+	// TargetPrefetchProfileLabel is a snapshot label key that indicates the name of
+	// the prefetch profile recorded in the TOC of the eStargz layer. If the layer
+	// contains the profile, the files listed in it are prefetched instead of the
+	// range specified by the landmarks or TargetPrefetchSizeLabel.
+	TargetPrefetchProfileLabel = "containerd.io/snapshot/remote/stargz.prefetch-profile"
+
+	// TargetPrefetchPathsLabel is a snapshot label key that indicates the comma-separated
+	// list of paths to prefetch in the layer which isn't optimized (i.e. contains no
+	// prefetch landmark). Each path can be a glob pattern of path.Match and directories
+	// matching it are prefetched recursively.
+	TargetPrefetchPathsLabel = "containerd.io/snapshot/remote/stargz.prefetch-paths"
+
+	// TargetPrefetchPathsFileLabel is a snapshot label key that indicates the path to a
+	// local file listing paths to prefetch in the same way as TargetPrefetchPathsLabel,
+	// one per line. Empty lines and lines starting with "#" are ignored. The path is
+	// relative to Config.PrefetchPathsDir and files outside of that directory can't be
+	// specified because labels are set by clients and images.
+	TargetPrefetchPathsFileLabel = "containerd.io/snapshot/remote/stargz.prefetch-paths-file"
+
+	// TargetZranIndexLabel is a snapshot label key that indicates the digest of the
+	// blob of the layer index (see fs/layerindex) of the non-eStargz tar.gz layer.
+	// The index blob must be stored in the same repository as the layer.
+	TargetZranIndexLabel = "containerd.io/snapshot/remote/zran.index"
 )
 
 type Config struct {
@@ -46,11 +70,34 @@ type Config struct {
 	DisableVerification bool   `toml:"disable_verification"`
 	MaxConcurrency      int64  `toml:"max_concurrency"`
 
+	// TOCSignatureKeys are paths to PEM-encoded public keys (ed25519 or ECDSA)
+	// trusted for verifying eStargz layers whose TOCs are signed (see
+	// estargz.WithTOCSigningKey). These are used when the TOC digest isn't
+	// passed through the layer annotation.
+	TOCSignatureKeys []string `toml:"toc_signature_keys"`
+
+	// TailFetchSize is the number of bytes speculatively read from the tail of
+	// eStargz layers for getting the footer and the TOC in a single request when
+	// the layer doesn't have the TOC size annotation. Zero means the default
+	// (1 MiB) and a negative value disables the speculative read.
+	TailFetchSize int64 `toml:"tail_fetch_size"`
+
+	// PrefetchPathsDir is the directory containing the lists of paths to
+	// prefetch which can be specified by TargetPrefetchPathsFileLabel. Empty
+	// disables that label.
+	PrefetchPathsDir string `toml:"prefetch_paths_dir"`
+
 	// BlobConfig is config for layer blob management.
 	BlobConfig `toml:"blob"`
 
 	// DirectoryCacheConfig is config for directory-based cache.
 	DirectoryCacheConfig `toml:"directory_cache"`
+
+	// ZranConfig is config for lazily pulling non-eStargz tar.gz layers.
+	ZranConfig `toml:"zran"`
+
+	// TarConfig is config for lazily pulling uncompressed tar layers.
+	TarConfig `toml:"tar"`
 }
 
 type BlobConfig struct {
@@ -65,3 +112,21 @@ type DirectoryCacheConfig struct {
 	MaxCacheFds      int  `toml:"max_cache_fds"`
 	SyncAdd          bool `toml:"sync_add"`
 }
+
+type ZranConfig struct {
+	// Enable enables lazily pulling non-eStargz tar.gz layers using layer indexes.
+	Enable bool `toml:"enable"`
+
+	// SpanSize is the interval of gzip checkpoints in the uncompressed layer.
+	SpanSize int64 `toml:"span_size"`
+
+	// NoLocalBuild disables building the index by fetching the whole layer when
+	// the index is neither stored locally nor provided as a blob.
+	NoLocalBuild bool `toml:"no_local_build"`
+}
+
+type TarConfig struct {
+	// Enable enables lazily pulling uncompressed tar layers. Contents of these
+	// layers can't be verified so the layer must be allowed to skip verification.
+	Enable bool `toml:"enable"`
+}
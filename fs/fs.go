@@ -38,12 +38,16 @@ package fs
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"context"
+	"crypto"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -59,6 +63,7 @@ import (
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/layerindex"
 	"github.com/containerd/stargz-snapshotter/fs/reader"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/fs/source"
@@ -85,6 +90,8 @@ const (
 	defaultResolveResultEntry = 100
 	defaultPrefetchTimeoutSec = 10
 	defaultMaxConcurrency     = 2
+	defaultTailFetchSize      = 1 << 20
+	indexBuildBufSize         = 4 << 20
 	statFileMode              = syscall.S_IFREG | 0400 // -r--------
 	stateDirMode              = syscall.S_IFDIR | 0500 // dr-x------
 )
@@ -150,6 +157,14 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snbase.Fil
 	if maxConcurrency == 0 {
 		maxConcurrency = defaultMaxConcurrency
 	}
+	tailFetchSize := cfg.TailFetchSize
+	if tailFetchSize == 0 {
+		tailFetchSize = defaultTailFetchSize
+	}
+	tocSignatureKeys, err := loadTOCSignatureKeys(cfg.TOCSignatureKeys)
+	if err != nil {
+		return nil, err
+	}
 	getSources := fsOpts.getSources
 	if getSources == nil {
 		getSources = source.FromDefaultLabels(
@@ -161,6 +176,7 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snbase.Fil
 		fsCache:               fsCache,
 		prefetchSize:          cfg.PrefetchSize,
 		prefetchTimeout:       prefetchTimeout,
+		tailFetchSize:         tailFetchSize,
 		noprefetch:            cfg.NoPrefetch,
 		noBackgroundFetch:     cfg.NoBackgroundFetch,
 		debug:                 cfg.Debug,
@@ -170,14 +186,39 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snbase.Fil
 		backgroundTaskManager: task.NewBackgroundTaskManager(maxConcurrency, 5*time.Second),
 		allowNoVerification:   cfg.AllowNoVerification,
 		disableVerification:   cfg.DisableVerification,
+		zranEnable:            cfg.ZranConfig.Enable,
+		zranSpanSize:          cfg.ZranConfig.SpanSize,
+		zranNoLocalBuild:      cfg.ZranConfig.NoLocalBuild,
+		tarEnable:             cfg.TarConfig.Enable,
+		indexDir:              filepath.Join(root, "layerindex"),
+		tocSignatureKeys:      tocSignatureKeys,
+		prefetchPathsDir:      cfg.PrefetchPathsDir,
 	}, nil
 }
 
+// loadTOCSignatureKeys reads public keys trusted for verifying signed TOCs.
+func loadTOCSignatureKeys(paths []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read TOC signature key %q", p)
+		}
+		key, err := estargz.ParseTOCVerificationKey(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid TOC signature key %q", p)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
 type filesystem struct {
 	resolver              *remote.Resolver
 	fsCache               cache.BlobCache
 	prefetchSize          int64
 	prefetchTimeout       time.Duration
+	tailFetchSize         int64
 	noprefetch            bool
 	noBackgroundFetch     bool
 	debug                 bool
@@ -192,6 +233,13 @@ type filesystem struct {
 	disableVerification   bool
 	getSources            source.GetSources
 	resolveG              singleflight.Group
+	zranEnable            bool
+	zranSpanSize          int64
+	zranNoLocalBuild      bool
+	tarEnable             bool
+	indexDir              string
+	tocSignatureKeys      []crypto.PublicKey
+	prefetchPathsDir      string
 }
 
 func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
@@ -218,7 +266,19 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	go func() {
 		rErr := fmt.Errorf("failed to resolve target")
 		for _, s := range src {
-			l, err := fs.resolveLayer(ctx, s.Hosts, s.Name, s.Target)
+			target := s.Target
+			if tocSize, ok := labels[estargz.TOCSizeAnnotation]; ok {
+				target.Annotations = map[string]string{estargz.TOCSizeAnnotation: tocSize}
+				for k, v := range s.Target.Annotations {
+					target.Annotations[k] = v
+				}
+			}
+			l, err := fs.resolveLayer(ctx, s.Hosts, s.Name, target)
+			if err != nil && (fs.zranEnable || fs.tarEnable) {
+				// The layer isn't eStargz. Try to lazily read it as a tar.gz or tar layer.
+				log.G(ctx).WithError(err).Debugf("trying to resolve as an indexed layer")
+				l, err = fs.resolveIndexedLayer(ctx, s.Hosts, s.Name, s.Target, labels)
+			}
 			if err == nil {
 				resultChan <- l
 				return
@@ -254,6 +314,14 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		// Skip if verification is disabled completely
 		l.skipVerify()
 		log.G(ctx).Debugf("Verification forcefully skipped")
+	} else if l.indexTOCDigest != "" {
+		// Verify this layer using the index. The index is trusted because it's
+		// verified when it's fetched or built.
+		if err := l.verify(l.indexTOCDigest); err != nil {
+			log.G(ctx).WithError(err).Debugf("invalid layer")
+			return errors.Wrapf(err, "invalid indexed layer")
+		}
+		log.G(ctx).Debugf("verified with layer index")
 	} else if tocDigest, ok := labels[estargz.TOCJSONDigestAnnotation]; ok {
 		// Verify this layer using the TOC JSON digest passed through label.
 		dgst, err := digest.Parse(tocDigest)
@@ -266,6 +334,14 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 			return errors.Wrapf(err, "invalid stargz layer")
 		}
 		log.G(ctx).Debugf("verified")
+	} else if len(fs.tocSignatureKeys) > 0 && l.verifiableReader.TOCSigned() {
+		// Verify this layer using the signature of the TOC embedded in the
+		// layer. This is available even if the annotation is lost.
+		if err := l.verifySignature(fs.tocSignatureKeys); err != nil {
+			log.G(ctx).WithError(err).Debugf("invalid signature of layer")
+			return errors.Wrapf(err, "invalid signed stargz layer")
+		}
+		log.G(ctx).Debugf("verified with TOC signature")
 	} else if _, ok := labels[config.TargetSkipVerifyLabel]; ok && fs.allowNoVerification {
 		// If unverified layer is allowed, use it with warning.
 		// This mode is for legacy stargz archives which don't contain digests
@@ -296,10 +372,15 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 				prefetchSize = ps
 			}
 		}
+		profile := labels[config.TargetPrefetchProfileLabel]
+		paths, err := prefetchPathsOf(labels, fs.prefetchPathsDir)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("ignoring paths to prefetch")
+		}
 		go func() {
 			fs.backgroundTaskManager.DoPrioritizedTask()
 			defer fs.backgroundTaskManager.DonePrioritizedTask()
-			if err := l.prefetch(prefetchSize); err != nil {
+			if err := l.prefetch(prefetchSize, profile, paths); err != nil {
 				log.G(ctx).WithError(err).Debug("failed to prefetched layer")
 				return
 			}
@@ -366,6 +447,72 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 
 func (fs *filesystem) resolveLayer(ctx context.Context, hosts docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (*layer, error) {
 	name := refspec.String() + "/" + desc.Digest.String()
+	return fs.resolve(ctx, name, func(ctx context.Context) (*layer, error) {
+		blob, err := fs.resolveBlob(ctx, hosts, refspec, desc)
+		if err != nil {
+			return nil, err
+		}
+
+		// Get a reader for stargz archive. The TOC and the footer are read at
+		// once if the size of them is known or guessed.
+		vr, root, err := reader.NewReader(fs.prioritizedReader(blob), fs.fsCache,
+			reader.WithTailFetchSize(fs.tailFetchSizeOf(desc)))
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to resolve: layer cannot be read")
+			return nil, errors.Wrap(err, "failed to read layer")
+		}
+
+		// Combine layer information together
+		return newLayer(desc, blob, vr, root, fs.prefetchTimeout), nil
+	})
+}
+
+// tailFetchSizeOf returns the number of bytes read at once from the tail of the
+// layer for getting the footer and the TOC. The size annotated to the layer is
+// preferred to the configured speculative size.
+func (fs *filesystem) tailFetchSizeOf(desc ocispec.Descriptor) int64 {
+	if s, ok := desc.Annotations[estargz.TOCSizeAnnotation]; ok {
+		if size, err := strconv.ParseInt(s, 10, 64); err == nil && size > 0 {
+			return size
+		}
+	}
+	if fs.tailFetchSize < 0 {
+		return 0
+	}
+	return fs.tailFetchSize
+}
+
+// resolveIndexedLayer resolves the non-eStargz tar.gz or tar layer with the layer
+// index (see fs/layerindex).
+func (fs *filesystem) resolveIndexedLayer(ctx context.Context, hosts docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, labels map[string]string) (*layer, error) {
+	name := refspec.String() + "/" + desc.Digest.String() + "/index"
+	return fs.resolve(ctx, name, func(ctx context.Context) (*layer, error) {
+		blob, err := fs.resolveBlob(ctx, hosts, refspec, desc)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := fs.layerIndex(ctx, hosts, refspec, desc, blob, labels)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to resolve: layer index unavailable")
+			return nil, errors.Wrap(err, "failed to get layer index")
+		}
+		vr, root, err := reader.NewReaderWithOpenFunc(fs.prioritizedReader(blob), fs.fsCache, idx.Open,
+			reader.WithLayerID(desc.Digest.String()))
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to resolve: indexed layer cannot be read")
+			return nil, errors.Wrap(err, "failed to read indexed layer")
+		}
+		l := newLayer(desc, blob, vr, root, fs.prefetchTimeout)
+		if idx.Verifiable() {
+			l.indexTOCDigest = idx.TOCDigest()
+		}
+		return l, nil
+	})
+}
+
+// resolve resolves the layer using the passed function. The result is cached
+// with the specified name.
+func (fs *filesystem) resolve(ctx context.Context, name string, resolveFn func(ctx context.Context) (*layer, error)) (*layer, error) {
 	ctx, cancel := context.WithCancel(log.WithLogger(ctx, log.G(ctx).WithField("src", name)))
 	defer cancel()
 
@@ -378,44 +525,10 @@ func (fs *filesystem) resolveLayer(ctx context.Context, hosts docker.RegistryHos
 
 	resultChan := fs.resolveG.DoChan(name, func() (interface{}, error) {
 		log.G(ctx).Debugf("resolving")
-
-		// Resolve the blob. The result will be cached for future use. This is effective
-		// in some failure cases including resolving is succeeded but the blob is non-stargz.
-		var blob remote.Blob
-		fs.blobResultMu.Lock()
-		c, ok := fs.blobResult.Get(name)
-		fs.blobResultMu.Unlock()
-		if ok && c.(remote.Blob).Check() == nil {
-			blob = c.(remote.Blob)
-		} else {
-			var err error
-			blob, err = fs.resolver.Resolve(ctx, hosts, refspec, desc)
-			if err != nil {
-				log.G(ctx).WithError(err).Debugf("failed to resolve source")
-				return nil, errors.Wrap(err, "failed to resolve the source")
-			}
-			fs.blobResultMu.Lock()
-			fs.blobResult.Add(name, blob)
-			fs.blobResultMu.Unlock()
-		}
-
-		// Get a reader for stargz archive.
-		// Each file's read operation is a prioritized task and all background tasks
-		// will be stopped during the execution so this can avoid being disturbed for
-		// NW traffic by background tasks.
-		sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (n int, err error) {
-			fs.backgroundTaskManager.DoPrioritizedTask()
-			defer fs.backgroundTaskManager.DonePrioritizedTask()
-			return blob.ReadAt(p, offset)
-		}), 0, blob.Size())
-		vr, root, err := reader.NewReader(sr, fs.fsCache)
+		l, err := resolveFn(ctx)
 		if err != nil {
-			log.G(ctx).WithError(err).Debugf("failed to resolve: layer cannot be read")
-			return nil, errors.Wrap(err, "failed to read layer")
+			return nil, err
 		}
-
-		// Combine layer information together
-		l := newLayer(desc, blob, vr, root, fs.prefetchTimeout)
 		fs.resolveResultMu.Lock()
 		fs.resolveResult.Add(name, l)
 		fs.resolveResultMu.Unlock()
@@ -437,6 +550,197 @@ func (fs *filesystem) resolveLayer(ctx context.Context, hosts docker.RegistryHos
 	return res.Val.(*layer), nil
 }
 
+// resolveBlob resolves the blob. The result will be cached for future use. This is
+// effective in some failure cases including resolving is succeeded but the blob is
+// non-stargz.
+func (fs *filesystem) resolveBlob(ctx context.Context, hosts docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (remote.Blob, error) {
+	name := refspec.String() + "/" + desc.Digest.String()
+	fs.blobResultMu.Lock()
+	c, ok := fs.blobResult.Get(name)
+	fs.blobResultMu.Unlock()
+	if ok && c.(remote.Blob).Check() == nil {
+		return c.(remote.Blob), nil
+	}
+	blob, err := fs.resolver.Resolve(ctx, hosts, refspec, desc)
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("failed to resolve source")
+		return nil, errors.Wrap(err, "failed to resolve the source")
+	}
+	fs.blobResultMu.Lock()
+	fs.blobResult.Add(name, blob)
+	fs.blobResultMu.Unlock()
+	return blob, nil
+}
+
+// prioritizedReader returns the reader of the blob. Each file's read operation is
+// a prioritized task and all background tasks will be stopped during the execution
+// so this can avoid being disturbed for NW traffic by background tasks.
+func (fs *filesystem) prioritizedReader(blob remote.Blob) *io.SectionReader {
+	return io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (n int, err error) {
+		fs.backgroundTaskManager.DoPrioritizedTask()
+		defer fs.backgroundTaskManager.DonePrioritizedTask()
+		return blob.ReadAt(p, offset)
+	}), 0, blob.Size())
+}
+
+// layerIndex returns the index of the tar.gz or tar layer. The index is searched
+// in the local store first.
+//
+// For tar.gz layers, the blob specified by the label is used if any. If it's not
+// available, the index is built by fetching the whole layer unless it's disabled
+// by the config. For tar layers, the index is built by walking tar headers with
+// range requests.
+//
+// The index taken from the remote is stored locally.
+func (fs *filesystem) layerIndex(ctx context.Context, hosts docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, blob remote.Blob, labels map[string]string) (*layerindex.Index, error) {
+	indexPath := filepath.Join(fs.indexDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	if f, err := os.Open(indexPath); err == nil {
+		idx, err := layerindex.Read(bufio.NewReader(f))
+		f.Close()
+		if err == nil && idx.Layer == desc.Digest {
+			return idx, nil
+		}
+		log.G(ctx).WithError(err).Warnf("invalid layer index stored at %q", indexPath)
+	}
+
+	isGzip, err := isGzipBlob(blob)
+	if err != nil {
+		return nil, err
+	}
+	if !isGzip {
+		if !fs.tarEnable {
+			return nil, fmt.Errorf("lazily pulling tar layers is disabled")
+		}
+		log.G(ctx).Debugf("building layer index by walking tar headers")
+		idx, err := layerindex.BuildTar(fs.prioritizedReader(blob), desc.Digest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to build layer index of tar")
+		}
+		if err := storeLayerIndex(indexPath, idx); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to store layer index")
+		}
+		return idx, nil
+	}
+	if !fs.zranEnable {
+		return nil, fmt.Errorf("lazily pulling tar.gz layers is disabled")
+	}
+
+	var idx *layerindex.Index
+	if idxDgstStr, ok := labels[config.TargetZranIndexLabel]; ok {
+		idxDgst, perr := digest.Parse(idxDgstStr)
+		if perr != nil {
+			return nil, errors.Wrapf(perr, "invalid layer index digest: %v", idxDgstStr)
+		}
+		idx, err = fs.fetchLayerIndex(ctx, hosts, refspec, idxDgst)
+		if err == nil && idx.Layer != desc.Digest {
+			err = fmt.Errorf("layer index is for %q; want %q", idx.Layer, desc.Digest)
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to get layer index %q", idxDgst)
+			idx = nil
+		}
+	}
+	if idx == nil {
+		if fs.zranNoLocalBuild {
+			return nil, fmt.Errorf("layer index isn't available: %v", err)
+		}
+		log.G(ctx).Infof("building layer index by fetching the whole layer")
+		if idx, err = fs.buildLayerIndex(desc, blob); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := storeLayerIndex(indexPath, idx); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to store layer index")
+	}
+	return idx, nil
+}
+
+// isGzipBlob reports whether the blob starts with the gzip magic number.
+func isGzipBlob(blob remote.Blob) (bool, error) {
+	if blob.Size() < 2 {
+		return false, nil
+	}
+	magic := make([]byte, 2)
+	if _, err := blob.ReadAt(magic, 0); err != nil {
+		return false, errors.Wrapf(err, "failed to read magic number of the layer")
+	}
+	return magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+func (fs *filesystem) fetchLayerIndex(ctx context.Context, hosts docker.RegistryHosts, refspec reference.Spec, dgst digest.Digest) (*layerindex.Index, error) {
+	blob, err := fs.resolver.Resolve(ctx, hosts, refspec, ocispec.Descriptor{
+		MediaType: layerindex.MediaType,
+		Digest:    dgst,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve layer index")
+	}
+	verifier := dgst.Verifier()
+	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+		return blob.ReadAt(p, offset, remote.WithCacheOpts(cache.Direct()))
+	}), 0, blob.Size())
+	idx, err := layerindex.Read(io.TeeReader(sr, verifier))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(verifier, sr); err != nil {
+		return nil, err
+	}
+	if !verifier.Verified() {
+		return nil, fmt.Errorf("invalid layer index; digest mismatch")
+	}
+	return idx, nil
+}
+
+func (fs *filesystem) buildLayerIndex(desc ocispec.Descriptor, blob remote.Blob) (*layerindex.Index, error) {
+	verifier := desc.Digest.Verifier()
+	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+		return blob.ReadAt(p, offset, remote.WithCacheOpts(cache.Direct()))
+	}), 0, blob.Size())
+	r := io.TeeReader(bufio.NewReaderSize(sr, indexBuildBufSize), verifier)
+	var opts []layerindex.Option
+	if fs.zranSpanSize > 0 {
+		opts = append(opts, layerindex.WithSpan(fs.zranSpanSize))
+	}
+	idx, err := layerindex.Build(r, desc.Digest, opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to build layer index")
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, err
+	}
+	if !verifier.Verified() {
+		return nil, fmt.Errorf("invalid layer %q; digest mismatch", desc.Digest)
+	}
+	return idx, nil
+}
+
+// storeLayerIndex atomically stores the index to the specified path.
+func storeLayerIndex(p string, idx *layerindex.Index) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	bw := bufio.NewWriter(f)
+	if _, err := idx.WriteTo(bw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
 func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
 	// This is a prioritized task and all background tasks will be stopped
 	// execution so this can avoid being disturbed for NW traffic by background
@@ -539,6 +843,10 @@ type layer struct {
 	prefetchWaiter   *waiter
 	prefetchTimeout  time.Duration
 	r                reader.Reader
+
+	// indexTOCDigest is the TOC digest of the layer index if this layer is
+	// read with it.
+	indexTOCDigest digest.Digest
 }
 
 func (l *layer) reader() (reader.Reader, error) {
@@ -557,13 +865,30 @@ func (l *layer) verify(tocDigest digest.Digest) (err error) {
 	return
 }
 
-func (l *layer) prefetch(prefetchSize int64) error {
+func (l *layer) verifySignature(keys []crypto.PublicKey) (err error) {
+	l.r, err = l.verifiableReader.VerifyTOCSignature(keys...)
+	return
+}
+
+func (l *layer) prefetch(prefetchSize int64, profile string, paths []string) error {
 	defer l.prefetchWaiter.done() // Notify the completion
 
 	lr, err := l.reader()
 	if err != nil {
 		return err
 	}
+	if profile != "" {
+		if p, ok := lr.PrefetchProfile(profile); ok {
+			// prefetch the files needed by the selected workload
+			return l.prefetchProfile(lr, p)
+		}
+	}
+	if len(paths) > 0 {
+		if _, ok := lr.Lookup(estargz.PrefetchLandmark); !ok {
+			// prefetch the specified files of the unoptimized layer
+			return l.prefetchPaths(lr, paths)
+		}
+	}
 	if _, ok := lr.Lookup(estargz.NoPrefetchLandmark); ok {
 		// do not prefetch this layer
 		return nil
@@ -590,6 +915,169 @@ func (l *layer) prefetch(prefetchSize int64) error {
 	return nil
 }
 
+func (l *layer) prefetchProfile(lr reader.Reader, p *estargz.PrefetchProfile) error {
+	regions := make([]region, 0, len(p.Files))
+	files := make(map[string]struct{}, len(p.Files))
+	for _, f := range p.Files {
+		regions = append(regions, region{f.Offset, f.Size})
+		files[f.Name] = struct{}{}
+	}
+	return errors.Wrapf(l.prefetchFiles(lr, regions, files), "failed to prefetch profile %q", p.Name)
+}
+
+func (l *layer) prefetchPaths(lr reader.Reader, patterns []string) error {
+	root, ok := lr.Lookup("")
+	if !ok {
+		return fmt.Errorf("failed to get a TOCEntry of the root")
+	}
+	type dirEntry struct {
+		name string
+		e    *estargz.TOCEntry
+	}
+	var (
+		regions []region
+		files   = make(map[string]struct{})
+		dirs    = []dirEntry{{"", root}}
+	)
+	for len(dirs) > 0 {
+		dir := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		dir.e.ForeachChild(func(baseName string, e *estargz.TOCEntry) bool {
+			name := path.Join(dir.name, baseName)
+			if e.Type == "dir" {
+				dirs = append(dirs, dirEntry{name, e})
+				return true
+			}
+			if !matchPrefetchPaths(patterns, name) {
+				return true
+			}
+			if offset, size, ok := lr.FileRange(name); ok {
+				regions = append(regions, region{offset, size})
+				files[e.Name] = struct{}{} // hardlinks are resolved to the target
+			}
+			return true
+		})
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].offset < regions[j].offset })
+	return errors.Wrap(l.prefetchFiles(lr, regions, files), "failed to prefetch paths")
+}
+
+// region is a range of the blob.
+type region struct {
+	offset int64
+	size   int64
+}
+
+// prefetchFiles fetches the regions of the blob storing the files and caches
+// the uncompressed contents of the files. Regions are fetched in the given
+// order and a region is coalesced with the previous one only if they overlap or
+// are adjacent, so the order of profiles is kept.
+func (l *layer) prefetchFiles(lr reader.Reader, regions []region, files map[string]struct{}) error {
+	var start, end int64
+	for i, r := range regions {
+		if i > 0 && r.offset >= start && r.offset <= end {
+			if e := r.offset + r.size; e > end {
+				end = e
+			}
+			continue
+		}
+		if end > start {
+			if err := l.blob.Cache(start, end-start); err != nil {
+				return err
+			}
+		}
+		start, end = r.offset, r.offset+r.size
+	}
+	if end > start {
+		if err := l.blob.Cache(start, end-start); err != nil {
+			return err
+		}
+	}
+
+	// Cache uncompressed contents of the files
+	return lr.Cache(reader.WithFilter(func(e *estargz.TOCEntry) bool {
+		_, ok := files[e.Name]
+		return ok
+	}))
+}
+
+// prefetchPathsOf returns the patterns of paths to prefetch specified by
+// TargetPrefetchPathsLabel and TargetPrefetchPathsFileLabel. The file specified
+// by the latter is resolved under dir.
+func prefetchPathsOf(labels map[string]string, dir string) ([]string, error) {
+	var paths []string
+	if v, ok := labels[config.TargetPrefetchPathsLabel]; ok {
+		paths = append(paths, strings.Split(v, ",")...)
+	}
+	if name, ok := labels[config.TargetPrefetchPathsFileLabel]; ok {
+		f, err := prefetchPathsFile(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read the list of paths to prefetch")
+		}
+		paths = append(paths, strings.Split(string(b), "\n")...)
+	}
+	var patterns []string
+	for _, p := range paths {
+		p = strings.TrimSpace(p)
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		p = strings.TrimPrefix(path.Clean("/"+p), "/")
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid path %q to prefetch", p)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// prefetchPathsFile returns the path of the file name under dir. Labels can be
+// set by clients and images so files outside of dir, including the ones
+// reached through symlinks, are rejected.
+func prefetchPathsFile(dir, name string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("%q label is specified but prefetch_paths_dir isn't configured", config.TargetPrefetchPathsFileLabel)
+	}
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("path %q to the list of paths must be relative", name)
+	}
+	if name = filepath.Clean(name); name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q to the list of paths must be inside prefetch_paths_dir", name)
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	f, err := filepath.EvalSymlinks(filepath.Join(root, name))
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, f); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q to the list of paths must be inside prefetch_paths_dir", name)
+	}
+	return f, nil
+}
+
+// matchPrefetchPaths reports whether the path or any of its parent directories
+// matches any of the patterns.
+func matchPrefetchPaths(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if p == "" {
+			return true // root directory
+		}
+		for n := name; n != "." && n != "/" && n != ""; n = path.Dir(n) {
+			if ok, _ := path.Match(p, n); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (l *layer) waitForPrefetchCompletion() error {
 	return l.prefetchWaiter.wait(l.prefetchTimeout)
 }
@@ -671,8 +1159,8 @@ func (n *node) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
 	normalEnts := map[string]bool{}
 	n.e.ForeachChild(func(baseName string, ent *estargz.TOCEntry) bool {
 
-		// We don't want to show prefetch landmarks in "/".
-		if n.e.Name == "" && (baseName == estargz.PrefetchLandmark || baseName == estargz.NoPrefetchLandmark) {
+		// We don't want to show prefetch landmarks and tar-split metadata in "/".
+		if n.e.Name == "" && isReservedName(baseName) {
 			return true
 		}
 
@@ -719,8 +1207,8 @@ func (n *node) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
 var _ = (fusefs.NodeLookuper)((*node)(nil))
 
 func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
-	// We don't want to show prefetch landmarks in "/".
-	if n.e.Name == "" && (name == estargz.PrefetchLandmark || name == estargz.NoPrefetchLandmark) {
+	// We don't want to show prefetch landmarks and tar-split metadata in "/".
+	if n.e.Name == "" && isReservedName(name) {
 		return nil, syscall.ENOENT
 	}
 
@@ -850,6 +1338,45 @@ func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResul
 	return fuse.ReadResultData(dest[:n]), 0
 }
 
+// holeSeeker is implemented by readers of files which can contain holes
+// (i.e. sparse files).
+type holeSeeker interface {
+	NextDataOffset(offset int64) (int64, bool)
+	NextHoleOffset(offset int64) int64
+}
+
+const (
+	// whence values of lseek(2) for seeking data and holes of sparse files.
+	seekData = 3
+	seekHole = 4
+)
+
+var _ = (fusefs.FileLseeker)((*file)(nil))
+
+func (f *file) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
+	if off >= uint64(f.e.Size) {
+		return 0, syscall.ENXIO
+	}
+	hs, ok := f.ra.(holeSeeker)
+	switch whence {
+	case seekData:
+		if !ok {
+			return off, 0 // the whole file is data
+		}
+		dataOff, ok := hs.NextDataOffset(int64(off))
+		if !ok {
+			return 0, syscall.ENXIO
+		}
+		return uint64(dataOff), 0
+	case seekHole:
+		if !ok {
+			return uint64(f.e.Size), 0
+		}
+		return uint64(hs.NextHoleOffset(int64(off))), 0
+	}
+	return 0, syscall.EINVAL
+}
+
 var _ = (fusefs.FileGetattrer)((*file)(nil))
 
 func (f *file) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
@@ -1155,6 +1682,16 @@ func statFileToAttr(sf *statFile, size uint64, out *fuse.Attr) fusefs.StableAttr
 	}
 }
 
+// isReservedName returns true if the name in "/" is reserved by eStargz and
+// isn't a part of the filesystem.
+func isReservedName(name string) bool {
+	switch name {
+	case estargz.PrefetchLandmark, estargz.NoPrefetchLandmark, estargz.TarSplitName:
+		return true
+	}
+	return false
+}
+
 // modeOfEntry gets system's mode bits from TOCEntry
 func modeOfEntry(e *estargz.TOCEntry) uint32 {
 	// Permission bits
@@ -26,8 +26,11 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -35,6 +38,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"syscall"
@@ -45,6 +49,7 @@ import (
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
 	"github.com/containerd/stargz-snapshotter/fs/reader"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/fs/source"
@@ -95,7 +100,11 @@ type nopreader struct{}
 
 func (r nopreader) OpenFile(name string) (io.ReaderAt, error)    { return nil, nil }
 func (r nopreader) Lookup(name string) (*estargz.TOCEntry, bool) { return nil, false }
-func (r nopreader) Cache(opts ...reader.CacheOption) error       { return nil }
+func (r nopreader) PrefetchProfile(name string) (*estargz.PrefetchProfile, bool) {
+	return nil, false
+}
+func (r nopreader) FileRange(name string) (int64, int64, bool) { return 0, 0, false }
+func (r nopreader) Cache(opts ...reader.CacheOption) error      { return nil }
 
 type breakBlob struct {
 	success bool
@@ -399,11 +408,16 @@ func (db *dummyBlob) Refresh(ctx context.Context, hosts docker.RegistryHosts, re
 type chunkSizeInfo int
 type prioritizedFilesInfo []string
 type stargzOnlyInfo bool
+type prefetchProfileInfo struct {
+	name  string
+	files []string
+}
 
 func buildStargz(t *testing.T, ents []tarent, opts ...interface{}) (*io.SectionReader, digest.Digest) {
 	var chunkSize chunkSizeInfo
 	var prioritizedFiles prioritizedFilesInfo
 	var stargzOnly bool
+	var profiles []estargz.Option
 	for _, opt := range opts {
 		if v, ok := opt.(chunkSizeInfo); ok {
 			chunkSize = v
@@ -411,6 +425,8 @@ func buildStargz(t *testing.T, ents []tarent, opts ...interface{}) (*io.SectionR
 			prioritizedFiles = v
 		} else if v, ok := opt.(stargzOnlyInfo); ok {
 			stargzOnly = bool(v)
+		} else if v, ok := opt.(prefetchProfileInfo); ok {
+			profiles = append(profiles, estargz.WithPrefetchProfile(v.name, v.files))
 		} else {
 			t.Fatalf("unsupported opt")
 		}
@@ -448,8 +464,10 @@ func buildStargz(t *testing.T, ents []tarent, opts ...interface{}) (*io.SectionR
 	}
 	rc, err := estargz.Build(
 		io.NewSectionReader(bytes.NewReader(tarData), 0, int64(len(tarData))),
-		estargz.WithPrioritizedFiles([]string(prioritizedFiles)),
-		estargz.WithChunkSize(int(chunkSize)),
+		append([]estargz.Option{
+			estargz.WithPrioritizedFiles([]string(prioritizedFiles)),
+			estargz.WithChunkSize(int(chunkSize)),
+		}, profiles...)...,
 	)
 	if err != nil {
 		t.Fatalf("failed to build verifiable stargz: %v", err)
@@ -835,6 +853,9 @@ func TestPrefetch(t *testing.T) {
 		wants            []string // filenames to compare
 		prefetchSize     func(*testing.T, *layer) int64
 		prioritizedFiles []string
+		profile          string
+		paths            []string
+		rangeOf          string // file whose range is wanted to be fetched
 		stargz           bool
 	}{
 		{
@@ -880,14 +901,71 @@ func TestPrefetch(t *testing.T) {
 			prefetchSize:     landmarkPosition,
 			prioritizedFiles: []string{"foo/", "foo/bar.txt"},
 		},
+		{
+			name: "profile",
+			in: []tarent{
+				regfile("foo.txt", sampleData1),
+				regfile("bar.txt", sampleData2),
+				regfile("baz.txt", sampleData1),
+			},
+			wantNum:          chunkNum(sampleData2),
+			wants:            []string{"bar.txt"},
+			prioritizedFiles: []string{"foo.txt"},
+			profile:          "worker",
+		},
+		{
+			name: "unknown_profile",
+			in: []tarent{
+				regfile("foo.txt", sampleData1),
+				regfile("bar.txt", sampleData2),
+				regfile("baz.txt", sampleData1),
+			},
+			wantNum:          chunkNum(sampleData1),
+			wants:            []string{"foo.txt"},
+			prefetchSize:     landmarkPosition,
+			prioritizedFiles: []string{"foo.txt"},
+			profile:          "unknown",
+		},
+		{
+			name: "paths",
+			in: []tarent{
+				directory("foo/"),
+				regfile("foo/bar.txt", sampleData1),
+				directory("buz/"),
+				regfile("buz/buzbuz.txt", sampleData2),
+			},
+			wantNum: chunkNum(sampleData2),
+			wants:   []string{"buz/buzbuz.txt"},
+			paths:   []string{"b*z"},
+			rangeOf: "buz/buzbuz.txt",
+		},
+		{
+			name: "paths_optimized",
+			in: []tarent{
+				regfile("foo.txt", sampleData1),
+				regfile("bar.txt", sampleData2),
+			},
+			wantNum:          chunkNum(sampleData1),
+			wants:            []string{"foo.txt"},
+			prefetchSize:     landmarkPosition,
+			prioritizedFiles: []string{"foo.txt"},
+			paths:            []string{"bar.txt"},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			sr, dgst := buildStargz(t, tt.in,
+			opts := []interface{}{
 				chunkSizeInfo(sampleChunkSize),
 				prioritizedFilesInfo(tt.prioritizedFiles),
-				stargzOnlyInfo(tt.stargz))
+				stargzOnlyInfo(tt.stargz),
+			}
+			if tt.profile != "" {
+				opts = append(opts,
+					prefetchProfileInfo{"web", []string{"baz.txt"}},
+					prefetchProfileInfo{"worker", []string{"bar.txt"}})
+			}
+			sr, dgst := buildStargz(t, tt.in, opts...)
 			blob := newBlob(sr)
 			cache := &testCache{membuf: map[string]string{}, t: t}
 			vr, _, err := reader.NewReader(sr, cache)
@@ -901,17 +979,35 @@ func TestPrefetch(t *testing.T) {
 				t.Errorf("failed to verify reader: %v", err)
 				return
 			}
-			prefetchSize := int64(0)
+			prefetchOffset, prefetchSize := int64(0), int64(0)
 			if tt.prefetchSize != nil {
 				prefetchSize = tt.prefetchSize(t, l)
 			}
-			if err := l.prefetch(defaultPrefetchSize); err != nil {
+			if tt.rangeOf != "" {
+				lr, err := l.reader()
+				if err != nil {
+					t.Fatalf("failed to get reader from layer: %v", err)
+				}
+				var ok bool
+				if prefetchOffset, prefetchSize, ok = lr.FileRange(tt.rangeOf); !ok {
+					t.Fatalf("range of %q not found", tt.rangeOf)
+				}
+			} else if tt.profile != "" {
+				lr, err := l.reader()
+				if err != nil {
+					t.Fatalf("failed to get reader from layer: %v", err)
+				}
+				if p, ok := lr.PrefetchProfile(tt.profile); ok {
+					prefetchOffset, prefetchSize = p.Files[0].Offset, p.Files[0].Size
+				}
+			}
+			if err := l.prefetch(defaultPrefetchSize, tt.profile, tt.paths); err != nil {
 				t.Errorf("failed to prefetch: %v", err)
 				return
 			}
-			if blob.calledPrefetchOffset != 0 {
+			if blob.calledPrefetchOffset != prefetchOffset {
 				t.Errorf("invalid prefetch offset %d; want %d",
-					blob.calledPrefetchOffset, 0)
+					blob.calledPrefetchOffset, prefetchOffset)
 			}
 			if blob.calledPrefetchSize != prefetchSize {
 				t.Errorf("invalid prefetch size %d; want %d",
@@ -963,6 +1059,7 @@ type sampleBlob struct {
 	readCalled           bool
 	calledPrefetchOffset int64
 	calledPrefetchSize   int64
+	calledCaches         []region
 }
 
 func (sb *sampleBlob) Authn(tr http.RoundTripper) (http.RoundTripper, error) { return nil, nil }
@@ -976,6 +1073,7 @@ func (sb *sampleBlob) ReadAt(p []byte, offset int64, opts ...remote.Option) (int
 func (sb *sampleBlob) Cache(offset int64, size int64, option ...remote.Option) error {
 	sb.calledPrefetchOffset = offset
 	sb.calledPrefetchSize = size
+	sb.calledCaches = append(sb.calledCaches, region{offset, size})
 	return nil
 }
 func (sb *sampleBlob) Refresh(ctx context.Context, hosts docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
@@ -1006,6 +1104,19 @@ func (tc *testCache) Add(key string, p []byte, opts ...cache.Option) {
 	tc.t.Logf("  cached [%s...]: %q", key[:8], string(p))
 }
 
+func TestPrefetchFilesOrder(t *testing.T) {
+	blob := newBlob(io.NewSectionReader(strings.NewReader(""), 0, 0))
+	l := &layer{blob: blob}
+	regions := []region{{100, 10}, {0, 10}, {10, 5}, {200, 10}, {205, 10}, {150, 10}}
+	if err := l.prefetchFiles(nopreader{}, regions, nil); err != nil {
+		t.Fatalf("failed to prefetch files: %v", err)
+	}
+	want := []region{{100, 10}, {0, 15}, {200, 15}, {150, 10}}
+	if !reflect.DeepEqual(blob.calledCaches, want) {
+		t.Errorf("fetched regions = %v; want %v", blob.calledCaches, want)
+	}
+}
+
 func TestWaiter(t *testing.T) {
 	var (
 		w         = newWaiter()
@@ -1032,3 +1143,138 @@ func TestWaiter(t *testing.T) {
 		t.Errorf("wait time is too short: %v; want %v", doneTime.Sub(startTime), waitTime)
 	}
 }
+
+func TestTailFetchSizeOf(t *testing.T) {
+	annotated := func(v string) ocispec.Descriptor {
+		return ocispec.Descriptor{Annotations: map[string]string{estargz.TOCSizeAnnotation: v}}
+	}
+	tests := []struct {
+		name       string
+		configured int64
+		desc       ocispec.Descriptor
+		want       int64
+	}{
+		{"speculative", 1000, ocispec.Descriptor{}, 1000},
+		{"disabled", -1, ocispec.Descriptor{}, 0},
+		{"annotated", 1000, annotated("123"), 123},
+		{"annotated_disabled", -1, annotated("123"), 123},
+		{"invalid_annotation", 1000, annotated("foo"), 1000},
+		{"zero_annotation", 1000, annotated("0"), 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &filesystem{tailFetchSize: tt.configured}
+			if got := fs.tailFetchSizeOf(tt.desc); got != tt.want {
+				t.Errorf("tailFetchSizeOf() = %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTOCSignatureKeys(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testtocsignaturekeys")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	valid, invalid := filepath.Join(tmp, "valid.pem"), filepath.Join(tmp, "invalid.pem")
+	if err := ioutil.WriteFile(valid, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	if err := ioutil.WriteFile(invalid, []byte("invalid"), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	keys, err := loadTOCSignatureKeys([]string{valid})
+	if err != nil {
+		t.Fatalf("failed to load key: %v", err)
+	}
+	if len(keys) != 1 || !pub.Equal(keys[0]) {
+		t.Errorf("unexpected keys loaded: %v", keys)
+	}
+	for _, paths := range [][]string{{valid, invalid}, {filepath.Join(tmp, "notexist")}} {
+		if _, err := loadTOCSignatureKeys(paths); err == nil {
+			t.Errorf("loading %v must fail", paths)
+		}
+	}
+}
+
+func TestPrefetchPathsOf(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testprefetchpaths")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "lists")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("failed to make directory of lists: %v", err)
+	}
+	listFile := filepath.Join(dir, "list")
+	if err := ioutil.WriteFile(listFile, []byte("# comment\n/usr/lib/python3*\n\n  ./etc/passwd  \n"), 0600); err != nil {
+		t.Fatalf("failed to write list: %v", err)
+	}
+	patterns, err := prefetchPathsOf(map[string]string{
+		config.TargetPrefetchPathsLabel:     "/bin/sh,app/*.js,",
+		config.TargetPrefetchPathsFileLabel: "list",
+	}, dir)
+	if err != nil {
+		t.Fatalf("failed to get paths: %v", err)
+	}
+	want := []string{"bin/sh", "app/*.js", "usr/lib/python3*", "etc/passwd"}
+	if !reflect.DeepEqual(patterns, want) {
+		t.Errorf("patterns = %v; want %v", patterns, want)
+	}
+	for name, wantMatch := range map[string]bool{
+		"bin/sh":                     true,
+		"bin/bash":                   false,
+		"app/index.js":               true,
+		"app/lib/index.js":           false,
+		"usr/lib/python3.9/os.py":    true,
+		"usr/lib/python2.7/os.py":    false,
+		"etc/passwd":                 true,
+		"etc/passwd.bak":             false,
+		"usr/lib/python3.9/a/b/c.py": true,
+	} {
+		if got := matchPrefetchPaths(patterns, name); got != wantMatch {
+			t.Errorf("match %q = %v; want %v", name, got, wantMatch)
+		}
+	}
+	if !matchPrefetchPaths([]string{""}, "any/file") {
+		t.Errorf("root must match all files")
+	}
+	if _, err := prefetchPathsOf(map[string]string{config.TargetPrefetchPathsLabel: "[invalid"}, dir); err == nil {
+		t.Errorf("invalid pattern must be rejected")
+	}
+
+	// Only files in the directory can be read.
+	outside := filepath.Join(tmp, "outside")
+	if err := ioutil.WriteFile(outside, []byte("/etc/shadow\n"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("failed to make symlink: %v", err)
+	}
+	for _, tt := range []struct {
+		name string
+		dir  string
+	}{
+		{"notexist", dir},
+		{"list", ""},
+		{listFile, dir},
+		{outside, dir},
+		{"../outside", dir},
+		{"a/../../outside", dir},
+		{"link", dir},
+	} {
+		if _, err := prefetchPathsOf(map[string]string{config.TargetPrefetchPathsFileLabel: tt.name}, tt.dir); err == nil {
+			t.Errorf("list file %q in %q must be rejected", tt.name, tt.dir)
+		}
+	}
+}
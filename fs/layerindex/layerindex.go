@@ -0,0 +1,471 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package layerindex indexes legacy (non-eStargz) tar.gz and tar layers so that
+// they can be lazily read by the filesystem.
+//
+// An Index consists of the table of files in the layer and, for tar.gz layers,
+// the gzip checkpoints of the layer (see zran package). The file table is an
+// eStargz TOC whose offsets point to file payloads in the *uncompressed* tar
+// stream, so the layer can be read through estargz.Reader without conversion.
+package layerindex
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/zran"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MediaType is the media type of the serialized Index blob.
+	MediaType = "application/vnd.containerd.stargz-snapshotter.layerindex.v1+gzip"
+
+	// DefaultChunkSize is the default size of chunks of regular files.
+	DefaultChunkSize = 4 << 20
+
+	indexMagic  = "LAYERIDX"
+	maxTOCBytes = 1 << 30
+)
+
+// Index is the index of a tar.gz or tar layer.
+type Index struct {
+	// Layer is the digest of the indexed (compressed) layer blob.
+	Layer digest.Digest
+
+	// TOC is the JSON-serialized eStargz TOC of the layer. Offsets of entries
+	// point to the uncompressed tar stream.
+	TOC []byte
+
+	// Zran is the gzip checkpoints of the layer. This is nil if the layer is
+	// an uncompressed tar.
+	Zran *zran.Index
+}
+
+type options struct {
+	span      int64
+	chunkSize int64
+}
+
+// Option is an option used during building the index.
+type Option func(o *options)
+
+// WithSpan specifies the interval of gzip checkpoints in the uncompressed
+// stream. zran.DefaultSpan is used by default.
+func WithSpan(span int64) Option {
+	return func(o *options) {
+		o.span = span
+	}
+}
+
+// WithChunkSize specifies the size of chunks of regular files.
+// DefaultChunkSize is used by default.
+func WithChunkSize(chunkSize int64) Option {
+	return func(o *options) {
+		o.chunkSize = chunkSize
+	}
+}
+
+// Build indexes the passed tar.gz layer whose digest is dgst. The whole layer
+// is read from r but the caller is responsible for verifying it against dgst.
+func Build(r io.Reader, dgst digest.Digest, opts ...Option) (*Index, error) {
+	o := options{
+		span:      zran.DefaultSpan,
+		chunkSize: DefaultChunkSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.span <= 0 || o.chunkSize <= 0 {
+		return nil, fmt.Errorf("span and chunk size must be positive")
+	}
+
+	pr, pw := io.Pipe()
+	type zranResult struct {
+		idx *zran.Index
+		err error
+	}
+	zranC := make(chan zranResult, 1)
+	go func() {
+		idx, err := zran.BuildIndex(pw, r, o.span)
+		pw.CloseWithError(err)
+		zranC <- zranResult{idx, err}
+	}()
+
+	cr := &countReader{r: pr}
+	toc, err := buildTOC(tar.NewReader(cr), func() int64 { return cr.n }, o.chunkSize, true)
+	if err == nil {
+		// Consume the remaining stream (e.g. tar EOF blocks) so that all
+		// checkpoints are recorded.
+		_, err = io.Copy(ioutil.Discard, pr)
+	}
+	if err != nil {
+		pr.CloseWithError(err)
+		<-zranC
+		return nil, err
+	}
+	zr := <-zranC
+	if zr.err != nil {
+		return nil, errors.Wrapf(zr.err, "failed to build gzip index")
+	}
+	tocJSON, err := json.Marshal(toc)
+	if err != nil {
+		return nil, err
+	}
+	return &Index{Layer: dgst, TOC: tocJSON, Zran: zr.idx}, nil
+}
+
+// BuildTar indexes the passed uncompressed tar layer whose digest is dgst. Only
+// tar headers are read from sr and file payloads are skipped using Seek so this
+// can be used with blobs read through range requests. As payloads aren't read,
+// the TOC doesn't contain digests of files and chunks so the layer contents
+// can't be verified with this index.
+func BuildTar(sr *io.SectionReader, dgst digest.Digest, opts ...Option) (*Index, error) {
+	o := options{
+		chunkSize: DefaultChunkSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.chunkSize <= 0 {
+		return nil, fmt.Errorf("chunk size must be positive")
+	}
+	if _, err := sr.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(sr)
+	toc, err := buildTOC(tr, func() int64 {
+		off, _ := sr.Seek(0, io.SeekCurrent) // never fails
+		return off
+	}, o.chunkSize, false)
+	if err != nil {
+		return nil, err
+	}
+	tocJSON, err := json.Marshal(toc)
+	if err != nil {
+		return nil, err
+	}
+	return &Index{Layer: dgst, TOC: tocJSON}, nil
+}
+
+// buildTOC walks the tar stream and returns the TOC whose offsets point to file
+// payloads in the stream. offset must return the current position in the tar
+// stream. If readPayload is true, payloads are read for calculating digests
+// of files and chunks.
+func buildTOC(tr *tar.Reader, offset func() int64, chunkSize int64, readPayload bool) (*estargz.JTOC, error) {
+	toc := &estargz.JTOC{Version: 1}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading from source tar: tar.Reader.Next: %v", err)
+		}
+		if isSparse(h) {
+			// Holes of sparse files are filled by tar.Reader so the payload
+			// isn't stored contiguously in the stream.
+			return nil, fmt.Errorf("sparse file %q is not supported", h.Name)
+		}
+		ent, err := tocEntry(h)
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg || h.Size == 0 {
+			toc.Entries = append(toc.Entries, ent)
+			continue
+		}
+
+		// tar.Reader doesn't read ahead so the payload starts here.
+		dataOff := offset()
+		regFileEntry := ent
+		payloadDigest := digest.Canonical.Digester()
+		tee := io.TeeReader(tr, payloadDigest.Hash())
+		var written int64
+		for written < h.Size {
+			size := chunkSize
+			if remain := h.Size - written; remain < size {
+				size = remain
+			} else {
+				ent.ChunkSize = size
+			}
+			ent.Offset = dataOff + written
+			ent.ChunkOffset = written
+			if readPayload {
+				chunkDigest := digest.Canonical.Digester()
+				if _, err := io.CopyN(chunkDigest.Hash(), tee, size); err != nil {
+					return nil, fmt.Errorf("error reading %q: %v", h.Name, err)
+				}
+				ent.ChunkDigest = chunkDigest.Digest().String()
+			}
+			toc.Entries = append(toc.Entries, ent)
+			written += size
+			ent = &estargz.TOCEntry{
+				Name: h.Name,
+				Type: "chunk",
+			}
+		}
+		if readPayload {
+			regFileEntry.Digest = payloadDigest.Digest().String()
+			if offset()-dataOff != h.Size {
+				return nil, fmt.Errorf("sparse file %q is not supported", h.Name)
+			}
+		}
+	}
+	return toc, nil
+}
+
+// isSparse reports whether the header is of a sparse file.
+func isSparse(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range h.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+func tocEntry(h *tar.Header) (*estargz.TOCEntry, error) {
+	xattrs := make(map[string][]byte)
+	const xattrPAXRecordsPrefix = "SCHILY.xattr."
+	for k, v := range h.PAXRecords {
+		if strings.HasPrefix(k, xattrPAXRecordsPrefix) {
+			xattrs[k[len(xattrPAXRecordsPrefix):]] = []byte(v)
+		}
+	}
+	ent := &estargz.TOCEntry{
+		Name:        h.Name,
+		Mode:        h.Mode,
+		UID:         h.Uid,
+		GID:         h.Gid,
+		Uname:       h.Uname,
+		Gname:       h.Gname,
+		ModTime3339: formatModtime(h.ModTime),
+		Xattrs:      xattrs,
+	}
+	switch h.Typeflag {
+	case tar.TypeLink:
+		ent.Type = "hardlink"
+		ent.LinkName = h.Linkname
+	case tar.TypeSymlink:
+		ent.Type = "symlink"
+		ent.LinkName = h.Linkname
+	case tar.TypeDir:
+		ent.Type = "dir"
+	case tar.TypeReg:
+		ent.Type = "reg"
+		ent.Size = h.Size
+	case tar.TypeChar:
+		ent.Type = "char"
+		ent.DevMajor = int(h.Devmajor)
+		ent.DevMinor = int(h.Devminor)
+	case tar.TypeBlock:
+		ent.Type = "block"
+		ent.DevMajor = int(h.Devmajor)
+		ent.DevMinor = int(h.Devminor)
+	case tar.TypeFifo:
+		ent.Type = "fifo"
+	default:
+		return nil, fmt.Errorf("unsupported input tar entry %q", h.Typeflag)
+	}
+	return ent, nil
+}
+
+func formatModtime(t time.Time) string {
+	if t.IsZero() || t.Unix() == 0 {
+		return ""
+	}
+	return t.UTC().Round(time.Second).Format(time.RFC3339)
+}
+
+// TOCDigest returns the digest of the TOC. Open verifies file payloads
+// against the chunk digests in the TOC so the layer contents can be verified
+// with this digest, unless the index is of an uncompressed tar (see Verifiable).
+func (idx *Index) TOCDigest() digest.Digest {
+	return digest.FromBytes(idx.TOC)
+}
+
+// Verifiable reports whether the TOC contains digests of files and chunks.
+func (idx *Index) Verifiable() bool {
+	return idx.Zran != nil
+}
+
+// Open returns estargz.Reader of the layer blob using this index. The reader
+// decompresses the requested range from the nearest gzip checkpoint.
+func (idx *Index) Open(sr *io.SectionReader) (*estargz.Reader, error) {
+	if idx.Zran == nil {
+		// Uncompressed tar. Payloads can be read from the blob directly.
+		return estargz.OpenWithTOC(sr, idx.TOC, plainDecompressor{})
+	}
+	if sr.Size() != idx.Zran.CompressedSize {
+		return nil, fmt.Errorf("blob size %d doesn't match to the index (%d)",
+			sr.Size(), idx.Zran.CompressedSize)
+	}
+	zr := zran.NewReaderAt(sr, idx.Zran)
+	return estargz.OpenWithTOC(io.NewSectionReader(zr, 0, zr.Size()), idx.TOC, plainDecompressor{})
+}
+
+// WriteTo serializes the index to w.
+func (idx *Index) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	zw := gzip.NewWriter(cw)
+	bw := bufio.NewWriter(zw)
+	bw.WriteString(indexMagic)
+	if err := writeBytes(bw, []byte(idx.Layer)); err != nil {
+		return cw.n, err
+	}
+	if err := writeBytes(bw, idx.TOC); err != nil {
+		return cw.n, err
+	}
+	if idx.Zran == nil {
+		bw.WriteByte(0)
+	} else {
+		bw.WriteByte(1)
+		if _, err := idx.Zran.WriteTo(bw); err != nil {
+			return cw.n, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+	if err := zw.Close(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
+}
+
+// Read parses the index serialized by WriteTo.
+func Read(r io.Reader) (*Index, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decompress layer index")
+	}
+	defer zr.Close()
+	br := bufio.NewReader(zr)
+	magic := make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, errors.Wrapf(err, "failed to read magic of layer index")
+	}
+	if string(magic) != indexMagic {
+		return nil, fmt.Errorf("invalid magic %q of layer index", string(magic))
+	}
+	layer, err := readBytes(br)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read layer digest")
+	}
+	dgst, err := digest.Parse(string(layer))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid layer digest")
+	}
+	toc, err := readBytes(br)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read TOC")
+	}
+	idx := &Index{Layer: dgst, TOC: toc}
+	hasZran, err := br.ReadByte()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read index type")
+	}
+	switch hasZran {
+	case 0:
+	case 1:
+		if idx.Zran, err = zran.ReadIndex(br); err != nil {
+			return nil, errors.Wrapf(err, "failed to read gzip index")
+		}
+	default:
+		return nil, fmt.Errorf("unknown index type %d", hasZran)
+	}
+	return idx, nil
+}
+
+func writeBytes(w io.Writer, p []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint64(len(p))); err != nil {
+		return err
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+func readBytes(r io.Reader) ([]byte, error) {
+	var size uint64
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxTOCBytes {
+		return nil, fmt.Errorf("too large field (%d bytes)", size)
+	}
+	p := make([]byte, size)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// plainDecompressor is a Decompressor for the uncompressed stream. This is
+// only used for reading file payloads so the footer isn't supported.
+type plainDecompressor struct{}
+
+func (plainDecompressor) Reader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+func (plainDecompressor) FooterSize() int64 {
+	return 0
+}
+
+func (plainDecompressor) ParseFooter(p []byte) (blobPayloadSize, tocOffset, tocSize int64, err error) {
+	return 0, 0, 0, fmt.Errorf("footer isn't supported by indexed layers")
+}
+
+func (plainDecompressor) ParseTOC(r io.Reader) (toc *estargz.JTOC, tocDgst digest.Digest, err error) {
+	return nil, "", fmt.Errorf("TOC isn't stored in indexed layers")
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return
+}
@@ -0,0 +1,262 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layerindex
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+type testFile struct {
+	name     string
+	typeflag byte
+	contents []byte
+	linkname string
+}
+
+func TestIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+	randBytes := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	files := []testFile{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/empty", typeflag: tar.TypeReg},
+		{name: "dir/small", typeflag: tar.TypeReg, contents: []byte("hello world")},
+		{name: "dir/large", typeflag: tar.TypeReg, contents: randBytes(300000)},
+		{name: "dir/text", typeflag: tar.TypeReg, contents: bytes.Repeat([]byte("abcdefg"), 20000)},
+		{name: "link", typeflag: tar.TypeLink, linkname: "dir/small"},
+		{name: "symlink", typeflag: tar.TypeSymlink, linkname: "dir/large"},
+		{name: "last", typeflag: tar.TypeReg, contents: []byte("x")},
+	}
+	for _, span := range []int64{1 << 10, 64 << 10} {
+		for _, chunkSize := range []int64{1000, DefaultChunkSize} {
+			t.Run(fmt.Sprintf("span=%d,chunk=%d", span, chunkSize), func(t *testing.T) {
+				blob := buildTarGz(t, files)
+				dgst := digest.FromBytes(blob)
+				idx, err := Build(bytes.NewReader(blob), dgst, WithSpan(span), WithChunkSize(chunkSize))
+				if err != nil {
+					t.Fatalf("failed to build index: %v", err)
+				}
+
+				// serialization round-trip
+				var buf bytes.Buffer
+				if _, err := idx.WriteTo(&buf); err != nil {
+					t.Fatalf("failed to write index: %v", err)
+				}
+				idx, err = Read(&buf)
+				if err != nil {
+					t.Fatalf("failed to read index: %v", err)
+				}
+				if idx.Layer != dgst {
+					t.Fatalf("layer digest = %q; want %q", idx.Layer, dgst)
+				}
+
+				r, err := idx.Open(io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob))))
+				if err != nil {
+					t.Fatalf("failed to open indexed layer: %v", err)
+				}
+				v, err := r.VerifyTOC(idx.TOCDigest())
+				if err != nil {
+					t.Fatalf("failed to verify TOC: %v", err)
+				}
+				for _, f := range files {
+					e, ok := r.Lookup(f.name)
+					if !ok {
+						t.Fatalf("entry %q not found", f.name)
+					}
+					if f.typeflag != tar.TypeReg && f.typeflag != tar.TypeLink {
+						if f.linkname != e.LinkName {
+							t.Errorf("linkname of %q = %q; want %q", f.name, e.LinkName, f.linkname)
+						}
+						continue
+					}
+					want := f.contents
+					if f.typeflag == tar.TypeLink {
+						want = contentsOf(t, files, f.linkname)
+					}
+					sr, err := r.OpenFile(f.name)
+					if err != nil {
+						t.Fatalf("failed to open %q: %v", f.name, err)
+					}
+					got, err := ioutil.ReadAll(sr)
+					if err != nil {
+						t.Fatalf("failed to read %q: %v", f.name, err)
+					}
+					if !bytes.Equal(got, want) {
+						t.Errorf("contents of %q mismatch (got %d bytes, want %d bytes)", f.name, len(got), len(want))
+					}
+					for off := int64(0); off < e.Size; off += chunkSize {
+						ce, ok := r.ChunkEntryForOffset(f.name, off)
+						if !ok {
+							t.Fatalf("chunk of %q at %d not found", f.name, off)
+						}
+						cv, err := v.Verifier(ce)
+						if err != nil {
+							t.Fatalf("verifier of %q at %d not found: %v", f.name, off, err)
+						}
+						cv.Write(want[ce.ChunkOffset : ce.ChunkOffset+ce.ChunkSize])
+						if !cv.Verified() {
+							t.Errorf("chunk of %q at %d isn't verified", f.name, off)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestIndexTar(t *testing.T) {
+	files := []testFile{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/empty", typeflag: tar.TypeReg},
+		{name: "dir/small", typeflag: tar.TypeReg, contents: []byte("hello world")},
+		{name: "dir/large", typeflag: tar.TypeReg, contents: bytes.Repeat([]byte("0123456789"), 100000)},
+		{name: "link", typeflag: tar.TypeLink, linkname: "dir/large"},
+		{name: "symlink", typeflag: tar.TypeSymlink, linkname: "dir/small"},
+	}
+	blob := buildTar(t, files)
+	ra := &countReaderAt{ra: bytes.NewReader(blob)}
+	idx, err := BuildTar(io.NewSectionReader(ra, 0, int64(len(blob))), digest.FromBytes(blob), WithChunkSize(100000))
+	if err != nil {
+		t.Fatalf("failed to build index: %v", err)
+	}
+	if ra.n >= int64(len(blob))/2 {
+		t.Errorf("too many bytes (%d) are read for indexing %d bytes tar", ra.n, len(blob))
+	}
+	if idx.Verifiable() {
+		t.Errorf("index of tar must not be verifiable")
+	}
+	var buf bytes.Buffer
+	if _, err := idx.WriteTo(&buf); err != nil {
+		t.Fatalf("failed to write index: %v", err)
+	}
+	if idx, err = Read(&buf); err != nil {
+		t.Fatalf("failed to read index: %v", err)
+	}
+	r, err := idx.Open(io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob))))
+	if err != nil {
+		t.Fatalf("failed to open indexed layer: %v", err)
+	}
+	for _, f := range files {
+		e, ok := r.Lookup(f.name)
+		if !ok {
+			t.Fatalf("entry %q not found", f.name)
+		}
+		if f.typeflag == tar.TypeSymlink {
+			if e.LinkName != f.linkname {
+				t.Errorf("linkname of %q = %q; want %q", f.name, e.LinkName, f.linkname)
+			}
+			continue
+		}
+		if f.typeflag == tar.TypeDir {
+			continue
+		}
+		want := f.contents
+		if f.typeflag == tar.TypeLink {
+			want = contentsOf(t, files, f.linkname)
+		}
+		sr, err := r.OpenFile(f.name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", f.name, err)
+		}
+		got, err := ioutil.ReadAll(sr)
+		if err != nil {
+			t.Fatalf("failed to read %q: %v", f.name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("contents of %q mismatch (got %d bytes, want %d bytes)", f.name, len(got), len(want))
+		}
+	}
+}
+
+func TestSizeMismatch(t *testing.T) {
+	blob := buildTarGz(t, []testFile{{name: "foo", typeflag: tar.TypeReg, contents: []byte("foo")}})
+	idx, err := Build(bytes.NewReader(blob), digest.FromBytes(blob))
+	if err != nil {
+		t.Fatalf("failed to build index: %v", err)
+	}
+	if _, err := idx.Open(io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob))-1)); err == nil {
+		t.Errorf("opening a blob with the wrong size must fail")
+	}
+}
+
+func contentsOf(t *testing.T, files []testFile, name string) []byte {
+	for _, f := range files {
+		if f.name == name {
+			return f.contents
+		}
+	}
+	t.Fatalf("file %q not found", name)
+	return nil
+}
+
+type countReaderAt struct {
+	ra io.ReaderAt
+	n  int64
+}
+
+func (r *countReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ra.ReadAt(p, off)
+	r.n += int64(n)
+	return n, err
+}
+
+func buildTarGz(t *testing.T, files []testFile) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(buildTar(t, files)); err != nil {
+		t.Fatalf("failed to write gzip: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close gzip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func buildTar(t *testing.T, files []testFile) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: f.typeflag,
+			Name:     f.name,
+			Linkname: f.linkname,
+			Mode:     0644,
+			Size:     int64(len(f.contents)),
+		}); err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		if _, err := tw.Write(f.contents); err != nil {
+			t.Fatalf("failed to write tar payload: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	return buf.Bytes()
+}
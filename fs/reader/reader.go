@@ -25,15 +25,18 @@ package reader
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"path/filepath"
 	"runtime"
 	"sync"
 
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
@@ -42,9 +45,15 @@ import (
 
 const maxWalkDepth = 10000
 
+// decompressors are the non-gzip decompressors supported in addition to the
+// default gzip-based eStargz.
+var decompressors = []estargz.Decompressor{new(zstdchunked.Decompressor)}
+
 type Reader interface {
 	OpenFile(name string) (io.ReaderAt, error)
 	Lookup(name string) (*estargz.TOCEntry, bool)
+	PrefetchProfile(name string) (*estargz.PrefetchProfile, bool)
+	FileRange(name string) (offset, size int64, ok bool)
 	Cache(opts ...CacheOption) error
 }
 
@@ -67,6 +76,22 @@ func (vr *VerifiableReader) VerifyTOC(tocDigest digest.Digest) (Reader, error) {
 	return vr.r, nil
 }
 
+// TOCSigned returns true if the TOC of the layer is signed.
+func (vr *VerifiableReader) TOCSigned() bool {
+	return len(vr.r.r.TOCSignature()) > 0
+}
+
+// VerifyTOCSignature verifies the layer with the signature of the TOC made by
+// any of the trusted keys instead of the known TOC digest.
+func (vr *VerifiableReader) VerifyTOCSignature(keys ...crypto.PublicKey) (Reader, error) {
+	v, err := vr.r.r.VerifyTOCSignature(keys...)
+	if err != nil {
+		return nil, err
+	}
+	vr.r.verifier = v
+	return vr.r, nil
+}
+
 type nopTOCEntryVerifier struct{}
 
 func (nev nopTOCEntryVerifier) Verifier(ce *estargz.TOCEntry) (digest.Verifier, error) {
@@ -86,8 +111,31 @@ func (nv nopVerifier) Verified() bool {
 // NewReader creates a Reader based on the given stargz blob and cache implementation.
 // It returns VerifiableReader so the caller must provide a estargz.TOCEntryVerifier
 // to use for verifying file or chunk contained in this stargz blob.
-func NewReader(sr *io.SectionReader, cache cache.BlobCache) (*VerifiableReader, *estargz.TOCEntry, error) {
-	r, err := estargz.Open(sr)
+func NewReader(sr *io.SectionReader, cache cache.BlobCache, opts ...Option) (*VerifiableReader, *estargz.TOCEntry, error) {
+	var rOpts options
+	for _, o := range opts {
+		o(&rOpts)
+	}
+	return NewReaderWithOpenFunc(sr, cache, func(sr *io.SectionReader) (*estargz.Reader, error) {
+		return estargz.Open(sr,
+			estargz.WithDecompressors(decompressors...),
+			estargz.WithTailFetchSize(rOpts.tailFetchSize),
+		)
+	}, opts...)
+}
+
+// OpenFunc parses the layer blob and returns estargz.Reader of it.
+type OpenFunc func(sr *io.SectionReader) (*estargz.Reader, error)
+
+// NewReaderWithOpenFunc is the same as NewReader but the blob is parsed by the
+// specified function. This can be used for layers that aren't eStargz but are
+// readable through estargz.Reader (e.g. indexed tar.gz layers).
+func NewReaderWithOpenFunc(sr *io.SectionReader, cache cache.BlobCache, open OpenFunc, opts ...Option) (*VerifiableReader, *estargz.TOCEntry, error) {
+	var rOpts options
+	for _, o := range opts {
+		o(&rOpts)
+	}
+	r, err := open(sr)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "failed to parse stargz")
 	}
@@ -98,9 +146,11 @@ func NewReader(sr *io.SectionReader, cache cache.BlobCache) (*VerifiableReader,
 	}
 
 	vr := &reader{
-		r:     r,
-		sr:    sr,
-		cache: cache,
+		r:       r,
+		sr:      sr,
+		cache:   cache,
+		open:    open,
+		layerID: rOpts.layerID,
 		bufPool: sync.Pool{
 			New: func() interface{} {
 				return new(bytes.Buffer)
@@ -117,6 +167,22 @@ type reader struct {
 	cache    cache.BlobCache
 	bufPool  sync.Pool
 	verifier estargz.TOCEntryVerifier
+	open     OpenFunc
+	layerID  string
+}
+
+// fileID returns the ID of the file used for generating cache keys of its chunks.
+// Files without digests (e.g. in legacy stargz or indexed tar layers) are
+// identified by the layer and the offset.
+func (gr *reader) fileID(e *estargz.TOCEntry) string {
+	if e.Digest != "" {
+		return e.Digest
+	}
+	if e.InnerOffset != 0 {
+		// packed files share the Offset
+		return fmt.Sprintf("%s@%d+%d", gr.layerID, e.Offset, e.InnerOffset)
+	}
+	return fmt.Sprintf("%s@%d", gr.layerID, e.Offset)
 }
 
 func (gr *reader) OpenFile(name string) (io.ReaderAt, error) {
@@ -130,7 +196,8 @@ func (gr *reader) OpenFile(name string) (io.ReaderAt, error) {
 	}
 	return &file{
 		name:   name,
-		digest: e.Digest,
+		size:   e.Size,
+		digest: gr.fileID(e),
 		r:      gr.r,
 		cache:  gr.cache,
 		ra:     sr,
@@ -142,6 +209,14 @@ func (gr *reader) Lookup(name string) (*estargz.TOCEntry, bool) {
 	return gr.r.Lookup(name)
 }
 
+func (gr *reader) PrefetchProfile(name string) (*estargz.PrefetchProfile, bool) {
+	return gr.r.PrefetchProfile(name)
+}
+
+func (gr *reader) FileRange(name string) (offset, size int64, ok bool) {
+	return gr.r.FileRange(name)
+}
+
 func (gr *reader) Cache(opts ...CacheOption) (err error) {
 	var cacheOpts cacheOptions
 	for _, o := range opts {
@@ -150,7 +225,7 @@ func (gr *reader) Cache(opts ...CacheOption) (err error) {
 
 	r := gr.r
 	if cacheOpts.reader != nil {
-		if r, err = estargz.Open(cacheOpts.reader); err != nil {
+		if r, err = gr.open(cacheOpts.reader); err != nil {
 			return errors.Wrap(err, "failed to parse stargz")
 		}
 	}
@@ -170,12 +245,12 @@ func (gr *reader) Cache(opts ...CacheOption) (err error) {
 	eg.Go(func() error {
 		return gr.cacheWithReader(egCtx,
 			0, eg, semaphore.NewWeighted(int64(runtime.GOMAXPROCS(0))),
-			root, r, filter, cacheOpts.cacheOpts...)
+			root, r, filter, make(map[int64]struct{}), cacheOpts.cacheOpts...)
 	})
 	return eg.Wait()
 }
 
-func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *errgroup.Group, sem *semaphore.Weighted, dir *estargz.TOCEntry, r *estargz.Reader, filter func(*estargz.TOCEntry) bool, opts ...cache.Option) (rErr error) {
+func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *errgroup.Group, sem *semaphore.Weighted, dir *estargz.TOCEntry, r *estargz.Reader, filter func(*estargz.TOCEntry) bool, cachedStreams map[int64]struct{}, opts ...cache.Option) (rErr error) {
 	if currentDepth > maxWalkDepth {
 		return fmt.Errorf("TOCEntry tree is too deep (depth:%d)", currentDepth)
 	}
@@ -195,7 +270,7 @@ func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *err
 					e.Name, dir.Name)
 				return false
 			}
-			if err := gr.cacheWithReader(ctx, currentDepth+1, eg, sem, e, r, filter, opts...); err != nil {
+			if err := gr.cacheWithReader(ctx, currentDepth+1, eg, sem, e, r, filter, cachedStreams, opts...); err != nil {
 				rErr = err
 				return false
 			}
@@ -221,9 +296,34 @@ func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *err
 		for nr < e.Size {
 			ce, ok := r.ChunkEntryForOffset(e.Name, nr)
 			if !ok {
+				// skip the hole of the sparse file
+				if dataOff, ok := r.NextDataOffset(e.Name, nr); ok && dataOff > nr {
+					nr = dataOff
+					continue
+				}
 				break
 			}
-			nr += ce.ChunkSize
+			nr = ce.ChunkOffset + ce.ChunkSize
+
+			if ents, ok := r.PackedEntries(ce.Offset); ok {
+				// Small files packed into the same stream are cached at once.
+				if _, ok := cachedStreams[ce.Offset]; ok {
+					continue
+				}
+				cachedStreams[ce.Offset] = struct{}{}
+				if err := sem.Acquire(ctx, 1); err != nil {
+					rErr = err
+					return false
+				}
+				eg.Go(func() error {
+					defer sem.Release(1)
+					if gr.isCached(r, ents, opts...) {
+						return nil
+					}
+					return gr.cacheStream(r, ents, nil, opts...)
+				})
+				continue
+			}
 
 			if err := sem.Acquire(ctx, 1); err != nil {
 				rErr = err
@@ -234,7 +334,7 @@ func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *err
 				defer sem.Release(1)
 
 				// Check if the target chunks exists in the cache
-				id := genID(e.Digest, ce.ChunkOffset, ce.ChunkSize)
+				id := genID(gr.fileID(e), ce.ChunkOffset, ce.ChunkSize)
 				if _, err := gr.cache.FetchAt(id, 0, nil, opts...); err == nil {
 					return nil
 				}
@@ -277,6 +377,7 @@ func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *err
 
 type file struct {
 	name   string
+	size   int64
 	digest string
 	ra     io.ReaderAt
 	r      *estargz.Reader
@@ -291,7 +392,16 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	for nr < len(p) {
 		ce, ok := sf.r.ChunkEntryForOffset(sf.name, offset+int64(nr))
 		if !ok {
-			break
+			// holes of sparse files are read as zeros
+			n := sf.holeSize(offset+int64(nr), int64(len(p)-nr))
+			if n == 0 {
+				break
+			}
+			for i := range p[nr : int64(nr)+n] {
+				p[nr+i] = 0
+			}
+			nr += int(n)
+			continue
 		}
 		var (
 			id           = genID(sf.digest, ce.ChunkOffset, ce.ChunkSize)
@@ -307,7 +417,29 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 			continue
 		}
 
-		// We missed cache. Take it from underlying reader.
+		// We missed cache. If this chunk is packed with other small files, all
+		// of them are decompressed and cached at once.
+		if ents, ok := sf.r.PackedEntries(ce.Offset); ok {
+			var ip []byte
+			if err := sf.gr.cacheStream(sf.r, ents, func(e *estargz.TOCEntry, b []byte) {
+				if e == ce {
+					ip = b
+				}
+			}); err != nil {
+				return 0, err
+			}
+			if int64(len(ip)) != ce.ChunkSize {
+				return 0, fmt.Errorf("chunk %q (offset:%d) not found in the stream", ce.Name, ce.ChunkOffset)
+			}
+			n := copy(p[nr:], ip[lowerDiscard:ce.ChunkSize-upperDiscard])
+			if int64(n) != expectedSize {
+				return 0, fmt.Errorf("unexpected final data size %d; want %d", n, expectedSize)
+			}
+			nr += n
+			continue
+		}
+
+		// Take it from underlying reader.
 		// We read the whole chunk here and add it to the cache so that following
 		// reads against neighboring chunks can take the data without decmpression.
 		if lowerDiscard == 0 && upperDiscard == 0 {
@@ -319,7 +451,7 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 			}
 
 			// Verify this chunk
-			if err := sf.verify(ip, ce); err != nil {
+			if err := sf.gr.verify(ip, ce); err != nil {
 				return 0, errors.Wrap(err, "invalid chunk")
 			}
 
@@ -340,7 +472,7 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 		}
 
 		// Verify this chunk
-		if err := sf.verify(ip, ce); err != nil {
+		if err := sf.gr.verify(ip, ce); err != nil {
 			sf.gr.bufPool.Put(b)
 			return 0, errors.Wrap(err, "invalid chunk")
 		}
@@ -358,8 +490,81 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	return nr, nil
 }
 
-func (sf *file) verify(p []byte, ce *estargz.TOCEntry) error {
-	v, err := sf.gr.verifier.Verifier(ce)
+// isCached returns true if all chunks are cached.
+func (gr *reader) isCached(r *estargz.Reader, ents []*estargz.TOCEntry, opts ...cache.Option) bool {
+	for _, ce := range ents {
+		e, ok := r.Lookup(ce.Name)
+		if !ok {
+			return false
+		}
+		if _, err := gr.cache.FetchAt(genID(gr.fileID(e), ce.ChunkOffset, ce.ChunkSize), 0, nil, opts...); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheStream decompresses the stream containing the packed chunks once and
+// adds all of them to the cache after verification. fn is called with the
+// contents of each chunk if non-nil.
+func (gr *reader) cacheStream(r *estargz.Reader, ents []*estargz.TOCEntry, fn func(*estargz.TOCEntry, []byte), opts ...cache.Option) error {
+	dr, err := r.OpenStream(ents[0])
+	if err != nil {
+		return errors.Wrap(err, "failed to open stream")
+	}
+	defer dr.Close()
+	var pos int64
+	for _, ce := range ents {
+		if _, err := io.CopyN(ioutil.Discard, dr, ce.InnerOffset-pos); err != nil {
+			return errors.Wrapf(err, "failed to seek to %q (offset:%d)", ce.Name, ce.ChunkOffset)
+		}
+		b := make([]byte, ce.ChunkSize)
+		if _, err := io.ReadFull(dr, b); err != nil {
+			return errors.Wrapf(err, "failed to read %q (offset:%d)", ce.Name, ce.ChunkOffset)
+		}
+		pos = ce.InnerOffset + ce.ChunkSize
+		if err := gr.verify(b, ce); err != nil {
+			return errors.Wrap(err, "invalid chunk")
+		}
+		e, ok := r.Lookup(ce.Name)
+		if !ok {
+			return fmt.Errorf("failed to get TOCEntry %q", ce.Name)
+		}
+		gr.cache.Add(genID(gr.fileID(e), ce.ChunkOffset, ce.ChunkSize), b, opts...)
+		if fn != nil {
+			fn(ce, b)
+		}
+	}
+	return nil
+}
+
+// holeSize returns the size of the hole at the offset up to max bytes. This
+// returns 0 if the offset isn't in a hole.
+func (sf *file) holeSize(offset, max int64) int64 {
+	dataOff, ok := sf.r.NextDataOffset(sf.name, offset)
+	if !ok {
+		dataOff = sf.size
+	}
+	if n := dataOff - offset; n < max {
+		return positive(n)
+	}
+	return max
+}
+
+// NextDataOffset returns the offset of the next data at or after the offset.
+// ok is false if no data follows the offset.
+func (sf *file) NextDataOffset(offset int64) (int64, bool) {
+	return sf.r.NextDataOffset(sf.name, offset)
+}
+
+// NextHoleOffset returns the offset of the next hole at or after the offset.
+// The end of the file is regarded as a hole.
+func (sf *file) NextHoleOffset(offset int64) int64 {
+	return sf.r.NextHoleOffset(sf.name, offset)
+}
+
+func (gr *reader) verify(p []byte, ce *estargz.TOCEntry) error {
+	v, err := gr.verifier.Verifier(ce)
 	if err != nil {
 		return errors.Wrapf(err, "verifier not found %q (offset:%d,size:%d)",
 			ce.Name, ce.ChunkOffset, ce.ChunkSize)
@@ -388,6 +593,31 @@ func positive(n int64) int64 {
 	return n
 }
 
+// Option is an option used during creating Reader.
+type Option func(*options)
+
+type options struct {
+	layerID       string
+	tailFetchSize int64
+}
+
+// WithLayerID specifies the ID of the layer (e.g. the digest of the blob). This
+// is used for generating cache keys of files that don't have digests in TOC.
+func WithLayerID(id string) Option {
+	return func(opts *options) {
+		opts.layerID = id
+	}
+}
+
+// WithTailFetchSize specifies the number of bytes read at once from the tail of
+// the blob when NewReader parses the footer and the TOC.
+// See also estargz.WithTailFetchSize.
+func WithTailFetchSize(size int64) Option {
+	return func(opts *options) {
+		opts.tailFetchSize = size
+	}
+}
+
 type CacheOption func(*cacheOptions)
 
 type cacheOptions struct {
@@ -25,6 +25,7 @@ package reader
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"strings"
@@ -33,6 +34,7 @@ import (
 
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
 	digest "github.com/opencontainers/go-digest"
 )
 
@@ -43,12 +45,26 @@ const (
 	lastChunkOffset1   = sampleChunkSize * (int64(len(sampleData1)) / sampleChunkSize)
 )
 
+var srcCompressions = map[string]estargz.Compression{
+	"gzip":        estargz.NewGzipCompressionWithLevel(gzip.BestCompression),
+	"zstdchunked": zstdchunked.NewCompression(3),
+}
+
 // Tests Reader for failure cases.
 func TestFailReader(t *testing.T) {
+	for cn, c := range srcCompressions {
+		c := c
+		t.Run(cn, func(t *testing.T) {
+			testFailReader(t, c)
+		})
+	}
+}
+
+func testFailReader(t *testing.T, c estargz.Compression) {
 	testFileName := "test"
 	stargzFile, _ := buildStargz(t, []tarent{
 		regfile(testFileName, sampleData1),
-	}, chunkSizeInfo(sampleChunkSize))
+	}, chunkSizeInfo(sampleChunkSize), c)
 	br := &breakReaderAt{
 		ReaderAt: stargzFile,
 		success:  true,
@@ -209,67 +225,69 @@ func TestFileReadAt(t *testing.T) {
 			for bo, baseo := range baseOffsetCond {
 				for fn, filesize := range fileSizeCond {
 					for cc, cacheExcept := range cacheCond {
-						t.Run(fmt.Sprintf("reading_%s_%s_%s_%s_%s", sn, in, bo, fn, cc), func(t *testing.T) {
-							if filesize > int64(len(sampleData1)) {
-								t.Fatal("sample file size is larger than sample data")
-							}
-
-							wantN := size
-							offset := baseo + innero
-							if remain := filesize - offset; remain < wantN {
-								if wantN = remain; wantN < 0 {
-									wantN = 0
+						for srcName, c := range srcCompressions {
+							t.Run(fmt.Sprintf("reading_%s_%s_%s_%s_%s_%s", sn, in, bo, fn, cc, srcName), func(t *testing.T) {
+								if filesize > int64(len(sampleData1)) {
+									t.Fatal("sample file size is larger than sample data")
 								}
-							}
-
-							// use constant string value as a data source.
-							want := strings.NewReader(sampleData1)
-
-							// data we want to get.
-							wantData := make([]byte, wantN)
-							_, err := want.ReadAt(wantData, offset)
-							if err != nil && err != io.EOF {
-								t.Fatalf("want.ReadAt (offset=%d,size=%d): %v", offset, wantN, err)
-							}
-
-							// data we get through a file.
-							f := makeFile(t, []byte(sampleData1)[:filesize], sampleChunkSize)
-							f.ra = newExceptSectionReader(t, f.ra, cacheExcept...)
-							for _, reg := range cacheExcept {
-								f.cache.Add(genID(f.digest, reg.b, reg.e-reg.b+1), []byte(sampleData1[reg.b:reg.e+1]))
-							}
-							respData := make([]byte, size)
-							n, err := f.ReadAt(respData, offset)
-							if err != nil {
-								t.Errorf("failed to read off=%d, size=%d, filesize=%d: %v", offset, size, filesize, err)
-								return
-							}
-							respData = respData[:n]
-
-							if !bytes.Equal(wantData, respData) {
-								t.Errorf("off=%d, filesize=%d; read data{size=%d,data=%q}; want (size=%d,data=%q)",
-									offset, filesize, len(respData), string(respData), wantN, string(wantData))
-								return
-							}
-
-							// check cache has valid contents.
-							cn := 0
-							nr := 0
-							for int64(nr) < wantN {
-								ce, ok := f.r.ChunkEntryForOffset(f.name, offset+int64(nr))
-								if !ok {
-									break
+
+								wantN := size
+								offset := baseo + innero
+								if remain := filesize - offset; remain < wantN {
+									if wantN = remain; wantN < 0 {
+										wantN = 0
+									}
 								}
-								data := make([]byte, ce.ChunkSize)
-								n, err := f.cache.FetchAt(genID(f.digest, ce.ChunkOffset, ce.ChunkSize), 0, data)
-								if err != nil || n != int(ce.ChunkSize) {
-									t.Errorf("missed cache of offset=%d, size=%d: %v(got size=%d)", ce.ChunkOffset, ce.ChunkSize, err, n)
+
+								// use constant string value as a data source.
+								want := strings.NewReader(sampleData1)
+
+								// data we want to get.
+								wantData := make([]byte, wantN)
+								_, err := want.ReadAt(wantData, offset)
+								if err != nil && err != io.EOF {
+									t.Fatalf("want.ReadAt (offset=%d,size=%d): %v", offset, wantN, err)
+								}
+
+								// data we get through a file.
+								f := makeFile(t, []byte(sampleData1)[:filesize], sampleChunkSize, c)
+								f.ra = newExceptSectionReader(t, f.ra, cacheExcept...)
+								for _, reg := range cacheExcept {
+									f.cache.Add(genID(f.digest, reg.b, reg.e-reg.b+1), []byte(sampleData1[reg.b:reg.e+1]))
+								}
+								respData := make([]byte, size)
+								n, err := f.ReadAt(respData, offset)
+								if err != nil {
+									t.Errorf("failed to read off=%d, size=%d, filesize=%d: %v", offset, size, filesize, err)
 									return
 								}
-								nr += n
-								cn++
-							}
-						})
+								respData = respData[:n]
+
+								if !bytes.Equal(wantData, respData) {
+									t.Errorf("off=%d, filesize=%d; read data{size=%d,data=%q}; want (size=%d,data=%q)",
+										offset, filesize, len(respData), string(respData), wantN, string(wantData))
+									return
+								}
+
+								// check cache has valid contents.
+								cn := 0
+								nr := 0
+								for int64(nr) < wantN {
+									ce, ok := f.r.ChunkEntryForOffset(f.name, offset+int64(nr))
+									if !ok {
+										break
+									}
+									data := make([]byte, ce.ChunkSize)
+									n, err := f.cache.FetchAt(genID(f.digest, ce.ChunkOffset, ce.ChunkSize), 0, data)
+									if err != nil || n != int(ce.ChunkSize) {
+										t.Errorf("missed cache of offset=%d, size=%d: %v(got size=%d)", ce.ChunkOffset, ce.ChunkSize, err, n)
+										return
+									}
+									nr += n
+									cn++
+								}
+							})
+						}
 					}
 				}
 			}
@@ -277,6 +295,74 @@ func TestFileReadAt(t *testing.T) {
 	}
 }
 
+// Tests small files packed into a stream are decompressed and cached at once.
+func TestPackedFiles(t *testing.T) {
+	files := map[string]string{
+		"a": "aaaaaaaaaa",
+		"b": "bbbbbbbbbbbbbbbbbbbb",
+		"c": "ccc",
+	}
+	var ents []tarent
+	for _, name := range []string{"a", "b", "c"} {
+		ents = append(ents, regfile(name, files[name]))
+	}
+	for srcName, c := range srcCompressions {
+		for _, useCache := range []bool{false, true} {
+			c, useCache := c, useCache
+			t.Run(fmt.Sprintf("%s,cache=%v", srcName, useCache), func(t *testing.T) {
+				sr, dgst := buildStargz(t, ents, minChunkSizeInfo(4096), c)
+				sgz, err := estargz.Open(sr, estargz.WithDecompressors(c))
+				if err != nil {
+					t.Fatalf("failed to parse converted stargz: %v", err)
+				}
+				e, ok := sgz.Lookup("b")
+				if !ok {
+					t.Fatalf("failed to get b")
+				}
+				if packed, ok := sgz.PackedEntries(e.Offset); !ok || len(packed) < len(files) {
+					t.Fatalf("files must be packed into a stream; got %d entries", len(packed))
+				}
+				ev, err := sgz.VerifyTOC(dgst)
+				if err != nil {
+					t.Fatalf("failed to verify stargz: %v", err)
+				}
+				br := &breakReaderAt{ReaderAt: sr, success: true}
+				r, _, err := newReader(io.NewSectionReader(br, 0, sr.Size()), &testCache{membuf: map[string]string{}, t: t}, ev)
+				if err != nil {
+					t.Fatalf("failed to open stargz file: %v", err)
+				}
+				if useCache {
+					if err := r.Cache(); err != nil {
+						t.Fatalf("failed to cache: %v", err)
+					}
+				} else {
+					ra, err := r.OpenFile("b")
+					if err != nil {
+						t.Fatalf("failed to open b: %v", err)
+					}
+					p := make([]byte, 5)
+					if n, err := ra.ReadAt(p, 3); err != nil || string(p[:n]) != files["b"][3:8] {
+						t.Fatalf("failed to read b: %q, %v", string(p[:n]), err)
+					}
+				}
+
+				// All files must be served from the cache.
+				br.success = false
+				for name, want := range files {
+					ra, err := r.OpenFile(name)
+					if err != nil {
+						t.Fatalf("failed to open %q: %v", name, err)
+					}
+					p := make([]byte, len(want))
+					if n, err := ra.ReadAt(p, 0); err != nil || string(p[:n]) != want {
+						t.Errorf("failed to read %q from cache: %q, %v", name, string(p[:n]), err)
+					}
+				}
+			})
+		}
+	}
+}
+
 type exceptSectionReader struct {
 	ra     io.ReaderAt
 	except map[region]bool
@@ -299,13 +385,13 @@ func (er *exceptSectionReader) ReadAt(p []byte, offset int64) (int, error) {
 	return er.ra.ReadAt(p, offset)
 }
 
-func makeFile(t *testing.T, contents []byte, chunkSize int64) *file {
+func makeFile(t *testing.T, contents []byte, chunkSize int64, c estargz.Compression) *file {
 	testName := "test"
 	sr, dgst := buildStargz(t, []tarent{
 		regfile(testName, string(contents)),
-	}, chunkSizeInfo(chunkSize))
+	}, chunkSizeInfo(chunkSize), c)
 
-	sgz, err := estargz.Open(sr)
+	sgz, err := estargz.Open(sr, estargz.WithDecompressors(c))
 	if err != nil {
 		t.Fatalf("failed to parse converted stargz: %v", err)
 	}
@@ -350,13 +436,21 @@ func regfile(name string, contents string) tarent {
 }
 
 type chunkSizeInfo int
+type minChunkSizeInfo int
 
 func buildStargz(t *testing.T, ents []tarent, opts ...interface{}) (*io.SectionReader, digest.Digest) {
 	var chunkSize chunkSizeInfo
+	var minChunkSize minChunkSizeInfo
+	var compression estargz.Compression = estargz.NewGzipCompressionWithLevel(gzip.BestCompression)
 	for _, opt := range opts {
-		if v, ok := opt.(chunkSizeInfo); ok {
+		switch v := opt.(type) {
+		case chunkSizeInfo:
 			chunkSize = v
-		} else {
+		case minChunkSizeInfo:
+			minChunkSize = v
+		case estargz.Compression:
+			compression = v
+		default:
 			t.Fatalf("unsupported opt")
 		}
 	}
@@ -380,6 +474,8 @@ func buildStargz(t *testing.T, ents []tarent, opts ...interface{}) (*io.SectionR
 	rc, err := estargz.Build(
 		io.NewSectionReader(bytes.NewReader(tarData), 0, int64(len(tarData))),
 		estargz.WithChunkSize(int(chunkSize)),
+		estargz.WithMinChunkSize(int(minChunkSize)),
+		estargz.WithCompression(compression),
 	)
 	if err != nil {
 		t.Fatalf("failed to build verifiable stargz: %v", err)
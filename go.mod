@@ -16,6 +16,7 @@ require (
 	github.com/hanwen/go-fuse/v2 v2.0.4-0.20201208195215-4a458845028b
 	github.com/hashicorp/go-multierror v1.1.0
 	github.com/hashicorp/golang-lru v0.5.3 // indirect
+	github.com/klauspost/compress v1.11.3
 	github.com/kr/text v0.2.0 // indirect
 	github.com/moby/sys/mountinfo v0.4.0
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
@@ -17,6 +17,7 @@
 package estargz
 
 import (
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
@@ -28,6 +29,7 @@ import (
 	"github.com/containerd/containerd/images/converter/uncompress"
 	"github.com/containerd/containerd/labels"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -57,6 +59,46 @@ func LayerConvertWithLayerOptsFunc(opts map[digest.Digest][]estargz.Option) conv
 // Otherwise "containerd.io/snapshot/stargz/toc.digest" annotation will be lost,
 // because the Docker media type does not support layer annotations.
 func LayerConvertFunc(opts ...estargz.Option) converter.ConvertFunc {
+	return layerConvertFunc(gzipMediaType, opts...)
+}
+
+// LayerConvertZstdChunkedFunc converts legacy tar.gz layers into zstd:chunked
+// layers which are eStargz compressed with zstd (see estargz/zstdchunked).
+// Media type is changed to the OCI tar+zstd media type because Docker media
+// types don't support zstd.
+//
+// Options which change the compression of eStargz (e.g. WithCompressionLevel)
+// are ignored unless WithCompression is specified in opts.
+func LayerConvertZstdChunkedFunc(opts ...estargz.Option) converter.ConvertFunc {
+	opts = append([]estargz.Option{
+		estargz.WithCompression(zstdchunked.NewCompression(defaultZstdCompressionLevel)),
+	}, opts...)
+	return layerConvertFunc(zstdMediaType, opts...)
+}
+
+// defaultZstdCompressionLevel is the default compression level of zstd.
+const defaultZstdCompressionLevel = 3
+
+func gzipMediaType(mediaType string) string {
+	if uncompress.IsUncompressedType(mediaType) {
+		if images.IsDockerType(mediaType) {
+			return mediaType + ".gzip"
+		}
+		return mediaType + "+gzip"
+	}
+	return mediaType
+}
+
+func zstdMediaType(mediaType string) string {
+	switch mediaType {
+	case images.MediaTypeDockerSchema2LayerForeign, images.MediaTypeDockerSchema2LayerForeignGzip,
+		ocispec.MediaTypeImageLayerNonDistributable, ocispec.MediaTypeImageLayerNonDistributableGzip:
+		return ocispec.MediaTypeImageLayerNonDistributable + "+zstd"
+	}
+	return ocispec.MediaTypeImageLayer + "+zstd"
+}
+
+func layerConvertFunc(mediaType func(string) string, opts ...estargz.Option) converter.ConvertFunc {
 	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
 		if !images.IsLayerType(desc.MediaType) {
 			// No conversion. No need to return an error here.
@@ -81,15 +123,6 @@ func LayerConvertFunc(opts ...estargz.Option) converter.ConvertFunc {
 			logrus.Debugf("estargz: uncompressed %s into %s", desc.Digest, uncompressedDesc.Digest)
 		}
 
-		info, err := cs.Info(ctx, desc.Digest)
-		if err != nil {
-			return nil, err
-		}
-		labelz := info.Labels
-		if labelz == nil {
-			labelz = make(map[string]string)
-		}
-
 		uncompressedReaderAt, err := cs.ReaderAt(ctx, *uncompressedDesc)
 		if err != nil {
 			return nil, err
@@ -101,49 +134,237 @@ func LayerConvertFunc(opts ...estargz.Option) converter.ConvertFunc {
 			return nil, err
 		}
 		defer blob.Close()
-		ref := fmt.Sprintf("convert-estargz-from-%s", desc.Digest)
-		w, err := cs.Writer(ctx, content.WithRef(ref))
+		return writeEstargzBlob(ctx, cs, desc, fmt.Sprintf("convert-estargz-from-%s", desc.Digest), blob, mediaType)
+	}
+}
+
+// LayerConvertStreamFunc converts legacy tar.gz layers into eStargz tar.gz
+// layers in the same way as LayerConvertFunc, but builds eStargz directly from
+// the layer content with estargz.BuildFromStream instead of storing the
+// uncompressed layer to the content store first. Prioritized files are placed
+// in the order of the layer tar. If opts contain options unsupported by
+// estargz.BuildFromStream or the layer isn't compressed with gzip, this falls
+// back to LayerConvertFunc.
+func LayerConvertStreamFunc(opts ...estargz.Option) converter.ConvertFunc {
+	return layerConvertStreamFunc(gzipMediaType, opts...)
+}
+
+// LayerConvertZstdChunkedStreamFunc converts legacy tar.gz layers into
+// zstd:chunked layers in the same way as LayerConvertZstdChunkedFunc, but
+// builds them directly from the layer content. See LayerConvertStreamFunc for
+// details.
+func LayerConvertZstdChunkedStreamFunc(opts ...estargz.Option) converter.ConvertFunc {
+	opts = append([]estargz.Option{
+		estargz.WithCompression(zstdchunked.NewCompression(defaultZstdCompressionLevel)),
+	}, opts...)
+	return layerConvertStreamFunc(zstdMediaType, opts...)
+}
+
+func layerConvertStreamFunc(mediaType func(string) string, opts ...estargz.Option) converter.ConvertFunc {
+	fallback := layerConvertFunc(mediaType, opts...)
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if !images.IsLayerType(desc.MediaType) {
+			// No conversion. No need to return an error here.
+			return nil, nil
+		}
+		if c, err := images.DiffCompression(ctx, desc.MediaType); err != nil || (c != "gzip" && !uncompress.IsUncompressedType(desc.MediaType)) {
+			return fallback(ctx, cs, desc)
+		}
+		ra, err := cs.ReaderAt(ctx, desc)
 		if err != nil {
 			return nil, err
 		}
-		defer w.Close()
-
-		// Reset the writing position
-		// Old writer possibly remains without aborted
-		// (e.g. conversion interrupted by a signal)
-		if err := w.Truncate(0); err != nil {
+		defer ra.Close()
+		blob, err := estargz.BuildFromStream(io.NewSectionReader(ra, 0, desc.Size), opts...)
+		if errors.Cause(err) == estargz.ErrStreamUnsupported {
+			logrus.Debugf("estargz: options unsupported by streaming; uncompressing %s first", desc.Digest)
+			return fallback(ctx, cs, desc)
+		} else if err != nil {
 			return nil, err
 		}
+		defer blob.Close()
+		return writeEstargzBlob(ctx, cs, desc, fmt.Sprintf("convert-estargz-from-%s", desc.Digest), blob, mediaType)
+	}
+}
 
-		n, err := io.Copy(w, blob)
-		if err != nil {
-			return nil, err
+// writeEstargzBlob writes the eStargz blob converted from desc to the content
+// store using ref and returns its descriptor.
+func writeEstargzBlob(ctx context.Context, cs content.Store, desc ocispec.Descriptor, ref string, blob *estargz.Blob, mediaType func(string) string) (*ocispec.Descriptor, error) {
+	newDesc, err := writeBlob(ctx, cs, desc, ref, func(w io.Writer) (digest.Digest, error) {
+		if _, err := io.Copy(w, blob); err != nil {
+			return "", err
 		}
 		if err := blob.Close(); err != nil {
+			return "", err
+		}
+		return blob.DiffID(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	newDesc.MediaType = mediaType(newDesc.MediaType)
+	if newDesc.Annotations == nil {
+		newDesc.Annotations = make(map[string]string, 2)
+	}
+	newDesc.Annotations[estargz.TOCJSONDigestAnnotation] = blob.TOCDigest().String()
+	newDesc.Annotations[estargz.TOCSizeAnnotation] = fmt.Sprintf("%d", blob.TOCSize())
+	return newDesc, nil
+}
+
+// writeBlob writes the blob converted from desc to the content store using ref.
+// write writes the blob and returns its DiffID, which is recorded as the label
+// of the blob. The returned descriptor is desc with the digest and the size of
+// the new blob.
+func writeBlob(ctx context.Context, cs content.Store, desc ocispec.Descriptor, ref string, write func(w io.Writer) (digest.Digest, error)) (*ocispec.Descriptor, error) {
+	info, err := cs.Info(ctx, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	labelz := info.Labels
+	if labelz == nil {
+		labelz = make(map[string]string)
+	}
+	w, err := cs.Writer(ctx, content.WithRef(ref))
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	// Reset the writing position
+	// Old writer possibly remains without aborted
+	// (e.g. conversion interrupted by a signal)
+	if err := w.Truncate(0); err != nil {
+		return nil, err
+	}
+
+	c := &counter{w: w}
+	diffID, err := write(c)
+	if err != nil {
+		return nil, err
+	}
+	// update diffID label
+	labelz[labels.LabelUncompressed] = diffID.String()
+	if err = w.Commit(ctx, c.n, "", content.WithLabels(labelz)); err != nil && !errdefs.IsAlreadyExists(err) {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	newDesc := desc
+	newDesc.Digest = w.Digest()
+	newDesc.Size = c.n
+	return &newDesc, nil
+}
+
+// LayerRevertFunc converts eStargz layers (including zstd:chunked) back into
+// legacy tar.gz layers. TOC, landmarks and the footer are removed. If the layer
+// was built with tar-split metadata (estargz.WithTarSplit), the reverted layer
+// has the same DiffID as the layer the eStargz was converted from. Media types
+// of zstd:chunked layers are changed to tar+gzip ones. Non-eStargz layers are
+// unchanged.
+func LayerRevertFunc() converter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if !images.IsLayerType(desc.MediaType) || uncompress.IsUncompressedType(desc.MediaType) {
+			// No conversion. No need to return an error here.
+			return nil, nil
+		}
+		ra, err := cs.ReaderAt(ctx, desc)
+		if err != nil {
 			return nil, err
 		}
-		// update diffID label
-		labelz[labels.LabelUncompressed] = blob.DiffID().String()
-		if err = w.Commit(ctx, n, "", content.WithLabels(labelz)); err != nil && !errdefs.IsAlreadyExists(err) {
+		defer ra.Close()
+		r, err := estargz.Open(io.NewSectionReader(ra, 0, desc.Size),
+			estargz.WithDecompressors(new(zstdchunked.Decompressor)))
+		if err != nil {
+			// Not an eStargz layer. No conversion.
+			logrus.WithError(err).Debugf("estargz: skipping non-eStargz layer %s", desc.Digest)
+			return nil, nil
+		}
+		tr, err := r.PlainTar()
+		if err != nil {
 			return nil, err
 		}
-		if err := w.Close(); err != nil {
+		defer tr.Close()
+		ref := fmt.Sprintf("revert-estargz-from-%s", desc.Digest)
+		newDesc, err := writeBlob(ctx, cs, desc, ref, func(w io.Writer) (digest.Digest, error) {
+			zw := gzip.NewWriter(w)
+			diffID := digest.Canonical.Digester()
+			if _, err := io.Copy(zw, io.TeeReader(tr, diffID.Hash())); err != nil {
+				return "", err
+			}
+			if err := zw.Close(); err != nil {
+				return "", err
+			}
+			return diffID.Digest(), nil
+		})
+		if err != nil {
 			return nil, err
 		}
-		newDesc := desc
-		if uncompress.IsUncompressedType(newDesc.MediaType) {
-			if images.IsDockerType(newDesc.MediaType) {
-				newDesc.MediaType += ".gzip"
-			} else {
-				newDesc.MediaType += "+gzip"
+		newDesc.MediaType = revertedMediaType(newDesc.MediaType)
+		if newDesc.Annotations != nil {
+			newDesc.Annotations = make(map[string]string, len(desc.Annotations))
+			for k, v := range desc.Annotations {
+				if k != estargz.TOCJSONDigestAnnotation && k != estargz.TOCSizeAnnotation {
+					newDesc.Annotations[k] = v
+				}
+			}
+			if len(newDesc.Annotations) == 0 {
+				newDesc.Annotations = nil
 			}
 		}
-		newDesc.Digest = w.Digest()
-		newDesc.Size = n
-		if newDesc.Annotations == nil {
-			newDesc.Annotations = make(map[string]string, 1)
+		return newDesc, nil
+	}
+}
+
+// LayerUpgradeFunc upgrades legacy stargz layers into eStargz so that they can
+// be verified with the TOC digest. The compressed payload of the legacy layer is
+// reused and only the TOC and the footer are rewritten. Media type is unchanged.
+// Other layers are unchanged.
+//
+// Should be used in conjunction with WithDockerToOCI(). See LayerConvertFunc
+// for more details.
+func LayerUpgradeFunc(opts ...estargz.Option) converter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if !images.IsLayerType(desc.MediaType) || uncompress.IsUncompressedType(desc.MediaType) {
+			// No conversion. No need to return an error here.
+			return nil, nil
+		}
+		ra, err := cs.ReaderAt(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		defer ra.Close()
+		blob, err := estargz.Upgrade(io.NewSectionReader(ra, 0, desc.Size), opts...)
+		if errors.Cause(err) == estargz.ErrNotLegacyStargz {
+			// No conversion. No need to return an error here.
+			return nil, nil
+		} else if err != nil {
+			return nil, err
 		}
-		newDesc.Annotations[estargz.TOCJSONDigestAnnotation] = blob.TOCDigest().String()
-		return &newDesc, nil
+		defer blob.Close()
+		ref := fmt.Sprintf("upgrade-stargz-from-%s", desc.Digest)
+		return writeEstargzBlob(ctx, cs, desc, ref, blob, func(mediaType string) string { return mediaType })
 	}
 }
+
+func revertedMediaType(mediaType string) string {
+	switch mediaType {
+	case ocispec.MediaTypeImageLayer + "+zstd":
+		return ocispec.MediaTypeImageLayerGzip
+	case ocispec.MediaTypeImageLayerNonDistributable + "+zstd":
+		return ocispec.MediaTypeImageLayerNonDistributableGzip
+	}
+	return mediaType
+}
+
+// counter counts the bytes written to the underlying writer.
+type counter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -18,12 +18,14 @@ package estargz
 
 import (
 	"context"
+	"io"
 	"testing"
 
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/images/converter"
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
 	"github.com/containerd/stargz-snapshotter/util/testutil"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -31,13 +33,52 @@ import (
 // TestLayerConvertFunc tests eStargz conversion.
 // TestLayerConvertFunc is a pure unit test that does not need the daemon to be running.
 func TestLayerConvertFunc(t *testing.T) {
+	tests := []struct {
+		name          string
+		lcf           converter.ConvertFunc
+		wantMediaType string
+	}{
+		{
+			name:          "gzip",
+			lcf:           LayerConvertFunc(estargz.WithPrioritizedFiles([]string{"hello"})),
+			wantMediaType: ocispec.MediaTypeImageLayerGzip,
+		},
+		{
+			name:          "zstdchunked",
+			lcf:           LayerConvertZstdChunkedFunc(estargz.WithPrioritizedFiles([]string{"hello"})),
+			wantMediaType: ocispec.MediaTypeImageLayer + "+zstd",
+		},
+		{
+			name:          "gzip-stream",
+			lcf:           LayerConvertStreamFunc(estargz.WithPrioritizedFiles([]string{"hello"})),
+			wantMediaType: ocispec.MediaTypeImageLayerGzip,
+		},
+		{
+			name:          "zstdchunked-stream",
+			lcf:           LayerConvertZstdChunkedStreamFunc(estargz.WithPrioritizedFiles([]string{"hello"})),
+			wantMediaType: ocispec.MediaTypeImageLayer + "+zstd",
+		},
+		{
+			name:          "stream-fallback",
+			lcf:           LayerConvertStreamFunc(estargz.WithTarSplit()),
+			wantMediaType: ocispec.MediaTypeImageLayerGzip,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			testLayerConvertFunc(t, tt.lcf, tt.wantMediaType)
+		})
+	}
+}
+
+func testLayerConvertFunc(t *testing.T, lcf converter.ConvertFunc, wantMediaType string) {
 	ctx := context.Background()
 	desc, cs, err := testutil.EnsureHello(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	lcf := LayerConvertFunc(estargz.WithPrioritizedFiles([]string{"hello"}))
 	docker2oci := true
 	platformMC := platforms.DefaultStrict()
 	cf := converter.DefaultIndexConvertFunc(lcf, docker2oci, platformMC)
@@ -52,6 +93,9 @@ func TestLayerConvertFunc(t *testing.T) {
 		if hDesc.Annotations != nil {
 			if x, ok := hDesc.Annotations[estargz.TOCJSONDigestAnnotation]; ok && len(x) > 0 {
 				tocDigests = append(tocDigests, x)
+				if hDesc.MediaType != wantMediaType {
+					t.Errorf("media type = %q; want %q", hDesc.MediaType, wantMediaType)
+				}
 			}
 		}
 		return nil, nil
@@ -68,3 +112,74 @@ func TestLayerConvertFunc(t *testing.T) {
 		t.Fatal("no eStargz layer was created")
 	}
 }
+
+// TestLayerRevertFunc tests reverting eStargz into legacy tar.gz.
+// TestLayerRevertFunc is a pure unit test that does not need the daemon to be running.
+func TestLayerRevertFunc(t *testing.T) {
+	tests := []struct {
+		name string
+		lcf  converter.ConvertFunc
+	}{
+		{
+			name: "gzip",
+			lcf:  LayerConvertFunc(estargz.WithTarSplit()),
+		},
+		{
+			name: "zstdchunked",
+			lcf:  LayerConvertZstdChunkedFunc(),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			desc, cs, err := testutil.EnsureHello(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			platformMC := platforms.DefaultStrict()
+			esgzDesc, err := converter.DefaultIndexConvertFunc(tt.lcf, true, platformMC)(ctx, cs, *desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newDesc, err := converter.DefaultIndexConvertFunc(LayerRevertFunc(), false, platformMC)(ctx, cs, *esgzDesc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var layers int
+			handler := func(hCtx context.Context, hDesc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+				if !images.IsLayerType(hDesc.MediaType) {
+					return nil, nil
+				}
+				layers++
+				if hDesc.MediaType != ocispec.MediaTypeImageLayerGzip {
+					t.Errorf("media type = %q; want %q", hDesc.MediaType, ocispec.MediaTypeImageLayerGzip)
+				}
+				if _, ok := hDesc.Annotations[estargz.TOCJSONDigestAnnotation]; ok {
+					t.Errorf("TOC digest annotation must be removed from %s", hDesc.Digest)
+				}
+				ra, err := cs.ReaderAt(hCtx, hDesc)
+				if err != nil {
+					return nil, err
+				}
+				defer ra.Close()
+				if _, err := estargz.Open(io.NewSectionReader(ra, 0, hDesc.Size),
+					estargz.WithDecompressors(new(zstdchunked.Decompressor))); err == nil {
+					t.Errorf("layer %s must not be eStargz", hDesc.Digest)
+				}
+				return nil, nil
+			}
+			handlers := images.Handlers(
+				images.ChildrenHandler(cs),
+				images.HandlerFunc(handler),
+			)
+			if err := images.Walk(ctx, handlers, *newDesc); err != nil {
+				t.Fatal(err)
+			}
+			if layers == 0 {
+				t.Fatal("no layer was found")
+			}
+		})
+	}
+}
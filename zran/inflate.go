@@ -0,0 +1,604 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zran
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// This file implements a DEFLATE (RFC1951) decoder for gzip (RFC1952) streams.
+// Unlike compress/flate, this decoder can record checkpoints at deflate block
+// boundaries and resume decompression from them. This is the same technique as
+// zran.c in the zlib distribution.
+
+const (
+	windowSize  = 32 << 10 // history size of DEFLATE
+	maxMatchLen = 258
+	maxCodeBits = 15
+	primaryBits = 9 // number of bits looked up at once when decoding a code
+	histSize    = 2 * windowSize
+)
+
+var (
+	// errDone is returned by writers to stop decompression early.
+	errDone = errors.New("zran: done")
+
+	errInvalidCode = errors.New("zran: invalid huffman code")
+)
+
+var (
+	lengthBase  = [...]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [...]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [...]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [...]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+	// order of code length code lengths
+	codeLengthOrder = [...]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+var (
+	fixedOnce           sync.Once
+	fixedLit, fixedDist huffman
+	fixedInitErr        error
+)
+
+func initFixed() {
+	var lengths [288 + 30]uint8
+	for i := 0; i < 144; i++ {
+		lengths[i] = 8
+	}
+	for i := 144; i < 256; i++ {
+		lengths[i] = 9
+	}
+	for i := 256; i < 280; i++ {
+		lengths[i] = 7
+	}
+	for i := 280; i < 288; i++ {
+		lengths[i] = 8
+	}
+	for i := 288; i < len(lengths); i++ {
+		lengths[i] = 5
+	}
+	if err := fixedLit.init(lengths[:288]); err != nil {
+		fixedInitErr = err
+		return
+	}
+	fixedInitErr = fixedDist.init(lengths[288:])
+}
+
+// bitReader reads bits from the stream LSB first.
+type bitReader struct {
+	r   io.ByteReader
+	n   int64  // number of bytes read from r
+	b   uint64 // bit buffer
+	nb  uint   // number of bits in b
+	err error  // sticky read error
+}
+
+// fill reads bytes until at least n bits are available or an error occurs.
+func (br *bitReader) fill(n uint) {
+	for br.nb < n && br.err == nil {
+		c, err := br.r.ReadByte()
+		if err != nil {
+			br.err = err
+			return
+		}
+		br.b |= uint64(c) << br.nb
+		br.nb += 8
+		br.n++
+	}
+}
+
+func (br *bitReader) bits(n uint) (uint32, error) {
+	if br.nb < n {
+		if br.fill(n); br.nb < n {
+			return 0, br.readErr()
+		}
+	}
+	v := uint32(br.b & (1<<n - 1))
+	br.b >>= n
+	br.nb -= n
+	return v, nil
+}
+
+func (br *bitReader) readErr() error {
+	if br.err == nil || br.err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return br.err
+}
+
+// alignByte discards the remaining bits of the current byte.
+func (br *bitReader) alignByte() {
+	br.b >>= br.nb % 8
+	br.nb -= br.nb % 8
+}
+
+// pos returns the position of the next unread bit as the byte offset and the
+// number of bits already consumed in that byte.
+func (br *bitReader) pos() (in int64, bits uint8) {
+	p := br.n*8 - int64(br.nb)
+	return p / 8, uint8(p % 8)
+}
+
+// huffman is a canonical huffman code. Codes up to primaryBits long are
+// decoded by table lookup and longer ones are decoded bit by bit.
+type huffman struct {
+	count  [maxCodeBits + 1]uint16
+	symbol []uint16                 // symbols ordered by their codes
+	table  [1 << primaryBits]uint16 // symbol<<4 | length, or 0 for longer codes
+}
+
+func (h *huffman) init(lengths []uint8) error {
+	for i := range h.count {
+		h.count[i] = 0
+	}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left <<= 1
+		if left -= int(h.count[l]); left < 0 {
+			return errors.New("zran: over-subscribed huffman code")
+		}
+	}
+	// Incomplete codes are allowed. Unused codes are reported as invalid on decoding.
+
+	var offs [maxCodeBits + 1]uint16
+	for l := 1; l < maxCodeBits; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	if cap(h.symbol) < len(lengths) {
+		h.symbol = make([]uint16, len(lengths))
+	}
+	h.symbol = h.symbol[:len(lengths)]
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+
+	for i := range h.table {
+		h.table[i] = 0
+	}
+	code, idx := 0, 0
+	for l := uint(1); l <= primaryBits; l++ {
+		for k := 0; k < int(h.count[l]); k++ {
+			e := h.symbol[idx]<<4 | uint16(l)
+			for j := reverseBits(code, l); j < len(h.table); j += 1 << l {
+				h.table[j] = e
+			}
+			code++
+			idx++
+		}
+		code <<= 1
+	}
+	return nil
+}
+
+func (h *huffman) decode(br *bitReader) (int, error) {
+	if br.nb < maxCodeBits {
+		br.fill(maxCodeBits)
+	}
+	if e := h.table[br.b&(1<<primaryBits-1)]; e != 0 {
+		if l := uint(e & 0xf); l <= br.nb {
+			br.b >>= l
+			br.nb -= l
+			return int(e >> 4), nil
+		}
+	}
+	// Slow path for long codes and the end of the stream.
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxCodeBits; l++ {
+		b, err := br.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(b)
+		count := int(h.count[l])
+		if code-count < first {
+			return int(h.symbol[index+(code-first)]), nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errInvalidCode
+}
+
+func reverseBits(code int, n uint) int {
+	r := 0
+	for i := uint(0); i < n; i++ {
+		r = r<<1 | code&1
+		code >>= 1
+	}
+	return r
+}
+
+// inflater decompresses gzip members and writes the result to w.
+type inflater struct {
+	br *bitReader
+	w  io.Writer
+
+	hist    [histSize]byte // history window followed by the pending output
+	pos     int            // write position in hist
+	flushed int            // hist[:flushed] has been written to w
+	have    int            // number of valid history bytes before pos (<= windowSize)
+	out     int64          // offset of the uncompressed stream
+
+	lit, dist huffman
+	lengths   [288 + 32]uint8
+
+	// verifyCRC is true if the current member is decompressed from its head.
+	verifyCRC   bool
+	crc         uint32
+	memberStart int64
+
+	// span is the interval of checkpoints. Zero means no checkpoint is recorded.
+	span        int64
+	checkpoints []Checkpoint
+}
+
+// newInflater returns an inflater resuming from the specified position. The
+// bitReader must be positioned at the beginning of a deflate block or a gzip
+// member. window is the uncompressed data preceding out.
+func newInflater(br *bitReader, w io.Writer, window []byte, out int64) *inflater {
+	if len(window) > windowSize {
+		window = window[len(window)-windowSize:]
+	}
+	f := &inflater{br: br, w: w, out: out, pos: windowSize, flushed: windowSize, have: len(window)}
+	copy(f.hist[windowSize-len(window):], window)
+	return f
+}
+
+// run decompresses gzip members until the end of the stream. If resumed is
+// true, the stream is assumed to start from a deflate block in a member.
+func (f *inflater) run(resumed bool) error {
+	fixedOnce.Do(initFixed)
+	if fixedInitErr != nil {
+		return fixedInitErr
+	}
+	for first := true; ; first = false {
+		if !first || !resumed {
+			if !first {
+				// Check if there is another member.
+				if f.br.fill(8); f.br.nb == 0 {
+					if f.br.err == io.EOF {
+						return nil
+					}
+					return f.br.readErr()
+				}
+			}
+			if err := f.readHeader(); err != nil {
+				return err
+			}
+			f.verifyCRC, f.crc, f.memberStart = true, 0, f.out
+		}
+		if err := f.inflate(); err != nil {
+			return err
+		}
+		if err := f.flush(); err != nil {
+			return err
+		}
+		f.br.alignByte()
+		crc, err := f.br.bits(32)
+		if err != nil {
+			return err
+		}
+		isize, err := f.br.bits(32)
+		if err != nil {
+			return err
+		}
+		if f.verifyCRC {
+			if crc != f.crc {
+				return fmt.Errorf("zran: invalid checksum %#x; want %#x", f.crc, crc)
+			}
+			if isize != uint32(f.out-f.memberStart) {
+				return fmt.Errorf("zran: invalid size %d; want %d", uint32(f.out-f.memberStart), isize)
+			}
+		}
+	}
+}
+
+func (f *inflater) readHeader() error {
+	var h [10]byte
+	for i := range h {
+		b, err := f.br.bits(8)
+		if err != nil {
+			return err
+		}
+		h[i] = byte(b)
+	}
+	if h[0] != 0x1f || h[1] != 0x8b || h[2] != 8 {
+		return errors.New("zran: invalid gzip header")
+	}
+	flg := h[3]
+	if flg&0xe0 != 0 {
+		return errors.New("zran: reserved gzip flags are set")
+	}
+	if flg&(1<<2) != 0 { // FEXTRA
+		xlen, err := f.br.bits(16)
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i < xlen; i++ {
+			if _, err := f.br.bits(8); err != nil {
+				return err
+			}
+		}
+	}
+	for _, flag := range []byte{1 << 3, 1 << 4} { // FNAME, FCOMMENT
+		if flg&flag == 0 {
+			continue
+		}
+		for {
+			c, err := f.br.bits(8)
+			if err != nil {
+				return err
+			}
+			if c == 0 {
+				break
+			}
+		}
+	}
+	if flg&(1<<1) != 0 { // FHCRC
+		if _, err := f.br.bits(16); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inflate decompresses deflate blocks until the final block.
+func (f *inflater) inflate() error {
+	for {
+		if f.span > 0 && (len(f.checkpoints) == 0 || f.out-f.checkpoints[len(f.checkpoints)-1].Out >= f.span) {
+			f.checkpoint()
+		}
+		final, err := f.br.bits(1)
+		if err != nil {
+			return err
+		}
+		typ, err := f.br.bits(2)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 0:
+			err = f.stored()
+		case 1:
+			err = f.codes(&fixedLit, &fixedDist)
+		case 2:
+			if err = f.dynamic(); err == nil {
+				err = f.codes(&f.lit, &f.dist)
+			}
+		default:
+			err = errors.New("zran: invalid block type")
+		}
+		if err != nil {
+			return err
+		}
+		if final == 1 {
+			return nil
+		}
+	}
+}
+
+func (f *inflater) checkpoint() {
+	in, bits := f.br.pos()
+	window := make([]byte, f.have)
+	copy(window, f.hist[f.pos-f.have:f.pos])
+	f.checkpoints = append(f.checkpoints, Checkpoint{In: in, Bits: bits, Out: f.out, Window: window})
+}
+
+func (f *inflater) stored() error {
+	f.br.alignByte()
+	n, err := f.br.bits(16)
+	if err != nil {
+		return err
+	}
+	nn, err := f.br.bits(16)
+	if err != nil {
+		return err
+	}
+	if uint16(n) != ^uint16(nn) {
+		return errors.New("zran: invalid stored block length")
+	}
+	for i := uint32(0); i < n; i++ {
+		if f.pos == len(f.hist) {
+			if err := f.slide(); err != nil {
+				return err
+			}
+		}
+		c, err := f.br.bits(8)
+		if err != nil {
+			return err
+		}
+		f.hist[f.pos] = byte(c)
+		f.pos++
+	}
+	f.advance(int(n))
+	return nil
+}
+
+func (f *inflater) dynamic() error {
+	nlen, err := f.br.bits(5)
+	if err != nil {
+		return err
+	}
+	ndist, err := f.br.bits(5)
+	if err != nil {
+		return err
+	}
+	ncode, err := f.br.bits(4)
+	if err != nil {
+		return err
+	}
+	nlen, ndist, ncode = nlen+257, ndist+1, ncode+4
+	if nlen > 286 || ndist > 30 {
+		return errors.New("zran: too many length or distance codes")
+	}
+
+	var clens [19]uint8
+	for i := uint32(0); i < ncode; i++ {
+		l, err := f.br.bits(3)
+		if err != nil {
+			return err
+		}
+		clens[codeLengthOrder[i]] = uint8(l)
+	}
+	var clen huffman
+	if err := clen.init(clens[:]); err != nil {
+		return err
+	}
+
+	lengths := f.lengths[:nlen+ndist]
+	for i := 0; i < len(lengths); {
+		sym, err := clen.decode(f.br)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var l uint8
+		var rep uint32
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errors.New("zran: repeat with no previous length")
+			}
+			l = lengths[i-1]
+			rep, err = f.br.bits(2)
+			rep += 3
+		case 17:
+			rep, err = f.br.bits(3)
+			rep += 3
+		default:
+			rep, err = f.br.bits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(rep) > len(lengths) {
+			return errors.New("zran: too many code lengths")
+		}
+		for ; rep > 0; rep-- {
+			lengths[i] = l
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return errors.New("zran: no end-of-block code")
+	}
+	if err := f.lit.init(lengths[:nlen]); err != nil {
+		return err
+	}
+	return f.dist.init(lengths[nlen:])
+}
+
+func (f *inflater) codes(lit, dist *huffman) error {
+	for {
+		if f.pos > len(f.hist)-maxMatchLen {
+			if err := f.slide(); err != nil {
+				return err
+			}
+		}
+		sym, err := lit.decode(f.br)
+		if err != nil {
+			return err
+		}
+		if sym < 256 {
+			f.hist[f.pos] = byte(sym)
+			f.pos++
+			f.advance(1)
+			continue
+		} else if sym == 256 {
+			return nil
+		}
+		sym -= 257
+		if sym >= len(lengthBase) {
+			return errInvalidCode
+		}
+		extra, err := f.br.bits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int(lengthBase[sym]) + int(extra)
+		dsym, err := dist.decode(f.br)
+		if err != nil {
+			return err
+		}
+		if dsym >= len(distBase) {
+			return errInvalidCode
+		}
+		if extra, err = f.br.bits(uint(distExtra[dsym])); err != nil {
+			return err
+		}
+		d := int(distBase[dsym]) + int(extra)
+		if d > f.have {
+			return errors.New("zran: invalid distance too far back")
+		}
+		for i := 0; i < length; i++ {
+			f.hist[f.pos] = f.hist[f.pos-d]
+			f.pos++
+		}
+		f.advance(length)
+	}
+}
+
+func (f *inflater) advance(n int) {
+	f.out += int64(n)
+	if f.have += n; f.have > windowSize {
+		f.have = windowSize
+	}
+}
+
+// slide flushes the pending output and moves the history window to the head
+// of the buffer.
+func (f *inflater) slide() error {
+	if err := f.flush(); err != nil {
+		return err
+	}
+	copy(f.hist[:], f.hist[f.pos-windowSize:f.pos])
+	f.pos = windowSize
+	f.flushed = windowSize
+	return nil
+}
+
+func (f *inflater) flush() error {
+	if f.flushed == f.pos {
+		return nil
+	}
+	p := f.hist[f.flushed:f.pos]
+	f.flushed = f.pos
+	if f.verifyCRC {
+		f.crc = crc32.Update(f.crc, crc32.IEEETable, p)
+	}
+	_, err := f.w.Write(p)
+	return err
+}
@@ -0,0 +1,258 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package zran provides random access to gzip streams using checkpoints.
+//
+// A checkpoint records the position of a deflate block in the compressed
+// stream and the 32KiB of uncompressed data preceding it. Decompression can be
+// resumed from any checkpoint so reading a range of the uncompressed data
+// requires decompressing at most the span between two checkpoints. This is the
+// same technique as zran.c in the zlib distribution.
+package zran
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultSpan is the default interval of checkpoints in the uncompressed
+	// stream.
+	DefaultSpan = 1 << 20
+
+	indexMagic = "ZRANIDX1"
+
+	// readBufSize is the size of the buffer for reading the compressed stream.
+	readBufSize = 64 << 10
+)
+
+// Checkpoint is a position in the gzip stream where decompression can be
+// resumed.
+type Checkpoint struct {
+	// In is the offset of the byte in the compressed stream which contains
+	// the first bit of the deflate block.
+	In int64
+
+	// Bits is the number of bits of the byte at In which belong to the
+	// previous block.
+	Bits uint8
+
+	// Out is the offset of this checkpoint in the uncompressed stream.
+	Out int64
+
+	// Window is the uncompressed data (up to 32KiB) preceding Out.
+	Window []byte
+}
+
+// Index is a set of checkpoints of a gzip stream.
+type Index struct {
+	// Span is the minimal interval of checkpoints in the uncompressed stream.
+	Span int64
+
+	// CompressedSize is the size of the gzip stream.
+	CompressedSize int64
+
+	// UncompressedSize is the size of the uncompressed stream.
+	UncompressedSize int64
+
+	// Checkpoints are sorted by their offsets.
+	Checkpoints []Checkpoint
+}
+
+// BuildIndex decompresses the gzip stream read from r and builds the index of
+// it with checkpoints every span bytes of the uncompressed data. The
+// uncompressed stream is written to w. All gzip members must be valid including
+// the checksums.
+func BuildIndex(w io.Writer, r io.Reader, span int64) (*Index, error) {
+	if span <= 0 {
+		span = DefaultSpan
+	}
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReaderSize(r, readBufSize)
+	}
+	bitr := &bitReader{r: br}
+	f := newInflater(bitr, w, nil, 0)
+	f.span = span
+	if err := f.run(false); err != nil {
+		return nil, errors.Wrap(err, "failed to decompress gzip stream")
+	}
+	return &Index{
+		Span:             span,
+		CompressedSize:   bitr.n,
+		UncompressedSize: f.out,
+		Checkpoints:      f.checkpoints,
+	}, nil
+}
+
+// WriteTo writes the binary representation of the index to w.
+func (idx *Index) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	bw.WriteString(indexMagic)
+	for _, v := range []int64{idx.Span, idx.CompressedSize, idx.UncompressedSize, int64(len(idx.Checkpoints))} {
+		binary.Write(bw, binary.BigEndian, v)
+	}
+	for _, cp := range idx.Checkpoints {
+		binary.Write(bw, binary.BigEndian, cp.In)
+		binary.Write(bw, binary.BigEndian, cp.Out)
+		bw.WriteByte(cp.Bits)
+		binary.Write(bw, binary.BigEndian, uint32(len(cp.Window)))
+		bw.Write(cp.Window)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ReadIndex reads the index written by Index.WriteTo.
+func ReadIndex(r io.Reader) (*Index, error) {
+	magic := make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, errors.Wrap(err, "failed to read index magic")
+	}
+	if string(magic) != indexMagic {
+		return nil, fmt.Errorf("invalid index magic %q", string(magic))
+	}
+	var hdr [4]int64
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return nil, errors.Wrap(err, "failed to read index header")
+	}
+	idx := &Index{Span: hdr[0], CompressedSize: hdr[1], UncompressedSize: hdr[2]}
+	if hdr[3] < 0 {
+		return nil, fmt.Errorf("invalid number of checkpoints %d", hdr[3])
+	}
+	var lastOut int64
+	for i := int64(0); i < hdr[3]; i++ {
+		var cp Checkpoint
+		var wlen uint32
+		if err := binary.Read(r, binary.BigEndian, &cp.In); err != nil {
+			return nil, errors.Wrapf(err, "failed to read checkpoint %d", i)
+		}
+		if err := binary.Read(r, binary.BigEndian, &cp.Out); err != nil {
+			return nil, errors.Wrapf(err, "failed to read checkpoint %d", i)
+		}
+		if err := binary.Read(r, binary.BigEndian, &cp.Bits); err != nil {
+			return nil, errors.Wrapf(err, "failed to read checkpoint %d", i)
+		}
+		if err := binary.Read(r, binary.BigEndian, &wlen); err != nil {
+			return nil, errors.Wrapf(err, "failed to read checkpoint %d", i)
+		}
+		if cp.Bits > 7 || wlen > windowSize || cp.In < 0 || cp.In > idx.CompressedSize ||
+			cp.Out < lastOut || cp.Out > idx.UncompressedSize || (i == 0 && cp.Out != 0) {
+			return nil, fmt.Errorf("invalid checkpoint %d (in=%d,bits=%d,out=%d,window=%d)",
+				i, cp.In, cp.Bits, cp.Out, wlen)
+		}
+		cp.Window = make([]byte, wlen)
+		if _, err := io.ReadFull(r, cp.Window); err != nil {
+			return nil, errors.Wrapf(err, "failed to read window of checkpoint %d", i)
+		}
+		lastOut = cp.Out
+		idx.Checkpoints = append(idx.Checkpoints, cp)
+	}
+	if len(idx.Checkpoints) == 0 {
+		return nil, fmt.Errorf("index doesn't contain checkpoints")
+	}
+	return idx, nil
+}
+
+// ReaderAt provides random access to the uncompressed data of a gzip stream.
+type ReaderAt struct {
+	ra  io.ReaderAt
+	idx *Index
+}
+
+// NewReaderAt returns ReaderAt of the gzip stream read from ra using the index.
+func NewReaderAt(ra io.ReaderAt, idx *Index) *ReaderAt {
+	return &ReaderAt{ra: ra, idx: idx}
+}
+
+// Size returns the size of the uncompressed stream.
+func (r *ReaderAt) Size() int64 {
+	return r.idx.UncompressedSize
+}
+
+// ReadAt reads the uncompressed stream. Decompression starts from the nearest
+// checkpoint preceding off.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("invalid offset")
+	}
+	if off >= r.idx.UncompressedSize {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	cps := r.idx.Checkpoints
+	i := sort.Search(len(cps), func(i int) bool { return cps[i].Out > off }) - 1
+	if i < 0 {
+		return 0, fmt.Errorf("checkpoint for offset %d not found", off)
+	}
+	cp := cps[i]
+	sr := io.NewSectionReader(r.ra, cp.In, r.idx.CompressedSize-cp.In)
+	br := &bitReader{r: bufio.NewReaderSize(sr, readBufSize)}
+	if _, err := br.bits(uint(cp.Bits)); err != nil {
+		return 0, err
+	}
+	w := &rangeWriter{skip: off - cp.Out, p: p}
+	// Checkpoints are always placed after the gzip header so resume from the block.
+	err := newInflater(br, w, cp.Window, cp.Out).run(true)
+	if err == errDone {
+		return w.n, nil
+	} else if err != nil {
+		return w.n, err
+	}
+	return w.n, io.EOF
+}
+
+// rangeWriter discards the first skip bytes and fills p with the following
+// bytes. errDone is returned when p is filled.
+type rangeWriter struct {
+	skip int64
+	p    []byte
+	n    int
+}
+
+func (w *rangeWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	if w.skip >= int64(len(p)) {
+		w.skip -= int64(len(p))
+		return written, nil
+	}
+	p = p[w.skip:]
+	w.skip = 0
+	w.n += copy(w.p[w.n:], p)
+	if w.n == len(w.p) {
+		return written, errDone
+	}
+	return written, nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return
+}
@@ -0,0 +1,173 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zran
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func testData(kind string, size int, rnd *rand.Rand) []byte {
+	b := make([]byte, size)
+	switch kind {
+	case "random":
+		rnd.Read(b)
+	case "text":
+		words := []string{"foo", "bar", "baz", "stargz", "snapshotter", "\n", " ", "containerd"}
+		var buf bytes.Buffer
+		for buf.Len() < size {
+			buf.WriteString(words[rnd.Intn(len(words))])
+		}
+		copy(b, buf.Bytes())
+	case "zero":
+	case "mixed":
+		for i := 0; i < size; {
+			n := rnd.Intn(100000) + 1
+			if i+n > size {
+				n = size - i
+			}
+			if rnd.Intn(2) == 0 {
+				rnd.Read(b[i : i+n])
+			}
+			i += n
+		}
+	}
+	return b
+}
+
+func gzipData(t *testing.T, data []byte, level int, members int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < members; i++ {
+		zw, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			t.Fatalf("failed to create gzip writer: %v", err)
+		}
+		zw.Name = "test" // exercise the optional gzip header fields
+		zw.Extra = []byte("extra")
+		part := data[len(data)*i/members : len(data)*(i+1)/members]
+		if _, err := zw.Write(part); err != nil {
+			t.Fatalf("failed to compress: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("failed to close gzip writer: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	levels := []int{gzip.NoCompression, gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression, gzip.HuffmanOnly}
+	for _, kind := range []string{"random", "text", "zero", "mixed"} {
+		for _, level := range levels {
+			for _, members := range []int{1, 3} {
+				for _, span := range []int64{1 << 10, 64 << 10} {
+					kind, level, members, span := kind, level, members, span
+					t.Run(fmt.Sprintf("%s-level=%d-members=%d-span=%d", kind, level, members, span), func(t *testing.T) {
+						data := testData(kind, 300000, rnd)
+						gz := gzipData(t, data, level, members)
+
+						var out bytes.Buffer
+						idx, err := BuildIndex(&out, bytes.NewReader(gz), span)
+						if err != nil {
+							t.Fatalf("failed to build index: %v", err)
+						}
+						if !bytes.Equal(out.Bytes(), data) {
+							t.Fatalf("unexpected decompressed data")
+						}
+						if idx.CompressedSize != int64(len(gz)) || idx.UncompressedSize != int64(len(data)) {
+							t.Fatalf("size = (%d, %d); want (%d, %d)",
+								idx.CompressedSize, idx.UncompressedSize, len(gz), len(data))
+						}
+
+						// Check serialization
+						var idxBuf bytes.Buffer
+						if _, err := idx.WriteTo(&idxBuf); err != nil {
+							t.Fatalf("failed to write index: %v", err)
+						}
+						idx2, err := ReadIndex(&idxBuf)
+						if err != nil {
+							t.Fatalf("failed to read index: %v", err)
+						}
+						if len(idx2.Checkpoints) != len(idx.Checkpoints) {
+							t.Fatalf("number of checkpoints = %d; want %d", len(idx2.Checkpoints), len(idx.Checkpoints))
+						}
+
+						ra := NewReaderAt(bytes.NewReader(gz), idx2)
+						if ra.Size() != int64(len(data)) {
+							t.Fatalf("Size() = %d; want %d", ra.Size(), len(data))
+						}
+						// Read across checkpoints and at the boundaries
+						offs := []int64{0, int64(len(data)) - 1}
+						for _, cp := range idx.Checkpoints {
+							offs = append(offs, cp.Out)
+						}
+						for i := 0; i < 20; i++ {
+							offs = append(offs, rnd.Int63n(int64(len(data))))
+						}
+						for _, off := range offs {
+							size := rnd.Intn(3*int(span)) + 1
+							p := make([]byte, size)
+							n, err := ra.ReadAt(p, off)
+							want := data[off:]
+							if len(want) > size {
+								want = want[:size]
+							}
+							if len(want) < size {
+								if err != io.EOF {
+									t.Fatalf("ReadAt(off=%d,size=%d) must return EOF; got %v", off, size, err)
+								}
+							} else if err != nil {
+								t.Fatalf("failed to ReadAt(off=%d,size=%d): %v", off, size, err)
+							}
+							if !bytes.Equal(p[:n], want) {
+								t.Fatalf("unexpected data at off=%d,size=%d", off, size)
+							}
+						}
+					})
+				}
+			}
+		}
+	}
+}
+
+func TestBrokenStream(t *testing.T) {
+	data := testData("text", 100000, rand.New(rand.NewSource(1)))
+	gz := gzipData(t, data, gzip.BestCompression, 1)
+
+	// Broken checksum must be detected
+	broken := append([]byte{}, gz...)
+	broken[len(broken)-5] ^= 0xff
+	if _, err := BuildIndex(ioutil.Discard, bytes.NewReader(broken), 0); err == nil {
+		t.Errorf("broken checksum must be detected")
+	}
+
+	// Truncated stream
+	if _, err := BuildIndex(ioutil.Discard, bytes.NewReader(gz[:len(gz)/2]), 0); err == nil {
+		t.Errorf("truncated stream must be detected")
+	}
+
+	// Not a gzip
+	if _, err := BuildIndex(ioutil.Discard, bytes.NewReader(data), 0); err == nil {
+		t.Errorf("non-gzip stream must be rejected")
+	}
+}